@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 
+	"github.com/trungaczne/gimmick/parser"
+	"github.com/trungaczne/gimmick/vm"
 	"github.com/urfave/cli"
 )
 
@@ -22,15 +27,151 @@ func main() {
 			Value: "",
 			Usage: "Filename of the script",
 		},
+		cli.StringFlag{
+			Name:  "path",
+			Value: "",
+			Usage: "Directories searched for imports, separated by " + string(os.PathListSeparator) + ", after the script's directory",
+		},
 	}
 	app.Action = func(c *cli.Context) {
 		file := c.String("file")
 		if file == "" {
 			log.Println("Please specify a filename")
+			return
+		}
+		searchPath := append([]string{filepath.Dir(file)}, filepath.SplitList(c.String("path"))...)
+		if err := run(file, searchPath); err != nil {
+			log.Println(err)
 		}
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "types",
+			Usage:     "Print the inferred types of the functions and variables of a script",
+			ArgsUsage: "<filename>",
+			Action: func(c *cli.Context) {
+				file := c.Args().First()
+				if file == "" {
+					file = c.GlobalString("file")
+				}
+				if file == "" {
+					log.Println("Please specify a filename")
+					return
+				}
+				if err := types(file); err != nil {
+					log.Println(err)
+				}
+			},
+		},
+		{
+			Name:      "expand",
+			Usage:     "Print the source of a script once its macros are expanded",
+			ArgsUsage: "<filename>",
+			Action: func(c *cli.Context) {
+				file := c.Args().First()
+				if file == "" {
+					file = c.GlobalString("file")
+				}
+				if file == "" {
+					log.Println("Please specify a filename")
+					return
+				}
+				if err := expand(file); err != nil {
+					log.Println(err)
+				}
+			},
+		},
+	}
+
 	if err := app.Run(os.Args); err != nil {
 		log.Println("app.Run() error:", err)
 	}
 }
+
+// run executes the script and prints the value of its last expression
+func run(file string, searchPath []string) error {
+	interp := vm.NewInterpreter()
+	loader := parser.NewLoader(interp, searchPath)
+	id, err := loader.Load(file)
+	if err != nil {
+		return err
+	}
+	for _, warning := range loader.Warnings {
+		log.Println("warning:", warning)
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		return err
+	}
+	result, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// read parses the script, its macros unexpanded
+func read(file string) (parser.ModuleNode, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return parser.ModuleNode{}, err
+	}
+	module, err := parser.Parse(string(text))
+	if err != nil {
+		return parser.ModuleNode{}, fmt.Errorf("%s:%s", file, err)
+	}
+	return module, nil
+}
+
+// parse reads the script and expands its macros
+func parse(file string) (parser.ModuleNode, error) {
+	module, err := read(file)
+	if err != nil {
+		return module, err
+	}
+	module, errs := parser.Expand(module)
+	if len(errs) > 0 {
+		return parser.ModuleNode{}, prefix(file, errs)
+	}
+	return module, nil
+}
+
+// prefix puts the name of the script before the positions of errs
+func prefix(file string, errs vm.CompileErrors) vm.CompileErrors {
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s:%s", file, err)
+	}
+	return errs
+}
+
+// types prints the inferred types of the script's definitions, the imported
+// modules aren't loaded and their values are dynamic
+func types(file string) error {
+	module, err := parse(file)
+	if err != nil {
+		return err
+	}
+	signatures, errs := parser.InferTypes(module)
+	for _, signature := range signatures {
+		fmt.Println(signature)
+	}
+	if len(errs) > 0 {
+		return prefix(file, errs)
+	}
+	return nil
+}
+
+// expand prints the source of the script once its macros are expanded
+func expand(file string) error {
+	module, err := read(file)
+	if err != nil {
+		return err
+	}
+	source, errs := parser.ExpandSource(module)
+	if len(errs) > 0 {
+		return prefix(file, errs)
+	}
+	fmt.Print(source)
+	return nil
+}
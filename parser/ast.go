@@ -11,6 +11,24 @@ type Node interface {
 	CodeGen(builder CodeBuilder)
 }
 
+// Pattern is the left hand side of a match arm
+type Pattern interface {
+	Token
+	String() string
+	// MatchCodeGen tests the value held by the variable subject, whose type
+	// is dataType when known, and defines the variables the pattern binds.
+	// It returns the positions of the jumps to patch with where to go when
+	// the value doesn't match
+	MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64
+}
+
+// Pos is where a token or node starts in the text, 1-based. Nodes built by
+// the compiler have the zero Pos
+type Pos struct {
+	Line   int
+	Column int
+}
+
 /* --- Tokens ---*/
 
 type EOFToken struct {
@@ -21,23 +39,132 @@ type EmptyToken struct {
 
 type KeywordToken struct {
 	Name string
+	Pos  Pos
 }
 
 type CharToken struct {
 	Name string
+	Pos  Pos
 }
 
+// Default is nil when omitted. A Variadic argument, Name: ...Type, collects
+// the remaining arguments into a list of Type
 type ArgDeclToken struct {
 	NameToken IdentifierNode
 	TypeToken IdentifierNode
+	Default   Node
+	Variadic  bool
 }
 
 type ArgListToken struct {
 	ArgDecl []ArgDeclToken
 }
 
+// Names are the names of the named arguments, empty for the positional
+// ones, see FunctionCallNode
 type ParamListToken struct {
 	ParamList []Node
+	Names     []string
+}
+
+// Name: Value in a call
+type NamedParamToken struct {
+	Name  string
+	Value Node
+}
+
+// the operators and operands following the first operand of an expression
+type OperatorChainToken struct {
+	Operators []CharToken
+	Operands  []Node
+}
+
+// (ParamList) following an expression
+type CallToken struct {
+	ParamList []Node
+	Pos       Pos
+}
+
+type IndexToken struct {
+	Index Node
+}
+
+type SliceToken struct {
+	Low  Node
+	High Node
+}
+
+// = Expr or op= Expr following an assignment target
+type AssignmentTailToken struct {
+	Operator string
+	Expr     Node
+	Pos      Pos
+}
+
+type MapEntryToken struct {
+	Key   Node
+	Value Node
+}
+
+type MapEntriesToken struct {
+	Entries []MapEntryToken
+}
+
+// .Name following an expression
+type FieldToken struct {
+	Name string
+	Pos  Pos
+}
+
+// .Name(ParamList) following an expression, Pos is the position of Name
+type MethodToken struct {
+	Name      string
+	ParamList []Node
+	Names     []string
+	Pos       Pos
+}
+
+type FieldInitToken struct {
+	Name  string
+	Value Node
+}
+
+type FieldInitsToken struct {
+	Inits []FieldInitToken
+}
+
+type VariantsToken struct {
+	Variants []Variant
+}
+
+// the patterns between the brackets of a VariantPattern
+type PatternListToken struct {
+	Patterns []Pattern
+}
+
+// catch Var { Block }
+type CatchToken struct {
+	Var   string
+	Block BlockNode
+}
+
+type MatchArmsToken struct {
+	Arms []MatchArm
+}
+
+type FieldPatternToken struct {
+	Name    string
+	Pattern Pattern
+}
+
+type FieldPatternsToken struct {
+	Patterns []FieldPatternToken
+}
+
+// the calls, [index], [low:high], .field and .method() following an
+// expression
+type PostfixChainToken struct {
+	Postfixes []Token
 }
 
 /* --- Nodes ---*/
@@ -50,30 +177,332 @@ type FloatLiteralNode struct {
 	Value float64
 }
 
+type StringLiteralNode struct {
+	Value string
+}
+
+type BoolLiteralNode struct {
+	Value bool
+}
+
 type IdentifierNode struct {
 	Name string
 }
 
+// def Name(ArgList): ReturnType { Block }, ReturnType is empty when omitted.
+// Defaults holds the default value of each argument, nil when it has none.
+// When Variadic, the last argument collects the remaining ones into a list,
+// its type in ArgList being the type of the elements. Name is Type.Name for a
+// function associated with a type. A Const function, declared with
+// const def, can be called in the expression of a constant. Operator is the
+// binary operator defined by def (a: Left) Operator (b: Right), whose Name
+// is "Left Operator Right", empty for the other functions
 type FunctionDefNode struct {
-	Name    string
+	Name       string
+	Operator   string
+	Const      bool
+	ArgList    []NameType
+	Defaults   []Node
+	Variadic   bool
+	ReturnType string
+	Block      BlockNode
+	Pos        Pos
+}
+
+// fn(ArgList) { Block }, an anonymous function capturing the variables it
+// uses from the enclosing functions
+type LambdaNode struct {
 	ArgList []NameType
 	Block   BlockNode
 }
 
+// Name(ParamList), Names holds the names of the named arguments and is
+// parallel to ParamList, nil when every argument is positional
 type FunctionCallNode struct {
 	Name      string
 	ParamList []Node
+	Names     []string
+	Pos       Pos
+}
+
+// Callee(ParamList), calling the function value Callee evaluates to. Pos is
+// the position of the (
+type CallNode struct {
+	Callee    Node
+	ParamList []Node
+	Pos       Pos
+}
+
+// Receiver.Method(ParamList), calling Method with Receiver as the first
+// argument. Method is the function of the type of Receiver defined with
+// def Type.Method, or else the function Method in scope
+type MethodCallNode struct {
+	Receiver  Node
+	Method    string
+	ParamList []Node
+	Names     []string
+	Pos       Pos
 }
 
+// Pos is the position of the operator
 type BinaryOperatorNode struct {
 	Left     Node
 	Operator string
 	Right    Node
+	Pos      Pos
+}
+
+type ListLiteralNode struct {
+	Elements []Node
+}
+
+// {Keys[0]: Values[0], ...}
+type MapLiteralNode struct {
+	Keys   []Node
+	Values []Node
+}
+
+// Container[Index]
+type IndexNode struct {
+	Container Node
+	Index     Node
+}
+
+// Container[Low:High], omitted bounds are nil
+type SliceNode struct {
+	Container Node
+	Low       Node
+	High      Node
+}
+
+// Container[Index] = Expr
+type IndexAssignmentNode struct {
+	Container Node
+	Index     Node
+	Expr      Node
+}
+
+// import "Path" as Alias, Alias is empty when omitted, see Name
+type ImportNode struct {
+	Path  string
+	Alias string
 }
 
+// infixl Precedence Operator = Function, or infixr, at the top level of a
+// module. The parser reads Operator after it as a BinaryOperatorNode, which
+// calls the Function in scope at the declaration
+type InfixDefNode struct {
+	Right      bool
+	Precedence int64
+	Operator   string
+	Function   string
+	Pos        Pos
+}
+
+// type Name { Fields }
+type TypeDefNode struct {
+	Name   string
+	Fields []NameType
+}
+
+// enum Name { Variants }
+type EnumDefNode struct {
+	Name     string
+	Variants []Variant
+}
+
+// Type{Names[0]: Values[0], ...}, every field of the type is given
+type StructLiteralNode struct {
+	Type   string
+	Names  []string
+	Values []Node
+}
+
+// Object.Field, Pos is the position of the .
+type FieldNode struct {
+	Object Node
+	Field  string
+	Pos    Pos
+}
+
+// Object.Field = Expr
+type FieldAssignmentNode struct {
+	Object Node
+	Field  string
+	Expr   Node
+	Pos    Pos
+}
+
+// Target Operator= Expr, Target being an IdentifierNode, an IndexNode or a
+// FieldNode. The parts of Target are evaluated once
+type CompoundAssignmentNode struct {
+	Target   Node
+	Operator string
+	Expr     Node
+	Pos      Pos
+}
+
+type UnaryOperatorNode struct {
+	Operator string
+	Operand  Node
+	Pos      Pos
+}
+
+// let Name: Type = Expr, or var for a mutable variable. Type is optional
+type DeclarationNode struct {
+	Mutable bool
+	Name    string
+	Type    string
+	Expr    Node
+	Pos     Pos
+}
+
+// const Name: Type = Expr, Expr being evaluated at compile time. Type is
+// optional
+type ConstNode struct {
+	Name string
+	Type string
+	Expr Node
+	Pos  Pos
+}
+
+// Dest = Expr. Within a quote, Dest is $name for the code bound to name, a
+// name, an index or a field
 type AssignmentNode struct {
 	Dest string
 	Expr Node
+	Pos  Pos
+}
+
+// Else is nil, a BlockNode or an IfNode for `else if`
+type IfNode struct {
+	Cond Node
+	Then BlockNode
+	Else Node
+	Pos  Pos
+}
+
+type WhileNode struct {
+	Cond  Node
+	Block BlockNode
+	Pos   Pos
+}
+
+// for Var in Iterable { Block }
+type ForNode struct {
+	Var      string
+	Iterable Node
+	Block    BlockNode
+}
+
+// From..To, the integers from From up to but excluding To. Only valid as the
+// iterable of a for loop
+type RangeNode struct {
+	From Node
+	To   Node
+}
+
+// match Value { Arms[0], ... }, the value of the first arm whose pattern
+// matches, nil when none does
+type MatchNode struct {
+	Value Node
+	Arms  []MatchArm
+}
+
+// Pattern => Body
+type MatchArm struct {
+	Pattern Pattern
+	Body    Node
+}
+
+/* --- Patterns --- */
+
+// _
+type WildcardPattern struct {
+}
+
+// a name, binding the value to a new variable
+type BindingPattern struct {
+	Name string
+}
+
+// a literal, or a negated numeric literal
+type LiteralPattern struct {
+	Value Node
+}
+
+// Alternatives[0] | Alternatives[1] | ...
+type AlternativePattern struct {
+	Alternatives []Pattern
+}
+
+// Type{Fields[0]: Patterns[0], ...}, a field on its own is bound to a
+// variable of the same name
+type StructPattern struct {
+	Type     string
+	Fields   []string
+	Patterns []Pattern
+}
+
+// Variant(Patterns[0], ...), matching the fields of a variant by position.
+// A variant without fields is written as a BindingPattern
+type VariantPattern struct {
+	Variant  string
+	Patterns []Pattern
+}
+
+// try { Try } catch CatchVar { Catch } finally { Finally }, Catch and
+// Finally are nil when omitted, but not both
+type TryNode struct {
+	Try      BlockNode
+	CatchVar string
+	Catch    Node
+	Finally  Node
+}
+
+type ThrowNode struct {
+	Expr Node
+}
+
+type BreakNode struct {
+}
+
+type ContinueNode struct {
+}
+
+type ReturnNode struct {
+	Expr Node
+	Pos  Pos
+}
+
+// macro Name(Params) { Block }, expanded by Expand. Block runs at expansion
+// time with Params bound to the unevaluated arguments of a call, its value
+// replaces the call
+type MacroDefNode struct {
+	Name   string
+	Params []string
+	Block  BlockNode
+	Pos    Pos
+}
+
+// Name!(Args)
+type MacroCallNode struct {
+	Name string
+	Args []Node
+	Pos  Pos
+}
+
+// quote { Block }, the code of Block as the value of a macro. Within it,
+// $name is replaced by the code bound to name
+type QuoteNode struct {
+	Block BlockNode
+	Pos   Pos
+}
+
+// $Name within a quote
+type UnquoteNode struct {
+	Name string
+	Pos  Pos
 }
 
 type BlockNode struct {
@@ -1,50 +1,1394 @@
 package parser
 
-import . "github.com/trungaczne/gimmick/vm"
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
 
 /* --- VM bytecode generation routines ---*/
 
+// Every node pushes exactly one value onto the stack
+
+// Compile generates the code of module into interp, once its macros are
+// expanded, returning the ID of the function running the module's top level
+// expressions
+func Compile(module ModuleNode, interp *GimmickInterpreter) (int64, error) {
+	module, errs := Expand(module)
+	if len(errs) > 0 {
+		return -1, errs
+	}
+	types, errs := TypeCheck(module)
+	if len(errs) > 0 {
+		return -1, errs
+	}
+	builder := NewBuilder(interp)
+	module.CodeGen(typedBuilder{builder, types})
+	return builder.Finish()
+}
+
+// typedBuilder is the CodeBuilder of a module, along with the types
+// TypeCheck inferred for its nodes
+type typedBuilder struct {
+	CodeBuilder
+	types NodeTypes
+}
+
+func (builder typedBuilder) DefineFunc(name string, params []Param, code ScopedBuilder) int64 {
+	return builder.CodeBuilder.DefineFunc(name, params, builder.scoped(code))
+}
+
+func (builder typedBuilder) DefineLambda(signature []NameType, code ScopedBuilder) int64 {
+	return builder.CodeBuilder.DefineLambda(signature, builder.scoped(code))
+}
+
+func (builder typedBuilder) Evaluate(name string, code ScopedBuilder) (interface{}, error) {
+	return builder.CodeBuilder.Evaluate(name, builder.scoped(code))
+}
+
+func (builder typedBuilder) BeginFinally(code ScopedBuilder) {
+	builder.CodeBuilder.BeginFinally(builder.scoped(code))
+}
+
+// scoped hands the types over to the builder code is given
+func (builder typedBuilder) scoped(code ScopedBuilder) ScopedBuilder {
+	return func(scopedBuilder CodeBuilder) {
+		code(typedBuilder{scopedBuilder, builder.types})
+	}
+}
+
+// objectType is the type of object, whose field is accessed or method is
+// called at pos. It's the inferred one when known, the one the builder can
+// tell otherwise
+func objectType(builder CodeBuilder, object Node, pos Pos) string {
+	if typed, ok := builder.(typedBuilder); ok {
+		if name, ok := typed.types[pos]; ok {
+			return name
+		}
+	}
+	return staticType(builder, object)
+}
+
 func (node IntegerLiteralNode) CodeGen(builder CodeBuilder) {
 	builder.Push(
 		Instruction{INST_PUSH, node.Value, ARG_NOOP},
 	)
 }
 
+// pushValue pushes a value computed at compile time, ints as immediates.
+// Lists, maps and structs are built anew, like literals
+func pushValue(builder CodeBuilder, value interface{}) {
+	switch v := value.(type) {
+	case int64:
+		builder.Push(PushInst(v))
+	case *List:
+		for _, element := range v.Elements {
+			pushValue(builder, element)
+		}
+		builder.Push(ListInst(int64(len(v.Elements))))
+	case *Map:
+		keys := v.Keys().Elements
+		for _, key := range keys {
+			element, _ := v.Get(key)
+			pushValue(builder, key)
+			pushValue(builder, element)
+		}
+		builder.Push(MapInst(int64(len(keys))))
+	case *Struct:
+		if v.Type.Enum != nil && len(v.Fields) == 0 {
+			// unit variants are unique
+			builder.Push(ConstInst(builder.Constant(v)))
+			return
+		}
+		for _, field := range v.Fields {
+			pushValue(builder, field)
+		}
+		builder.Push(StructInst(v.Type.ID))
+	default:
+		builder.Push(ConstInst(builder.Constant(v)))
+	}
+}
+
+// inlinable tells whether pushValue can rebuild value, functions can't be
+// constants
+func inlinable(value interface{}) bool {
+	switch v := value.(type) {
+	case *Closure:
+		return false
+	case *List:
+		for _, element := range v.Elements {
+			if !inlinable(element) {
+				return false
+			}
+		}
+	case *Map:
+		for _, key := range v.Keys().Elements {
+			if element, _ := v.Get(key); !inlinable(element) {
+				return false
+			}
+		}
+	case *Struct:
+		for _, field := range v.Fields {
+			if !inlinable(field) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (node FloatLiteralNode) CodeGen(builder CodeBuilder) {
-	builder.Push(PushInst(int64(node.Value)))
+	builder.Push(ConstInst(builder.Constant(node.Value)))
+}
+
+func (node StringLiteralNode) CodeGen(builder CodeBuilder) {
+	builder.Push(ConstInst(builder.Constant(node.Value)))
+}
+
+func (node BoolLiteralNode) CodeGen(builder CodeBuilder) {
+	builder.Push(ConstInst(builder.Constant(node.Value)))
+}
+
+// push the value of a symbol, functions are turned into closures
+func loadSymbol(builder CodeBuilder, name string, sym Symbol) {
+	switch sym.Type {
+	case SYM_BUILTIN:
+		builder.Errorf("builtin %s can only be called", name)
+		builder.Push(ConstInst(builder.Constant(nil)))
+	case SYM_TYPE:
+		builder.Errorf("type %s is not a value", name)
+		builder.Push(ConstInst(builder.Constant(nil)))
+	case SYM_MODULE:
+		builder.Errorf("module %s is not a value", name)
+		builder.Push(ConstInst(builder.Constant(nil)))
+	case SYM_ENUM:
+		builder.Errorf("enum %s is not a value", name)
+		builder.Push(ConstInst(builder.Constant(nil)))
+	case SYM_VARIANT:
+		unit := variantUnit(builder, sym)
+		if unit == nil {
+			builder.Errorf("variant %s has fields, construct it with %s(...)", name, name)
+			builder.Push(ConstInst(builder.Constant(nil)))
+			return
+		}
+		builder.Push(ConstInst(builder.Constant(unit)))
+	case SYM_FUN:
+		builder.Push(ClosureInst(sym.ID))
+	case SYM_UPVAL:
+		builder.Push(LoadUpvalInst(sym.ID))
+	case SYM_GLOBAL:
+		builder.Push(LoadGlobalInst(sym.ID))
+	case SYM_CONST:
+		pushValue(builder, builder.ConstValue(sym.ID))
+	default:
+		builder.Push(LoadInst(sym.ID))
+	}
+}
+
+// variantUnit is the value of a variant without fields, nil for the
+// variants with fields
+func variantUnit(builder CodeBuilder, sym Symbol) *Struct {
+	variantType := builder.Type(sym.ID)
+	for i, variant := range variantType.Enum.Variants {
+		if variant == variantType {
+			return variantType.Enum.Units[i]
+		}
+	}
+	return nil
 }
 
 func (node IdentifierNode) CodeGen(builder CodeBuilder) {
-	builder.Push(PushInst(builder.Resolve(node.Name)))
+	loadSymbol(builder, node.Name, builder.Resolve(node.Name))
+}
+
+// constant is the value of a literal, or of a negated numeric literal
+func constant(node Node) (interface{}, bool) {
+	switch n := node.(type) {
+	case IntegerLiteralNode:
+		return n.Value, true
+	case FloatLiteralNode:
+		return n.Value, true
+	case StringLiteralNode:
+		return n.Value, true
+	case BoolLiteralNode:
+		return n.Value, true
+	case UnaryOperatorNode:
+		if n.Operator != "-" {
+			break
+		}
+		switch operand := n.Operand.(type) {
+		case IntegerLiteralNode:
+			return -operand.Value, true
+		case FloatLiteralNode:
+			return -operand.Value, true
+		}
+	}
+	return nil, false
+}
+
+// params are the arguments of node as its callers see them, along with the
+// names of the ones whose default isn't a constant
+func (node FunctionDefNode) params() ([]Param, []string) {
+	params := []Param{}
+	invalid := []string{}
+	for i, arg := range node.ArgList {
+		param := Param{NameType: arg, Variadic: node.Variadic && i == len(node.ArgList)-1}
+		if i < len(node.Defaults) && node.Defaults[i] != nil {
+			value, ok := constant(node.Defaults[i])
+			if !ok {
+				invalid = append(invalid, arg.Name)
+			}
+			param.Default, param.HasDefault = value, true
+		}
+		params = append(params, param)
+	}
+	return params, invalid
 }
 
 func (node FunctionDefNode) CodeGen(builder CodeBuilder) {
-	builder.DefineFunc(node.ArgList, func(scopedBuilder CodeBuilder) {
+	if dot := strings.Index(node.Name, "."); dot >= 0 && node.Operator == "" {
+		owner := node.Name[:dot]
+		if sym, ok := builder.Lookup(owner); !ok || sym.Type != SYM_TYPE && sym.Type != SYM_ENUM {
+			builder.Errorf("%s is not a type, can't define %s", owner, node.Name)
+		}
+	}
+	params, invalid := node.params()
+	for _, name := range invalid {
+		builder.Errorf("default value of argument %s of %s must be a constant", name, node.Name)
+	}
+	id := builder.DefineFunc(node.Name, params, func(scopedBuilder CodeBuilder) {
 		node.Block.CodeGen(scopedBuilder)
 	})
+	if node.Const {
+		builder.MarkConst(id)
+	}
+	// the uses of the operator compiled from now on call the function when
+	// the types of the operands are known, see BinaryOperatorNode
+	if node.Operator != "" && id >= 0 {
+		builder.DefineOperator(node.Operator, node.ArgList[0].Type, node.ArgList[1].Type, id)
+	}
+	// a definition is an expression too, its value is the function
+	builder.Push(ClosureInst(id))
+}
+
+func (node LambdaNode) CodeGen(builder CodeBuilder) {
+	id := builder.DefineLambda(node.ArgList, func(scopedBuilder CodeBuilder) {
+		node.Block.CodeGen(scopedBuilder)
+	})
+	builder.Push(ClosureInst(id))
+}
+
+// bindArguments maps the count arguments of a call to the params of the
+// function name, names being the names of the arguments, nil when they're
+// all positional. slots holds the argument given for each param, -1 when
+// omitted, and rest the arguments collected by the variadic one. Positional
+// arguments fill the params from the left
+func bindArguments(name string, params []Param, count int, names []string) (slots []int, rest []int, errs []string) {
+	slots = make([]int, len(params))
+	for i := range slots {
+		slots[i] = -1
+	}
+	fixed := len(params)
+	if fixed > 0 && params[fixed-1].Variadic {
+		fixed--
+	}
+	next, extra := 0, 0
+	named := false
+	for i := 0; i < count; i++ {
+		argName := ""
+		if names != nil {
+			argName = names[i]
+		}
+		if argName == "" {
+			switch {
+			case named:
+				errs = append(errs, fmt.Sprintf("positional argument after named arguments in call to %s", name))
+			case next < fixed:
+				slots[next] = i
+				next++
+			case fixed < len(params):
+				rest = append(rest, i)
+			default:
+				extra++
+			}
+			continue
+		}
+		named = true
+		found := -1
+		for p, param := range params {
+			if param.Name == argName {
+				found = p
+			}
+		}
+		switch {
+		case found < 0:
+			errs = append(errs, fmt.Sprintf("%s has no argument %s", name, argName))
+		case params[found].Variadic:
+			errs = append(errs, fmt.Sprintf("variadic argument %s of %s cannot be named", argName, name))
+		case slots[found] >= 0:
+			errs = append(errs, fmt.Sprintf("argument %s of %s is given twice", argName, name))
+		default:
+			slots[found] = i
+		}
+	}
+
+	if extra > 0 {
+		required := 0
+		for _, param := range params[:fixed] {
+			if !param.HasDefault {
+				required++
+			}
+		}
+		if required == fixed {
+			errs = append(errs, fmt.Sprintf("%s expects %d arguments, got %d", name, fixed, next+extra))
+		} else {
+			errs = append(errs, fmt.Sprintf("%s expects at most %d arguments, got %d", name, fixed, next+extra))
+		}
+	}
+	if len(errs) > 0 {
+		return slots, rest, errs
+	}
+	for p, param := range params[:fixed] {
+		if slots[p] < 0 && !param.HasDefault {
+			errs = append(errs, fmt.Sprintf("missing argument %s in call to %s", param.Name, name))
+		}
+	}
+	return slots, rest, errs
+}
+
+// argumentsCodeGen pushes the arguments of a call to a function taking
+// params, in the order of params. They're evaluated from left to right,
+// through variables when given in another order
+func (node FunctionCallNode) argumentsCodeGen(builder CodeBuilder, params []Param) {
+	slots, rest, errs := bindArguments(node.Name, params, len(node.ParamList), node.Names)
+	for _, err := range errs {
+		builder.Errorf("%s", err)
+	}
+
+	order := []int{}
+	for _, slot := range slots {
+		if slot >= 0 {
+			order = append(order, slot)
+		}
+	}
+	order = append(order, rest...)
+	locals := map[int]int64{}
+	if !sort.IntsAreSorted(order) {
+		for i, arg := range node.ParamList {
+			locals[i] = builder.NewLocal()
+			arg.CodeGen(builder)
+			builder.Push(AssignInst(locals[i]))
+		}
+	}
+	push := func(i int) {
+		if local, ok := locals[i]; ok {
+			builder.Push(LoadInst(local))
+		} else {
+			node.ParamList[i].CodeGen(builder)
+		}
+	}
+
+	for p, param := range params {
+		switch {
+		case param.Variadic:
+			for _, i := range rest {
+				push(i)
+			}
+			builder.Push(ListInst(int64(len(rest))))
+		case slots[p] >= 0:
+			push(slots[p])
+		default:
+			builder.Push(ConstInst(builder.Constant(param.Default)))
+		}
+	}
+}
+
+// method is the method call node stands for when its name is qualified by
+// a value rather than by a module or a type, as in x.f(a)
+func (node FunctionCallNode) method(builder CodeBuilder) (MethodCallNode, bool) {
+	dot := strings.Index(node.Name, ".")
+	if dot < 0 {
+		return MethodCallNode{}, false
+	}
+	sym, ok := builder.Lookup(node.Name[:dot])
+	if ok && (sym.Type == SYM_MODULE || sym.Type == SYM_TYPE || sym.Type == SYM_ENUM) {
+		return MethodCallNode{}, false
+	}
+	receiver := IdentifierNode{node.Name[:dot]}
+	return MethodCallNode{receiver, node.Name[dot+1:], node.ParamList, node.Names, node.Pos}, true
 }
 
 func (node FunctionCallNode) CodeGen(builder CodeBuilder) {
+	if method, ok := node.method(builder); ok {
+		method.CodeGen(builder)
+		return
+	}
+	sym := builder.Resolve(node.Name)
+	if params := builder.Params(sym.ID); sym.Type == SYM_FUN && params != nil {
+		node.argumentsCodeGen(builder, params)
+		builder.Push(InvokeInst(sym.ID))
+		return
+	}
+	if node.Names != nil {
+		builder.Errorf("%s takes no named arguments", node.Name)
+	}
 	for _, arg := range node.ParamList {
 		// IMPLICATION: arguments are processed from left to right
 		arg.CodeGen(builder)
 	}
-	builder.Push(InvokeInst(builder.Resolve(node.Name)))
+	switch sym.Type {
+	case SYM_FUN:
+		builder.Push(InvokeInst(sym.ID))
+	case SYM_BUILTIN:
+		builder.Push(BuiltinInst(sym.ID, int64(len(node.ParamList))))
+	case SYM_VARIANT:
+		// constructing a variant, the arguments being its fields
+		variantType := builder.Type(sym.ID)
+		if len(node.ParamList) != len(variantType.Fields) {
+			builder.Errorf("%s expects %d fields, got %d", node.Name, len(variantType.Fields), len(node.ParamList))
+		}
+		if len(variantType.Fields) == 0 {
+			loadSymbol(builder, node.Name, sym)
+			return
+		}
+		builder.Push(StructInst(sym.ID))
+	default:
+		// calling a function value
+		loadSymbol(builder, node.Name, sym)
+		builder.Push(CallInst(int64(len(node.ParamList))))
+	}
+}
+
+func (node CallNode) CodeGen(builder CodeBuilder) {
+	for _, arg := range node.ParamList {
+		arg.CodeGen(builder)
+	}
+	node.Callee.CodeGen(builder)
+	builder.Push(CallInst(int64(len(node.ParamList))))
+}
+
+// call is the call to the function name standing for node, the receiver
+// being its first argument
+func (node MethodCallNode) call(name string) FunctionCallNode {
+	names := node.Names
+	if names != nil {
+		names = append([]string{""}, names...)
+	}
+	return FunctionCallNode{name, append([]Node{node.Receiver}, node.ParamList...), names, node.Pos}
+}
+
+func (node MethodCallNode) CodeGen(builder CodeBuilder) {
+	name := builder.ResolveMethod(objectType(builder, node.Receiver, node.Pos), node.Method)
+	node.call(name).CodeGen(builder)
 }
 
+// The operators defined by the script are called directly when the types of
+// the operands are known, and else found by the interpreter at run time
 func (node BinaryOperatorNode) CodeGen(builder CodeBuilder) {
+	if call, ok := node.infixCall(); ok {
+		call.CodeGen(builder)
+		return
+	}
 	node.Left.CodeGen(builder)
 	node.Right.CodeGen(builder)
+	if id, ok := builder.Operator(node.Operator, operandType(builder, node.Left), operandType(builder, node.Right)); ok {
+		builder.Push(InvokeInst(id))
+		return
+	}
 	builder.Push(BinaryInst(node.Operator))
 }
 
+// infixCall is the call of the function of an operator declared with infixl
+// or infixr, which is named by the operator where it's declared
+func (node BinaryOperatorNode) infixCall() (FunctionCallNode, bool) {
+	if _, ok := BINARY_PRECEDENCE[node.Operator]; ok {
+		return FunctionCallNode{}, false
+	}
+	return FunctionCallNode{node.Operator, []Node{node.Left, node.Right}, nil, node.Pos}, true
+}
+
+func (node ListLiteralNode) CodeGen(builder CodeBuilder) {
+	for _, element := range node.Elements {
+		element.CodeGen(builder)
+	}
+	builder.Push(ListInst(int64(len(node.Elements))))
+}
+
+func (node MapLiteralNode) CodeGen(builder CodeBuilder) {
+	for i := range node.Keys {
+		node.Keys[i].CodeGen(builder)
+		node.Values[i].CodeGen(builder)
+	}
+	builder.Push(MapInst(int64(len(node.Keys))))
+}
+
+func (node IndexNode) CodeGen(builder CodeBuilder) {
+	node.Container.CodeGen(builder)
+	node.Index.CodeGen(builder)
+	builder.Push(IndexInst())
+}
+
+func (node SliceNode) CodeGen(builder CodeBuilder) {
+	node.Container.CodeGen(builder)
+	for _, bound := range []Node{node.Low, node.High} {
+		if bound == nil {
+			builder.Push(ConstInst(builder.Constant(nil)))
+		} else {
+			bound.CodeGen(builder)
+		}
+	}
+	builder.Push(SliceInst())
+}
+
+// checkMutable reports the modification of a constant through container,
+// which would only change the copy pushValue made
+func checkMutable(builder CodeBuilder, container Node) {
+	switch n := container.(type) {
+	case IdentifierNode:
+		if sym, ok := builder.Lookup(n.Name); ok && sym.Type == SYM_CONST {
+			builder.Errorf("cannot modify constant %s", n.Name)
+		}
+	case IndexNode:
+		checkMutable(builder, n.Container)
+	case FieldNode:
+		checkMutable(builder, n.Object)
+	}
+}
+
+func (node IndexAssignmentNode) CodeGen(builder CodeBuilder) {
+	checkMutable(builder, node.Container)
+	node.Container.CodeGen(builder)
+	node.Index.CodeGen(builder)
+	node.Expr.CodeGen(builder)
+	builder.Push(SetIndexInst())
+}
+
+// staticType is the name of the type node evaluates to when the compiler
+// can tell, empty otherwise
+func staticType(builder CodeBuilder, node Node) string {
+	switch n := node.(type) {
+	case StructLiteralNode:
+		// the value of a variant has the type of its enum
+		if sym, ok := builder.Lookup(n.Type); ok && sym.Type == SYM_VARIANT {
+			return sym.DataType
+		}
+		return n.Type
+	case FunctionCallNode:
+		if sym, ok := builder.Lookup(n.Name); ok && sym.Type == SYM_VARIANT {
+			return sym.DataType
+		}
+	case IdentifierNode:
+		if sym, ok := builder.Lookup(n.Name); ok {
+			return sym.DataType
+		}
+	case FieldNode:
+		sym, ok := builder.Lookup(objectType(builder, n.Object, n.Pos))
+		if !ok || (sym.Type != SYM_TYPE && sym.Type != SYM_VARIANT) {
+			return ""
+		}
+		structType := builder.Type(sym.ID)
+		if index := structType.FieldIndex(n.Field); index >= 0 {
+			return structType.Fields[index].Type
+		}
+	case DeclarationNode:
+		return declaredType(builder, n)
+	case AssignmentNode:
+		return staticType(builder, n.Expr)
+	case FieldAssignmentNode:
+		return staticType(builder, n.Expr)
+	case CompoundAssignmentNode:
+		return staticType(builder, n.Target)
+	}
+	return ""
+}
+
+// operandType is staticType, knowing the types of literals as well
+func operandType(builder CodeBuilder, node Node) string {
+	switch node.(type) {
+	case IntegerLiteralNode:
+		return "int"
+	case FloatLiteralNode:
+		return "float"
+	case StringLiteralNode:
+		return "string"
+	case BoolLiteralNode:
+		return "bool"
+	case ListLiteralNode:
+		return "list"
+	case MapLiteralNode:
+		return "map"
+	}
+	return staticType(builder, node)
+}
+
+// the annotation of a declaration, or the type of its initializer
+func declaredType(builder CodeBuilder, node DeclarationNode) string {
+	if node.Type != "" {
+		return node.Type
+	}
+	return staticType(builder, node.Expr)
+}
+
+// Name is the name the module is imported as
+func (node ImportNode) Name() string {
+	if node.Alias != "" {
+		return node.Alias
+	}
+	base := path.Base(node.Path)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+func (node ImportNode) CodeGen(builder CodeBuilder) {
+	// imported modules are compiled first and defined by the Loader
+	if sym, ok := builder.Lookup(node.Name()); !ok || sym.Type != SYM_MODULE {
+		builder.Errorf("cannot import %q, imports are resolved by a Loader at the top level of a file", node.Path)
+	}
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node InfixDefNode) CodeGen(builder CodeBuilder) {
+	// the function is resolved here, a variable named like it where the
+	// operator is used doesn't stand for it
+	if sym, ok := builder.Lookup(node.Function); ok {
+		builder.DefineAlias(node.Operator, sym)
+	} else {
+		builder.Errorf("undefined %s in the declaration of operator %s", node.Function, node.Operator)
+	}
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node TypeDefNode) CodeGen(builder CodeBuilder) {
+	// the type is defined when hoisted by the enclosing block
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node EnumDefNode) CodeGen(builder CodeBuilder) {
+	// like types, enums are defined when hoisted
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node StructLiteralNode) CodeGen(builder CodeBuilder) {
+	sym := builder.Resolve(node.Type)
+	if sym.ID < 0 {
+		// undefined, already reported by Resolve
+		builder.Push(ConstInst(builder.Constant(nil)))
+		return
+	}
+	// variants with fields can be constructed with their field names too
+	if sym.Type != SYM_TYPE && sym.Type != SYM_VARIANT {
+		builder.Errorf("%s is not a type", node.Type)
+		builder.Push(ConstInst(builder.Constant(nil)))
+		return
+	}
+	structType := builder.Type(sym.ID)
+	values := map[string]Node{}
+	for i, name := range node.Names {
+		if _, ok := values[name]; ok {
+			builder.Errorf("duplicate field %s in %s literal", name, node.Type)
+		}
+		if structType.FieldIndex(name) < 0 {
+			builder.Errorf("%s has no field %s", node.Type, name)
+		}
+		values[name] = node.Values[i]
+	}
+	// IMPLICATION: fields are evaluated in the order of the type definition
+	for _, field := range structType.Fields {
+		value, ok := values[field.Name]
+		if !ok {
+			builder.Errorf("missing field %s in %s literal", field.Name, node.Type)
+			builder.Push(ConstInst(builder.Constant(nil)))
+			continue
+		}
+		value.CodeGen(builder)
+	}
+	builder.Push(StructInst(sym.ID))
+}
+
+func (node FieldNode) CodeGen(builder CodeBuilder) {
+	if module, ok := node.Object.(IdentifierNode); ok {
+		if sym, ok := builder.Lookup(module.Name); ok && (sym.Type == SYM_MODULE || sym.Type == SYM_TYPE || sym.Type == SYM_ENUM) {
+			// module.function or Type.function as a value
+			name := module.Name + "." + node.Field
+			loadSymbol(builder, name, builder.Resolve(name))
+			return
+		}
+	}
+	node.Object.CodeGen(builder)
+	id, index := builder.ResolveField(objectType(builder, node.Object, node.Pos), node.Field)
+	builder.Push(GetFieldInst(id, index))
+}
+
+func (node FieldAssignmentNode) CodeGen(builder CodeBuilder) {
+	checkMutable(builder, node.Object)
+	node.Object.CodeGen(builder)
+	node.Expr.CodeGen(builder)
+	id, index := builder.ResolveField(objectType(builder, node.Object, node.Pos), node.Field)
+	builder.Push(SetFieldInst(id, index))
+}
+
+func (node CompoundAssignmentNode) CodeGen(builder CodeBuilder) {
+	switch target := node.Target.(type) {
+	case IdentifierNode:
+		// evaluating a name twice has no side effect
+		value := BinaryOperatorNode{target, node.Operator, node.Expr, node.Pos}
+		AssignmentNode{target.Name, value, node.Pos}.CodeGen(builder)
+	case IndexNode:
+		checkMutable(builder, target.Container)
+		container := builder.NewLocal()
+		index := builder.NewLocal()
+		target.Container.CodeGen(builder)
+		builder.Push(AssignInst(container))
+		target.Index.CodeGen(builder)
+		builder.Push(
+			AssignInst(index),
+			LoadInst(container), LoadInst(index),
+			LoadInst(container), LoadInst(index), IndexInst(),
+		)
+		node.Expr.CodeGen(builder)
+		builder.Push(BinaryInst(node.Operator), SetIndexInst())
+	case FieldNode:
+		checkMutable(builder, target.Object)
+		object := builder.NewLocal()
+		target.Object.CodeGen(builder)
+		id, index := builder.ResolveField(objectType(builder, target.Object, target.Pos), target.Field)
+		builder.Push(
+			AssignInst(object),
+			LoadInst(object),
+			LoadInst(object), GetFieldInst(id, index),
+		)
+		node.Expr.CodeGen(builder)
+		builder.Push(BinaryInst(node.Operator), SetFieldInst(id, index))
+	default:
+		builder.Errorf("cannot assign to %s", node.Target.String())
+		builder.Push(ConstInst(builder.Constant(nil)))
+	}
+}
+
+func (node UnaryOperatorNode) CodeGen(builder CodeBuilder) {
+	node.Operand.CodeGen(builder)
+	if node.Operator != "+" {
+		// unary plus is a no-op
+		builder.Push(UnaryInst(node.Operator))
+	}
+}
+
+func (node DeclarationNode) CodeGen(builder CodeBuilder) {
+	// the variable isn't in scope yet, so `let x = x + 1` refers to an outer x
+	node.Expr.CodeGen(builder)
+	id := builder.Define(node.Name, !node.Mutable, declaredType(builder, node))
+	// a new cell each time the declaration runs, closures created in a loop
+	// don't share the variables declared in its block
+	builder.Push(DefineInst(id), LoadInst(id))
+}
+
+func (node ConstNode) CodeGen(builder CodeBuilder) {
+	value, err := builder.Evaluate("const "+node.Name, func(scopedBuilder CodeBuilder) {
+		node.Expr.CodeGen(scopedBuilder)
+	})
+	if err != nil {
+		builder.Errorf("%v", Diagnostic{node.Pos.Line, node.Pos.Column, fmt.Sprintf("cannot evaluate %s at compile time: %v", node.Name, err)})
+	} else if !inlinable(value) {
+		builder.Errorf("constant %s can't hold a function", node.Name)
+		value = nil
+	}
+	id := builder.DefineConst(node.Name, value)
+	pushValue(builder, builder.ConstValue(id))
+}
+
 func (node AssignmentNode) CodeGen(builder CodeBuilder) {
 	node.Expr.CodeGen(builder)
-	id := builder.ResolveOrDefine(node.Dest)
-	builder.Push(AssignInst(id))
+	sym := builder.Resolve(node.Dest)
+	switch {
+	case sym.Type == SYM_FUN:
+		builder.Errorf("cannot assign to function %s", node.Dest)
+	case sym.Type == SYM_TYPE:
+		builder.Errorf("cannot assign to type %s", node.Dest)
+	case sym.Type == SYM_MODULE:
+		builder.Errorf("cannot assign to module %s", node.Dest)
+	case sym.Type == SYM_CONST:
+		builder.Errorf("cannot assign to constant %s", node.Dest)
+	case sym.ReadOnly:
+		builder.Errorf("cannot assign to %s, it is declared with let", node.Dest)
+	case sym.Type == SYM_UPVAL:
+		builder.Push(AssignUpvalInst(sym.ID), LoadUpvalInst(sym.ID))
+		return
+	case sym.Type == SYM_GLOBAL:
+		builder.Push(AssignGlobalInst(sym.ID), LoadGlobalInst(sym.ID))
+		return
+	}
+	builder.Push(AssignInst(sym.ID), LoadInst(sym.ID))
+}
+
+func (node IfNode) CodeGen(builder CodeBuilder) {
+	node.Cond.CodeGen(builder)
+	jumpToElse := builder.Position()
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	builder.BeginScope()
+	node.Then.CodeGen(builder)
+	builder.EndScope()
+	jumpToEnd := builder.Position()
+	builder.Push(JumpInst(ARG_NOOP))
+
+	builder.Patch(jumpToElse, builder.Position())
+	if node.Else != nil {
+		builder.BeginScope()
+		node.Else.CodeGen(builder)
+		builder.EndScope()
+	} else {
+		// the value of an if without else whose condition doesn't hold
+		builder.Push(ConstInst(builder.Constant(nil)))
+	}
+	builder.Patch(jumpToEnd, builder.Position())
+}
+
+func (node WhileNode) CodeGen(builder CodeBuilder) {
+	builder.BeginLoop()
+	head := builder.Position()
+	node.Cond.CodeGen(builder)
+	exit := builder.Position()
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	builder.BeginScope()
+	node.Block.CodeGen(builder)
+	builder.EndScope()
+	builder.Push(PopInst(), JumpInst(head))
+
+	builder.Patch(exit, builder.Position())
+	builder.EndLoop(head)
+	// loops have no meaningful value
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node ForNode) CodeGen(builder CodeBuilder) {
+	switch iterable := node.Iterable.(type) {
+	default:
+		node.iterCodeGen(builder)
+	case RangeNode:
+		node.rangeCodeGen(builder, iterable)
+	}
+}
+
+// for loops over anything INST_ITER accepts
+func (node ForNode) iterCodeGen(builder CodeBuilder) {
+	node.Iterable.CodeGen(builder)
+	items := builder.NewLocal()
+	index := builder.NewLocal()
+	builder.Push(IterInst(), AssignInst(items), PushInst(0), AssignInst(index))
+
+	builder.BeginScope()
+	defer builder.EndScope()
+	id := builder.Define(node.Var, false, "")
+
+	builder.BeginLoop()
+	head := builder.Position()
+	builder.Push(
+		LoadInst(index), LoadInst(items), BuiltinInst(BuiltinID("len"), 1),
+		BinaryInst("<"),
+	)
+	exit := builder.Position()
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	builder.Push(LoadInst(items), LoadInst(index), IndexInst(), DefineInst(id))
+	node.Block.CodeGen(builder)
+	builder.Push(PopInst())
+
+	step := builder.Position()
+	builder.Push(
+		LoadInst(index), PushInst(1), BinaryInst("+"), AssignInst(index),
+		JumpInst(head),
+	)
+
+	builder.Patch(exit, builder.Position())
+	builder.EndLoop(step)
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node ForNode) rangeCodeGen(builder CodeBuilder, iterable RangeNode) {
+	// both bounds are evaluated once, before the loop
+	iterable.From.CodeGen(builder)
+	iterable.To.CodeGen(builder)
+	end := builder.NewLocal()
+	// the loop variable is scoped to the loop, along with the block's
+	// declarations
+	builder.BeginScope()
+	defer builder.EndScope()
+	id := builder.Define(node.Var, false, "")
+	builder.Push(AssignInst(end), AssignInst(id))
+
+	builder.BeginLoop()
+	head := builder.Position()
+	builder.Push(LoadInst(id), LoadInst(end), BinaryInst("<"))
+	exit := builder.Position()
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	node.Block.CodeGen(builder)
+	builder.Push(PopInst())
+
+	// like Go, every iteration gets its own copy of the loop variable
+	step := builder.Position()
+	builder.Push(
+		LoadInst(id), DefineInst(id),
+		LoadInst(id), PushInst(1), BinaryInst("+"), AssignInst(id),
+		JumpInst(head),
+	)
+
+	builder.Patch(exit, builder.Position())
+	builder.EndLoop(step)
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node RangeNode) CodeGen(builder CodeBuilder) {
+	builder.Errorf("range %s outside of a for loop", node.String())
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node BreakNode) CodeGen(builder CodeBuilder) {
+	builder.Break()
+	// unreachable, but keeps the stack balanced for the code that follows
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node ContinueNode) CodeGen(builder CodeBuilder) {
+	builder.Continue()
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node ReturnNode) CodeGen(builder CodeBuilder) {
+	node.Expr.CodeGen(builder)
+	builder.Return()
+	// unreachable, but keeps the stack balanced for the code that follows
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node TryNode) CodeGen(builder CodeBuilder) {
+	// handlers cut the stack back to its height before the try block
+	mark := builder.NewLocal()
+	builder.Push(MarkInst(mark))
+	finally := func(scopedBuilder CodeBuilder) {
+		node.Finally.CodeGen(scopedBuilder)
+		// the value of the finally block is dropped
+		scopedBuilder.Push(PopInst())
+	}
+	if node.Finally != nil {
+		builder.BeginFinally(finally)
+	}
+
+	start := builder.Position()
+	builder.BeginScope()
+	node.Try.CodeGen(builder)
+	builder.EndScope()
+	end := builder.Position()
+	exits := []int64{end}
+	builder.Push(JumpInst(ARG_NOOP))
+
+	if node.Catch != nil {
+		builder.AddHandler(start, end, builder.Position(), mark)
+		builder.BeginScope()
+		id := builder.Define(node.CatchVar, true, "Error")
+		builder.Push(DefineInst(id))
+		node.Catch.CodeGen(builder)
+		builder.EndScope()
+		exits = append(exits, builder.Position())
+		builder.Push(JumpInst(ARG_NOOP))
+	}
+
+	if node.Finally != nil {
+		builder.EndFinally()
+		// exceptions escaping the try and catch blocks run the finally
+		// block, then are thrown again
+		builder.AddHandler(start, builder.Position(), builder.Position(), mark)
+		exception := builder.NewLocal()
+		builder.Push(AssignInst(exception))
+		builder.BeginScope()
+		finally(builder)
+		builder.EndScope()
+		builder.Push(LoadInst(exception), ThrowInst())
+	}
+
+	for _, exit := range exits {
+		builder.Patch(exit, builder.Position())
+	}
+	if node.Finally != nil {
+		builder.BeginScope()
+		finally(builder)
+		builder.EndScope()
+	}
+}
+
+func (node ThrowNode) CodeGen(builder CodeBuilder) {
+	node.Expr.CodeGen(builder)
+	builder.Push(ThrowInst())
+	// unreachable, but keeps the stack balanced for the code that follows
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node MatchNode) CodeGen(builder CodeBuilder) {
+	node.Value.CodeGen(builder)
+	subject := builder.NewLocal()
+	builder.Push(AssignInst(subject))
+	dataType := staticType(builder, node.Value)
+
+	ends := []int64{}
+	for _, arm := range node.Arms {
+		// the variables bound by the pattern are scoped to the arm
+		builder.BeginScope()
+		fails := arm.Pattern.MatchCodeGen(builder, subject, dataType)
+		arm.Body.CodeGen(builder)
+		builder.EndScope()
+		ends = append(ends, builder.Position())
+		builder.Push(JumpInst(ARG_NOOP))
+		// on to the next arm
+		for _, fail := range fails {
+			builder.Patch(fail, builder.Position())
+		}
+	}
+	// no arm matched
+	builder.Push(LoadInst(subject))
+	builder.Push(NoMatchInst())
+	for _, end := range ends {
+		builder.Patch(end, builder.Position())
+	}
+
+	if missing := missingCases(builder, node.Arms, dataType); missing != "" {
+		builder.Warnf("match is not exhaustive, missing %s", missing)
+	}
+}
+
+// missingCases describes the values of a closed set, the bools, the
+// variants of an enum or a struct type, that no arm matches. It's empty when
+// the match is exhaustive or the set isn't closed
+func missingCases(builder CodeBuilder, arms []MatchArm, dataType string) string {
+	isBool := dataType == "bool"
+	covered := map[bool]bool{}
+	variants := map[*StructType]bool{}
+	for _, arm := range arms {
+		if irrefutable(builder, arm.Pattern, dataType) {
+			return ""
+		}
+		for _, value := range boolLiterals(arm.Pattern) {
+			isBool = true
+			covered[value] = true
+		}
+		for _, variant := range coveredVariants(builder, arm.Pattern) {
+			variants[variant] = true
+		}
+	}
+	if enum := enumType(builder, dataType); enum != nil {
+		missing := []string{}
+		for _, variant := range enum.Variants {
+			if !variants[variant] {
+				missing = append(missing, variant.Name)
+			}
+		}
+		return strings.Join(missing, ", ")
+	}
+	if isBool {
+		missing := []string{}
+		for _, value := range []bool{true, false} {
+			if !covered[value] {
+				missing = append(missing, fmt.Sprint(value))
+			}
+		}
+		return strings.Join(missing, ", ")
+	}
+	if sym, ok := builder.Lookup(dataType); ok && sym.Type == SYM_TYPE {
+		return dataType + "{...}"
+	}
+	return ""
+}
+
+// enumType returns nil when dataType isn't an enum
+func enumType(builder CodeBuilder, dataType string) *EnumType {
+	if sym, ok := builder.Lookup(dataType); ok && sym.Type == SYM_ENUM {
+		return builder.Enum(sym.ID)
+	}
+	return nil
+}
+
+// unitVariant tells whether name is a variant without fields, which a
+// BindingPattern matches instead of binding it
+func unitVariant(builder CodeBuilder, name string) (Symbol, bool) {
+	sym, ok := builder.Lookup(name)
+	if !ok || sym.Type != SYM_VARIANT || variantUnit(builder, sym) == nil {
+		return Symbol{}, false
+	}
+	return sym, true
+}
+
+// coveredVariants returns the variants whose every value pattern matches
+func coveredVariants(builder CodeBuilder, pattern Pattern) []*StructType {
+	switch p := pattern.(type) {
+	case BindingPattern:
+		if sym, ok := unitVariant(builder, p.Name); ok {
+			return []*StructType{builder.Type(sym.ID)}
+		}
+	case VariantPattern:
+		sym, ok := builder.Lookup(p.Variant)
+		if !ok || sym.Type != SYM_VARIANT {
+			return nil
+		}
+		variantType := builder.Type(sym.ID)
+		if len(p.Patterns) != len(variantType.Fields) {
+			return nil
+		}
+		for i, field := range variantType.Fields {
+			if !irrefutable(builder, p.Patterns[i], field.Type) {
+				return nil
+			}
+		}
+		return []*StructType{variantType}
+	case StructPattern:
+		sym, ok := builder.Lookup(p.Type)
+		if !ok || sym.Type != SYM_VARIANT {
+			return nil
+		}
+		variantType := builder.Type(sym.ID)
+		for i, field := range p.Fields {
+			index := variantType.FieldIndex(field)
+			if index < 0 || !irrefutable(builder, p.Patterns[i], variantType.Fields[index].Type) {
+				return nil
+			}
+		}
+		return []*StructType{variantType}
+	case AlternativePattern:
+		variants := []*StructType{}
+		for _, alternative := range p.Alternatives {
+			variants = append(variants, coveredVariants(builder, alternative)...)
+		}
+		return variants
+	}
+	return nil
+}
+
+// irrefutable tells whether pattern matches any value of the type dataType
+func irrefutable(builder CodeBuilder, pattern Pattern, dataType string) bool {
+	if enum := enumType(builder, dataType); enum != nil {
+		// the patterns covering every variant, e.g. the fields of a
+		// variant matching a nested enum
+		covered := map[*StructType]bool{}
+		for _, variant := range coveredVariants(builder, pattern) {
+			if variant.Enum == enum {
+				covered[variant] = true
+			}
+		}
+		if len(covered) == len(enum.Variants) {
+			return true
+		}
+	}
+	switch p := pattern.(type) {
+	case WildcardPattern:
+		return true
+	case BindingPattern:
+		_, isVariant := unitVariant(builder, p.Name)
+		return !isVariant
+	case AlternativePattern:
+		for _, alternative := range p.Alternatives {
+			if irrefutable(builder, alternative, dataType) {
+				return true
+			}
+		}
+	case StructPattern:
+		sym, ok1 := builder.Lookup(p.Type)
+		expected, ok2 := builder.Lookup(dataType)
+		if !ok1 || !ok2 || sym.Type != SYM_TYPE || sym != expected {
+			return false
+		}
+		structType := builder.Type(sym.ID)
+		for i, field := range p.Fields {
+			index := structType.FieldIndex(field)
+			if index < 0 || !irrefutable(builder, p.Patterns[i], structType.Fields[index].Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// the true and false literals of a pattern
+func boolLiterals(pattern Pattern) []bool {
+	switch p := pattern.(type) {
+	case LiteralPattern:
+		if literal, ok := p.Value.(BoolLiteralNode); ok {
+			return []bool{literal.Value}
+		}
+	case AlternativePattern:
+		values := []bool{}
+		for _, alternative := range p.Alternatives {
+			values = append(values, boolLiterals(alternative)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// the names of the variables a pattern binds
+func patternBindings(builder CodeBuilder, pattern Pattern) []string {
+	switch p := pattern.(type) {
+	case BindingPattern:
+		if _, ok := unitVariant(builder, p.Name); ok {
+			return nil
+		}
+		return []string{p.Name}
+	case AlternativePattern:
+		names := []string{}
+		for _, alternative := range p.Alternatives {
+			names = append(names, patternBindings(builder, alternative)...)
+		}
+		return names
+	case StructPattern:
+		names := []string{}
+		for _, field := range p.Patterns {
+			names = append(names, patternBindings(builder, field)...)
+		}
+		return names
+	case VariantPattern:
+		names := []string{}
+		for _, field := range p.Patterns {
+			names = append(names, patternBindings(builder, field)...)
+		}
+		return names
+	}
+	return nil
+}
+
+func (pattern WildcardPattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	return nil
+}
+
+func (pattern BindingPattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	if sym, ok := unitVariant(builder, pattern.Name); ok {
+		// like Rust, a variant in scope is matched rather than shadowed
+		builder.Push(LoadInst(subject), IsStructInst(sym.ID))
+		fail := builder.Position()
+		builder.Push(JumpIfFalseInst(ARG_NOOP))
+		return []int64{fail}
+	}
+	// like let, bound variables are read only
+	id := builder.Define(pattern.Name, true, dataType)
+	builder.Push(LoadInst(subject), DefineInst(id))
+	return nil
+}
+
+func (pattern LiteralPattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	builder.Push(LoadInst(subject))
+	pattern.Value.CodeGen(builder)
+	builder.Push(BinaryInst("=="))
+	fail := builder.Position()
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+	return []int64{fail}
+}
+
+func (pattern AlternativePattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	if names := patternBindings(builder, pattern); len(names) > 0 {
+		builder.Errorf("alternative patterns cannot bind variables: %s", strings.Join(names, ", "))
+	}
+	// every alternative but the last one jumps over the next ones when it
+	// matches, and falls through to the next one when it doesn't
+	matches := []int64{}
+	var fails []int64
+	for i, alternative := range pattern.Alternatives {
+		fails = alternative.MatchCodeGen(builder, subject, dataType)
+		if i == len(pattern.Alternatives)-1 {
+			break
+		}
+		matches = append(matches, builder.Position())
+		builder.Push(JumpInst(ARG_NOOP))
+		for _, fail := range fails {
+			builder.Patch(fail, builder.Position())
+		}
+	}
+	for _, match := range matches {
+		builder.Patch(match, builder.Position())
+	}
+	return fails
+}
+
+func (pattern StructPattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	sym := builder.Resolve(pattern.Type)
+	if sym.Type != SYM_TYPE && sym.Type != SYM_VARIANT {
+		if sym.ID >= 0 {
+			builder.Errorf("%s is not a type", pattern.Type)
+		}
+		return nil
+	}
+	structType := builder.Type(sym.ID)
+	builder.Push(LoadInst(subject), IsStructInst(sym.ID))
+	fails := []int64{builder.Position()}
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	seen := map[string]bool{}
+	for i, name := range pattern.Fields {
+		index := structType.FieldIndex(name)
+		switch {
+		case seen[name]:
+			builder.Errorf("duplicate field %s in %s pattern", name, pattern.Type)
+		case index < 0:
+			builder.Errorf("%s has no field %s", pattern.Type, name)
+			continue
+		}
+		seen[name] = true
+		if _, ok := pattern.Patterns[i].(WildcardPattern); ok {
+			continue
+		}
+		field := builder.NewLocal()
+		builder.Push(LoadInst(subject), GetFieldInst(sym.ID, index), AssignInst(field))
+		fieldType := structType.Fields[index].Type
+		fails = append(fails, pattern.Patterns[i].MatchCodeGen(builder, field, fieldType)...)
+	}
+	return fails
+}
+
+func (pattern VariantPattern) MatchCodeGen(builder CodeBuilder, subject int64, dataType string) []int64 {
+	sym := builder.Resolve(pattern.Variant)
+	if sym.Type != SYM_VARIANT {
+		if sym.ID >= 0 {
+			builder.Errorf("%s is not a variant", pattern.Variant)
+		}
+		return nil
+	}
+	variantType := builder.Type(sym.ID)
+	if len(pattern.Patterns) != len(variantType.Fields) {
+		builder.Errorf("%s has %d fields, the pattern has %d", pattern.Variant, len(variantType.Fields), len(pattern.Patterns))
+		return nil
+	}
+	builder.Push(LoadInst(subject), IsStructInst(sym.ID))
+	fails := []int64{builder.Position()}
+	builder.Push(JumpIfFalseInst(ARG_NOOP))
+
+	for i, fieldPattern := range pattern.Patterns {
+		if _, ok := fieldPattern.(WildcardPattern); ok {
+			continue
+		}
+		field := builder.NewLocal()
+		builder.Push(LoadInst(subject), GetFieldInst(sym.ID, int64(i)), AssignInst(field))
+		fails = append(fails, fieldPattern.MatchCodeGen(builder, field, variantType.Fields[i].Type)...)
+	}
+	return fails
 }
 
 func (node BlockNode) CodeGen(builder CodeBuilder) {
+	// functions and types can be used before the definition in the same
+	// block
+	for _, expr := range node.ExprList {
+		switch def := expr.(type) {
+		case FunctionDefNode:
+			params, _ := def.params()
+			builder.DeclareFunc(def.Name, params)
+		case TypeDefNode:
+			builder.DefineType(def.Name, def.Fields)
+		case EnumDefNode:
+			builder.DefineEnum(def.Name, def.Variants)
+		}
+	}
+
+	if len(node.ExprList) == 0 {
+		builder.Push(ConstInst(builder.Constant(nil)))
+	}
 	for i, expr := range node.ExprList {
 		expr.CodeGen(builder)
 		if i != len(node.ExprList)-1 {
@@ -54,6 +1398,28 @@ func (node BlockNode) CodeGen(builder CodeBuilder) {
 	}
 }
 
+// macros are gone once the module is expanded, see Expand
+
+func (node MacroDefNode) CodeGen(builder CodeBuilder) {
+	builder.Errorf("macro %s can only be defined in a block", node.Name)
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node MacroCallNode) CodeGen(builder CodeBuilder) {
+	builder.Errorf("macro %s isn't expanded", node.Name)
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node QuoteNode) CodeGen(builder CodeBuilder) {
+	builder.Errorf("quote outside of a macro")
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
+func (node UnquoteNode) CodeGen(builder CodeBuilder) {
+	builder.Errorf("$%s outside of a quote", node.Name)
+	builder.Push(ConstInst(builder.Constant(nil)))
+}
+
 func (node ModuleNode) CodeGen(builder CodeBuilder) {
 	node.Block.CodeGen(builder)
 }
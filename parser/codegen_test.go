@@ -1,6 +1,13 @@
 package parser
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
 
 func TestCodeGen(t *testing.T) {
 	code := `
@@ -22,3 +29,1481 @@ def do_something(x : int, y:int) {
 		t.Error(module)
 	}
 }
+
+// run compiles and executes code, returning the value of its last expression
+func run(t *testing.T, code string) interface{} {
+	module, err := Parse(code)
+	if err != nil {
+		t.Fatalf("Should not fail: %s - %s", code, err)
+	}
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatalf("Should compile: %s - %s", code, err)
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		t.Fatalf("Should run: %s - %s", code, err)
+	}
+	if len(interp.Stack.Value) != 1 {
+		t.Fatalf("Stack should hold exactly the result: %s - %v", code, interp.Stack.Value)
+	}
+	result, _ := interp.Stack.Pop()
+	return result
+}
+
+func expect(t *testing.T, code string, expected interface{}) {
+	result := run(t, code)
+	if result != expected {
+		t.Errorf("%s: expecting %v, got %v", code, expected, result)
+	}
+}
+
+func TestCodeGenExpression(t *testing.T) {
+	expect(t, "1 + 2 * 3", int64(7))
+	expect(t, "(1 + 2) * 3", int64(9))
+	expect(t, "10 - 2 - 3", int64(5))
+	expect(t, "2 * 3 < 2 + 3", false)
+	expect(t, "var x = 4 let y = x * x y - x", int64(12))
+	expect(t, "", nil)
+	expect(t, `
+def square(x: int) {
+	x * x
+}
+square(square(3))
+`, int64(81))
+}
+
+func TestCodeGenIf(t *testing.T) {
+	expect(t, "if 1 < 2 { 10 } else { 20 }", int64(10))
+	expect(t, "if 1 > 2 { 10 } else { 20 }", int64(20))
+	expect(t, "if false { 10 }", nil)
+	expect(t, "let x = if true { 1 } else { 2 } x + 1", int64(2))
+	expect(t, `
+def sign(x: int) {
+	if x < 0 {
+		-1
+	} else if x == 0 {
+		0
+	} else {
+		1
+	}
+}
+sign(-5) * 100 + sign(0) * 10 + sign(7)
+`, int64(-99))
+	expect(t, `
+var x = 5
+if x > 1 {
+	if x > 3 { x = x * 2 } else { x = 0 }
+	x + 1
+}
+`, int64(11))
+	expect(t, "if true {}", nil)
+}
+
+func TestCompileError(t *testing.T) {
+	for _, code := range []string{
+		"undefined_variable + 1",
+		"undefined_function(1)",
+		"let g = fn(a: int, a: int) {}",
+		"def f() {} def f() {}",
+		"def f(a: int, a: int) {}",
+		"def g() { let x = 1 def f() { x } }",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := Parse("def f() {\n\tx = \n}")
+	diag, ok := err.(Diagnostic)
+	if !ok {
+		t.Fatalf("Expecting a diagnostic: %v", err)
+	}
+	if diag.Line != 3 || diag.Column != 1 {
+		t.Errorf("Wrong position: %s", diag.Error())
+	}
+}
+
+func TestCodeGenLoop(t *testing.T) {
+	expect(t, `
+var i = 0
+var total = 0
+while i < 10 {
+	i = i + 1
+	total = total + i
+}
+total
+`, int64(55))
+
+	expect(t, `
+var total = 0
+for i in 0..5 {
+	for j in i..5 {
+		total = total + 1
+	}
+}
+total
+`, int64(15))
+
+	// break inside nested ifs leaves the innermost loop only
+	expect(t, `
+var count = 0
+for i in 0..10 {
+	for j in 0..10 {
+		if j > 2 {
+			if true { break }
+		}
+		count = count + 1
+	}
+}
+count
+`, int64(30))
+
+	expect(t, `
+var total = 0
+for i in 0..10 {
+	if i == 3 { continue } else if i == 7 { break }
+	total = total + i
+}
+total
+`, int64(18))
+
+	// continue in a while loop goes back to the condition
+	expect(t, `
+var i = 0
+var odd = 0
+while i < 10 {
+	i = i + 1
+	if i / 2 * 2 == i { continue }
+	odd = odd + 1
+}
+odd
+`, int64(5))
+
+	// break in the middle of an expression must not leave its operands on
+	// the stack
+	expect(t, `
+var x = 0
+while true {
+	x = x + 1 + if x > 5 { break } else { 1 }
+}
+x
+`, int64(6))
+
+	expect(t, "while false {}", nil)
+	expect(t, "var i = 7 for i in 0..3 { i } i", int64(7))
+}
+
+func TestLoopCompileError(t *testing.T) {
+	for _, code := range []string{
+		"break",
+		"continue",
+		"while true { def f() { break } }",
+		"for i in 0..1 { j } ",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenReturn(t *testing.T) {
+	expect(t, `
+def find(limit: int) {
+	for i in 0..100 {
+		while true {
+			if i * i > limit { return i }
+			break
+		}
+	}
+	-1
+}
+find(50) * 10 + find(100000)
+`, int64(79))
+
+	// the operands pending in the caller survive, the callee's are discarded
+	expect(t, `
+def early(x: int) {
+	1 + 2 + if x > 0 { return x } else { 0 }
+}
+100 + early(5) + early(-5)
+`, int64(108))
+
+	expect(t, `
+def fib(n: int) {
+	if n < 2 { return n }
+	fib(n - 1) + fib(n - 2)
+}
+fib(15)
+`, int64(610))
+
+	expect(t, "return 5 6", int64(5))
+}
+
+func TestCodeGenScope(t *testing.T) {
+	// inner declarations shadow outer ones until the end of their block
+	expect(t, `
+let x = 1
+var y = 0
+if true {
+	let x = 10
+	y = x
+}
+x + y
+`, int64(11))
+
+	expect(t, `
+let x = 2
+let r = if x > 1 {
+	let x = x * 100
+	x + 1
+} else { 0 }
+r + x
+`, int64(203))
+
+	expect(t, `
+var total = 0
+for i in 0..3 {
+	let doubled = i * 2
+	var j = 0
+	while j < 2 {
+		let doubled = 1
+		total = total + doubled
+		j = j + 1
+	}
+	total = total + doubled
+}
+total
+`, int64(12))
+
+	expect(t, `
+def f(x: int) {
+	var y: int = x
+	y = y + 1
+	y
+}
+f(1)
+`, int64(2))
+}
+
+func TestScopeCompileError(t *testing.T) {
+	for _, code := range []string{
+		// assigning an undeclared name
+		"x = 1",
+		"if true { var x = 1 } x = 2",
+		// let can't be reassigned
+		"let x = 1 x = 2",
+		// out of scope
+		"if true { let x = 1 } x",
+		"for i in 0..1 {} i",
+		"while false { let x = 1 } x",
+		// redeclaration in the same scope
+		"let x = 1 var x = 2",
+		"def f(x: int) { let x = 1 }",
+		"for i in 0..1 { let i = 1 }",
+		"def f() {} let f = 1",
+		"def f() {} f = 1",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenClosure(t *testing.T) {
+	// the types of the arguments are inferred when omitted
+	expect(t, `
+def add(x, y) { x + y }
+def twice(f, x) { f(f(x)) }
+add(1, 2) * 100 + twice(fn(x) { x * 3 }, 1)
+`, int64(309))
+
+	expect(t, `
+def make_counter() {
+	var n = 0
+	fn() {
+		n = n + 1
+		n
+	}
+}
+let a = make_counter()
+let b = make_counter()
+a() a()
+b()
+a() * 10 + b()
+`, int64(32))
+
+	// closures passed as callbacks, and named functions as values
+	expect(t, `
+def apply_twice(f: function, x: int) {
+	f(f(x))
+}
+def double(x: int) {
+	x * 2
+}
+let offset = 5
+apply_twice(fn(x: int) { x + offset }, 1) * 100 + apply_twice(double, 3)
+`, int64(1112))
+
+	// captures through several levels of closures
+	expect(t, `
+def outer() {
+	var x = 1
+	let middle = fn() {
+		let inner = fn() {
+			x = x + 10
+		}
+		inner()
+		x = x * 2
+	}
+	middle()
+	x
+}
+outer()
+`, int64(22))
+
+	// every loop iteration gets its own variables
+	expect(t, `
+var f0 = fn() { 0 }
+var f1 = fn() { 0 }
+for i in 0..2 {
+	let j = i * 10
+	let f = fn() { i + j }
+	if i == 0 { f0 = f } else { f1 = f }
+}
+f0() * 100 + f1()
+`, int64(11))
+
+	expect(t, `
+let f = fn(x: int) { x }
+f == f
+`, true)
+}
+
+func TestCodeGenCall(t *testing.T) {
+	expect(t, `
+def add(a: int, b: int) {
+	fn(c: int) { a + b + c }
+}
+add(1, 2)(3)
+`, int64(6))
+
+	expect(t, "(fn(x: int) { x })(1)", int64(1))
+	expect(t, "let curry = fn(a: int) { fn(b: int) { fn(c: int) { a * 100 + b * 10 + c } } } curry(1)(2)(3)", int64(123))
+}
+
+func TestCodeGenGlobal(t *testing.T) {
+	// functions use the variables of the top level, not only closures
+	expect(t, `
+let limit = 5
+def f(x: int) { x < limit }
+f(4)
+`, true)
+
+	expect(t, `
+var count = 0
+def inc() {
+	count = count + 1
+	fn() { count = count * 10 }
+}
+inc()
+let g = inc()
+g()
+count
+`, int64(20))
+
+	for _, code := range []string{
+		// let stays read only
+		"let limit = 5 def f() { limit = 1 }",
+		// only the top level is global
+		"if true { let x = 1 def f() { x } }",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestClosureError(t *testing.T) {
+	for _, code := range []string{
+		// named functions can't capture
+		"def f() { let y = 1 def g() { y } }",
+		"def f() { let x = 1 def g() { fn() { x } } }",
+		// captured let variables stay read only
+		"let x = 1 let f = fn() { x = 2 }",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+
+	for _, code := range []string{
+		"let x: any = 1 x(1)",
+		"let f: any = fn(a: int) { a } f(1, 2)",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		interp := NewInterpreter()
+		id, err := Compile(module, interp)
+		if err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		if err := interp.ExecFunc(id); err == nil {
+			t.Errorf("Should fail at runtime: %s", code)
+		}
+	}
+}
+
+func TestCodeGenList(t *testing.T) {
+	expect(t, "[10, 20, 30][1]", int64(20))
+	expect(t, "len([])", int64(0))
+	expect(t, "len([1, [2, 3], 4][1])", int64(2))
+
+	expect(t, `
+let xs = [1, 2, 3, 4, 5]
+xs[0] = xs[4] * 10
+var total = 0
+for x in xs { total = total + x }
+total
+`, int64(64))
+
+	expect(t, `
+let xs = [1, 2, 3, 4, 5]
+let a = xs[1:3]
+let b = xs[:2]
+let c = xs[3:]
+let d = xs[:]
+d[0] = 100
+len(a) * 1000 + a[0] * 100 + b[1] * 10 + c[1] + xs[0]
+`, int64(2000+200+20+5+1))
+
+	// lists are references
+	expect(t, `
+def fill(xs: list, value: int) {
+	for i in 0..len(xs) { xs[i] = value }
+}
+let xs = [0, 0, 0]
+let alias = xs
+fill(alias, 7)
+xs[0] + xs[1] + xs[2]
+`, int64(21))
+
+	expect(t, `
+let grid = [[1, 2], [3, 4]]
+grid[1][0] = grid[0][1] * 10
+grid[1][0]
+`, int64(20))
+
+	// each iteration captures its own element
+	expect(t, `
+let fs = [0, 0]
+var i = 0
+for x in [5, 6] {
+	fs[i] = fn() { x }
+	i = i + 1
+}
+let f0 = fs[0]
+let f1 = fs[1]
+f0() * 10 + f1()
+`, int64(56))
+
+	// builtins can be shadowed
+	expect(t, "def len(x: int) { 42 } len(1)", int64(42))
+}
+
+func TestListRuntimeError(t *testing.T) {
+	cases := map[string]string{
+		"[1, 2, 3][3]":          "Index 3 out of range for list of length 3",
+		"[1, 2, 3][-1]":         "Index -1 out of range for list of length 3",
+		"let xs = [] xs[0] = 1": "Index 0 out of range for list of length 0",
+		"[1, 2, 3][2:1]":        "Slice [2:1] out of range for list of length 3",
+		"[1, 2, 3][:4]":         "Slice [0:4] out of range for list of length 3",
+	}
+	for code, message := range cases {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		interp := NewInterpreter()
+		id, err := Compile(module, interp)
+		if err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		err = interp.ExecFunc(id)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expecting error %q, got %v", code, message, err)
+		}
+	}
+
+	module, _ := Parse("let f = len")
+	if _, err := Compile(module, NewInterpreter()); err == nil {
+		t.Errorf("Builtins can't be used as values")
+	}
+}
+
+func TestCodeGenMap(t *testing.T) {
+	expect(t, `{"a": 1, "b": 2}["b"]`, int64(2))
+	expect(t, `len({})`, int64(0))
+
+	expect(t, `
+let m = {"one": 1, "two": 2}
+m["three"] = 3
+m["one"] = 10
+delete(m, "two")
+delete(m, "missing")
+var total = 0
+for k in m { total = total + m[k] }
+total * 10 + len(m)
+`, int64(132))
+
+	expect(t, `
+let m = {1: true}
+(if has(m, 1) { 1 } else { 0 }) + (if has(m, 2) { 10 } else { 0 })
+`, int64(1))
+
+	// keys are iterated in insertion order, deleted then re-added keys go last
+	expect(t, `
+let m = {"c": 0, "a": 0, "b": 0}
+delete(m, "c")
+m["c"] = 0
+m["a"] = 1
+var order = ""
+for k in m { order = order + k }
+order
+`, "abc")
+
+	expect(t, `
+let counts = {}
+for word in ["a", "b", "a", "c", "a"] {
+	if has(counts, word) {
+		counts[word] = counts[word] + 1
+	} else {
+		counts[word] = 1
+	}
+}
+counts["a"] * 100 + counts["b"] * 10 + counts["c"]
+`, int64(311))
+}
+
+func TestMapRuntimeError(t *testing.T) {
+	module, _ := Parse(`let m = {"a": 1} m["b"]`)
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interp.ExecFunc(id)
+	if err == nil || !strings.Contains(err.Error(), `Key "b" not found`) {
+		t.Errorf("Expecting a missing key error, got %v", err)
+	}
+}
+
+func TestCodeGenString(t *testing.T) {
+	expect(t, `"a" + "b" < "b"`, true)
+	expect(t, `"abc" >= "abd"`, false)
+	expect(t, `let s = "abc" s[0] + s[2]`, "ac")
+	expect(t, `let s = "hello" s[1:3] + s[:1] + s[4:]`, "elho")
+	expect(t, `var n = 0 for c in ["b", "a", "c"] { if c <= "b" { n = n + 1 } } n`, int64(2))
+}
+
+func TestCodeGenFloat(t *testing.T) {
+	expect(t, "1.5 + 2.5", 4.0)
+	expect(t, "let x = 1.5 let y = -x * 2.0 - 0.5 y", -3.5)
+	expect(t, "7.0 / 2.0 + 2.0 ** 0.5 ** 2.0", 3.5+math.Pow(2, 0.25))
+	expect(t, "1.0 / 0.0", math.Inf(1))
+	expect(t, "(0.1 + 0.2 > 0.3) == (0.1 < 0.2)", true)
+	expect(t, `
+enum Shape { Circle(r: float), Square(side: float) }
+def area(s: Shape): float {
+	match s { Circle(r) => 3.0 * r * r, Square(side) => side * side }
+}
+area(Circle(2.0)) + area(Square(1.5))
+`, 14.25)
+}
+
+func TestStringRuntimeError(t *testing.T) {
+	cases := map[string]string{
+		`"abc"[3]`:   "Index 3 out of range for string of length 3",
+		`"abc"[-1]`:  "Index -1 out of range for string of length 3",
+		`"abc"[2:1]`: "Slice [2:1] out of range for string of length 3",
+	}
+	for code, message := range cases {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		interp := NewInterpreter()
+		id, err := Compile(module, interp)
+		if err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		err = interp.ExecFunc(id)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expecting error %q, got %v", code, message, err)
+		}
+	}
+}
+
+func TestCodeGenStruct(t *testing.T) {
+	expect(t, `
+type Point { x: int, y: int }
+let p = Point{y: 2, x: 1}
+p.x * 10 + p.y
+`, int64(12))
+
+	// types are hoisted, and annotations tell which type a field belongs to
+	expect(t, `
+def norm1(p: Point) { p.x + p.y }
+def translate(p: Point, d: Point) { p.x = p.x + d.x p.y = p.y + d.y }
+type Point { x: int, y: int }
+type Size { x: int, y: int }
+var p = Point{x: 1, y: 2}
+translate(p, Point{x: 10, y: 10})
+norm1(p)
+`, int64(23))
+
+	// without annotations, the types TypeCheck infers tell which type a
+	// field belongs to
+	expect(t, `
+type P { x: int }
+type Q { x: int }
+def f(a) { a.x }
+f(P{x: 1})
+`, int64(1))
+	expect(t, `
+type P { x: int }
+type Q { x: int }
+def set(a) { a.x = 5 a }
+set(Q{x: 1}).x * 10 + (fn(b) { b.x })(Q{x: 2})
+`, int64(52))
+
+	// field types are followed through nested structs
+	expect(t, `
+type Vec { x: int, y: int }
+type Body { pos: Vec, vel: Vec }
+type Other { pos: int }
+let b = Body{pos: Vec{x: 0, y: 0}, vel: Vec{x: 1, y: 2}}
+for i in 0..3 {
+	b.pos.x = b.pos.x + b.vel.x
+	b.pos.y = b.pos.y + b.vel.y
+}
+b.pos.x * 10 + b.pos.y
+`, int64(36))
+
+	// the type of a top level variable is known in functions
+	expect(t, `
+type Counter { n: int }
+let c = Counter{n: 0}
+def inc() { c.n = c.n + 1 }
+inc()
+inc()
+c.n
+`, int64(2))
+
+	// structs are references
+	expect(t, `
+type Cell { value: int }
+let a = Cell{value: 1}
+let b = a
+b.value = 2
+(if a == b { 10 } else { 0 }) + (if a == Cell{value: 2} { 100 } else { 0 }) + a.value
+`, int64(12))
+}
+
+func TestStructCompileError(t *testing.T) {
+	for _, code := range []string{
+		"type P { x: int } P{x: 1, y: 2}",
+		"type P { x: int, y: int } P{x: 1}",
+		"type P { x: int } P{x: 1, x: 2}",
+		"type P { x: int, x: int }",
+		"type P { x: int } type P { y: int }",
+		"Q{x: 1}",
+		"let Q = 1 Q{x: 1}",
+		"type P { x: int } P",
+		"type P { x: int } P = 1",
+		"let p = 1 p.x",
+		// without a known type, the field has to belong to a single type
+		"type P { x: int } type Q { x: int } def f(p: any) { p.x }",
+		"type P { x: int } let p: P = P{x: 1} p.y",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestStructRuntimeError(t *testing.T) {
+	module, _ := Parse(`
+type P { x: int }
+type Q { x: int }
+def f(p: P) { p.x }
+let q: any = Q{x: 1}
+f(q)
+`)
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interp.ExecFunc(id)
+	if err == nil || !strings.Contains(err.Error(), "Expected a P, got Q{x: 1}") {
+		t.Errorf("Expecting a type mismatch, got %v", err)
+	}
+}
+
+func TestCodeGenMatch(t *testing.T) {
+	classify := `
+def classify(n: int) {
+	match n {
+		0 => "zero",
+		1 | 2 => "small",
+		-1 => "minus one",
+		n => if n < 0 { "negative" } else { "large" },
+	}
+}
+`
+	for n, expected := range map[string]string{
+		"0": "zero", "1": "small", "2": "small", "-1": "minus one", "-5": "negative", "9": "large",
+	} {
+		expect(t, classify+"classify("+n+")", expected)
+	}
+
+	expect(t, `match "b" { "a" => 1, "b" | "c" => 2, _ => 3 }`, int64(2))
+	expect(t, `match -9223372036854775808 { -9223372036854775808 => 1, _ => 2 }`, int64(1))
+	// {} is a map, a block needs something in it
+	expect(t, `len(match 1 { _ => {} })`, int64(0))
+	expect(t, `match 1 { x => { let y = x + 1 y * 10 }, }`, int64(20))
+
+	expect(t, `
+type Point { x: int, y: int }
+type Line { from: Point, to: Point }
+def describe(shape: any) {
+	match shape {
+		Point{x: 0, y: 0} => "origin",
+		Point{x: 0, y} => "on y, " + str(y),
+		Point{x, y: _} => "at x " + str(x),
+		Line{from: Point{x: 0, y: 0}, to} => "from origin to " + str(to.x),
+		_ => "unknown",
+	}
+}
+def str(n: int) { match n { 0 => "0", 1 => "1", 2 => "2", _ => "many" } }
+describe(Point{x: 0, y: 0}) + "; " + describe(Point{x: 0, y: 2}) + "; " +
+	describe(Point{x: 1, y: 2}) + "; " +
+	describe(Line{from: Point{x: 0, y: 0}, to: Point{x: 2, y: 2}}) + "; " +
+	describe(Line{from: Point{x: 1, y: 0}, to: Point{x: 2, y: 2}}) + "; " + describe(1)
+`, "origin; on y, 2; at x 1; from origin to 2; unknown; unknown")
+
+	// arms are scoped, and match works in loops
+	expect(t, `
+var total = 0
+for i in 0..6 {
+	total = total + match i { 0 | 3 => 100, r => r }
+}
+total
+`, int64(212))
+}
+
+func TestMatchRuntimeError(t *testing.T) {
+	cases := map[string]string{
+		"match 5 { 1 => 2 }":        "No arm matches 5",
+		`match "a" {}`:              `No arm matches "a"`,
+		"match false { true => 1 }": "No arm matches false",
+		"type P { x: int } match P{x: 1} { P{x: 0} => 1 }":                   "No arm matches P{x: 1}",
+		"var n = 0 for i in 0..3 { n = match i { 0 => 1 } } n":               "No arm matches 1",
+		"enum E { A, B(x: int) } def f(e: E) { match e { A => 1 } } f(B(2))": "No arm matches B(2)",
+	}
+	for code, message := range cases {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		interp := NewInterpreter()
+		id, err := Compile(module, interp)
+		if err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		err = interp.ExecFunc(id)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expecting error %q, got %v", code, message, err)
+		}
+	}
+}
+
+func TestMatchCompileError(t *testing.T) {
+	for _, code := range []string{
+		"match 1 { x | 2 => x }",
+		"type P { x: int } match 1 { P{y} => y }",
+		"type P { x: int } match 1 { P{x, x} => x }",
+		"let Q = 1 match 1 { Q{x} => x }",
+		"match 1 { x => x = 2 }",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestMatchExhaustiveness(t *testing.T) {
+	for code, warning := range map[string]string{
+		"match true { true => 1 }":                                           "missing false",
+		"def f(b: bool) { match b { false => 1 } }":                          "missing true",
+		"def f(b: bool) { match b { } }":                                     "missing true, false",
+		"type P { x: int } def f(p: P) { match p { P{x: 0} => 1 } }":         "missing P{...}",
+		"match true { true | false => 1 }":                                   "",
+		"match 1 { 1 => 1 }":                                                 "",
+		"type P { x: int } def f(p: P) { match p { P{x: _} => 1 } }":         "",
+		"type P { x: int } def f(p: P) { match p { P{x: 0} => 1, q => 2 } }": "",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		builder := NewBuilder(NewInterpreter())
+		module.CodeGen(builder)
+		if _, err := builder.Finish(); err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		switch {
+		case warning == "" && len(builder.Warnings) > 0:
+			t.Errorf("%s: expecting no warning, got %v", code, builder.Warnings)
+		case warning != "" && (len(builder.Warnings) != 1 || !strings.Contains(builder.Warnings[0].Error(), warning)):
+			t.Errorf("%s: expecting %q, got %v", code, warning, builder.Warnings)
+		}
+	}
+}
+
+func TestCodeGenTry(t *testing.T) {
+	expect(t, `try { 1 / 0 } catch e { e.message }`, "Division by zero")
+	expect(t, `try { throw "boom" } catch e { e.message }`, "boom")
+	expect(t, `try { throw 42 } catch e { e.value }`, int64(42))
+	expect(t, `1 + try { 2 } catch e { 3 }`, int64(3))
+	expect(t, `1 + try { throw 0 } catch e { 3 }`, int64(4))
+	expect(t, `var x = 0 try { x = 1 } finally { x = x + 10 } x`, int64(11))
+	expect(t, `var x = 0 try { try { throw 1 } finally { x = 5 } } catch e { x + e.value }`, int64(6))
+	// rethrowing keeps the original trace
+	expect(t, `
+def f(n: int) { if n == 0 { throw "deep" } else { f(n - 1) } }
+def str(n: int) { match n { 5 => "5", _ => "?" } }
+try { try { f(3) } catch e { throw e } } catch e { e.message + " " + str(len(e.trace)) }
+`, "deep 5")
+
+	// finally blocks run when jumping out of them
+	expect(t, `
+var n = 0
+for i in 0..5 {
+	try {
+		if i == 3 { break }
+		n = n + i
+	} finally {
+		n = n + 100
+	}
+}
+n
+`, int64(403))
+	expect(t, `
+def f() {
+	var x = 1
+	try { return x } finally { x = 2 }
+	x
+}
+f()
+`, int64(1))
+	// what a finally block run by a jump throws isn't caught by its own try
+	expect(t, `
+var k = 0
+while true {
+	try {
+		try { break } catch e { k = k + 100 } finally { k = k + 1 throw k }
+	} catch e { break }
+}
+k
+`, int64(1))
+
+	// runtime errors are caught too
+	expect(t, `try { match 5 { 1 => 2 } } catch e { e.message }`, "No arm matches 5")
+	expect(t, `
+def f(n) { f(n + 1) }
+try { f(0) } catch e { e.message }
+`, "Stack overflow: more than 10000 nested calls")
+}
+
+func TestUncaughtError(t *testing.T) {
+	module, err := Parse(`def f() { throw "boom" } f()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interp.ExecFunc(id)
+	uncaught, ok := err.(UncaughtError)
+	if !ok || uncaught.Exception.Fields[0] != "boom" || !strings.Contains(err.Error(), "at f") {
+		t.Errorf("Expecting an uncaught boom, got %v", err)
+	}
+	if len(interp.CallStack) != 0 || len(interp.Stack.Value) != 0 {
+		t.Errorf("Should unwind everything: %v %v", interp.CallStack, interp.Stack.Value)
+	}
+}
+
+func TestCodeGenEnum(t *testing.T) {
+	shapes := `
+enum Shape { Circle(r: int), Rect(w: int, h: int), Empty }
+def area(s: Shape) {
+	match s {
+		Circle(r) => 3 * r * r,
+		Rect(w, h) => w * h,
+		Empty => 0,
+	}
+}
+`
+	expect(t, shapes+"area(Circle(2))", int64(12))
+	expect(t, shapes+"area(Rect(2, 5))", int64(10))
+	expect(t, shapes+"area(Empty)", int64(0))
+	expect(t, shapes+"area(Rect{w: 3, h: 3})", int64(9))
+	expect(t, shapes+"let r = Rect(2, 7) r.h", int64(7))
+	expect(t, shapes+"tag(Rect(1, 1)) + tag(Empty)", "RectEmpty")
+	expect(t, shapes+"Empty == Empty()", true)
+	expect(t, shapes+"match Rect(0, 4) { Rect{w: 0, h} => h, _ => -1 }", int64(4))
+	expect(t, shapes+"match Circle(1) { Rect(_, _) => 1, Circle(2) => 2, _ => 3 }", int64(3))
+
+	// a state machine
+	expect(t, `
+enum State { Idle, Running(ticks: int), Done }
+def step(s: State) {
+	match s {
+		Idle => Running(0),
+		Running(3) => Done,
+		Running(n) => Running(n + 1),
+		Done => Done,
+	}
+}
+var s = Idle
+var steps = 0
+while s != Done {
+	s = step(s)
+	steps = steps + 1
+}
+steps
+`, int64(5))
+}
+
+func TestEnumCompileError(t *testing.T) {
+	for _, code := range []string{
+		"enum E {}",
+		"enum E { A, A }",
+		"enum E { A(x: int, x: int) }",
+		"enum E { A } enum F { A }",
+		"enum E { A } E",
+		"enum E { A(x: int) } A",
+		"enum E { A(x: int) } A(1, 2)",
+		"enum E { A(x: int) } match A(1) { A(x, y) => x }",
+		"enum E { A(x: int) } match A(1) { E(x) => x }",
+		"enum E { A(x: int) } A(1).y",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestEnumExhaustiveness(t *testing.T) {
+	enum := "enum E { A, B(x: int), C(e: E) } "
+	for code, warning := range map[string]string{
+		"def f(e: E) { match e { A => 1 } }":                                 "missing B, C",
+		"def f(e: E) { match e { A | B(_) => 1, C(A) => 2 } }":               "missing C",
+		"def f(e: E) { match e { B(1) => 1, A | C(_) => 2 } }":               "missing B",
+		"def f(e: E) { match e { A | B(_) => 1, C(A | B(_) | C(_)) => 2 } }": "",
+		"def f(e: E) { match e { B{x} => x, A => 1, C(e) => 2 } }":           "",
+		"def f(e: E) { match e { A => 1, x => 2 } }":                         "",
+	} {
+		module, err := Parse(enum + code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		builder := NewBuilder(NewInterpreter())
+		module.CodeGen(builder)
+		if _, err := builder.Finish(); err != nil {
+			t.Errorf("Should compile: %s - %s", code, err)
+			continue
+		}
+		switch {
+		case warning == "" && len(builder.Warnings) > 0:
+			t.Errorf("%s: expecting no warning, got %v", code, builder.Warnings)
+		case warning != "" && (len(builder.Warnings) != 1 || !strings.Contains(builder.Warnings[0].Error(), warning)):
+			t.Errorf("%s: expecting %q, got %v", code, warning, builder.Warnings)
+		}
+	}
+}
+
+func TestCodeGenOperators(t *testing.T) {
+	expect(t, "7 % 3 + -7 % 3 * 10", int64(7%3+-7%3*10))
+	expect(t, "-7 / 2", int64(-7/2))
+	expect(t, "2 ** 3 ** 2", int64(512))
+	expect(t, "(0 - 2) ** 3", int64(-8))
+	expect(t, "-2 ** 2", int64(-4))
+	expect(t, "(-2) ** 2", int64(4))
+	expect(t, "def f(x: int) { -x ** 2 } f(3)", int64(-9))
+	expect(t, "2.0 ** -1.0", 0.5)
+	expect(t, "6 & 3 | 8 ^ 1", int64(6&3|8^1))
+	expect(t, "1 << 4 >> 2", int64(1<<4>>2))
+	expect(t, "-16 >> 2", int64(-16>>2))
+	expect(t, "~5 + ~-1", int64(^5+^-1))
+}
+
+func TestCodeGenCompoundAssignment(t *testing.T) {
+	expect(t, "var x = 10 x += 5 x -= 1 x *= 3 x /= 4 x %= 6 x", int64(((10+5-1)*3/4)%6))
+	expect(t, "var x = 1 let y = (x += 2) y * 10 + x", int64(33))
+	expect(t, "let xs = [1, 2, 3] xs[1] *= 10 xs[1]", int64(20))
+	expect(t, "type P { x: int } let p = P{x: 4} p.x -= 1 p.x", int64(3))
+	expect(t, "var n = 1 def double() { n *= 2 } double() double() n", int64(4))
+
+	// the container and the index are evaluated once
+	expect(t, `
+var calls = 0
+let xs = [1, 2, 3]
+let at = fn(i: int) { calls += 1 i }
+xs[at(2)] += 10
+xs[2] * 10 + calls
+`, int64(131))
+	expect(t, `
+type P { x: int }
+var calls = 0
+let p = P{x: 1}
+let get = fn() { calls += 1 p }
+get().x += 1
+p.x * 10 + calls
+`, int64(21))
+}
+
+func TestCodeGenArguments(t *testing.T) {
+	expect(t, "def f(x: int, y: int = 10) { x * 100 + y } f(1)", int64(110))
+	expect(t, "def f(x: int, y: int = 10) { x * 100 + y } f(y: 3, x: 1)", int64(103))
+	expect(t, "def f(x: int, y: float = -1.5) { y } f(1)", -1.5)
+	expect(t, "def sum(xs: ...int) { var s = 0 for x in xs { s += x } s } sum() + sum(1, 2, 3)", int64(6))
+	expect(t, "def g(x: int, rest: ...string) { len(rest) } g(1) * 10 + g(1, \"a\", \"b\")", int64(2))
+
+	// defaults and variadics apply to calls through function values too
+	expect(t, "def f(x: int, y: int = 10) { x * 100 + y } let g = f g(1) + g(2, 3)", int64(313))
+	expect(t, `
+def sum(xs: ...int) { var s = 0 for x in xs { s += x } s }
+def apply(h, x) { h(x) }
+let g = sum
+g() + g(1, 2, 3) * 10 + apply(sum, 5) * 100
+`, int64(560))
+
+	// named arguments are evaluated in the order they are written
+	expect(t, `
+var order = ""
+let t = fn(s: string, v: int) { order += s v }
+def f(x: int, y: int) { x * 10 + y }
+let r = f(y: t("b", 2), x: t("a", 1))
+if r == 12 { order } else { "" }
+`, "ba")
+}
+
+func TestArgumentsCompileError(t *testing.T) {
+	for _, code := range []string{
+		"def f(x: int) { x } f()",
+		"def f(x: int, y: int = 1) { x } f(1, 2, 3)",
+		"def f(x: int) { x } f(z: 1)",
+		"def f(x: int, y: int) { x } f(x: 1, 2)",
+		"def f(x: int) { x } f(1, x: 2)",
+		"def sum(xs: ...int) { xs } sum(xs: 1)",
+		"let y = 1 def f(x: int = y) { x }",
+		"len(x: \"a\")",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenMethodCall(t *testing.T) {
+	expect(t, `"abc".len()`, int64(3))
+	expect(t, "def inc(x: int, by: int = 1) { x + by } let x = 1 x.inc() + x.inc(by: 10)", int64(13))
+	expect(t, `
+def double(xs: list) { for i in 0..len(xs) { xs[i] *= 2 } xs }
+def sum(xs: list) { var s = 0 for x in xs { s += x } s }
+[1, 2, 3].double().double().sum()
+`, int64(24))
+
+	// functions associated with a type
+	expect(t, `
+type Point { x: int, y: int }
+def Point.norm(p: Point) { p.x * p.x + p.y * p.y }
+def Point.scale(p: Point, k: int) { Point{x: p.x * k, y: p.y * k} }
+let p = Point{x: 1, y: 2}
+p.scale(2).norm() + Point.norm(p)
+`, int64(25))
+	expect(t, `
+enum Shape { Square(side: int), Rect(w: int, h: int) }
+def Shape.area(s: Shape) {
+	match s { Square(side) => side * side, Rect(w, h) => w * h }
+}
+[Square(3)][0].area() + Rect(2, 5).area()
+`, int64(19))
+	expect(t, `
+type P { x: int }
+type Q { x: int }
+def P.get(p: P) { p.x }
+def Q.get(q: Q) { q.x * 10 }
+let q = Q{x: 2}
+let f = P.get
+q.get() + f(P{x: 1})
+`, int64(21))
+}
+
+func TestMethodCallCompileError(t *testing.T) {
+	for _, code := range []string{
+		"1.nothing()",
+		"def Nothing.f() { 1 }",
+		"let x = 1 def x.f() { 1 }",
+		"type P { x: int } P.f(1)",
+		// the type of the receiver has to be known to choose
+		"type P { x: int } type Q { x: int } def P.get(p: P) { 1 } def Q.get(q: Q) { 2 } [P{x: 1}][0].get()",
+		"type P { x: int } def P.len(p: P) { 1 } [P{x: 1}][0].len()",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenConst(t *testing.T) {
+	expect(t, "const LIMIT = 60 * 60 * 24 LIMIT", int64(86400))
+	expect(t, "const A = 2 const B: int = A ** 10 B", int64(1024))
+	expect(t, `const GREETING = "hello" + ", world" GREETING`, "hello, world")
+	expect(t, `
+const def fib(n: int): int { if n < 2 { n } else { fib(n - 1) + fib(n - 2) } }
+const F = fib(20)
+F
+`, int64(6765))
+	expect(t, `
+const def squares(n: int) { var m = {} for i in 0..n { m[i] = i * i } m }
+const TABLE = squares(10)
+TABLE[9]
+`, int64(81))
+	expect(t, `
+enum Color { Red, Rgb(r: int, g: int, b: int) }
+const def gray(v: int) { Rgb(v, v, v) }
+const COLORS = [Red, gray(128)]
+match COLORS[1] { Red => 0, Rgb(r, g, b) => r + g + b }
+`, int64(384))
+
+	// every use gets a copy, like a literal
+	expect(t, "const XS = [1, 2] let ys = XS ys[0] = 10 XS[0]", int64(1))
+
+	// the result is inlined, the function isn't called at run time
+	module, err := Parse("const def twice(x: int) { x * 2 } const X = twice(21) X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := false
+	for _, inst := range interp.Func[id].Inst {
+		if inst.Type == INST_INVOKE {
+			t.Errorf("Constants shouldn't be computed at run time: %v", interp.Func[id].Inst)
+		}
+		pushed = pushed || inst == PushInst(42)
+	}
+	if !pushed {
+		t.Errorf("Expecting 42 to be pushed: %v", interp.Func[id].Inst)
+	}
+}
+
+func TestConstCompileError(t *testing.T) {
+	for _, code := range []string{
+		"const X = 1 X = 2",
+		"const X = 1 X += 2",
+		"const XS = [1] XS[0] = 2",
+		"type P { x: int } const Q = P{x: 1} Q.x = 2",
+		"let n = 3 const X = n * 2",
+		"def f() { 1 } const X = f()",
+		"const X = f() const def f() { 1 }",
+		"def g() { 1 } const def f() { g() } const X = f()",
+		"const X = 1 / 0",
+		"const F = fn() { 1 }",
+		"const X = 1 const X = 2",
+		"let n = 3 const def f() { n } const X = f()",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+
+	// evaluation is bounded, a loop that never ends can't hang the compiler
+	code := "const def spin(n: int) { var i = 0 while true { i += 1 } i }\nconst X = spin(1)"
+	module, err := Parse(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Compile(module, NewInterpreter())
+	message := fmt.Sprintf("2:1: cannot evaluate X at compile time: Exceeded the limit of %d instructions", EVALUATION_STEPS)
+	if err == nil || !strings.Contains(err.Error(), message) {
+		t.Errorf("Expecting error %q, got %v", message, err)
+	}
+}
+
+func TestCodeGenMacro(t *testing.T) {
+	expect(t, `
+macro square(x) { quote { $x * $x } }
+square!(3 + 4)
+`, int64(49))
+	expect(t, `
+macro swap(a, b) { quote { let tmp = $a $a = $b $b = tmp } }
+var tmp = 1
+var other = 2
+swap!(tmp, other)
+tmp * 10 + other
+`, int64(21))
+	expect(t, `
+macro swap(a, b) { quote { let tmp = $a $a = $b $b = tmp } }
+let xs = [1, 2]
+swap!(xs[0], xs[1])
+xs[0] * 10 + xs[1]
+`, int64(21))
+	expect(t, `
+macro check(cond, message) { quote { if $cond == false { throw $message } } }
+def half(n: int) {
+    check!(n % 2 == 0, "odd")
+    n / 2
+}
+try { half(3) } catch e { e.message }
+`, "odd")
+
+	// a macro can use another one, and bind code with let
+	expect(t, `
+macro twice(e) { let body = quote { $e $e } body }
+macro four(e) { quote { twice!($e) twice!($e) } }
+var n = 0
+four!(n += 1)
+n
+`, int64(4))
+
+	// the variables of a quote don't capture the ones of the arguments
+	expect(t, `
+macro sum_to(n, each) { quote { var i = 0 var total = 0 while i < $n { total += $each i += 1 } total } }
+let i = 10
+sum_to!(3, i)
+`, int64(30))
+
+	// the definitions are scoped to their block
+	expect(t, `
+macro one() { quote { 1 } }
+def f() {
+    macro one() { quote { 2 } }
+    one!()
+}
+one!() + f() * 10
+`, int64(21))
+}
+
+func TestMacroCompileError(t *testing.T) {
+	for _, code := range []string{
+		"undefined!()",
+		"macro m(x) { quote { $x } } m!()",
+		"macro m() { quote { m!() } } m!()",
+		"macro m() { quote { 1 2 } } let x = m!()",
+		"macro m() { 1 } m!()",
+		"macro m() { quote { $y } } m!()",
+		"macro m(x) { quote { $x = 1 } } m!(f())",
+		"macro m() { quote { 1 } } macro m() { quote { 2 } } m!()",
+		"def f() { macro m() { quote { 1 } } } m!()",
+		"quote { 1 }",
+		"$x",
+		"$x = 1",
+		"let m = macro m() { quote { 1 } }",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenOperatorOverloading(t *testing.T) {
+	expect(t, `
+type Vec { x: int, y: int }
+def (a: Vec) + (b: Vec): Vec { Vec{x: a.x + b.x, y: a.y + b.y} }
+def (a: Vec) * (k: int): Vec { Vec{x: a.x * k, y: a.y * k} }
+let v = Vec{x: 1, y: 2} + Vec{x: 3, y: 4} * 2
+v.x * 100 + v.y
+`, int64(710))
+	expect(t, `
+type Vec { x: int, y: int }
+def (a: Vec) == (b: Vec) { a.x == b.x }
+Vec{x: 1, y: 2} == Vec{x: 1, y: 3}
+`, true)
+
+	// the operands of a generic function are dispatched at runtime
+	expect(t, `
+type Vec { x: int, y: int }
+def (a: Vec) + (b: Vec): Vec { Vec{x: a.x + b.x, y: a.y + b.y} }
+def add(a, b) { a + b }
+var v = add(Vec{x: 1, y: 2}, Vec{x: 3, y: 4})
+v += v
+v.x * 100 + v.y + add(1, 2) * 10000
+`, int64(30812))
+
+	module, err := Parse(`
+type Vec { x: int }
+def (a: Vec) + (b: Vec): Vec { a }
+let v = Vec{x: 1}
+v + v
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp := NewInterpreter()
+	id, err := Compile(module, interp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inst := range interp.Func[id].Inst {
+		if inst.Type == INST_BINARY {
+			t.Errorf("Should call the operator instead: %v", interp.Func[id].Inst)
+		}
+	}
+}
+
+func TestOperatorOverloadingCompileError(t *testing.T) {
+	for _, code := range []string{
+		"def (a: int) + (b: int): int { a }",
+		"def (a: Nope) + (b: int) { a }",
+		"type V { x: int } def (a: V) + (b: V) { a } def (a: V) + (b: V) { b }",
+		"type V { x: int } def (a: V) + (b: V) { a } def f() { def (a: V) + (b: V) { b } }",
+		"type V { x: int } def (a: V) + (b: V) { a } let v = V{x: 1} v - v",
+		"type V { x: int } def (a: V) + (b: V) { a } let v = V{x: 1} v + 1",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
+
+func TestCodeGenInfixDef(t *testing.T) {
+	expect(t, `
+def combine(a, b) { a * 10 + b }
+infixl 6 <+> = combine
+infixr 8 ^^ = pow
+def pow(a, b) { a ** b }
+def f(x) { x <+> 1 <+> 2 }
+(1 <+> 2 * 3 <+> 4) + f(5) + 2 ^^ 3 ^^ 2
+`, int64(164+512+512))
+	expect(t, `
+let join = fn(a, b) { a + "," + b }
+infixl 5 <|> = join
+"a" <|> "b" <|> "c"
+`, "a,b,c")
+	// the function is the one in scope at the declaration
+	expect(t, `
+def add(a, b) { a + b }
+infixl 6 <+> = add
+def g(add) {
+	let h = fn(add) { add <+> 10 }
+	h(add <+> 1)
+}
+g(2)
+`, int64(13))
+}
+
+func TestInfixDefCompileError(t *testing.T) {
+	for _, code := range []string{
+		"infixl 6 <+> = nope",
+		"def f(a) { a } infixl 6 <+> = f 1 <+> 2",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, err := Compile(module, NewInterpreter()); err == nil {
+			t.Errorf("Should not compile: %s", code)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/* --- Comparison of AST nodes --- */
+
+// Equal tells whether a and b are the same tree, regardless of the positions
+// the nodes were parsed at
+func Equal(a, b Node) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff describes the first difference between a and b, positions aside, as
+// the path leading to it from the roots, followed by the differing values:
+//
+//	Block.ExprList[1].Right.Left: {Int:1} != {Identifier:x}
+//
+// It is empty when a and b are Equal. A nil slice is equal to an empty one
+func Diff(a, b Node) string {
+	return diff("", reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+var posType = reflect.TypeOf(Pos{})
+
+// diff compares a and b, found at path, which is empty for the roots
+func diff(path string, a, b reflect.Value) string {
+	if !a.IsValid() || !b.IsValid() {
+		if a.IsValid() == b.IsValid() {
+			return ""
+		}
+		return mismatch(path, a, b)
+	}
+	if a.Type() != b.Type() {
+		return mismatch(path, a, b)
+	}
+	switch a.Kind() {
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() == b.IsNil() {
+				return ""
+			}
+			return mismatch(path, a, b)
+		}
+		return diff(path, a.Elem(), b.Elem())
+	case reflect.Struct:
+		if a.Type() == posType {
+			return ""
+		}
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i).Name
+			if path != "" {
+				field = path + "." + field
+			}
+			if d := diff(field, a.Field(i), b.Field(i)); d != "" {
+				return d
+			}
+		}
+		return ""
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return prefix(path) + fmt.Sprintf("%d elements != %d elements", a.Len(), b.Len())
+		}
+		for i := 0; i < a.Len(); i++ {
+			if d := diff(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i)); d != "" {
+				return d
+			}
+		}
+		return ""
+	}
+	if a.Interface() != b.Interface() {
+		return mismatch(path, a, b)
+	}
+	return ""
+}
+
+func mismatch(path string, a, b reflect.Value) string {
+	return prefix(path) + describe(a) + " != " + describe(b)
+}
+
+func prefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+func describe(value reflect.Value) string {
+	if !value.IsValid() || value.Kind() == reflect.Interface && value.IsNil() {
+		return "nil"
+	}
+	if value.Kind() == reflect.String {
+		return fmt.Sprintf("%q", value.String())
+	}
+	return fmt.Sprint(value.Interface())
+}
@@ -0,0 +1,28 @@
+package parser
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	a, err := Parse(`f(1) let y = x + 2 * 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse(`f( 1 )
+let y = x + z * 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Block.ExprList[1].Expr.Right.Left: {Int:2} != {Identifier:z}`
+	if d := Diff(a, b); d != expected {
+		t.Errorf("Expecting %s, got %s", expected, d)
+	}
+	if !Equal(a, a) || Equal(a, b) {
+		t.Errorf("Wrong equality")
+	}
+	if d := Diff(a, ModuleNode{}); d != "Block.ExprList: 2 elements != 0 elements" {
+		t.Errorf("Wrong difference: %s", d)
+	}
+	if !Equal(ModuleNode{BlockNode{nil}}, ModuleNode{BlockNode{[]Node{}}}) {
+		t.Errorf("A nil slice should equal an empty one")
+	}
+}
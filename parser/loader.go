@@ -0,0 +1,158 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+/* --- Programs made of several files --- */
+
+// the extension added to imports that don't have one
+const MODULE_EXTENSION = ".gm"
+
+// LoadedModule is a file compiled by a Loader
+type LoadedModule struct {
+	Path string
+	Node ModuleNode
+	// the function running the top level code of the module
+	FuncID  int64
+	Exports map[string]Symbol
+}
+
+// Loader compiles a file along with the modules it imports. Every module is
+// parsed and compiled once, however many files import it
+type Loader struct {
+	// directories searched for imports that don't start with ./ or ../
+	SearchPath []string
+	Interp     *GimmickInterpreter
+	// the warnings of every module, prefixed with its path
+	Warnings []error
+
+	modules map[string]*LoadedModule
+	// the modules in the order they finished compiling, dependencies first
+	order []*LoadedModule
+	// the files being loaded, to detect import cycles
+	loading []string
+}
+
+func NewLoader(interp *GimmickInterpreter, searchPath []string) *Loader {
+	return &Loader{SearchPath: searchPath, Interp: interp, modules: make(map[string]*LoadedModule)}
+}
+
+// Load compiles the program whose main module is the file at path. It
+// returns the ID of a function running the top level code of every module
+// once, dependencies first, and returning the value of the main module
+func (loader *Loader) Load(path string) (int64, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return -1, err
+	}
+	main, err := loader.load(abs)
+	if err != nil {
+		return -1, err
+	}
+	inst := []Instruction{}
+	for _, module := range loader.order {
+		if module != main {
+			inst = append(inst, InvokeInst(module.FuncID), PopInst())
+		}
+	}
+	inst = append(inst, InvokeInst(main.FuncID), ReturnInst())
+	return loader.Interp.AddFunc(inst), nil
+}
+
+// Modules returns the modules loaded so far, dependencies first
+func (loader *Loader) Modules() []*LoadedModule {
+	return loader.order
+}
+
+func (loader *Loader) load(path string) (*LoadedModule, error) {
+	for i, loading := range loader.loading {
+		if loading == path {
+			chain := append(append([]string{}, loader.loading[i:]...), path)
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if module, ok := loader.modules[path]; ok {
+		return module, nil
+	}
+	loader.loading = append(loader.loading, path)
+	defer func() {
+		loader.loading = loader.loading[0 : len(loader.loading)-1]
+	}()
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	node, err := Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", path, err)
+	}
+	node, errs := Expand(node)
+	var types NodeTypes
+	if len(errs) == 0 {
+		types, errs = TypeCheck(node)
+	}
+	if len(errs) > 0 {
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("%s:%s", path, err)
+		}
+		return nil, errs
+	}
+
+	builder := NewBuilder(loader.Interp)
+	// only the imports at the top level are resolved, the ones anywhere
+	// else are reported by ImportNode.CodeGen
+	for _, expr := range node.Block.ExprList {
+		imp, ok := expr.(ImportNode)
+		if !ok {
+			continue
+		}
+		depPath, err := loader.resolve(path, imp.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		dep, err := loader.load(depPath)
+		if err != nil {
+			return nil, err
+		}
+		builder.DefineModule(imp.Name(), dep.Exports)
+	}
+	node.CodeGen(typedBuilder{builder, types})
+	for _, warning := range builder.Warnings {
+		loader.Warnings = append(loader.Warnings, fmt.Errorf("%s: %v", path, warning))
+	}
+	exports := builder.Exports()
+	id, err := builder.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	module := &LoadedModule{path, node, id, exports}
+	loader.modules[path] = module
+	loader.order = append(loader.order, module)
+	return module, nil
+}
+
+// resolve finds the file of the import path found in the file from
+func (loader *Loader) resolve(from string, path string) (string, error) {
+	if filepath.Ext(path) == "" {
+		path += MODULE_EXTENSION
+	}
+	if strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") {
+		return filepath.Abs(filepath.Join(filepath.Dir(from), path))
+	}
+	for _, dir := range loader.SearchPath {
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return filepath.Abs(candidate)
+		}
+	}
+	return "", fmt.Errorf("cannot find module %q in %s", path, strings.Join(loader.SearchPath, ", "))
+}
@@ -0,0 +1,210 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+// writeFiles creates the files, keyed by their path relative to a new
+// temporary directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gimmick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func load(dir string, main string, searchPath ...string) (*GimmickInterpreter, int64, error) {
+	interp := NewInterpreter()
+	id, err := NewLoader(interp, searchPath).Load(filepath.Join(dir, main))
+	return interp, id, err
+}
+
+func TestLoader(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.gm": `
+import "./helpers" as h
+import "math/util"
+let add = h.add
+util.square(add(1, 2)) + h.double(util.square(2))
+`,
+		"helpers.gm": `
+def add(a: int, b: int) { a + b }
+def double(x: int) { _twice(x) }
+def _twice(x: int) { x * 2 }
+`,
+		"lib/math/util.gm": `
+def square(x: int) { x * x }
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	interp, id, err := load(dir, "main.gm", filepath.Join(dir, "lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := interp.Stack.Pop()
+	if result != int64(17) || len(interp.Stack.Value) != 0 {
+		t.Errorf("Wrong result: %v, stack %v", result, interp.Stack.Value)
+	}
+}
+
+func TestLoaderSharedModule(t *testing.T) {
+	// both a and b import shapes, which has to be compiled once for its
+	// Point to be the same type, and its variables to be shared
+	dir := writeFiles(t, map[string]string{
+		"main.gm": `
+import "./a"
+import "./b"
+import "./shapes"
+b.x(a.origin()) + shapes.count() * 10
+`,
+		"a.gm": `
+import "./shapes"
+def origin() {
+	shapes.count()
+	shapes.Point{x: 1, y: 0}
+}
+`,
+		"b.gm": `
+import "./shapes" as s
+def x(p: s.Point) { p.x }
+`,
+		"shapes.gm": `
+type Point { x: int, y: int }
+var made = 0
+def count() {
+	made = made + 1
+	made
+}
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	interp := NewInterpreter()
+	loader := NewLoader(interp, nil)
+	id, err := loader.Load(filepath.Join(dir, "main.gm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loader.Modules()) != 4 {
+		t.Errorf("Expecting 4 modules: %v", loader.Modules())
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := interp.Stack.Pop(); result != int64(21) {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
+
+func TestLoaderSharedFieldName(t *testing.T) {
+	// the fields of unannotated values are looked up in the types of their
+	// own module, not in those of the modules it imports
+	dir := writeFiles(t, map[string]string{
+		"main.gm": `
+import "./geo"
+type Point { x: int, y: int }
+def getx(p: any) { p.x }
+getx(Point{x: 4, y: 1}) + geo.sum(geo.Vec{x: 1, z: 2})
+`,
+		"geo.gm": `
+type Vec { x: int, z: int }
+def sum(v: any) { v.x + v.z }
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	interp, id, err := load(dir, "main.gm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := interp.Stack.Pop(); result != int64(7) {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
+
+func TestLoaderError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cycle.gm":   `import "./a"`,
+		"a.gm":       `import "./b"`,
+		"b.gm":       `import "./a"`,
+		"missing.gm": `import "nowhere"`,
+		"private.gm": `import "./c" c._hidden()`,
+		"c.gm":       `def _hidden() { 1 }`,
+		"nested.gm":  `if true { import "./c" }`,
+		"syntax.gm":  `import "./broken"`,
+		"broken.gm":  `def f( {`,
+		"alias.gm":   `import "./c" import "./c"`,
+	})
+	defer os.RemoveAll(dir)
+
+	for main, message := range map[string]string{
+		"cycle.gm": "import cycle: " + strings.Join([]string{
+			filepath.Join(dir, "a.gm"), filepath.Join(dir, "b.gm"), filepath.Join(dir, "a.gm"),
+		}, " -> "),
+		"missing.gm": `cannot find module "nowhere.gm"`,
+		"private.gm": "module c has no exported _hidden",
+		"nested.gm":  `cannot import "./c"`,
+		"syntax.gm":  "broken.gm:1:",
+		"alias.gm":   "c is already defined",
+	} {
+		_, _, err := load(dir, main)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expecting %q, got %v", main, message, err)
+		}
+	}
+}
+
+func TestLoaderEnum(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.gm": `
+import "./shapes" as s
+def area(shape: s.Shape) {
+	match shape { s.Square(side) => side * side, s.Empty() => 0 }
+}
+area(s.Square(3)) + area(s.Empty) + s.Square(2).side
+`,
+		"shapes.gm": `
+enum Shape { Square(side: int), Empty }
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	interp := NewInterpreter()
+	loader := NewLoader(interp, nil)
+	id, err := loader.Load(filepath.Join(dir, "main.gm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loader.Warnings) != 0 {
+		t.Errorf("Expecting an exhaustive match: %v", loader.Warnings)
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := interp.Stack.Pop(); result != int64(11) {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
@@ -0,0 +1,427 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+// the nesting of macro calls expanding to macro calls at which the expansion
+// is assumed to never end
+const MAX_MACRO_DEPTH = 100
+
+// Expand replaces the macro calls of module by the code their macro returns,
+// and removes the macro definitions. A macro is visible in the block it is
+// defined in, before and after its definition, and in the blocks nested in
+// it. A call used as a statement may expand to several expressions, they are
+// spliced into the block.
+//
+// Macros are hygienic: the variables declared in a quote are renamed, so
+// they can neither capture nor shadow the variables of the code given as
+// arguments
+func Expand(module ModuleNode) (ModuleNode, CompileErrors) {
+	expander := &expander{variants: map[string]bool{}}
+	Inspect(module, func(node Node) bool {
+		if enum, ok := node.(EnumDefNode); ok {
+			for _, variant := range enum.Variants {
+				expander.variants[variant.Name] = true
+			}
+		}
+		return true
+	})
+	block := expander.block(module.Block)
+	return ModuleNode{block}, expander.errors
+}
+
+// ExpandSource renders module as Gimmick source once its macros are
+// expanded, for the expand command
+func ExpandSource(module ModuleNode) (string, CompileErrors) {
+	expanded, errs := Expand(module)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	return Print(expanded), nil
+}
+
+type expander struct {
+	// the macros of the enclosing blocks, innermost last
+	scopes []map[string]MacroDefNode
+	// the variants of the enums of the module, which patterns name like
+	// variables
+	variants map[string]bool
+	// the number of expansions so far, numbering the renamed variables
+	count  int
+	depth  int
+	errors CompileErrors
+}
+
+func (e *expander) errorf(pos Pos, format string, args ...interface{}) {
+	e.errors = append(e.errors, Diagnostic{pos.Line, pos.Column, fmt.Sprintf(format, args...)})
+}
+
+func (e *expander) lookup(name string) (MacroDefNode, bool) {
+	for i := len(e.scopes) - 1; i >= 0; i-- {
+		if macro, ok := e.scopes[i][name]; ok {
+			return macro, true
+		}
+	}
+	return MacroDefNode{}, false
+}
+
+func (e *expander) block(block BlockNode) BlockNode {
+	scope := map[string]MacroDefNode{}
+	for _, expr := range block.ExprList {
+		macro, ok := expr.(MacroDefNode)
+		if !ok {
+			continue
+		}
+		if _, ok := scope[macro.Name]; ok {
+			e.errorf(macro.Pos, "macro %s is already defined", macro.Name)
+		}
+		scope[macro.Name] = macro
+	}
+	e.scopes = append(e.scopes, scope)
+	defer func() {
+		e.scopes = e.scopes[0 : len(e.scopes)-1]
+	}()
+
+	exprs := []Node{}
+	for _, expr := range block.ExprList {
+		switch n := expr.(type) {
+		case MacroDefNode:
+		case MacroCallNode:
+			exprs = append(exprs, e.call(n)...)
+		default:
+			exprs = append(exprs, e.expand(expr))
+		}
+	}
+	return BlockNode{exprs}
+}
+
+func (e *expander) expand(node Node) Node {
+	switch n := node.(type) {
+	case BlockNode:
+		return e.block(n)
+	case MacroCallNode:
+		exprs := e.call(n)
+		if len(exprs) != 1 {
+			e.errorf(n.Pos, "macro %s expands to %d expressions, it can only be used as a statement", n.Name, len(exprs))
+			return n
+		}
+		return exprs[0]
+	case MacroDefNode:
+		e.errorf(n.Pos, "macro %s can only be defined in a block", n.Name)
+		return n
+	case QuoteNode:
+		e.errorf(n.Pos, "quote outside of a macro")
+		return n
+	case UnquoteNode:
+		e.errorf(n.Pos, "$%s outside of a quote", n.Name)
+		return n
+	case AssignmentNode:
+		if strings.HasPrefix(n.Dest, "$") {
+			e.errorf(n.Pos, "%s outside of a quote", n.Dest)
+			return n
+		}
+	}
+	return mapChildren(node, e.expand)
+}
+
+// call returns the expansion of a macro call, expanded in turn
+func (e *expander) call(node MacroCallNode) []Node {
+	macro, ok := e.lookup(node.Name)
+	if !ok {
+		e.errorf(node.Pos, "undefined macro %s", node.Name)
+		return []Node{node}
+	}
+	if len(node.Args) != len(macro.Params) {
+		e.errorf(node.Pos, "macro %s expects %d arguments, got %d", node.Name, len(macro.Params), len(node.Args))
+		return []Node{node}
+	}
+	if e.depth >= MAX_MACRO_DEPTH {
+		e.errorf(node.Pos, "expansion of macro %s is too deep, it may be recursive", node.Name)
+		return []Node{node}
+	}
+
+	env := map[string][]Node{}
+	for i, param := range macro.Params {
+		env[param] = []Node{node.Args[i]}
+	}
+	e.count++
+	code, err := e.evaluate(macro.Block, env)
+	if err != nil {
+		e.errorf(node.Pos, "in macro %s: %v", node.Name, err)
+		return []Node{node}
+	}
+
+	e.depth++
+	defer func() {
+		e.depth--
+	}()
+	exprs := []Node{}
+	for _, expr := range code {
+		if call, ok := expr.(MacroCallNode); ok {
+			exprs = append(exprs, e.call(call)...)
+		} else {
+			exprs = append(exprs, e.expand(expr))
+		}
+	}
+	return exprs
+}
+
+// evaluate runs the body of a macro, env binding names to code. The body
+// can only declare variables, with let, and return code
+func (e *expander) evaluate(block BlockNode, env map[string][]Node) ([]Node, error) {
+	code := []Node{}
+	for _, expr := range block.ExprList {
+		var err error
+		if decl, ok := expr.(DeclarationNode); ok && !decl.Mutable {
+			code, err = e.value(decl.Expr, env)
+			env[decl.Name] = code
+		} else {
+			code, err = e.value(expr, env)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return code, nil
+}
+
+func (e *expander) value(node Node, env map[string][]Node) ([]Node, error) {
+	switch n := node.(type) {
+	case QuoteNode:
+		return e.quote(n, env)
+	case IdentifierNode:
+		if code, ok := env[n.Name]; ok {
+			return code, nil
+		}
+		return nil, fmt.Errorf("undefined %s", n.Name)
+	}
+	return nil, fmt.Errorf("%s can't be evaluated at expansion time, only let, quote and names are", printNode(node))
+}
+
+// quote returns the expressions of the block of node, $name replaced by the
+// code bound to name in env. In a block, $name stands for all the
+// expressions bound to name, elsewhere there must be exactly one
+func (e *expander) quote(node QuoteNode, env map[string][]Node) ([]Node, error) {
+	var err error
+	var substitute func(node Node) Node
+	substitute = func(node Node) Node {
+		switch n := node.(type) {
+		case UnquoteNode:
+			code, ok := env[n.Name]
+			if !ok {
+				err = fmt.Errorf("undefined $%s", n.Name)
+				return n
+			}
+			if len(code) != 1 {
+				err = fmt.Errorf("$%s is %d expressions, it can only be used as a statement", n.Name, len(code))
+				return n
+			}
+			return code[0]
+		case BlockNode:
+			exprs := []Node{}
+			for _, expr := range n.ExprList {
+				if unquote, ok := expr.(UnquoteNode); ok {
+					if code, ok := env[unquote.Name]; ok {
+						exprs = append(exprs, code...)
+						continue
+					}
+				}
+				exprs = append(exprs, substitute(expr))
+			}
+			return BlockNode{exprs}
+		case AssignmentNode:
+			if !strings.HasPrefix(n.Dest, "$") {
+				break
+			}
+			name := n.Dest[1:]
+			expr := substitute(n.Expr)
+			code, ok := env[name]
+			if !ok || len(code) != 1 {
+				return substitute(UnquoteNode{name, n.Pos})
+			}
+			switch dest := code[0].(type) {
+			case IdentifierNode:
+				return AssignmentNode{dest.Name, expr, n.Pos}
+			case IndexNode:
+				return IndexAssignmentNode{dest.Container, dest.Index, expr}
+			case FieldNode:
+				return FieldAssignmentNode{dest.Object, dest.Field, expr, dest.Pos}
+			}
+			err = fmt.Errorf("$%s can't be assigned to", name)
+			return n
+		case QuoteNode:
+			return n
+		}
+		return mapChildren(node, substitute)
+	}
+	block := substitute(e.hygiene(node.Block)).(BlockNode)
+	return block.ExprList, err
+}
+
+// hygiene renames the variables and functions declared in block, and the
+// uses of them, to names unique to the expansion. It runs before the
+// substitution of the arguments, which are left alone.
+//
+// The arguments of the functions defined with def are renamed too, along
+// with the names given to them in the calls of the block. Functions defined
+// for a type or an operator keep their names, they are found by their types
+func (e *expander) hygiene(block BlockNode) BlockNode {
+	names := map[string]string{}
+	defs := map[string]bool{}
+	declare := func(name string) {
+		if _, ok := names[name]; !ok && name != "" {
+			names[name] = fmt.Sprintf("__%s_%d", name, e.count)
+		}
+	}
+	var bindings func(pattern Pattern)
+	bindings = func(pattern Pattern) {
+		switch p := pattern.(type) {
+		case BindingPattern:
+			if !e.variants[p.Name] {
+				declare(p.Name)
+			}
+		case AlternativePattern:
+			for _, alternative := range p.Alternatives {
+				bindings(alternative)
+			}
+		case StructPattern:
+			for _, field := range p.Patterns {
+				bindings(field)
+			}
+		case VariantPattern:
+			for _, field := range p.Patterns {
+				bindings(field)
+			}
+		}
+	}
+	Inspect(block, func(node Node) bool {
+		switch n := node.(type) {
+		case DeclarationNode:
+			declare(n.Name)
+		case ConstNode:
+			declare(n.Name)
+		case FunctionDefNode:
+			if n.Operator == "" && !strings.Contains(n.Name, ".") {
+				declare(n.Name)
+				defs[n.Name] = true
+			}
+			for _, arg := range n.ArgList {
+				declare(arg.Name)
+			}
+		case LambdaNode:
+			for _, arg := range n.ArgList {
+				declare(arg.Name)
+			}
+		case ForNode:
+			declare(n.Var)
+		case TryNode:
+			declare(n.CatchVar)
+		case MatchNode:
+			for _, arm := range n.Arms {
+				bindings(arm.Pattern)
+			}
+		}
+		return true
+	})
+	if len(names) == 0 {
+		return block
+	}
+	return rename(block, names, defs).(BlockNode)
+}
+
+// rename returns node with the variables named like the keys of names
+// renamed to the values, and the named arguments in the calls of defs
+func rename(node Node, names map[string]string, defs map[string]bool) Node {
+	name := func(name string) string {
+		if renamed, ok := names[name]; ok {
+			return renamed
+		}
+		return name
+	}
+	args := func(argList []NameType) []NameType {
+		renamed := make([]NameType, len(argList))
+		for i, arg := range argList {
+			renamed[i] = NameType{Name: name(arg.Name), Type: arg.Type}
+		}
+		return renamed
+	}
+	var pattern func(p Pattern) Pattern
+	patterns := func(ps []Pattern) []Pattern {
+		renamed := make([]Pattern, len(ps))
+		for i, p := range ps {
+			renamed[i] = pattern(p)
+		}
+		return renamed
+	}
+	pattern = func(p Pattern) Pattern {
+		switch p := p.(type) {
+		case BindingPattern:
+			return BindingPattern{name(p.Name)}
+		case AlternativePattern:
+			return AlternativePattern{patterns(p.Alternatives)}
+		case StructPattern:
+			return StructPattern{p.Type, p.Fields, patterns(p.Patterns)}
+		case VariantPattern:
+			return VariantPattern{p.Variant, patterns(p.Patterns)}
+		}
+		return p
+	}
+
+	switch n := node.(type) {
+	case IdentifierNode:
+		n.Name = name(n.Name)
+		return n
+	case AssignmentNode:
+		n.Dest = name(n.Dest)
+		node = n
+	case DeclarationNode:
+		n.Name = name(n.Name)
+		node = n
+	case ConstNode:
+		n.Name = name(n.Name)
+		node = n
+	case FunctionDefNode:
+		n.Name = name(n.Name)
+		n.ArgList = args(n.ArgList)
+		node = n
+	case LambdaNode:
+		n.ArgList = args(n.ArgList)
+		node = n
+	case FunctionCallNode:
+		if defs[n.Name] && n.Names != nil {
+			renamed := make([]string, len(n.Names))
+			for i, argName := range n.Names {
+				renamed[i] = name(argName)
+			}
+			n.Names = renamed
+		}
+		// a call of a variable holding a function, or a call on a variable
+		// written like a qualified name
+		if i := strings.Index(n.Name, "."); i >= 0 {
+			n.Name = name(n.Name[0:i]) + n.Name[i:]
+		} else {
+			n.Name = name(n.Name)
+		}
+		node = n
+	case ForNode:
+		n.Var = name(n.Var)
+		node = n
+	case TryNode:
+		n.CatchVar = name(n.CatchVar)
+		node = n
+	case MatchNode:
+		arms := make([]MatchArm, len(n.Arms))
+		for i, arm := range n.Arms {
+			arms[i] = MatchArm{pattern(arm.Pattern), arm.Body}
+		}
+		n.Arms = arms
+		node = n
+	}
+	return mapChildren(node, func(child Node) Node {
+		return rename(child, names, defs)
+	})
+}
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+func TestExpand(t *testing.T) {
+	module, err := Parse(`
+macro swap(a, b) { quote { let tmp = $a $a = $b $b = tmp } }
+var tmp = 1
+var y = 2
+swap!(tmp, y)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, errs := Expand(module)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	expected := `var tmp = 1
+var y = 2
+let __tmp_1 = tmp
+tmp = y
+y = __tmp_1
+`
+	if source := Print(expanded); source != expected {
+		t.Errorf("Expecting:\n%s\ngot:\n%s", expected, source)
+	}
+}
+
+func TestExpandPatterns(t *testing.T) {
+	// the variables bound by patterns are renamed, the variants aren't
+	module, err := Parse(`
+enum Shape { Circle(r: int), Empty }
+macro area(shape) { quote { match $shape { Circle(r) => r * r, Empty => 0 } } }
+let r = Circle(3)
+area!(r)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, errs := Expand(module)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	match, ok := expanded.Block.ExprList[2].(MatchNode)
+	if !ok {
+		t.Fatalf("Expecting a match: %v", expanded.Block.ExprList)
+	}
+	if value, ok := match.Value.(IdentifierNode); !ok || value.Name != "r" {
+		t.Errorf("The argument shouldn't be renamed: %v", match.Value)
+	}
+	circle, ok := match.Arms[0].Pattern.(VariantPattern)
+	if !ok || circle.Patterns[0] != (BindingPattern{"__r_1"}) {
+		t.Errorf("The binding should be renamed: %v", match.Arms[0].Pattern)
+	}
+	if match.Arms[1].Pattern != (BindingPattern{"Empty"}) {
+		t.Errorf("The variant shouldn't be renamed: %v", match.Arms[1].Pattern)
+	}
+}
+
+func TestExpandFunctions(t *testing.T) {
+	// the functions of a quote and their arguments are renamed, so that they
+	// don't capture the variables of the caller
+	expect(t, "macro m(a) { quote { def h(x: int) { $a + x } h(1) } } const x = 10 m!(x)", int64(11))
+	expect(t, `
+macro twice(a) { quote { def h(x: int, y: int = 1) { x * y } h(y: 2, x: $a) } }
+def h(x: int) { x * 100 }
+const x = 3
+twice!(x)
+`, int64(6))
+
+	// a variable of the module is read as a global, one of the calling
+	// function isn't captured by the function
+	expect(t, "macro m(a) { quote { def h(x: int) { $a + x } h(1) } } let x = 10 m!(x)", int64(11))
+	module, err := Parse("macro m(a) { quote { def h(x: int) { $a + x } h(1) } } def f() { let x = 10 m!(x) } f()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compile(module, NewInterpreter()); err == nil || !strings.Contains(err.Error(), "x belongs to an enclosing function") {
+		t.Errorf("Expecting x not to be captured, got %v", err)
+	}
+
+	module, err = Parse("macro m(a) { quote { def h(x: int) { $a + x } h(x: 1) } } m!(2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, errs := Expand(module)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	expected := `def __h_1(__x_1: int) {
+    2 + __x_1
+}
+__h_1(__x_1: 1)
+`
+	if source := Print(expanded); source != expected {
+		t.Errorf("Expecting:\n%s\ngot:\n%s", expected, source)
+	}
+}
@@ -3,7 +3,9 @@ package parser
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	. "github.com/trungaczne/gimmick/vm"
 )
@@ -13,12 +15,43 @@ import (
 
 type Parser struct {
 	text string
+
+	// Diagnostics collects problems that don't stop the parse, e.g. an
+	// integer literal that overflows int64
+	Diagnostics []Diagnostic
+
+	// furthest position any matcher got stuck at, that's where syntax errors
+	// are reported
+	furthest int
+	// the offsets the lines start at, built by Position
+	lines []int
+	// the infix operators declared so far with infixl and infixr at the top
+	// level, they can be used until the end of the text
+	operators map[string]InfixDefNode
 }
 
 func NewParser(text string) *Parser {
 	return &Parser{text: text}
 }
 
+// Parse parses a whole module. Diagnostics are turned into errors
+func Parse(text string) (ModuleNode, error) {
+	parser := NewParser(text)
+	token, _, err := Module(parser, 0)
+	if err != nil {
+		pos := parser.findNonWhiteSpace(parser.furthest)
+		if pos == -1 {
+			pos = len(parser.text)
+		}
+		line, col := parser.Position(pos)
+		return ModuleNode{}, Diagnostic{line, col, "syntax error"}
+	}
+	if len(parser.Diagnostics) > 0 {
+		return ModuleNode{}, parser.Diagnostics[0]
+	}
+	return token.(ModuleNode), nil
+}
+
 /* --- Errors --- */
 
 type EOFError int
@@ -33,6 +66,57 @@ func (err NotMatchError) Error() string {
 	return fmt.Sprintf("Could not match type: " + string(err))
 }
 
+// Diagnostic is a positioned problem, found by the parser or TypeCheck
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (diag Diagnostic) Error() string {
+	return fmt.Sprintf("%d:%d: %s", diag.Line, diag.Column, diag.Message)
+}
+
+// Position converts a cursor into a 1-based line and column
+func (p *Parser) Position(cursor int) (int, int) {
+	if p.lines == nil {
+		p.lines = []int{0}
+		for i := 0; i < len(p.text); i++ {
+			if p.text[i] == '\n' {
+				p.lines = append(p.lines, i+1)
+			}
+		}
+	}
+	if cursor > len(p.text) {
+		cursor = len(p.text)
+	}
+	// the line is the last one starting at or before the cursor
+	line := sort.Search(len(p.lines), func(i int) bool { return p.lines[i] > cursor })
+	return line, cursor - p.lines[line-1] + 1
+}
+
+// pos is the position of the next non whitespace character
+func (p *Parser) pos(cursor int) Pos {
+	if next := p.findNonWhiteSpace(cursor); next != -1 {
+		cursor = next
+	}
+	line, col := p.Position(cursor)
+	return Pos{line, col}
+}
+
+// report records a diagnostic at cursor. Matchers are retried by MatchOneOf,
+// so the same diagnostic may be reported several times; only keep one
+func (p *Parser) report(cursor int, format string, args ...interface{}) {
+	line, col := p.Position(cursor)
+	diag := Diagnostic{line, col, fmt.Sprintf(format, args...)}
+	for _, existing := range p.Diagnostics {
+		if existing == diag {
+			return
+		}
+	}
+	p.Diagnostics = append(p.Diagnostics, diag)
+}
+
 func isWhiteSpace(c byte) bool {
 	return c == ' ' || c == '\n' || c == '\t'
 }
@@ -74,6 +158,9 @@ func MatchAll(wrapper MatchAllWrapper, defs ...TryFunc) TryFunc {
 		for _, f := range defs {
 			token, _cursor, err := f(parser, newCursor)
 			if err != nil {
+				if newCursor > parser.furthest {
+					parser.furthest = newCursor
+				}
 				return nil, cursor, err
 			}
 			newCursor = _cursor
@@ -107,6 +194,46 @@ func MatchOneOf(wrapper MatchOneOfWrapper, defs ...TryFunc) TryFunc {
 	}
 }
 
+// MatchWhere only accepts the tokens of def satisfying cond
+func MatchWhere(cond func(token Token) bool, def TryFunc) TryFunc {
+	return func(parser *Parser, cursor int) (Token, int, error) {
+		token, newCursor, err := def(parser, cursor)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if !cond(token) {
+			return nil, cursor, NotMatchError("MatchWhere")
+		}
+		return token, newCursor, nil
+	}
+}
+
+// MatchList reads items separated by separator, like the right recursive
+// MatchOneOf(wrapper, MatchAll(wrapper, item, separator, list), item) would,
+// but parsing every item once. With trailing, a separator can end the list,
+// the tail being an EmptyToken
+func MatchList(wrapper MatchAllWrapper, item TryFunc, separator TryFunc, trailing bool) TryFunc {
+	var list TryFunc
+	list = func(parser *Parser, cursor int) (Token, int, error) {
+		head, headCursor, err := item(parser, cursor)
+		if err != nil {
+			return nil, cursor, err
+		}
+		sep, sepCursor, err := separator(parser, headCursor)
+		if err != nil {
+			return head, headCursor, nil
+		}
+		if tail, tailCursor, err := list(parser, sepCursor); err == nil {
+			return wrapper([]Token{head, sep, tail}), tailCursor, nil
+		}
+		if trailing {
+			return wrapper([]Token{head, sep, EmptyToken{}}), sepCursor, nil
+		}
+		return head, headCursor, nil
+	}
+	return list
+}
+
 var REG_IDENTIFIER_INITIAL = regexp.MustCompile("[_a-zA-Z]")
 var REG_IDENTIFIER = regexp.MustCompile("^[_a-zA-Z0-9]+")
 
@@ -119,7 +246,33 @@ func Identifier(parser *Parser, cursor int) (Token, int, error) {
 		return IdentifierNode{string(first)}, newCursor, nil
 	}
 	rest := REG_IDENTIFIER.FindString(parser.text[newCursor:len(parser.text)])
-	return IdentifierNode{string(first) + rest}, newCursor + len(rest), nil
+	name := string(first) + rest
+	if RESERVED_WORDS[name] {
+		return nil, cursor, NotMatchError("Identifier")
+	}
+	return IdentifierNode{name}, newCursor + len(rest), nil
+}
+
+func AsQualifiedName(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	module, ok1 := tokens[0].(IdentifierNode)
+	name, ok2 := tokens[2].(IdentifierNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return IdentifierNode{module.Name + "." + name.Name}
+}
+
+// An identifier, optionally qualified by the name of an imported module or
+// of a type: util.parse, Point.norm
+func QualifiedName(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsQualifiedName, Identifier, char("."), Identifier),
+		Identifier,
+	)(parser, cursor)
 }
 
 // shared by Keyword and Char
@@ -138,7 +291,11 @@ func keyword(str string) TryFunc {
 		if err != nil {
 			return nil, newCursor, NotMatchError("keyword")
 		}
-		return KeywordToken{str}, newCursor, nil
+		// "def" shouldn't match the beginning of "define"
+		if newCursor < len(parser.text) && REG_IDENTIFIER.Match([]byte{parser.text[newCursor]}) {
+			return nil, cursor, NotMatchError("keyword")
+		}
+		return KeywordToken{str, parser.pos(cursor)}, newCursor, nil
 	}
 }
 
@@ -148,23 +305,74 @@ func char(str string) TryFunc {
 		if err != nil {
 			return nil, newCursor, NotMatchError("char")
 		}
-		return CharToken{str}, newCursor, nil
+		return CharToken{str, parser.pos(cursor)}, newCursor, nil
+	}
+}
+
+// sameLine is char, except str has to be on the line of cursor
+func sameLine(str string) TryFunc {
+	return func(parser *Parser, cursor int) (Token, int, error) {
+		pos := parser.findNonWhiteSpace(cursor)
+		if pos == -1 || strings.Contains(parser.text[cursor:pos], "\n") {
+			return nil, cursor, NotMatchError("sameLine")
+		}
+		return char(str)(parser, cursor)
 	}
 }
 
+// AsArgDecl leaves TypeToken empty when the type is omitted, it is then
+// inferred, see TypeCheck
 func AsArgDecl(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	declName, ok := tokens[0].(IdentifierNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	declType, _ := tokens[1].(IdentifierNode)
+	return ArgDeclToken{declName, declType, nil, false}
+}
+
+var ArgDecl = MatchAll(AsArgDecl, Identifier, TypeAnnotation)
+
+// AsDefaultArgDecl keeps the default value of `arg = value`
+func AsDefaultArgDecl(tokens []Token) Token {
 	if len(tokens) != 3 {
 		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
 	}
+	decl, ok1 := tokens[0].(ArgDeclToken)
+	value, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	decl.Default = value
+	return decl
+}
+
+func AsVariadicArgDecl(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
 	declName, ok1 := tokens[0].(IdentifierNode)
-	declType, ok2 := tokens[2].(IdentifierNode)
+	declType, ok2 := tokens[3].(IdentifierNode)
 	if !ok1 || !ok2 {
 		panic("Typecasting failure")
 	}
-	return ArgDeclToken{declName, declType}
+	return ArgDeclToken{declName, declType, nil, true}
 }
 
-var ArgDecl = MatchAll(AsArgDecl, Identifier, char(":"), Identifier)
+// an argument of a def, which may have a default value
+func DefArgDecl(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsDefaultArgDecl, ArgDecl, char("="), Expression),
+		ArgDecl,
+	)(parser, cursor)
+}
+
+// name: ...type, only valid as the last argument of a def
+var VariadicArgDecl = MatchAll(AsVariadicArgDecl, Identifier, char(":"), char("..."), QualifiedName)
 
 func Token2ArgListToken(token Token) Token {
 	list := []ArgDeclToken{}
@@ -211,33 +419,109 @@ func ArgList(parser *Parser, cursor int) (Token, int, error) {
 
 	return MatchOneOf(
 		Token2ArgListToken,
-		MatchAll(AsArgList, ArgDecl, char(","), ArgList),
-		ArgDecl,
+		MatchList(AsArgList, ArgDecl, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+// DefArgList is the ArgList of a def, whose arguments can have defaults and
+// the last one be variadic
+func DefArgList(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2ArgListToken,
+		MatchAll(AsArgList, DefArgDecl, char(","), DefArgList),
+		DefArgDecl,
+		VariadicArgDecl,
 		EmptyExpression,
 	)(parser, cursor)
 }
 
 func AsFunctionDef(tokens []Token) Token {
-	if len(tokens) != 8 {
-		panic(fmt.Sprintf("Should have 8 tokens: %v", tokens))
+	if len(tokens) != 9 {
+		panic(fmt.Sprintf("Should have 9 tokens: %v", tokens))
 	}
-	name, ok1 := tokens[1].(IdentifierNode)
-	arglist, ok2 := tokens[3].(ArgListToken)
-	block, ok3 := tokens[6].(BlockNode)
-	if !ok1 || !ok2 || !ok3 {
-		fmt.Println(ok1, ok2, ok3)
+	keyword, ok1 := tokens[0].(KeywordToken)
+	name, ok2 := tokens[1].(IdentifierNode)
+	arglist, ok3 := tokens[3].(ArgListToken)
+	block, ok4 := tokens[7].(BlockNode)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		panic("Typecasting failure")
+	}
+	returnType := ""
+	if typeName, ok := tokens[5].(IdentifierNode); ok {
+		returnType = typeName.Name
+	}
+	defaults := []Node{}
+	variadic := false
+	for _, decl := range arglist.ArgDecl {
+		defaults = append(defaults, decl.Default)
+		variadic = decl.Variadic
+	}
+	return FunctionDefNode{name.Name, "", false, arglistNameTypes(arglist), defaults, variadic, returnType, block, keyword.Pos}
+}
+
+// operatorName is the Name of the function defining operator for operands
+// of the types left and right
+func operatorName(operator string, left string, right string) string {
+	return left + " " + operator + " " + right
+}
+
+func AsOperatorDef(tokens []Token) Token {
+	if len(tokens) != 12 {
+		panic(fmt.Sprintf("Should have 12 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	left, ok2 := tokens[2].(ArgDeclToken)
+	operator, ok3 := tokens[4].(CharToken)
+	right, ok4 := tokens[6].(ArgDeclToken)
+	block, ok5 := tokens[10].(BlockNode)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		panic("Typecasting failure")
+	}
+	returnType := ""
+	if typeName, ok := tokens[8].(IdentifierNode); ok {
+		returnType = typeName.Name
+	}
+	args := arglistNameTypes(ArgListToken{[]ArgDeclToken{left, right}})
+	name := operatorName(operator.Name, left.TypeToken.Name, right.TypeToken.Name)
+	return FunctionDefNode{name, operator.Name, false, args, []Node{nil, nil}, false, returnType, block, keyword.Pos}
+}
+
+// AsConstFunctionDef marks the function of const def as Const
+func AsConstFunctionDef(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	def, ok := tokens[1].(FunctionDefNode)
+	if !ok {
 		panic("Typecasting failure")
 	}
+	def.Const = true
+	return def
+}
 
+func arglistNameTypes(arglist ArgListToken) []NameType {
 	nametype := []NameType{}
 	for _, v := range arglist.ArgDecl {
 		nametype = append(nametype, NameType{v.NameToken.Name, v.TypeToken.Name})
 	}
-	return FunctionDefNode{name.Name, nametype, block}
+	return nametype
+}
+
+func AsLambda(tokens []Token) Token {
+	if len(tokens) != 7 {
+		panic(fmt.Sprintf("Should have 7 tokens: %v", tokens))
+	}
+	arglist, ok1 := tokens[2].(ArgListToken)
+	block, ok2 := tokens[5].(BlockNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return LambdaNode{arglistNameTypes(arglist), block}
 }
 
 func Token2ParamListToken(token Token) Token {
-	list := []Node{}
+	list := ParamListToken{[]Node{}, []string{}}
 	switch paramToken := token.(type) {
 	default:
 		// probably should wrap Expression instead of doing this
@@ -245,228 +529,1800 @@ func Token2ParamListToken(token Token) Token {
 		if !ok {
 			panic("Typecasting failure")
 		}
-		list = append(list, node)
+		list.ParamList = append(list.ParamList, node)
+		list.Names = append(list.Names, "")
+	case NamedParamToken:
+		list.ParamList = append(list.ParamList, paramToken.Value)
+		list.Names = append(list.Names, paramToken.Name)
 	case ParamListToken:
-		list = append(list, paramToken.ParamList...)
+		return paramToken
 	case EmptyToken:
 		// do nothing
 	}
-	return ParamListToken{list}
+	return list
 }
 
 func AsParamList(tokens []Token) Token {
 	if len(tokens) != 3 {
 		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
 	}
-	head, ok1 := tokens[0].(Node)
+	head, ok1 := Token2ParamListToken(tokens[0]).(ParamListToken)
 	tail, ok2 := Token2ParamListToken(tokens[2]).(ParamListToken)
 	if !ok1 || !ok2 {
 		panic("Typecasting failure")
 	}
-	newList := []Node{head}
-	newList = append(newList, tail.ParamList...)
-	return ParamListToken{newList}
+	return ParamListToken{
+		append(head.ParamList, tail.ParamList...),
+		append(head.Names, tail.Names...),
+	}
 }
 
-func ParamList(parser *Parser, cursor int) (Token, int, error) {
+func AsNamedParam(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[0].(IdentifierNode)
+	value, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return NamedParamToken{name.Name, value}
+}
+
+// an argument of a call, positional or named
+func Argument(parser *Parser, cursor int) (Token, int, error) {
 	return MatchOneOf(
-		Token2ParamListToken,
-		MatchAll(
-			AsParamList,
-			Expression, char(","), ParamList,
-		),
+		identity,
+		MatchAll(AsNamedParam, Identifier, char(":"), Expression),
 		Expression,
-		EmptyExpression,
 	)(parser, cursor)
 }
 
-func AsFunctionCall(tokens []Token) Token {
-	if len(tokens) != 4 {
-		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
-	}
-	name, ok := tokens[0].(IdentifierNode)
-	paramList := tokens[2].(ParamListToken)
-	if !ok {
-		panic("Typecasting failure")
-	}
-	return FunctionCallNode{name.Name, paramList.ParamList}
+// ParamList is the arguments of a call
+func ParamList(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2ParamListToken,
+		MatchList(AsParamList, Argument, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
 }
 
-func identity(token Token) Token {
-	return token
+// ElementList is the elements of a list literal, a ParamList without names
+func ElementList(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2ParamListToken,
+		MatchList(AsParamList, Expression, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
 }
 
-func AsBinaryOperator(tokens []Token) Token {
-	if len(tokens) != 3 {
-		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+func AsFunctionCall(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
 	}
-	left, ok1 := tokens[0].(Node)
-	operator, ok2 := tokens[1].(CharToken)
-	right, ok3 := tokens[2].(Node)
-
+	pos, ok1 := tokens[0].(Pos)
+	name, ok2 := tokens[1].(IdentifierNode)
+	paramList, ok3 := tokens[3].(ParamListToken)
 	if !ok1 || !ok2 || !ok3 {
 		panic("Typecasting failure")
 	}
-	return BinaryOperatorNode{left, operator.Name, right}
+	return FunctionCallNode{name.Name, paramList.ParamList, paramList.names(), pos}
 }
 
-func AsBracketExpression(tokens []Token) Token {
-	if len(tokens) != 3 {
-		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+// names is the Names of a call, nil when every argument is positional
+func (token ParamListToken) names() []string {
+	for _, name := range token.Names {
+		if name != "" {
+			return token.Names
+		}
 	}
-	return tokens[1]
+	return nil
 }
 
-func AsAssignment(tokens []Token) Token {
+func AsCallToken(tokens []Token) Token {
 	if len(tokens) != 3 {
 		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
 	}
-	id, ok1 := tokens[0].(IdentifierNode)
-	expr, ok2 := tokens[2].(Node)
+	open, ok1 := tokens[0].(CharToken)
+	paramList, ok2 := tokens[1].(ParamListToken)
 	if !ok1 || !ok2 {
 		panic("Typecasting failure")
 	}
+	return CallToken{paramList.ParamList, open.Pos}
+}
 
-	return AssignmentNode{id.Name, expr}
+func Token2PostfixChainToken(token Token) Token {
+	switch chain := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case PostfixChainToken:
+		return chain
+	case EmptyToken:
+		return PostfixChainToken{}
+	}
 }
 
-func AsBlock(tokens []Token) Token {
+func AsPostfixChain(tokens []Token) Token {
 	if len(tokens) != 2 {
 		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
 	}
-	head, ok1 := tokens[0].(Node)
-	tail, ok2 := tokens[1].(BlockNode)
-	if !ok1 || !ok2 {
+	tail, ok := Token2PostfixChainToken(tokens[1]).(PostfixChainToken)
+	if !ok {
 		panic("Typecasting failure")
 	}
-	newList := []Node{}
-	newList = append(newList, head)
-	newList = append(newList, tail.ExprList...)
-	return BlockNode{newList}
+	return PostfixChainToken{append([]Token{tokens[0]}, tail.Postfixes...)}
 }
 
-func AsModule(tokens []Token) Token {
+// AsPostfixExpression applies the postfixes from left to right
+func AsPostfixExpression(tokens []Token) Token {
 	if len(tokens) != 2 {
 		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
 	}
-	head, ok1 := tokens[0].(BlockNode)
-	_, ok2 := tokens[1].(EOFToken)
+	node, ok1 := tokens[0].(Node)
+	chain, ok2 := Token2PostfixChainToken(tokens[1]).(PostfixChainToken)
 	if !ok1 || !ok2 {
 		panic("Typecasting failure")
 	}
-	return ModuleNode{head}
+	for _, postfix := range chain.Postfixes {
+		switch p := postfix.(type) {
+		default:
+			panic("Typecasting failure")
+		case CallToken:
+			node = CallNode{node, p.ParamList, p.Pos}
+		case IndexToken:
+			node = IndexNode{node, p.Index}
+		case SliceToken:
+			node = SliceNode{node, p.Low, p.High}
+		case FieldToken:
+			node = FieldNode{node, p.Name, p.Pos}
+		case MethodToken:
+			node = MethodCallNode{node, p.Name, p.ParamList, p.Names, p.Pos}
+		}
+	}
+	return node
 }
 
-func Token2BlockNode(token Token) Token {
-	list := []Node{}
-	switch blockToken := token.(type) {
+func identity(token Token) Token {
+	return token
+}
+
+func Token2OperatorChainToken(token Token) Token {
+	switch chain := token.(type) {
 	default:
 		panic("Typecasting failure")
-	case BlockNode:
-		list = append(list, blockToken.ExprList...)
-	case Node:
-		list = append(list, blockToken)
-	case EOFToken:
-		// do nothing
+	case OperatorChainToken:
+		return chain
 	case EmptyToken:
-		// do nothing
+		return OperatorChainToken{}
 	}
-	return BlockNode{list}
 }
 
-func Token2ModuleNode(token Token) Token {
-	switch module := token.(type) {
-	default:
+func AsOperatorChain(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	operator, ok1 := tokens[0].(CharToken)
+	operand, ok2 := tokens[1].(Node)
+	tail, ok3 := Token2OperatorChainToken(tokens[2]).(OperatorChainToken)
+	if !ok1 || !ok2 || !ok3 {
 		panic("Typecasting failure")
-	case ModuleNode:
-		return module
-	case EOFToken:
-		return ModuleNode{BlockNode{[]Node{}}}
+	}
+	return OperatorChainToken{
+		append([]CharToken{operator}, tail.Operators...),
+		append([]Node{operand}, tail.Operands...),
 	}
 }
 
-/* --- Keywords --- */
-
-var KEYWORD_DEF = keyword("def")
-
-/* --- Matchers --- */
+// AsExpression turns `a op b op c ...` into a tree of BinaryOperatorNode
+// according to BINARY_PRECEDENCE. Binary operators are left associative,
+// except those in RIGHT_ASSOCIATIVE. The operators declared with infixl and
+// infixr become calls of their function
+func (p *Parser) AsExpression(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(Node)
+	chain, ok2 := Token2OperatorChainToken(tokens[1]).(OperatorChainToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	node, operators, _ := p.climbPrecedence(head, chain.Operators, chain.Operands, 0)
+	if len(operators) != 0 {
+		panic("Logic error")
+	}
+	return node
+}
 
-func EndOfFile(parser *Parser, cursor int) (Token, int, error) {
-	_, newCursor, err := parser.fetch(cursor)
-	if _, ok := err.(EOFError); ok {
-		return EOFToken{}, newCursor, nil
+// climbPrecedence consumes operators binding at least as tight as minPrecedence
+// and returns the built node along with the unconsumed operators and operands
+func (p *Parser) climbPrecedence(left Node, operators []CharToken, operands []Node, minPrecedence int) (Node, []CharToken, []Node) {
+	for len(operators) > 0 && p.precedence(operators[0].Name) >= minPrecedence {
+		operator, right := operators[0], operands[0]
+		operators, operands = operators[1:], operands[1:]
+		for len(operators) > 0 && (p.precedence(operators[0].Name) > p.precedence(operator.Name) ||
+			p.rightAssociative(operator.Name) && operators[0].Name == operator.Name) {
+			right, operators, operands = p.climbPrecedence(right, operators, operands, p.precedence(operators[0].Name))
+		}
+		left = BinaryOperatorNode{left, operator.Name, right, operator.Pos}
 	}
-	return nil, cursor, NotMatchError("EOF")
+	return left, operators, operands
 }
 
-func EmptyExpression(parser *Parser, cursor int) (Token, int, error) {
-	return EmptyToken{}, cursor, nil
+func (p *Parser) precedence(operator string) int {
+	if def, ok := p.operators[operator]; ok {
+		return int(def.Precedence)
+	}
+	return BINARY_PRECEDENCE[operator]
 }
 
-func Module(parser *Parser, cursor int) (Token, int, error) {
-	return MatchOneOf(
-		Token2ModuleNode,
-		MatchAll(AsModule, Block, EndOfFile),
-		EndOfFile,
-	)(parser, cursor)
+// a right associative operator only groups to the right with itself, it is
+// left associative along with the other operators of the same precedence
+func (p *Parser) rightAssociative(operator string) bool {
+	if def, ok := p.operators[operator]; ok {
+		return def.Right
+	}
+	return RIGHT_ASSOCIATIVE[operator]
 }
 
-func Block(parser *Parser, cursor int) (Token, int, error) {
-	return MatchOneOf(
-		Token2BlockNode,
-		MatchAll(AsBlock, Expression, Block),
-		Expression,
-		EmptyExpression,
-	)(parser, cursor)
+func AsWhile(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	cond, ok2 := tokens[1].(Node)
+	block, ok3 := tokens[3].(BlockNode)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	return WhileNode{cond, block, keyword.Pos}
+}
+
+func AsFor(tokens []Token) Token {
+	if len(tokens) != 7 {
+		panic(fmt.Sprintf("Should have 7 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[1].(IdentifierNode)
+	iterable, ok2 := tokens[3].(Node)
+	block, ok3 := tokens[5].(BlockNode)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	return ForNode{name.Name, iterable, block}
+}
+
+func AsRange(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	from, ok1 := tokens[0].(Node)
+	to, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return RangeNode{from, to}
+}
+
+func AsLoopControl(token Token) Token {
+	keyword, ok := token.(KeywordToken)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	if keyword.Name == "break" {
+		return BreakNode{}
+	}
+	return ContinueNode{}
+}
+
+func AsReturn(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	expr, ok2 := tokens[1].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return ReturnNode{expr, keyword.Pos}
+}
+
+func AsUnaryOperator(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	operator, ok1 := tokens[0].(CharToken)
+	operand, ok2 := tokens[1].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return UnaryOperatorNode{operator.Name, operand, operator.Pos}
+}
+
+// AsNegativeLiteral negates a float literal, integer literals being read
+// with their sign
+func AsNegativeLiteral(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	switch literal := tokens[1].(type) {
+	case IntegerLiteralNode:
+		return literal
+	case FloatLiteralNode:
+		return FloatLiteralNode{-literal.Value}
+	}
+	panic("Typecasting failure")
+}
+
+func AsBracketExpression(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	return tokens[1]
+}
+
+func AsMacroDef(tokens []Token) Token {
+	if len(tokens) != 8 {
+		panic(fmt.Sprintf("Should have 8 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	name, ok2 := tokens[1].(IdentifierNode)
+	arglist, ok3 := Token2ArgListToken(tokens[3]).(ArgListToken)
+	block, ok4 := tokens[6].(BlockNode)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		panic("Typecasting failure")
+	}
+	params := []string{}
+	for _, arg := range arglist.ArgDecl {
+		params = append(params, arg.NameToken.Name)
+	}
+	return MacroDefNode{name.Name, params, block, keyword.Pos}
+}
+
+func AsMacroCall(tokens []Token) Token {
+	if len(tokens) != 6 {
+		panic(fmt.Sprintf("Should have 6 tokens: %v", tokens))
+	}
+	pos, ok1 := tokens[0].(Pos)
+	name, ok2 := tokens[1].(IdentifierNode)
+	args, ok3 := tokens[4].(ParamListToken)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	return MacroCallNode{name.Name, args.ParamList, pos}
+}
+
+func AsQuote(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	block, ok2 := tokens[2].(BlockNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return QuoteNode{block, keyword.Pos}
+}
+
+func AsUnquote(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	dollar, ok1 := tokens[0].(CharToken)
+	name, ok2 := tokens[1].(IdentifierNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return UnquoteNode{name.Name, dollar.Pos}
+}
+
+func AsListLiteral(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	elements, ok := tokens[1].(ParamListToken)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return ListLiteralNode{elements.ParamList}
+}
+
+func AsMapEntry(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	key, ok1 := tokens[0].(Node)
+	value, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return MapEntryToken{key, value}
+}
+
+func Token2MapEntriesToken(token Token) Token {
+	switch entries := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case MapEntriesToken:
+		return entries
+	case MapEntryToken:
+		return MapEntriesToken{[]MapEntryToken{entries}}
+	case EmptyToken:
+		return MapEntriesToken{}
+	}
+}
+
+func AsMapEntries(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(MapEntryToken)
+	tail, ok2 := Token2MapEntriesToken(tokens[2]).(MapEntriesToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return MapEntriesToken{append([]MapEntryToken{head}, tail.Entries...)}
+}
+
+func AsMapLiteral(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	entries, ok := Token2MapEntriesToken(tokens[1]).(MapEntriesToken)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	node := MapLiteralNode{[]Node{}, []Node{}}
+	for _, entry := range entries.Entries {
+		node.Keys = append(node.Keys, entry.Key)
+		node.Values = append(node.Values, entry.Value)
+	}
+	return node
+}
+
+func AsFieldInit(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[0].(IdentifierNode)
+	value, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return FieldInitToken{name.Name, value}
+}
+
+func Token2FieldInitsToken(token Token) Token {
+	switch inits := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case FieldInitsToken:
+		return inits
+	case FieldInitToken:
+		return FieldInitsToken{[]FieldInitToken{inits}}
+	}
+}
+
+func AsFieldInits(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(FieldInitToken)
+	tail, ok2 := Token2FieldInitsToken(tokens[2]).(FieldInitsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return FieldInitsToken{append([]FieldInitToken{head}, tail.Inits...)}
+}
+
+func AsStructLiteral(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[0].(IdentifierNode)
+	inits, ok2 := Token2FieldInitsToken(tokens[2]).(FieldInitsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	node := StructLiteralNode{name.Name, []string{}, []Node{}}
+	for _, init := range inits.Inits {
+		node.Names = append(node.Names, init.Name)
+		node.Values = append(node.Values, init.Value)
+	}
+	return node
+}
+
+func AsTypeDef(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[1].(IdentifierNode)
+	fields, ok2 := tokens[3].(ArgListToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return TypeDefNode{name.Name, arglistNameTypes(fields)}
+}
+
+func AsEnumDef(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[1].(IdentifierNode)
+	variants, ok2 := Token2VariantsToken(tokens[3]).(VariantsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return EnumDefNode{name.Name, variants.Variants}
+}
+
+func Token2VariantsToken(token Token) Token {
+	switch variants := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case VariantsToken:
+		return variants
+	case Variant:
+		return VariantsToken{[]Variant{variants}}
+	case EmptyToken:
+		return VariantsToken{}
+	}
+}
+
+func AsVariants(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(Variant)
+	tail, ok2 := Token2VariantsToken(tokens[2]).(VariantsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return VariantsToken{append([]Variant{head}, tail.Variants...)}
+}
+
+// AsVariant accepts `Name` and `Name(fields)`
+func AsVariant(tokens []Token) Token {
+	name, ok := tokens[0].(IdentifierNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	switch len(tokens) {
+	case 1:
+		return Variant{Name: name.Name, Fields: []NameType{}}
+	case 4:
+		fields, ok := tokens[2].(ArgListToken)
+		if !ok {
+			panic("Typecasting failure")
+		}
+		return Variant{Name: name.Name, Fields: arglistNameTypes(fields)}
+	}
+	panic(fmt.Sprintf("Should have 1 or 4 tokens: %v", tokens))
+}
+
+func AsFieldToken(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	dot, ok1 := tokens[0].(CharToken)
+	name, ok2 := tokens[1].(IdentifierNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return FieldToken{name.Name, dot.Pos}
+}
+
+func AsMethodToken(tokens []Token) Token {
+	if len(tokens) != 6 {
+		panic(fmt.Sprintf("Should have 6 tokens: %v", tokens))
+	}
+	pos, ok1 := tokens[1].(Pos)
+	name, ok2 := tokens[2].(IdentifierNode)
+	paramList, ok3 := tokens[4].(ParamListToken)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	return MethodToken{name.Name, paramList.ParamList, paramList.names(), pos}
+}
+
+// turns the EmptyToken of an omitted OptionalExpression into nil
+func optionalNode(token Token) Node {
+	if _, ok := token.(EmptyToken); ok {
+		return nil
+	}
+	node, ok := token.(Node)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return node
+}
+
+// AsSubscript turns [, an optional expression and the tail of a subscript
+// into an IndexToken or a SliceToken
+func AsSubscript(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	switch tail := tokens[2].(type) {
+	case CharToken:
+		return IndexToken{optionalNode(tokens[1])}
+	case SliceToken:
+		return SliceToken{optionalNode(tokens[1]), tail.High}
+	}
+	panic("Typecasting failure")
+}
+
+func AsSliceTail(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	return SliceToken{nil, optionalNode(tokens[1])}
+}
+
+// unlike the bounds of a slice, an index can't be omitted
+func isSubscript(token Token) bool {
+	if index, ok := token.(IndexToken); ok {
+		return index.Index != nil
+	}
+	return true
+}
+
+func AsInfixDef(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	precedence, ok2 := tokens[1].(IntegerLiteralNode)
+	operator, ok3 := tokens[2].(CharToken)
+	function, ok4 := tokens[4].(IdentifierNode)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		panic("Typecasting failure")
+	}
+	return InfixDefNode{keyword.Name == "infixr", precedence.Value, operator.Name, function.Name, keyword.Pos}
+}
+
+func AsImport(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	path, ok := tokens[1].(StringLiteralNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	switch alias := tokens[2].(type) {
+	default:
+		panic("Typecasting failure")
+	case EmptyToken:
+		return ImportNode{path.Value, ""}
+	case IdentifierNode:
+		return ImportNode{path.Value, alias.Name}
+	}
+}
+
+// AsImportAlias keeps the name of `as name`
+func AsImportAlias(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	return tokens[1]
+}
+
+func AsMatch(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	value, ok1 := tokens[1].(Node)
+	arms, ok2 := Token2MatchArmsToken(tokens[3]).(MatchArmsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return MatchNode{value, arms.Arms}
+}
+
+func Token2MatchArmsToken(token Token) Token {
+	switch arms := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case MatchArmsToken:
+		return arms
+	case MatchArm:
+		return MatchArmsToken{[]MatchArm{arms}}
+	case EmptyToken:
+		return MatchArmsToken{}
+	}
+}
+
+func AsMatchArms(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(MatchArm)
+	tail, ok2 := Token2MatchArmsToken(tokens[2]).(MatchArmsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return MatchArmsToken{append([]MatchArm{head}, tail.Arms...)}
+}
+
+func AsMatchArm(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	pattern, ok1 := tokens[0].(Pattern)
+	body, ok2 := tokens[2].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return MatchArm{pattern, body}
+}
+
+// AsArmBlock keeps the block of `{ block }`
+func AsArmBlock(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	return tokens[1]
+}
+
+func AsAlternativePattern(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok := tokens[0].(Pattern)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	switch tail := tokens[2].(type) {
+	default:
+		panic("Typecasting failure")
+	case AlternativePattern:
+		return AlternativePattern{append([]Pattern{head}, tail.Alternatives...)}
+	case Pattern:
+		return AlternativePattern{[]Pattern{head, tail}}
+	}
+}
+
+func AsLiteralPattern(tokens []Token) Token {
+	if len(tokens) != 1 {
+		panic(fmt.Sprintf("Should have 1 token: %v", tokens))
+	}
+	literal, ok := tokens[0].(Node)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return LiteralPattern{literal}
+}
+
+func AsBindingPattern(tokens []Token) Token {
+	if len(tokens) != 1 {
+		panic(fmt.Sprintf("Should have 1 token: %v", tokens))
+	}
+	name, ok := tokens[0].(IdentifierNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	if name.Name == "_" {
+		return WildcardPattern{}
+	}
+	return BindingPattern{name.Name}
+}
+
+// AsFieldPattern turns the shorthand `field` into `field: field`
+func AsFieldPattern(tokens []Token) Token {
+	name, ok := tokens[0].(IdentifierNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	switch len(tokens) {
+	case 1:
+		return FieldPatternToken{name.Name, BindingPattern{name.Name}}
+	case 3:
+		pattern, ok := tokens[2].(Pattern)
+		if !ok {
+			panic("Typecasting failure")
+		}
+		return FieldPatternToken{name.Name, pattern}
+	}
+	panic(fmt.Sprintf("Should have 1 or 3 tokens: %v", tokens))
+}
+
+func Token2FieldPatternsToken(token Token) Token {
+	switch patterns := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case FieldPatternsToken:
+		return patterns
+	case FieldPatternToken:
+		return FieldPatternsToken{[]FieldPatternToken{patterns}}
+	case EmptyToken:
+		return FieldPatternsToken{}
+	}
+}
+
+func AsFieldPatterns(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(FieldPatternToken)
+	tail, ok2 := Token2FieldPatternsToken(tokens[2]).(FieldPatternsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return FieldPatternsToken{append([]FieldPatternToken{head}, tail.Patterns...)}
+}
+
+func AsStructPattern(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[0].(IdentifierNode)
+	fields, ok2 := Token2FieldPatternsToken(tokens[2]).(FieldPatternsToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	pattern := StructPattern{name.Name, []string{}, []Pattern{}}
+	for _, field := range fields.Patterns {
+		pattern.Fields = append(pattern.Fields, field.Name)
+		pattern.Patterns = append(pattern.Patterns, field.Pattern)
+	}
+	return pattern
+}
+
+func Token2PatternListToken(token Token) Token {
+	switch patterns := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case PatternListToken:
+		return patterns
+	case Pattern:
+		return PatternListToken{[]Pattern{patterns}}
+	case EmptyToken:
+		return PatternListToken{}
+	}
+}
+
+func AsPatternList(tokens []Token) Token {
+	if len(tokens) != 3 {
+		panic(fmt.Sprintf("Should have 3 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(Pattern)
+	tail, ok2 := Token2PatternListToken(tokens[2]).(PatternListToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return PatternListToken{append([]Pattern{head}, tail.Patterns...)}
+}
+
+func AsVariantPattern(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[0].(IdentifierNode)
+	patterns, ok2 := Token2PatternListToken(tokens[2]).(PatternListToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return VariantPattern{name.Name, patterns.Patterns}
+}
+
+func AsTry(tokens []Token) Token {
+	if len(tokens) != 6 {
+		panic(fmt.Sprintf("Should have 6 tokens: %v", tokens))
+	}
+	block, ok := tokens[2].(BlockNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	node := TryNode{block, "", nil, nil}
+	switch catch := tokens[4].(type) {
+	default:
+		panic("Typecasting failure")
+	case EmptyToken:
+	case CatchToken:
+		node.CatchVar = catch.Var
+		node.Catch = catch.Block
+	}
+	switch finally := tokens[5].(type) {
+	default:
+		panic("Typecasting failure")
+	case EmptyToken:
+	case BlockNode:
+		node.Finally = finally
+	}
+	return node
+}
+
+func AsCatch(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	name, ok1 := tokens[1].(IdentifierNode)
+	block, ok2 := tokens[3].(BlockNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return CatchToken{name.Name, block}
+}
+
+// AsFinally keeps the block of `finally { block }`
+func AsFinally(tokens []Token) Token {
+	if len(tokens) != 4 {
+		panic(fmt.Sprintf("Should have 4 tokens: %v", tokens))
+	}
+	return tokens[2]
+}
+
+func AsThrow(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	expr, ok := tokens[1].(Node)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return ThrowNode{expr}
+}
+
+func AsBoolLiteral(token Token) Token {
+	keyword, ok := token.(KeywordToken)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return BoolLiteralNode{keyword.Name == "true"}
+}
+
+func AsIf(tokens []Token) Token {
+	if len(tokens) != 6 {
+		panic(fmt.Sprintf("Should have 6 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	cond, ok2 := tokens[1].(Node)
+	then, ok3 := tokens[3].(BlockNode)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	switch elseNode := tokens[5].(type) {
+	default:
+		panic("Typecasting failure")
+	case EmptyToken:
+		return IfNode{cond, then, nil, keyword.Pos}
+	case BlockNode:
+		return IfNode{cond, then, elseNode, keyword.Pos}
+	case IfNode:
+		return IfNode{cond, then, elseNode, keyword.Pos}
+	}
+}
+
+func AsElse(tokens []Token) Token {
+	switch len(tokens) {
+	case 2:
+		// else if
+		return tokens[1]
+	case 4:
+		return tokens[2]
+	}
+	panic(fmt.Sprintf("Should have 2 or 4 tokens: %v", tokens))
+}
+
+func AsDeclaration(tokens []Token) Token {
+	if len(tokens) != 5 {
+		panic(fmt.Sprintf("Should have 5 tokens: %v", tokens))
+	}
+	keyword, ok1 := tokens[0].(KeywordToken)
+	name, ok2 := tokens[1].(IdentifierNode)
+	expr, ok3 := tokens[4].(Node)
+	if !ok1 || !ok2 || !ok3 {
+		panic("Typecasting failure")
+	}
+	varType := ""
+	if typeName, ok := tokens[2].(IdentifierNode); ok {
+		varType = typeName.Name
+	}
+	if keyword.Name == "const" {
+		return ConstNode{name.Name, varType, expr, keyword.Pos}
+	}
+	return DeclarationNode{keyword.Name == "var", name.Name, varType, expr, keyword.Pos}
+}
+
+// AsTypeAnnotation keeps the type of `: type`
+func AsTypeAnnotation(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	return tokens[1]
+}
+
+// AsAssignmentTail keeps the operator of `op=`, empty for a plain =
+func AsAssignmentTail(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	operator, ok1 := tokens[0].(CharToken)
+	expr, ok2 := tokens[1].(Node)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return AssignmentTailToken{strings.TrimSuffix(operator.Name, "="), expr, operator.Pos}
+}
+
+// AsAssignment assigns the tail to the target, by the kind of target
+func AsAssignment(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	tail, ok := tokens[1].(AssignmentTailToken)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	if tail.Operator != "" {
+		return CompoundAssignmentNode{tokens[0].(Node), tail.Operator, tail.Expr, tail.Pos}
+	}
+	switch target := tokens[0].(type) {
+	case IdentifierNode:
+		return AssignmentNode{target.Name, tail.Expr, tail.Pos}
+	case UnquoteNode:
+		return AssignmentNode{"$" + target.Name, tail.Expr, tail.Pos}
+	case IndexNode:
+		return IndexAssignmentNode{target.Container, target.Index, tail.Expr}
+	case FieldNode:
+		return FieldAssignmentNode{target.Object, target.Field, tail.Expr, target.Pos}
+	}
+	panic("Typecasting failure")
+}
+
+func isAssignable(token Token) bool {
+	switch token.(type) {
+	case IdentifierNode, IndexNode, FieldNode, UnquoteNode:
+		return true
+	}
+	return false
+}
+
+func AsBlock(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(Node)
+	tail, ok2 := tokens[1].(BlockNode)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	newList := []Node{}
+	newList = append(newList, head)
+	newList = append(newList, tail.ExprList...)
+	return BlockNode{newList}
+}
+
+// A ; ends the statement before it, which is only needed when the next one
+// would continue it: `f; -1` is 2 statements, `f -1` a subtraction. It's an
+// empty statement otherwise, `{;}` being an empty block
+func AsSemicolon(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	block, ok := Token2BlockNode(tokens[1]).(BlockNode)
+	if !ok {
+		panic("Typecasting failure")
+	}
+	return block
+}
+
+func AsModule(tokens []Token) Token {
+	if len(tokens) != 2 {
+		panic(fmt.Sprintf("Should have 2 tokens: %v", tokens))
+	}
+	head, ok1 := tokens[0].(BlockNode)
+	_, ok2 := tokens[1].(EOFToken)
+	if !ok1 || !ok2 {
+		panic("Typecasting failure")
+	}
+	return ModuleNode{head}
+}
+
+func Token2BlockNode(token Token) Token {
+	list := []Node{}
+	switch blockToken := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case BlockNode:
+		list = append(list, blockToken.ExprList...)
+	case Node:
+		list = append(list, blockToken)
+	case EOFToken:
+		// do nothing
+	case EmptyToken:
+		// do nothing
+	}
+	return BlockNode{list}
+}
+
+func Token2ModuleNode(token Token) Token {
+	switch module := token.(type) {
+	default:
+		panic("Typecasting failure")
+	case ModuleNode:
+		return module
+	case EOFToken:
+		return ModuleNode{BlockNode{[]Node{}}}
+	}
+}
+
+/* --- Keywords --- */
+
+var KEYWORD_DEF = keyword("def")
+var KEYWORD_IF = keyword("if")
+var KEYWORD_ELSE = keyword("else")
+var KEYWORD_TRUE = keyword("true")
+var KEYWORD_FALSE = keyword("false")
+var KEYWORD_WHILE = keyword("while")
+var KEYWORD_FOR = keyword("for")
+var KEYWORD_IN = keyword("in")
+var KEYWORD_BREAK = keyword("break")
+var KEYWORD_CONTINUE = keyword("continue")
+var KEYWORD_RETURN = keyword("return")
+var KEYWORD_LET = keyword("let")
+var KEYWORD_VAR = keyword("var")
+var KEYWORD_FN = keyword("fn")
+var KEYWORD_TYPE = keyword("type")
+var KEYWORD_IMPORT = keyword("import")
+var KEYWORD_AS = keyword("as")
+var KEYWORD_MATCH = keyword("match")
+var KEYWORD_ENUM = keyword("enum")
+var KEYWORD_TRY = keyword("try")
+var KEYWORD_CATCH = keyword("catch")
+var KEYWORD_FINALLY = keyword("finally")
+var KEYWORD_THROW = keyword("throw")
+var KEYWORD_CONST = keyword("const")
+var KEYWORD_MACRO = keyword("macro")
+var KEYWORD_QUOTE = keyword("quote")
+var KEYWORD_INFIXL = keyword("infixl")
+var KEYWORD_INFIXR = keyword("infixr")
+
+// words that can't be used as identifiers
+var RESERVED_WORDS = map[string]bool{
+	"def":      true,
+	"if":       true,
+	"else":     true,
+	"true":     true,
+	"false":    true,
+	"while":    true,
+	"for":      true,
+	"in":       true,
+	"break":    true,
+	"continue": true,
+	"return":   true,
+	"let":      true,
+	"var":      true,
+	"fn":       true,
+	"type":     true,
+	"import":   true,
+	"as":       true,
+	"match":    true,
+	"enum":     true,
+	"try":      true,
+	"catch":    true,
+	"finally":  true,
+	"throw":    true,
+	"const":    true,
+	"macro":    true,
+	"quote":    true,
+	"infixl":   true,
+	"infixr":   true,
+}
+
+/* --- Matchers --- */
+
+func EndOfFile(parser *Parser, cursor int) (Token, int, error) {
+	_, newCursor, err := parser.fetch(cursor)
+	if _, ok := err.(EOFError); ok {
+		return EOFToken{}, newCursor, nil
+	}
+	return nil, cursor, NotMatchError("EOF")
+}
+
+func EmptyExpression(parser *Parser, cursor int) (Token, int, error) {
+	return EmptyToken{}, cursor, nil
+}
+
+func Module(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2ModuleNode,
+		MatchAll(AsModule, TopLevelBlock, EndOfFile),
+		EndOfFile,
+	)(parser, cursor)
+}
+
+// the statements of a module, which unlike those of a block may declare
+// operators
+func TopLevelBlock(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2BlockNode,
+		MatchAll(AsBlock, TopLevelStatement, TopLevelBlock),
+		MatchAll(AsSemicolon, char(";"), TopLevelBlock),
+		TopLevelStatement,
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func TopLevelStatement(parser *Parser, cursor int) (Token, int, error) {
+	// Statement would report the declaration
+	if token, newCursor, err := InfixDef(parser, cursor); err == nil {
+		return token, newCursor, nil
+	}
+	return Statement(parser, cursor)
+}
+
+func Block(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2BlockNode,
+		MatchAll(AsBlock, Statement, Block),
+		MatchAll(AsSemicolon, char(";"), Block),
+		Statement,
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+// An expression in a block. When it starts with an expression ending with a
+// block, the statement ends there: `if x { 1 } -1` is 2 statements. Type
+// and enum definitions and imports are only allowed here, so that they can
+// be hoisted
+func Statement(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		BlockExpression,
+		TypeDef,
+		EnumDef,
+		Import,
+		NestedInfixDef,
+		MatchAll(parser.AsExpression, OperandExpression, OperatorChain),
+	)(parser, cursor)
 }
 
 func Expression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(parser.AsExpression, GuardedExpression, OperatorChain)(parser, cursor)
+}
+
+// the `op operand op operand ...` tail of an expression
+func OperatorChain(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2OperatorChainToken,
+		MatchAll(
+			AsOperatorChain,
+			BinaryOperator, GuardedExpression, OperatorChain,
+		),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+// prevents left recursion
+func GuardedExpression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(identity, BlockExpression, OperandExpression)(parser, cursor)
+}
+
+// expressions ending with a block
+func BlockExpression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		If,
+		While,
+		For,
+		FunctionDef,
+		MatchAll(AsConstFunctionDef, KEYWORD_CONST, FunctionDef),
+		Lambda,
+		Match,
+		Try,
+		MacroDef,
+		MatchAll(AsQuote, KEYWORD_QUOTE, char("{"), Block, char("}")),
+	)(parser, cursor)
+}
+
+func OperandExpression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		Declaration,
+		UnaryExpression,
+		LoopControl,
+		Return,
+		MatchAll(AsThrow, KEYWORD_THROW, Expression),
+		PostfixOrAssignment,
+	)(parser, cursor)
+}
+
+// PostfixOrAssignment reads a postfix expression, then the assignment to it
+// if one follows. The target is only parsed once, whatever it turns out to be
+func PostfixOrAssignment(parser *Parser, cursor int) (Token, int, error) {
+	target, newCursor, err := PostfixExpression(parser, cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if !isAssignable(target) {
+		return target, newCursor, nil
+	}
+	tail, tailCursor, err := AssignmentTail(parser, newCursor)
+	if err != nil {
+		return target, newCursor, nil
+	}
+	return AsAssignment([]Token{target, tail}), tailCursor, nil
+}
+
+// = value, or op= value for x += 1, list[i] -= 1 or point.x *= 2
+func AssignmentTail(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsAssignmentTail,
+		MatchOneOf(identity, char("="), CompoundOperator), Expression,
+	)(parser, cursor)
+}
+
+// an expression followed by any number of calls, [index], [low:high], .field
+// or .method(), applied from left to right
+func PostfixExpression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsPostfixExpression, PrimaryExpression, PostfixChain)(parser, cursor)
+}
+
+func PostfixChain(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2PostfixChainToken,
+		MatchAll(AsPostfixChain, Postfix, PostfixChain),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func Postfix(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		// a ( on the next line starts another expression
+		MatchAll(AsCallToken, sameLine("("), ParamList, char(")")),
+		Subscript,
+		MatchAll(AsFieldToken, char("."), Identifier),
+		MatchAll(
+			AsMethodToken,
+			char("."), Here, Identifier, sameLine("("), ParamList, char(")"),
+		),
+	)(parser, cursor)
+}
+
+// [index] or [low:high]. Both start with [ and an optional expression, which
+// are only parsed once
+func Subscript(parser *Parser, cursor int) (Token, int, error) {
+	return MatchWhere(
+		isSubscript,
+		MatchAll(AsSubscript, char("["), OptionalExpression, SubscriptTail),
+	)(parser, cursor)
+}
+
+// the ] of an index or the :high] of a slice
+func SubscriptTail(parser *Parser, cursor int) (Token, int, error) {
 	return MatchOneOf(
 		identity,
-		MatchAll(
-			AsBinaryOperator,
-			GuardedExpression, BinaryOperator, Expression,
-		),
-		GuardedExpression,
+		char("]"),
+		MatchAll(AsSliceTail, char(":"), OptionalExpression, char("]")),
 	)(parser, cursor)
 }
 
-// prevents left recursion
-func GuardedExpression(parser *Parser, cursor int) (Token, int, error) {
+func PrimaryExpression(parser *Parser, cursor int) (Token, int, error) {
 	return MatchOneOf(
 		identity,
 		MatchAll(AsBracketExpression, char("("), Expression, char(")")),
-		MatchAll(AsAssignment, Identifier, char("="), Expression),
 		Literal,
+		ListLiteral,
+		MapLiteral,
+		StructLiteral,
 		Identifier,
-		FunctionDef,
 		FunctionCall,
+		MatchAll(
+			AsMacroCall,
+			Here, Identifier, char("!"), char("("), ElementList, char(")"),
+		),
+		Unquote,
+	)(parser, cursor)
+}
+
+func OptionalExpression(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(identity, Expression, EmptyExpression)(parser, cursor)
+}
+
+// Blocks only follow the headers of if, while, def etc, so a { where an
+// operand is expected always starts a map
+func MapLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsMapLiteral, char("{"), MapEntries, char("}"))(parser, cursor)
+}
+
+func MapEntries(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2MapEntriesToken,
+		MatchList(AsMapEntries, MapEntry, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func MapEntry(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsMapEntry, Expression, char(":"), Expression)(parser, cursor)
+}
+
+// at least one of catch and finally is required
+func Try(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(
+			AsTry,
+			KEYWORD_TRY, char("{"), Block, char("}"),
+			Catch, MatchOneOf(identity, Finally, EmptyExpression),
+		),
+		MatchAll(
+			AsTry,
+			KEYWORD_TRY, char("{"), Block, char("}"),
+			EmptyExpression, Finally,
+		),
+	)(parser, cursor)
+}
+
+func Catch(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsCatch,
+		KEYWORD_CATCH, Identifier, char("{"), Block, char("}"),
+	)(parser, cursor)
+}
+
+func Finally(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsFinally, KEYWORD_FINALLY, char("{"), Block, char("}"))(parser, cursor)
+}
+
+func Match(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsMatch,
+		KEYWORD_MATCH, Expression, char("{"), Arms, char("}"),
+	)(parser, cursor)
+}
+
+func Arms(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2MatchArmsToken,
+		MatchList(AsMatchArms, Arm, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+// The body of an arm is an expression or a block. Being tried first, the
+// expression wins for {}, which is an empty map
+func Arm(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsMatchArm,
+		AnyPattern, char("=>"),
+		MatchOneOf(
+			identity,
+			Expression,
+			MatchAll(AsArmBlock, char("{"), Block, char("}")),
+		),
+	)(parser, cursor)
+}
+
+func AnyPattern(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsAlternativePattern, SinglePattern, char("|"), AnyPattern),
+		SinglePattern,
+	)(parser, cursor)
+}
+
+func SinglePattern(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsLiteralPattern, Literal),
+		MatchAll(AsLiteralPattern, NegativeLiteral),
+		MatchAll(AsStructPattern, QualifiedName, char("{"), FieldPatterns, char("}")),
+		MatchAll(AsVariantPattern, QualifiedName, char("("), PatternList, char(")")),
+		MatchAll(AsBindingPattern, Identifier),
+	)(parser, cursor)
+}
+
+func PatternList(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2PatternListToken,
+		MatchList(AsPatternList, AnyPattern, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func FieldPatterns(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2FieldPatternsToken,
+		MatchList(AsFieldPatterns, FieldPattern, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func FieldPattern(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsFieldPattern, Identifier, char(":"), AnyPattern),
+		MatchAll(AsFieldPattern, Identifier),
+	)(parser, cursor)
+}
+
+// import "path" or import "path" as name
+func Import(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsImport,
+		KEYWORD_IMPORT, StringLiteral,
+		MatchOneOf(
+			identity,
+			MatchAll(AsImportAlias, KEYWORD_AS, Identifier),
+			EmptyExpression,
+		),
+	)(parser, cursor)
+}
+
+func TypeDef(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsTypeDef,
+		KEYWORD_TYPE, Identifier, char("{"), ArgList, char("}"),
+	)(parser, cursor)
+}
+
+// enum Name { Variant(field: type, ...), Variant, ... }
+func EnumDef(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsEnumDef,
+		KEYWORD_ENUM, Identifier, char("{"), Variants, char("}"),
+	)(parser, cursor)
+}
+
+func Variants(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2VariantsToken,
+		MatchList(AsVariants, EnumVariant, char(","), true),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func EnumVariant(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsVariant, Identifier, char("("), ArgList, char(")")),
+		MatchAll(AsVariant, Identifier),
+	)(parser, cursor)
+}
+
+// At least one field is required, otherwise the x{} of `if x {}` would be
+// taken for a struct literal
+func StructLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsStructLiteral, QualifiedName, char("{"), FieldInits, char("}"))(parser, cursor)
+}
+
+func FieldInits(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		Token2FieldInitsToken,
+		MatchList(AsFieldInits, FieldInit, char(","), false),
 	)(parser, cursor)
 }
 
-var BinaryOperator = MatchOneOf(
+func FieldInit(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsFieldInit, Identifier, char(":"), Expression)(parser, cursor)
+}
+
+func ListLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsListLiteral, char("["), ElementList, char("]"))(parser, cursor)
+}
+
+// BinaryOperator reads an operator of BINARY_PRECEDENCE or one declared
+// with infixl or infixr
+func BinaryOperator(parser *Parser, cursor int) (Token, int, error) {
+	return matchOperator(parser, cursor, parser.operators)
+}
+
+// BuiltinOperator only reads the operators of BINARY_PRECEDENCE, the ones
+// that can be overloaded
+func BuiltinOperator(parser *Parser, cursor int) (Token, int, error) {
+	return matchOperator(parser, cursor, nil)
+}
+
+// matchOperator takes the longest operator matching, so ** isn't read as *
+func matchOperator(parser *Parser, cursor int, declared map[string]InfixDefNode) (Token, int, error) {
+	best, bestCursor := "", -1
+	try := func(operator string) {
+		if newCursor, err := tryString(parser, cursor, operator); err == nil && newCursor > bestCursor {
+			best, bestCursor = operator, newCursor
+		}
+	}
+	for operator := range BINARY_PRECEDENCE {
+		try(operator)
+	}
+	for operator := range declared {
+		try(operator)
+	}
+	if bestCursor == -1 {
+		return nil, cursor, NotMatchError("BinaryOperator")
+	}
+	return CharToken{best, parser.pos(cursor)}, bestCursor, nil
+}
+
+// A minus in front of a number literal gives a negative literal rather than
+// a negation, -9223372036854775808 being in range. The postfixes of the
+// literal and ** bind tighter than the minus though: -2 ** 2 is -4
+func UnaryExpression(parser *Parser, cursor int) (Token, int, error) {
+	if token, newCursor, err := NegativeLiteral(parser, cursor); err == nil {
+		_, _, postfixErr := Postfix(parser, newCursor)
+		_, _, powerErr := Power(parser, newCursor)
+		if postfixErr != nil && powerErr != nil {
+			return token, newCursor, nil
+		}
+	}
+	return MatchAll(AsUnaryOperator, UnaryOperator, UnaryOperand)(parser, cursor)
+}
+
+// UnaryOperand is the operand of a unary operator along with the ** following
+// it. The exponent is read the same way, so that ** stays right associative
+func UnaryOperand(parser *Parser, cursor int) (Token, int, error) {
+	base, newCursor, err := GuardedExpression(parser, cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+	if power, powerCursor, err := Power(parser, newCursor); err == nil {
+		if exponent, exponentCursor, err := UnaryOperand(parser, powerCursor); err == nil {
+			return BinaryOperatorNode{base.(Node), "**", exponent.(Node), power.(CharToken).Pos}, exponentCursor, nil
+		}
+	}
+	return base, newCursor, nil
+}
+
+// Power reads **, but not a declared operator starting with it
+func Power(parser *Parser, cursor int) (Token, int, error) {
+	token, newCursor, err := BinaryOperator(parser, cursor)
+	if err != nil || token.(CharToken).Name != "**" {
+		return nil, cursor, NotMatchError("Power")
+	}
+	return token, newCursor, nil
+}
+
+// higher binds tighter. The levels are Haskell's, which infixl and infixr
+// use, but the bitwise operators are ranked like in Go
+var BINARY_PRECEDENCE = map[string]int{
+	"==": 4,
+	"!=": 4,
+	"<":  4,
+	"<=": 4,
+	">":  4,
+	">=": 4,
+	"+":  6,
+	"-":  6,
+	"|":  6,
+	"^":  6,
+	"*":  7,
+	"/":  7,
+	"%":  7,
+	"&":  7,
+	"<<": 7,
+	">>": 7,
+	"**": 8,
+}
+
+// 2 ** 3 ** 2 is 2 ** 9
+var RIGHT_ASSOCIATIVE = map[string]bool{
+	"**": true,
+}
+
+var UnaryOperator = MatchOneOf(
 	identity,
-	char("+"),
 	char("-"),
-	char("*"),
-	char("/"),
+	char("+"),
+	char("~"),
+)
+
+// the operators of `target op= value`
+var CompoundOperator = MatchOneOf(
+	identity,
+	char("+="),
+	char("-="),
+	char("*="),
+	char("/="),
+	char("%="),
 )
 
 func FunctionCall(parser *Parser, cursor int) (Token, int, error) {
 	return MatchAll(
 		AsFunctionCall,
-		Identifier, char("("), ParamList, char(")"),
+		Here, QualifiedName, char("("), ParamList, char(")"),
 	)(parser, cursor)
 }
 
+// Here matches nothing, its token is the Pos of what follows
+func Here(parser *Parser, cursor int) (Token, int, error) {
+	return parser.pos(cursor), cursor, nil
+}
+
 func Literal(parser *Parser, cursor int) (Token, int, error) {
-	return MatchOneOf(identity, IntegerLiteral, FloatLiteral)(parser, cursor)
+	return MatchOneOf(identity, IntegerLiteral, FloatLiteral, BoolLiteral, StringLiteral)(parser, cursor)
 }
 
-func FunctionDef(parser *Parser, cursor int) (Token, int, error) {
+// Double quoted, with Go's escape sequences
+var REG_STRING_LITERAL = regexp.MustCompile(`^"([^"\\\n]|\\.)*"`)
+
+func StringLiteral(parser *Parser, cursor int) (Token, int, error) {
+	cursor = parser.findNonWhiteSpace(cursor)
+	if cursor == -1 || cursor >= len(parser.text) {
+		return nil, cursor, NotMatchError("StringLiteral")
+	}
+	literal := REG_STRING_LITERAL.FindString(parser.text[cursor:len(parser.text)])
+	if literal == "" {
+		return nil, cursor, NotMatchError("StringLiteral")
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		parser.report(cursor, "invalid escape sequence in string literal %s", literal)
+	}
+	return StringLiteralNode{value}, cursor + len(literal), nil
+}
+
+func BoolLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(AsBoolLiteral, KEYWORD_TRUE, KEYWORD_FALSE)(parser, cursor)
+}
+
+func If(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsIf,
+		KEYWORD_IF, Expression,
+		char("{"), Block, char("}"),
+		Else,
+	)(parser, cursor)
+}
+
+func While(parser *Parser, cursor int) (Token, int, error) {
 	return MatchAll(
-		AsFunctionDef,
-		KEYWORD_DEF, Identifier,
+		AsWhile,
+		KEYWORD_WHILE, Expression,
+		char("{"), Block, char("}"),
+	)(parser, cursor)
+}
+
+func For(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsFor,
+		KEYWORD_FOR, Identifier, KEYWORD_IN, MatchOneOf(identity, Range, Expression),
+		char("{"), Block, char("}"),
+	)(parser, cursor)
+}
+
+func Range(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsRange, Expression, char(".."), Expression)(parser, cursor)
+}
+
+func LoopControl(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(AsLoopControl, KEYWORD_BREAK, KEYWORD_CONTINUE)(parser, cursor)
+}
+
+// let, var or const, the latter giving a ConstNode
+func Declaration(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsDeclaration,
+		MatchOneOf(identity, KEYWORD_LET, KEYWORD_VAR, KEYWORD_CONST), Identifier,
+		TypeAnnotation, char("="), Expression,
+	)(parser, cursor)
+}
+
+// optional `: type`
+func TypeAnnotation(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsTypeAnnotation, char(":"), QualifiedName),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func Return(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsReturn, KEYWORD_RETURN, Expression)(parser, cursor)
+}
+
+func Else(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(AsElse, KEYWORD_ELSE, If),
+		MatchAll(AsElse, KEYWORD_ELSE, char("{"), Block, char("}")),
+		EmptyExpression,
+	)(parser, cursor)
+}
+
+func Lambda(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsLambda,
+		KEYWORD_FN,
 		char("("), ArgList, char(")"),
 		char("{"),
 		Block,
@@ -474,11 +2330,178 @@ func FunctionDef(parser *Parser, cursor int) (Token, int, error) {
 	)(parser, cursor)
 }
 
-// TODO FIX THESE REGEXES
-var REG_INTEGER_LITERAL = regexp.MustCompile("[0-9]*")
-var REG_FLOAT_LITERAL = regexp.MustCompile("[0-9]*\\.[0-9]*")
+// infixl 6 <+> = combine declares the operator <+>, which can be used until
+// the end of the text, a <+> b calling combine(a, b)
+func InfixDef(parser *Parser, cursor int) (Token, int, error) {
+	token, newCursor, err := infixDeclaration(parser, cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+	parser.declareOperator(token.(InfixDefNode), parser.findNonWhiteSpace(cursor))
+	return token, newCursor, nil
+}
+
+// operators are declared for the whole text, so not in blocks
+func NestedInfixDef(parser *Parser, cursor int) (Token, int, error) {
+	token, newCursor, err := infixDeclaration(parser, cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+	parser.report(parser.findNonWhiteSpace(cursor), "operator %s can only be declared at the top level", token.(InfixDefNode).Operator)
+	return token, newCursor, nil
+}
+
+func infixDeclaration(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsInfixDef,
+		MatchOneOf(identity, KEYWORD_INFIXL, KEYWORD_INFIXR),
+		IntegerLiteral, OperatorSymbol, char("="), QualifiedName,
+	)(parser, cursor)
+}
+
+// the characters of the operators declared with infixl and infixr
+var REG_OPERATOR = regexp.MustCompile(`^[!%&*+\-/<=>?@^|~]+`)
+
+// operators which have a meaning already
+var RESERVED_OPERATORS = map[string]bool{
+	"=":  true,
+	"=>": true,
+	"!":  true,
+	"+=": true,
+	"-=": true,
+	"*=": true,
+	"/=": true,
+	"%=": true,
+}
+
+func OperatorSymbol(parser *Parser, cursor int) (Token, int, error) {
+	cursor = parser.findNonWhiteSpace(cursor)
+	if cursor == -1 || cursor >= len(parser.text) {
+		return nil, cursor, NotMatchError("OperatorSymbol")
+	}
+	operator := REG_OPERATOR.FindString(parser.text[cursor:])
+	if operator == "" {
+		return nil, cursor, NotMatchError("OperatorSymbol")
+	}
+	return CharToken{operator, parser.pos(cursor)}, cursor + len(operator), nil
+}
+
+// declareOperator adds the operator of def to the table BinaryOperator
+// reads. InfixDef may be matched several times at the same place, which
+// doesn't make it a redeclaration
+func (p *Parser) declareOperator(def InfixDefNode, cursor int) {
+	if _, ok := BINARY_PRECEDENCE[def.Operator]; ok || RESERVED_OPERATORS[def.Operator] {
+		p.report(cursor, "operator %s can't be declared", def.Operator)
+		return
+	}
+	if def.Precedence < 0 || def.Precedence > 9 {
+		p.report(cursor, "precedence of operator %s must be between 0 and 9", def.Operator)
+		return
+	}
+	if existing, ok := p.operators[def.Operator]; ok {
+		if existing.Pos != def.Pos {
+			p.report(cursor, "operator %s is already declared", def.Operator)
+		}
+		return
+	}
+	if p.operators == nil {
+		p.operators = map[string]InfixDefNode{}
+	}
+	p.operators[def.Operator] = def
+}
+
+// $name, within a quote
+func Unquote(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(AsUnquote, char("$"), Identifier)(parser, cursor)
+}
+
+// macro name(a, b) { ... }, the parameters have no type
+func MacroDef(parser *Parser, cursor int) (Token, int, error) {
+	untyped := func(token Token) bool {
+		arglist, ok := Token2ArgListToken(token).(ArgListToken)
+		if !ok {
+			return false
+		}
+		for _, arg := range arglist.ArgDecl {
+			if arg.TypeToken.Name != "" {
+				return false
+			}
+		}
+		return true
+	}
+	return MatchAll(
+		AsMacroDef,
+		KEYWORD_MACRO, Identifier,
+		char("("), MatchWhere(untyped, ArgList), char(")"),
+		char("{"), Block, char("}"),
+	)(parser, cursor)
+}
+
+// def name(args) { ... }, or def (a: Left) op (b: Right) { ... } for an
+// operator
+func FunctionDef(parser *Parser, cursor int) (Token, int, error) {
+	return MatchOneOf(
+		identity,
+		MatchAll(
+			AsFunctionDef,
+			KEYWORD_DEF, QualifiedName,
+			char("("), DefArgList, char(")"), TypeAnnotation,
+			char("{"),
+			Block,
+			char("}"),
+		),
+		MatchAll(
+			AsOperatorDef,
+			KEYWORD_DEF,
+			char("("), OperandDecl, char(")"),
+			BuiltinOperator,
+			char("("), OperandDecl, char(")"),
+			TypeAnnotation,
+			char("{"),
+			Block,
+			char("}"),
+		),
+	)(parser, cursor)
+}
+
+// an operand of an operator definition, whose type is required
+var OperandDecl = MatchAll(
+	AsArgDecl,
+	Identifier, MatchAll(AsTypeAnnotation, char(":"), QualifiedName),
+)
+
+// Digits may be grouped with single underscores: 1_000_000, 0xFF_FF
+var REG_INTEGER_LITERAL = regexp.MustCompile(
+	"^(0[xX]_?[0-9a-fA-F]+(_[0-9a-fA-F]+)*" +
+		"|0[oO]_?[0-7]+(_[0-7]+)*" +
+		"|0[bB]_?[01]+(_[01]+)*" +
+		"|[0-9]+(_[0-9]+)*)")
+
+// A float needs either a fraction or an exponent: 1.5, .5, 1e9, 2.5E-3
+var REG_FLOAT_LITERAL = regexp.MustCompile(
+	"^(([0-9]+(_[0-9]+)*)?\\.[0-9]+(_[0-9]+)*([eE][+-]?[0-9]+)?" +
+		"|[0-9]+(_[0-9]+)*[eE][+-]?[0-9]+)")
 
 func IntegerLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return integerLiteral(parser, cursor, "")
+}
+
+// NegativeLiteral reads a minus followed by a number literal. The range of
+// an integer is checked with the sign
+func NegativeLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return MatchAll(
+		AsNegativeLiteral,
+		char("-"), MatchOneOf(identity, negativeIntegerLiteral, FloatLiteral),
+	)(parser, cursor)
+}
+
+func negativeIntegerLiteral(parser *Parser, cursor int) (Token, int, error) {
+	return integerLiteral(parser, cursor, "-")
+}
+
+// integerLiteral reads the digits of an integer literal, which has the value
+// of sign followed by them
+func integerLiteral(parser *Parser, cursor int, sign string) (Token, int, error) {
 	cursor = parser.findNonWhiteSpace(cursor)
 	if cursor == -1 || cursor >= len(parser.text) {
 		return nil, cursor, NotMatchError("IntegerLiteral")
@@ -487,11 +2510,30 @@ func IntegerLiteral(parser *Parser, cursor int) (Token, int, error) {
 	if literal == "" {
 		return nil, cursor, NotMatchError("IntegerLiteral")
 	}
-	i, err := strconv.Atoi(literal)
+
+	digits := strings.Replace(literal, "_", "", -1)
+	base := 10
+	if len(digits) > 1 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+
+	i, err := strconv.ParseInt(sign+digits, base, 64)
 	if err != nil {
-		panic("Logic error")
+		// the regex only lets valid digits through, so this is an overflow
+		parser.report(cursor, "integer literal %s%s overflows int64", sign, literal)
+		i = 0
 	}
-	return IntegerLiteralNode{int64(i)}, cursor + len(literal), nil
+	return IntegerLiteralNode{i}, cursor + len(literal), nil
 }
 
 func FloatLiteral(parser *Parser, cursor int) (Token, int, error) {
@@ -499,13 +2541,14 @@ func FloatLiteral(parser *Parser, cursor int) (Token, int, error) {
 	if cursor == -1 || cursor >= len(parser.text) {
 		return nil, cursor, NotMatchError("FloatLiteral")
 	}
-	literal := REG_FLOAT_LITERAL.FindString(parser.text)
+	literal := REG_FLOAT_LITERAL.FindString(parser.text[cursor:len(parser.text)])
 	if literal == "" {
 		return nil, cursor, NotMatchError("FloatLiteral")
 	}
-	f, err := strconv.ParseFloat(literal, 64)
+	f, err := strconv.ParseFloat(strings.Replace(literal, "_", "", -1), 64)
 	if err != nil {
-		panic("Logic error")
+		parser.report(cursor, "float literal %s is out of range", literal)
+		f = 0
 	}
 	return FloatLiteralNode{f}, cursor + len(literal), nil
 }
@@ -2,7 +2,12 @@ package parser
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	. "github.com/trungaczne/gimmick/vm"
 )
 
 func testWrapper(tokens []Token) Token {
@@ -12,19 +17,44 @@ func testWrapper(tokens []Token) Token {
 	return tokens[0]
 }
 
-func pass(t *testing.T, funcName string, tryFunc TryFunc, text string) {
+// pass checks that tryFunc parses the whole of text into expected
+func pass(t *testing.T, funcName string, tryFunc TryFunc, text string, expected Token) {
 	tryFunc = MatchAll(testWrapper, tryFunc, EndOfFile)
 	parser := NewParser(text)
 	token, _, err := tryFunc(parser, 0)
-	node, ok := token.(Node)
-	if ok {
-		fmt.Println(PrettyPrint(node.String(), 4))
-	} else {
-		fmt.Println(token)
-	}
 	if err != nil {
 		t.Errorf("Should not fail: %s(\"%s\") - %s", funcName, text, err)
+		return
 	}
+	if d := diff("", reflect.ValueOf(token), reflect.ValueOf(expected)); d != "" {
+		t.Errorf("Wrong tree: %s(\"%s\") - %s", funcName, text, d)
+	}
+}
+
+// shorthands for the expected trees, whose positions are ignored
+
+func id(name string) IdentifierNode {
+	return IdentifierNode{name}
+}
+
+func integer(value int64) IntegerLiteralNode {
+	return IntegerLiteralNode{value}
+}
+
+func binary(left Node, operator string, right Node) BinaryOperatorNode {
+	return BinaryOperatorNode{left, operator, right, Pos{}}
+}
+
+func unary(operator string, operand Node) UnaryOperatorNode {
+	return UnaryOperatorNode{operator, operand, Pos{}}
+}
+
+func call(name string, args ...Node) FunctionCallNode {
+	return FunctionCallNode{name, args, nil, Pos{}}
+}
+
+func block(exprs ...Node) BlockNode {
+	return BlockNode{exprs}
 }
 
 func fail(t *testing.T, funcName string, tryFunc TryFunc, text string) {
@@ -37,9 +67,9 @@ func fail(t *testing.T, funcName string, tryFunc TryFunc, text string) {
 }
 
 func TestToken(t *testing.T) {
-	pass(t, "EndOfFile", EndOfFile, "")
+	pass(t, "EndOfFile", EndOfFile, "", EOFToken{})
 	fail(t, "EndOfFile", EndOfFile, ";")
-	pass(t, "Keyword", keyword("def"), "def")
+	pass(t, "Keyword", keyword("def"), "def", KeywordToken{"def", Pos{}})
 	fail(t, "Char", char("def"), "fart()")
 
 	pass(t, "MatchOneOf", MatchOneOf(
@@ -48,44 +78,184 @@ func TestToken(t *testing.T) {
 		keyword("compile"),
 	),
 		"compile",
+		KeywordToken{"compile", Pos{}},
 	)
 
-	pass(t, "ParamList", ParamList, "a, b, c")
-	pass(t, "ParamList", ParamList, "var_iable")
-	pass(t, "ParamList", ParamList, "")
+	pass(t, "ParamList", ParamList, "a, b, c", ParamListToken{[]Node{id("a"), id("b"), id("c")}, []string{"", "", ""}})
+	pass(t, "ParamList", ParamList, "var_iable", ParamListToken{[]Node{id("var_iable")}, []string{""}})
+	pass(t, "ParamList", ParamList, "", ParamListToken{[]Node{}, []string{}})
+	pass(t, "ParamList", ParamList, "y: 3, x: 1", ParamListToken{[]Node{integer(3), integer(1)}, []string{"y", "x"}})
+	pass(t, "ParamList", ParamList, "1, y: 3", ParamListToken{[]Node{integer(1), integer(3)}, []string{"", "y"}})
 
-	pass(t, "ArgList", ArgList, "name:string")
-	pass(t, "ArgList", ArgList, "name:string, age:int")
-	pass(t, "ArgList", ArgList, "")
+	pass(t, "ArgList", ArgList, "name:string", ArgListToken{[]ArgDeclToken{{id("name"), id("string"), nil, false}}})
+	pass(t, "ArgList", ArgList, "name:string, age:int", ArgListToken{[]ArgDeclToken{{id("name"), id("string"), nil, false}, {id("age"), id("int"), nil, false}}})
+	pass(t, "ArgList", ArgList, "", ArgListToken{[]ArgDeclToken{}})
 	fail(t, "ArgList", ArgList, ",name:string, age:int")
 }
 
 func TestNode(t *testing.T) {
-	pass(t, "IntegerLiteral", IntegerLiteral, "1230498")
+	pass(t, "IntegerLiteral", IntegerLiteral, "1230498", integer(1230498))
 	fail(t, "IntegerLiteral", IntegerLiteral, "XD")
 
-	pass(t, "FloatLiteral", FloatLiteral, "100.00")
-	pass(t, "FloatLiteral", FloatLiteral, ".02")
+	pass(t, "FloatLiteral", FloatLiteral, "100.00", FloatLiteralNode{100})
+	pass(t, "FloatLiteral", FloatLiteral, ".02", FloatLiteralNode{0.02})
+	pass(t, "FloatLiteral", FloatLiteral, "6.022e23", FloatLiteralNode{6.022e+23})
+	pass(t, "FloatLiteral", FloatLiteral, "1E-9", FloatLiteralNode{1e-09})
+	fail(t, "FloatLiteral", FloatLiteral, ".")
+	fail(t, "FloatLiteral", FloatLiteral, "1.")
+	fail(t, "IntegerLiteral", IntegerLiteral, "")
+	fail(t, "IntegerLiteral", IntegerLiteral, "1__000")
+	fail(t, "IntegerLiteral", IntegerLiteral, "1000_")
+	fail(t, "IntegerLiteral", IntegerLiteral, "0x")
+
+	pass(t, "Expression", Expression, "-1", integer(-1))
+	pass(t, "Expression", Expression, "-x * +3", binary(unary("-", id("x")), "*", unary("+", integer(3))))
+	pass(t, "Expression", Expression, "1 - -(2 + 3)", binary(integer(1), "-", unary("-", binary(integer(2), "+", integer(3)))))
+	pass(t, "Expression", Expression, "x = -0x10", AssignmentNode{"x", integer(-16), Pos{}})
 
-	pass(t, "FunctionDef", FunctionDef, "def myfunc(){}")
-	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: hello, hi:there){}")
-	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: e){}")
-	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: e,){}") // this shouldn't pass btw
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(){}", FunctionDefNode{Name: "myfunc", Block: block()})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: hello, hi:there){}", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "name", Type: "hello"}, {Name: "hi", Type: "there"}}, Defaults: []Node{nil, nil}, Block: block()})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: e){}", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "name", Type: "e"}}, Defaults: []Node{nil}, Block: block()})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(name: e,){}", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "name", Type: "e"}}, Defaults: []Node{nil}, Block: block()}) // this shouldn't pass btw
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(x: int): int { x }", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "x", Type: "int"}}, Defaults: []Node{nil}, ReturnType: "int", Block: block(id("x"))})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(x, y: int) { x }", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "x", Type: ""}, {Name: "y", Type: "int"}}, Defaults: []Node{nil, nil}, Block: block(id("x"))})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(x: int, y: int = 10){}", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "x", Type: "int"}, {Name: "y", Type: "int"}}, Defaults: []Node{nil, integer(10)}, Block: block()})
+	pass(t, "FunctionDef", FunctionDef, "def sum(xs: ...int){}", FunctionDefNode{Name: "sum", ArgList: []NameType{{Name: "xs", Type: "int"}}, Defaults: []Node{nil}, Variadic: true, Block: block()})
+	pass(t, "FunctionDef", FunctionDef, "def myfunc(x, rest: ...string){}", FunctionDefNode{Name: "myfunc", ArgList: []NameType{{Name: "x", Type: ""}, {Name: "rest", Type: "string"}}, Defaults: []Node{nil, nil}, Variadic: true, Block: block()})
+	fail(t, "FunctionDef", FunctionDef, "def myfunc(x: int): { x }")
 	fail(t, "FunctionDef", FunctionDef, "def myfunc(){")
 	fail(t, "FunctionDef", FunctionDef, "def myfunc){")
 	fail(t, "FunctionDef", FunctionDef, "def myfunc(,name: e){}")
+	fail(t, "FunctionDef", FunctionDef, "def sum(xs: ...int, y){}")
+	pass(t, "FunctionDef", FunctionDef, "def Point.norm(p: Point) { p.x }", FunctionDefNode{Name: "Point.norm", ArgList: []NameType{{Name: "p", Type: "Point"}}, Defaults: []Node{nil}, Block: block(FieldNode{id("p"), "x", Pos{}})})
+	pass(t, "FunctionDef", FunctionDef, "def (a: Vec) + (b: Vec): Vec { a }", FunctionDefNode{Name: "Vec + Vec", Operator: "+", ArgList: []NameType{{Name: "a", Type: "Vec"}, {Name: "b", Type: "Vec"}}, Defaults: []Node{nil, nil}, ReturnType: "Vec", Block: block(id("a"))})
+	pass(t, "FunctionDef", FunctionDef, "def (a: Vec) == (b: Vec) { true }", FunctionDefNode{Name: "Vec == Vec", Operator: "==", ArgList: []NameType{{Name: "a", Type: "Vec"}, {Name: "b", Type: "Vec"}}, Defaults: []Node{nil, nil}, Block: block(BoolLiteralNode{true})})
+	fail(t, "FunctionDef", FunctionDef, "def (a) + (b: Vec) { a }")
+	fail(t, "FunctionDef", FunctionDef, "def (a: Vec) + { a }")
+	pass(t, "Expression", Expression, "const def square(x: int) { x * x }", FunctionDefNode{Name: "square", Const: true, ArgList: []NameType{{Name: "x", Type: "int"}}, Defaults: []Node{nil}, Block: block(binary(id("x"), "*", id("x")))})
+	pass(t, "Expression", Expression, "const LIMIT: int = 60 * 60", ConstNode{"LIMIT", "int", binary(integer(60), "*", integer(60)), Pos{}})
+	fail(t, "Expression", Expression, "const = 1")
 
-	pass(t, "Expression", Expression, "myfunc(100, 200)")
-	pass(t, "Expression", Expression, "myfunc()")
-	pass(t, "Expression", Expression, "1.3")
-	pass(t, "Expression", Expression, "x = 100")
+	pass(t, "Expression", Expression, "myfunc(100, 200)", call("myfunc", integer(100), integer(200)))
+	pass(t, "Expression", Expression, "myfunc()", call("myfunc"))
+	pass(t, "Expression", Expression, "1.3", FloatLiteralNode{1.3})
+	pass(t, "Expression", Expression, "x = 100", AssignmentNode{"x", integer(100), Pos{}})
 	fail(t, "Expression", Expression, ";myfunc()")
 
-	pass(t, "Expression", Expression, "name = myfunc(100, 200) + 588 * (x + 2)")
-	pass(t, "Expression", Expression, "1 + 1")
+	pass(t, "Expression", Expression, "name = myfunc(100, 200) + 588 * (x + 2)", AssignmentNode{"name", binary(call("myfunc", integer(100), integer(200)), "+", binary(integer(588), "*", binary(id("x"), "+", integer(2)))), Pos{}})
+	pass(t, "Expression", Expression, "1 + 1", binary(integer(1), "+", integer(1)))
 	fail(t, "Expression", Expression, "(100 + 200) = myfunc")
 
-	pass(t, "Block", Block, "100+200 300+400 x=400 y=500 * 80 * (90 + z) ")
+	pass(t, "Block", Block, "100+200 300+400 x=400 y=500 * 80 * (90 + z) ", block(binary(integer(100), "+", integer(200)), binary(integer(300), "+", integer(400)), AssignmentNode{"x", integer(400), Pos{}}, AssignmentNode{"y", binary(binary(integer(500), "*", integer(80)), "*", binary(integer(90), "+", id("z"))), Pos{}}))
+
+	pass(t, "Expression", Expression, "if x < 1 { 1 }", IfNode{binary(id("x"), "<", integer(1)), block(integer(1)), nil, Pos{}})
+	pass(t, "Expression", Expression, "if x <= 1 { 1 } else { 2 }", IfNode{binary(id("x"), "<=", integer(1)), block(integer(1)), block(integer(2)), Pos{}})
+	pass(t, "Expression", Expression, "if x == 1 { 1 } else if x != 2 { 2 } else { y = true }", IfNode{binary(id("x"), "==", integer(1)), block(integer(1)), IfNode{binary(id("x"), "!=", integer(2)), block(integer(2)), block(AssignmentNode{"y", BoolLiteralNode{true}, Pos{}}), Pos{}}, Pos{}})
+	pass(t, "Expression", Expression, "y = if x >= 1 { 1 } else { 2 } + 1", AssignmentNode{"y", binary(IfNode{binary(id("x"), ">=", integer(1)), block(integer(1)), block(integer(2)), Pos{}}, "+", integer(1)), Pos{}})
+	fail(t, "Expression", Expression, "if x { 1 } else")
+	fail(t, "Expression", Expression, "if { 1 }")
+	fail(t, "Expression", Expression, "else = 1")
+	pass(t, "Expression", Expression, "iffy = elsewhere", AssignmentNode{"iffy", id("elsewhere"), Pos{}})
+	fail(t, "FunctionDef", FunctionDef, "define(){}")
+
+	pass(t, "Expression", Expression, "while x < 10 { x = x + 1 }", WhileNode{binary(id("x"), "<", integer(10)), block(AssignmentNode{"x", binary(id("x"), "+", integer(1)), Pos{}}), Pos{}})
+	pass(t, "Expression", Expression, "while true { if x { break } else { continue } }", WhileNode{BoolLiteralNode{true}, block(IfNode{id("x"), block(BreakNode{}), block(ContinueNode{}), Pos{}}), Pos{}})
+	pass(t, "Expression", Expression, "for i in 0..10 { i }", ForNode{"i", RangeNode{integer(0), integer(10)}, block(id("i"))})
+	pass(t, "Expression", Expression, "for i in a + 1..f(b) {}", ForNode{"i", RangeNode{binary(id("a"), "+", integer(1)), call("f", id("b"))}, block()})
+	fail(t, "Expression", Expression, "for i in {}")
+	fail(t, "Expression", Expression, "for 1 in 0..10 {}")
+	fail(t, "Expression", Expression, "while true")
+	pass(t, "Expression", Expression, "format = input", AssignmentNode{"format", id("input"), Pos{}})
+
+	pass(t, "Expression", Expression, "return x + 1", ReturnNode{binary(id("x"), "+", integer(1)), Pos{}})
+	pass(t, "Expression", Expression, "if x { return 1 } else { return f(2) }", IfNode{id("x"), block(ReturnNode{integer(1), Pos{}}), block(ReturnNode{call("f", integer(2)), Pos{}}), Pos{}})
+	fail(t, "Expression", Expression, "return")
+	pass(t, "Expression", Expression, "returned = 1", AssignmentNode{"returned", integer(1), Pos{}})
+
+	pass(t, "Expression", Expression, "let x = 1", DeclarationNode{false, "x", "", integer(1), Pos{}})
+	pass(t, "Expression", Expression, "var x: int = 1 + 2", DeclarationNode{true, "x", "int", binary(integer(1), "+", integer(2)), Pos{}})
+	pass(t, "Expression", Expression, "let x: float = if y { 1.0 } else { 2.0 }", DeclarationNode{false, "x", "float", IfNode{id("y"), block(FloatLiteralNode{1}), block(FloatLiteralNode{2}), Pos{}}, Pos{}})
+	fail(t, "Expression", Expression, "let x")
+	fail(t, "Expression", Expression, "var x: = 1")
+	fail(t, "Expression", Expression, "let var = 1")
+	pass(t, "Expression", Expression, "letter = variable", AssignmentNode{"letter", id("variable"), Pos{}})
+
+	pass(t, "Expression", Expression, "fn(x: int) { x + 1 }", LambdaNode{[]NameType{{Name: "x", Type: "int"}}, block(binary(id("x"), "+", integer(1)))})
+	pass(t, "Expression", Expression, "sort(xs, fn(a: int, b: int) { a < b })", call("sort", id("xs"), LambdaNode{[]NameType{{Name: "a", Type: "int"}, {Name: "b", Type: "int"}}, block(binary(id("a"), "<", id("b")))}))
+	pass(t, "Expression", Expression, "let f = fn() {}", DeclarationNode{false, "f", "", LambdaNode{[]NameType{}, block()}, Pos{}})
+	fail(t, "Expression", Expression, "fn x() {}")
+	pass(t, "Expression", Expression, "fname = fn_value", AssignmentNode{"fname", id("fn_value"), Pos{}})
+	pass(t, "Expression", Expression, "add(1, 2)(3)", CallNode{Callee: call("add", integer(1), integer(2)), ParamList: []Node{integer(3)}})
+	pass(t, "Expression", Expression, "(fn(x: int) { x })(1)", CallNode{Callee: LambdaNode{[]NameType{{Name: "x", Type: "int"}}, block(id("x"))}, ParamList: []Node{integer(1)}})
+	fail(t, "Expression", Expression, "f(1)(")
+	fail(t, "Expression", Expression, "f(1)\n(2)")
+
+	pass(t, "Expression", Expression, "[]", ListLiteralNode{[]Node{}})
+	pass(t, "Expression", Expression, "[1, [2, 3], f(x)]", ListLiteralNode{[]Node{integer(1), ListLiteralNode{[]Node{integer(2), integer(3)}}, call("f", id("x"))}})
+	pass(t, "Expression", Expression, "xs[0]", IndexNode{id("xs"), integer(0)})
+	pass(t, "Expression", Expression, "xs[i + 1][j] * 2", binary(IndexNode{IndexNode{id("xs"), binary(id("i"), "+", integer(1))}, id("j")}, "*", integer(2)))
+	pass(t, "Expression", Expression, "f(x)[0]", IndexNode{call("f", id("x")), integer(0)})
+	pass(t, "Expression", Expression, "[1, 2][0]", IndexNode{ListLiteralNode{[]Node{integer(1), integer(2)}}, integer(0)})
+	pass(t, "Expression", Expression, "xs[1:2]", SliceNode{id("xs"), integer(1), integer(2)})
+	pass(t, "Expression", Expression, "xs[:n]", SliceNode{id("xs"), nil, id("n")})
+	pass(t, "Expression", Expression, "xs[n:]", SliceNode{id("xs"), id("n"), nil})
+	pass(t, "Expression", Expression, "xs[:]", SliceNode{id("xs"), nil, nil})
+	pass(t, "Expression", Expression, "xs[i] = xs[i - 1] + 1", IndexAssignmentNode{id("xs"), id("i"), binary(IndexNode{id("xs"), binary(id("i"), "-", integer(1))}, "+", integer(1))})
+	pass(t, "Expression", Expression, "grid[y][x] = 0", IndexAssignmentNode{IndexNode{id("grid"), id("y")}, id("x"), integer(0)})
+	pass(t, "Expression", Expression, "for x in xs { x }", ForNode{"x", id("xs"), block(id("x"))})
+	pass(t, "Expression", Expression, "for x in [1, 2] { x }", ForNode{"x", ListLiteralNode{[]Node{integer(1), integer(2)}}, block(id("x"))})
+	fail(t, "Expression", Expression, "xs[]")
+	fail(t, "Expression", Expression, "xs[1:2] = ys")
+	fail(t, "Expression", Expression, "f(x) = 1")
+
+	pass(t, "Expression", Expression, `"hello"`, StringLiteralNode{"hello"})
+	pass(t, "Expression", Expression, `"say \"hi\"\n"`, StringLiteralNode{"say \"hi\"\n"})
+	fail(t, "Expression", Expression, `"unterminated`)
+	pass(t, "Expression", Expression, "{}", MapLiteralNode{[]Node{}, []Node{}})
+	pass(t, "Expression", Expression, `{"a": 1, "b": [2, 3], 4: {}}`, MapLiteralNode{[]Node{StringLiteralNode{"a"}, StringLiteralNode{"b"}, integer(4)}, []Node{integer(1), ListLiteralNode{[]Node{integer(2), integer(3)}}, MapLiteralNode{[]Node{}, []Node{}}}})
+	pass(t, "Expression", Expression, `m["a"] = m["b"] + 1`, IndexAssignmentNode{id("m"), StringLiteralNode{"a"}, binary(IndexNode{id("m"), StringLiteralNode{"b"}}, "+", integer(1))})
+	pass(t, "Expression", Expression, `{"a": 1}["a"]`, IndexNode{MapLiteralNode{[]Node{StringLiteralNode{"a"}}, []Node{integer(1)}}, StringLiteralNode{"a"}})
+	pass(t, "Expression", Expression, "if has(m, k) { m[k] } else { {} }", IfNode{call("has", id("m"), id("k")), block(IndexNode{id("m"), id("k")}), block(MapLiteralNode{[]Node{}, []Node{}}), Pos{}})
+	fail(t, "Expression", Expression, `{"a"}`)
+	fail(t, "Expression", Expression, `{"a": 1,, "b": 2}`)
+	pass(t, "Statement", Statement, "type Point { x: int, y: int }", TypeDefNode{"Point", []NameType{{Name: "x", Type: "int"}, {Name: "y", Type: "int"}}})
+	fail(t, "Expression", Expression, "type Point { x: int }")
+	pass(t, "Expression", Expression, "Point{x: 1, y: p.y + 1}.x", FieldNode{StructLiteralNode{"Point", []string{"x", "y"}, []Node{integer(1), binary(FieldNode{id("p"), "y", Pos{}}, "+", integer(1))}}, "x", Pos{}})
+	pass(t, "Expression", Expression, "ps[0].pos.x = 2", FieldAssignmentNode{FieldNode{IndexNode{id("ps"), integer(0)}, "pos", Pos{}}, "x", integer(2), Pos{}})
+	pass(t, "Expression", Expression, "if p == Point{x: 1} { p }", IfNode{binary(id("p"), "==", StructLiteralNode{"Point", []string{"x"}, []Node{integer(1)}}), block(id("p")), nil, Pos{}})
+	pass(t, "Expression", Expression, "for x in xs {}", ForNode{"x", id("xs"), block()})
+	fail(t, "Expression", Expression, "Point{x: 1,}")
+	fail(t, "Expression", Expression, "p.0")
+	pass(t, "Statement", Statement, `import "math/util"`, ImportNode{"math/util", ""})
+	pass(t, "Statement", Statement, `import "./helpers" as h`, ImportNode{"./helpers", "h"})
+	fail(t, "Statement", Statement, `import helpers`)
+	pass(t, "Expression", Expression, "h.parse(x) + h.Point{x: 1}.x", binary(call("h.parse", id("x")), "+", FieldNode{StructLiteralNode{"h.Point", []string{"x"}, []Node{integer(1)}}, "x", Pos{}}))
+	pass(t, "Expression", Expression, "fn(p: h.Point) { p }", LambdaNode{[]NameType{{Name: "p", Type: "h.Point"}}, block(id("p"))})
+	pass(t, "Expression", Expression, "match x { 0 => a, 1 | -2.5 => b, P{x, y: Q{z: _}} => c, _ => { d } }", MatchNode{id("x"), []MatchArm{{LiteralPattern{integer(0)}, id("a")}, {AlternativePattern{[]Pattern{LiteralPattern{integer(1)}, LiteralPattern{FloatLiteralNode{-2.5}}}}, id("b")}, {StructPattern{"P", []string{"x", "y"}, []Pattern{BindingPattern{"x"}, StructPattern{"Q", []string{"z"}, []Pattern{WildcardPattern{}}}}}, id("c")}, {WildcardPattern{}, block(id("d"))}}})
+	pass(t, "Expression", Expression, "match x {}", MatchNode{id("x"), nil})
+	pass(t, "Block", Block, "match x { _ => 1 } -1", block(MatchNode{id("x"), []MatchArm{{WildcardPattern{}, integer(1)}}}, integer(-1)))
+	fail(t, "Expression", Expression, "match x { 0 => a,, }")
+	fail(t, "Expression", Expression, "match x { a + 1 => a }")
+	pass(t, "Expression", Expression, "try { f() } catch e { e.message } finally { g() }", TryNode{block(call("f")), "e", block(FieldNode{id("e"), "message", Pos{}}), block(call("g"))})
+	pass(t, "Expression", Expression, "try { f() } finally { g() }", TryNode{block(call("f")), "", nil, block(call("g"))})
+	pass(t, "Expression", Expression, "throw \"boom\"", ThrowNode{StringLiteralNode{"boom"}})
+	fail(t, "Expression", Expression, "try { f() }")
+	fail(t, "Expression", Expression, "try { f() } catch { g() }")
+	pass(t, "Statement", Statement, "enum Shape { Circle(r: float), Rect(w: float, h: float), Empty }", EnumDefNode{"Shape", []Variant{{Name: "Circle", Fields: []NameType{{Name: "r", Type: "float"}}}, {Name: "Rect", Fields: []NameType{{Name: "w", Type: "float"}, {Name: "h", Type: "float"}}}, {Name: "Empty", Fields: []NameType{}}}})
+	pass(t, "Statement", Statement, "enum State { Idle, Running(pid: int), }", EnumDefNode{"State", []Variant{{Name: "Idle", Fields: []NameType{}}, {Name: "Running", Fields: []NameType{{Name: "pid", Type: "int"}}}}})
+	fail(t, "Expression", Expression, "enum State { Idle }")
+	pass(t, "Expression", Expression, "x += 1", CompoundAssignmentNode{id("x"), "+", integer(1), Pos{}})
+	pass(t, "Expression", Expression, "xs[i + 1] %= ~2", CompoundAssignmentNode{IndexNode{id("xs"), binary(id("i"), "+", integer(1))}, "%", unary("~", integer(2)), Pos{}})
+	pass(t, "Expression", Expression, "p.q.x *= 2 ** n", CompoundAssignmentNode{FieldNode{FieldNode{id("p"), "q", Pos{}}, "x", Pos{}}, "*", binary(integer(2), "**", id("n")), Pos{}})
+	fail(t, "Expression", Expression, "f() += 1")
+	fail(t, "Statement", Statement, "enum State { Idle Done }")
+	pass(t, "Expression", Expression, "match s { Circle(r) => r, Rect(_, Circle(h)) => h, Empty | Idle => 0 }", MatchNode{id("s"), []MatchArm{{VariantPattern{"Circle", []Pattern{BindingPattern{"r"}}}, id("r")}, {VariantPattern{"Rect", []Pattern{WildcardPattern{}, VariantPattern{"Circle", []Pattern{BindingPattern{"h"}}}}}, id("h")}, {AlternativePattern{[]Pattern{BindingPattern{"Empty"}, BindingPattern{"Idle"}}}, integer(0)}}})
+	pass(t, "Expression", Expression, "macro unless(cond, body) { quote { if $cond == false { $body } } }", MacroDefNode{"unless", []string{"cond", "body"}, block(QuoteNode{block(IfNode{binary(UnquoteNode{"cond", Pos{}}, "==", BoolLiteralNode{false}), block(UnquoteNode{"body", Pos{}}), nil, Pos{}}), Pos{}}), Pos{}})
+	pass(t, "Expression", Expression, "macro swap(a, b) { let t = quote { $a } quote { $a = $b $b = $t } }", MacroDefNode{"swap", []string{"a", "b"}, block(DeclarationNode{false, "t", "", QuoteNode{block(UnquoteNode{"a", Pos{}}), Pos{}}, Pos{}}, QuoteNode{block(AssignmentNode{"$a", UnquoteNode{"b", Pos{}}, Pos{}}, AssignmentNode{"$b", UnquoteNode{"t", Pos{}}, Pos{}}), Pos{}}), Pos{}})
+	pass(t, "Expression", Expression, "x = unless!(n > 0, print(n)) + twice!()", AssignmentNode{"x", binary(MacroCallNode{"unless", []Node{binary(id("n"), ">", integer(0)), call("print", id("n"))}, Pos{}}, "+", MacroCallNode{"twice", []Node{}, Pos{}}), Pos{}})
+	pass(t, "Expression", Expression, "quote { $x += 1 }", QuoteNode{block(CompoundAssignmentNode{UnquoteNode{"x", Pos{}}, "+", integer(1), Pos{}}), Pos{}})
+	fail(t, "Expression", Expression, "macro typed(x: int) { x }")
+	fail(t, "Expression", Expression, "$1")
 
 	pass(t, "Block", Block, `
 def main() {
@@ -96,5 +266,405 @@ def do_something(x : int, y:int) {
 	x = 100 + 200
 	y
 }
-`)
+`, block(FunctionDefNode{Name: "main", Block: block(call("do_something", id("x"), id("y")))}, FunctionDefNode{Name: "do_something", ArgList: []NameType{{Name: "x", Type: "int"}, {Name: "y", Type: "int"}}, Defaults: []Node{nil, nil}, Block: block(AssignmentNode{"x", binary(integer(100), "+", integer(200)), Pos{}}, id("y"))}))
+}
+
+func TestNumericLiteral(t *testing.T) {
+	integers := map[string]int64{
+		"0":                   0,
+		"42":                  42,
+		"1_000_000":           1000000,
+		"0xff":                255,
+		"0XFF_FF":             65535,
+		"0o17":                15,
+		"0b1010_1010":         170,
+		"9223372036854775807": 9223372036854775807,
+	}
+	for text, expected := range integers {
+		parser := NewParser(text)
+		token, _, err := MatchAll(testWrapper, Literal, EndOfFile)(parser, 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		node, ok := token.(IntegerLiteralNode)
+		if !ok || node.Value != expected {
+			t.Errorf("%s: expecting %d, got %v", text, expected, token)
+		}
+		if len(parser.Diagnostics) != 0 {
+			t.Errorf("%s: unexpected diagnostics %v", text, parser.Diagnostics)
+		}
+	}
+
+	floats := map[string]float64{
+		"1.5":       1.5,
+		".25":       0.25,
+		"1e3":       1000,
+		"2.5E-1":    0.25,
+		"1_000.5e1": 10005,
+	}
+	for text, expected := range floats {
+		parser := NewParser(text)
+		token, _, err := MatchAll(testWrapper, Literal, EndOfFile)(parser, 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		node, ok := token.(FloatLiteralNode)
+		if !ok || node.Value != expected {
+			t.Errorf("%s: expecting %v, got %v", text, expected, token)
+		}
+	}
+}
+
+func TestLiteralOverflow(t *testing.T) {
+	for _, text := range []string{"9223372036854775808", "0x1_0000_0000_0000_0000", "1e400"} {
+		parser := NewParser("x = \n  " + text)
+		_, _, err := MatchAll(testWrapper, Expression, EndOfFile)(parser, 0)
+		if err != nil {
+			t.Errorf("Overflow should not stop the parse: %s - %s", text, err)
+		}
+		if len(parser.Diagnostics) != 1 {
+			t.Errorf("%s: expecting 1 diagnostic, got %v", text, parser.Diagnostics)
+			continue
+		}
+		diag := parser.Diagnostics[0]
+		if diag.Line != 2 || diag.Column != 3 {
+			t.Errorf("%s: wrong position %s", text, diag.Error())
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"1 + 2 * 3":       "(1 + (2 * 3))",
+		"1 * 2 + 3":       "((1 * 2) + 3)",
+		"1 - 2 - 3":       "((1 - 2) - 3)",
+		"1 + 2 < 3 * 4":   "((1 + 2) < (3 * 4))",
+		"a * (b + c) / d": "((a * (b + c)) / d)",
+		"1 + 2 * 3 - 4":   "((1 + (2 * 3)) - 4)",
+		"2 ** 3 ** 2":     "(2 ** (3 ** 2))",
+		"2 * 3 ** 2":      "(2 * (3 ** 2))",
+		"2 ** 3 * 2":      "((2 ** 3) * 2)",
+		"a | b & c":       "(a | (b & c))",
+		"a ^ b << 2 + 1":  "((a ^ (b << 2)) + 1)",
+		"a % b * c":       "((a % b) * c)",
+		"a >> 1 == b | c": "((a >> 1) == (b | c))",
+		// ** binds tighter than the unary operators
+		"-2 ** 2":      "(-(2 ** 2))",
+		"-x ** 2 * 3":  "((-(x ** 2)) * 3)",
+		"-2 ** 3 ** 2": "(-(2 ** (3 ** 2)))",
+		"2 ** -1":      "(2 ** -1)",
+		"2 ** -x ** 2": "(2 ** (-(x ** 2)))",
+		"~a ** b + 1":  "((~(a ** b)) + 1)",
+		"-2 * 3":       "(-2 * 3)",
+	}
+	for text, expected := range cases {
+		token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser(text), 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if got := parenthesize(token.(Node)); got != expected {
+			t.Errorf("%s: expecting %s, got %s", text, expected, got)
+		}
+	}
+}
+
+func TestInfixDef(t *testing.T) {
+	cases := map[string]string{
+		"a <+> b":            "(a <+> b)",
+		"a <+> b <+> c":      "((a <+> b) <+> c)",
+		"a ++ b ++ c":        "(a ++ (b ++ c))",
+		"a + b <+> c * d":    "((a + b) <+> (c * d))",
+		"a <+> b ++ c == d":  "(((a <+> b) ++ c) == d)",
+		"a <+> b ** c":       "(a <+> (b ** c))",
+		"a <?> b <+> c ** 2": "((a <?> b) <+> (c ** 2))",
+		"a < -b":             "(a < (-b))",
+	}
+	for text, expected := range cases {
+		module, err := Parse("infixl 6 <+> = f\ninfixr 5 ++ = g\ninfixl 9 <?> = h.map\n" + text)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if got := parenthesize(module.Block.ExprList[3]); got != expected {
+			t.Errorf("%s: expecting %s, got %s", text, expected, got)
+		}
+	}
+
+	// a declared operator starting with ** isn't read as **
+	module, err := Parse("infixl 6 **> = f\n-2 **> b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parenthesize(module.Block.ExprList[1]); got != "(-2 **> b)" {
+		t.Errorf("-2 **> b: expecting (-2 **> b), got %s", got)
+	}
+
+	// the operators can only be used after their declaration, at the top
+	// level
+	fail(t, "Module", Module, "a <+> b infixl 6 <+> = f")
+	fail(t, "Block", Block, "infixl 6 <+> = f a <+> b")
+	fail(t, "Module", Module, "if true { infixl 6 <+> = f } a <+> b")
+
+	for text, expected := range map[string]string{
+		"infixl 6 + = f":                     "1:1: operator + can't be declared",
+		"infixl 6 += = f":                    "1:1: operator += can't be declared",
+		"infixr 10 <+> = f":                  "1:1: precedence of operator <+> must be between 0 and 9",
+		"infixl 6 <+> = f\ninfixr 5 <+> = g": "2:1: operator <+> is already declared",
+		"def f() { infixl 6 <+> = add 0 }":   "1:11: operator <+> can only be declared at the top level",
+		"if true {\n\tinfixr 6 <+> = add\n}": "2:2: operator <+> can only be declared at the top level",
+	} {
+		if _, err := Parse(text); err == nil || err.Error() != expected {
+			t.Errorf("%s: expecting %s, got %v", text, expected, err)
+		}
+	}
+}
+
+func parenthesize(node Node) string {
+	switch n := node.(type) {
+	case BinaryOperatorNode:
+		return "(" + parenthesize(n.Left) + " " + n.Operator + " " + parenthesize(n.Right) + ")"
+	case FunctionCallNode:
+		args := []string{}
+		for _, arg := range n.ParamList {
+			args = append(args, parenthesize(arg))
+		}
+		return n.Name + "(" + strings.Join(args, ", ") + ")"
+	case IntegerLiteralNode:
+		return fmt.Sprint(n.Value)
+	case IdentifierNode:
+		return n.Name
+	case UnaryOperatorNode:
+		return "(" + n.Operator + parenthesize(n.Operand) + ")"
+	}
+	return node.String()
+}
+
+func TestStatement(t *testing.T) {
+	cases := map[string]int{
+		"if x { 1 } -1":               2,
+		"for i in 0..3 {} -1":         2,
+		"def f() {} -f()":             2,
+		"x = if y { 1 } else { 2 }":   1,
+		"(if y { 1 } else { 2 }) - 1": 1,
+		"f; -1":                       2,
+		"f -1":                        1,
+		"f; (1 + 2) * 3":              2,
+		"x = 1; -1":                   2,
+		"x = 1;":                      1,
+		";x;; y;":                     2,
+		";":                           0,
+	}
+	for text, expected := range cases {
+		token, _, err := MatchAll(testWrapper, Block, EndOfFile)(NewParser(text), 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if got := len(token.(BlockNode).ExprList); got != expected {
+			t.Errorf("%s: expecting %d statements, got %d", text, expected, got)
+		}
+	}
+}
+
+func TestSemicolon(t *testing.T) {
+	module, err := Parse("let x = 1;\n-x; x\nmatch x { _ => {;} }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(module.Block.ExprList); got != 4 {
+		t.Errorf("Expecting 4 statements, got %d", got)
+	}
+	match := module.Block.ExprList[3].(MatchNode)
+	if body, ok := match.Arms[0].Body.(BlockNode); !ok || len(body.ExprList) != 0 {
+		t.Errorf("Expecting an empty block, got %v", match.Arms[0].Body)
+	}
+
+	// a ; can only end a statement
+	fail(t, "Module", Module, "1 + ; 2")
+	fail(t, "Module", Module, "f(1;)")
+}
+
+func TestNegativeLiteral(t *testing.T) {
+	literals := map[string]Token{
+		"-9223372036854775808": IntegerLiteralNode{Value: -9223372036854775808},
+		"-0x10":                IntegerLiteralNode{Value: -16},
+		"-1_000":               IntegerLiteralNode{Value: -1000},
+		"-2.5e-1":              FloatLiteralNode{Value: -0.25},
+	}
+	for text, expected := range literals {
+		parser := NewParser(text)
+		token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(parser, 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if token != expected {
+			t.Errorf("%s: expecting %v, got %v", text, expected, token)
+		}
+		if len(parser.Diagnostics) != 0 {
+			t.Errorf("%s: unexpected diagnostics %v", text, parser.Diagnostics)
+		}
+	}
+
+	// anything else is still a negation
+	for _, text := range []string{"-x", "-(2)", "--1"} {
+		parser := NewParser(text)
+		token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(parser, 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if _, ok := token.(UnaryOperatorNode); !ok {
+			t.Errorf("%s: expecting a negation, got %v", text, token)
+		}
+	}
+
+	parser := NewParser("-9223372036854775809")
+	MatchAll(testWrapper, Expression, EndOfFile)(parser, 0)
+	if len(parser.Diagnostics) != 1 {
+		t.Errorf("-9223372036854775809: expecting 1 diagnostic, got %v", parser.Diagnostics)
+	}
+}
+
+func TestCall(t *testing.T) {
+	token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser("make()(1)(2, 3)"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, ok := token.(CallNode)
+	if !ok || len(outer.ParamList) != 2 {
+		t.Fatalf("Expecting a call with 2 arguments: %v", token)
+	}
+	inner, ok := outer.Callee.(CallNode)
+	if !ok || len(inner.ParamList) != 1 {
+		t.Fatalf("Expecting a call with 1 argument: %v", outer.Callee)
+	}
+	if call, ok := inner.Callee.(FunctionCallNode); !ok || call.Name != "make" {
+		t.Errorf("Expecting a call to make: %v", inner.Callee)
+	}
+
+	token, _, err = MatchAll(testWrapper, Expression, EndOfFile)(NewParser("(fn() { f })()"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call, ok := token.(CallNode); !ok {
+		t.Errorf("Expecting a call: %v", token)
+	} else if _, ok := call.Callee.(LambdaNode); !ok {
+		t.Errorf("Expecting a lambda: %v", call.Callee)
+	}
+}
+
+func TestPostfix(t *testing.T) {
+	token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser("-xs[0][1:]"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unary, ok := token.(UnaryOperatorNode)
+	if !ok {
+		t.Fatalf("Unary minus should apply to the postfix expression: %v", token)
+	}
+	slice, ok := unary.Operand.(SliceNode)
+	if !ok || slice.High != nil {
+		t.Fatalf("Expecting a slice: %v", unary.Operand)
+	}
+	if _, ok := slice.Container.(IndexNode); !ok {
+		t.Fatalf("Expecting an index: %v", slice.Container)
+	}
+}
+
+// every nested expression must be parsed a bounded number of times, or the
+// time grows exponentially with the depth
+func TestNestingTime(t *testing.T) {
+	nest := func(open string, inner string, close string) string {
+		return strings.Repeat(open, 30) + inner + strings.Repeat(close, 30)
+	}
+	for _, text := range []string{
+		nest("f(", "1", ")"),
+		nest("f(1, ", "1", ")"),
+		nest("xs[", "0", "]"),
+		nest("xs[1:", "0", "]"),
+		nest("1 + (", "1", ")"),
+		nest("[1, ", "1", "]"),
+		nest("{1: ", "1", "}"),
+		nest("P{x: ", "1", "}"),
+		nest("x = [", "1", "]"),
+		nest("x += [", "1", "]"),
+		nest("p.x = (", "1", ")"),
+		nest("xs[0] *= (", "1", ")"),
+		nest("-(", "1", ")"),
+		nest("-2 ** (", "1", ")"),
+		nest("match 1 { _ => ", "1", " }"),
+	} {
+		start := time.Now()
+		_, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser(text), 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s took %v", text, elapsed)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser("a.b[0].c = 1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, ok := token.(FieldAssignmentNode)
+	if !ok || assignment.Field != "c" {
+		t.Fatalf("Expecting an assignment to c: %v", token)
+	}
+	index, ok := assignment.Object.(IndexNode)
+	if !ok {
+		t.Fatalf("Expecting an index: %v", assignment.Object)
+	}
+	if field, ok := index.Container.(FieldNode); !ok || field.Field != "b" {
+		t.Fatalf("Expecting the field b: %v", index.Container)
+	}
+}
+
+func TestMethodCall(t *testing.T) {
+	token, _, err := MatchAll(testWrapper, Expression, EndOfFile)(NewParser("xs[0].map(g).filter(h, n: 1)"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, ok := token.(MethodCallNode)
+	if !ok || filter.Method != "filter" || len(filter.ParamList) != 2 || filter.Names[1] != "n" {
+		t.Fatalf("Expecting a call to filter: %v", token)
+	}
+	mapCall, ok := filter.Receiver.(MethodCallNode)
+	if !ok || mapCall.Method != "map" || mapCall.Names != nil {
+		t.Fatalf("Expecting a call to map: %v", filter.Receiver)
+	}
+	if _, ok := mapCall.Receiver.(IndexNode); !ok {
+		t.Fatalf("Expecting an index: %v", mapCall.Receiver)
+	}
+}
+
+func TestStringLiteral(t *testing.T) {
+	cases := map[string]string{
+		`""`:          "",
+		`"abc"`:       "abc",
+		`"a\tb\"c\\"`: "a\tb\"c\\",
+		`"\u00e9"`:    "\u00e9",
+	}
+	for text, expected := range cases {
+		token, _, err := MatchAll(testWrapper, Literal, EndOfFile)(NewParser(text), 0)
+		if err != nil {
+			t.Errorf("Should not fail: %s - %s", text, err)
+			continue
+		}
+		if node, ok := token.(StringLiteralNode); !ok || node.Value != expected {
+			t.Errorf("%s: expecting %q, got %v", text, expected, token)
+		}
+	}
+
+	parser := NewParser(`"\q"`)
+	if _, _, err := StringLiteral(parser, 0); err != nil || len(parser.Diagnostics) != 1 {
+		t.Errorf("Expecting a diagnostic for the invalid escape: %v", parser.Diagnostics)
+	}
 }
@@ -0,0 +1,424 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+/* --- Gimmick source of AST nodes --- */
+
+const INDENT = "    "
+
+// Print renders node as Gimmick source, one statement per line and blocks
+// indented, with only the parentheses the precedence of the operators
+// requires. Parsing the source gives node back
+func Print(node Node) string {
+	switch n := node.(type) {
+	case ModuleNode:
+		lines := printStatements(n.Block.ExprList)
+		if len(lines) == 0 {
+			return ""
+		}
+		return strings.Join(lines, "\n") + "\n"
+	case BlockNode:
+		return printBlock(n)
+	}
+	return printStatement(node)
+}
+
+// the precedence of the binary operators sits between these
+const (
+	// let, return and the like, which take the rest of the expression
+	PRECEDENCE_OPEN = 0
+	// unary operators, whose operand takes the ** following it
+	PRECEDENCE_UNARY = 100
+	// the expressions ending with a block
+	PRECEDENCE_BLOCK = 101
+	// literals, names, calls and postfix expressions
+	PRECEDENCE_PRIMARY = 102
+)
+
+func precedence(node Node) int {
+	switch n := node.(type) {
+	case BinaryOperatorNode:
+		return BINARY_PRECEDENCE[n.Operator]
+	case IntegerLiteralNode:
+		// a postfix or ** following a negative number applies to the number
+		// without its minus
+		if n.Value < 0 {
+			return PRECEDENCE_UNARY
+		}
+	case FloatLiteralNode:
+		if math.Signbit(n.Value) {
+			return PRECEDENCE_UNARY
+		}
+	case DeclarationNode, ConstNode, AssignmentNode, IndexAssignmentNode,
+		FieldAssignmentNode, CompoundAssignmentNode, ReturnNode, ThrowNode,
+		RangeNode:
+		return PRECEDENCE_OPEN
+	case UnaryOperatorNode, BreakNode, ContinueNode, BlockNode, ImportNode,
+		TypeDefNode, EnumDefNode, InfixDefNode:
+		return PRECEDENCE_UNARY
+	case IfNode, WhileNode, ForNode, FunctionDefNode, LambdaNode, MatchNode,
+		TryNode, MacroDefNode, QuoteNode:
+		return PRECEDENCE_BLOCK
+	}
+	return PRECEDENCE_PRIMARY
+}
+
+// endsWithBlock is whether node is an expression ending with a block, which
+// ends a statement it starts
+func endsWithBlock(node Node) bool {
+	switch node.(type) {
+	case IfNode, WhileNode, ForNode, FunctionDefNode, LambdaNode, MatchNode,
+		TryNode, MacroDefNode, QuoteNode:
+		return true
+	}
+	return false
+}
+
+// printStatement is printNode, but a binary operation starting with an
+// expression ending with a block is bracketed
+func printStatement(node Node) string {
+	binary, ok := node.(BinaryOperatorNode)
+	for ok {
+		if endsWithBlock(binary.Left) {
+			return "(" + printNode(node) + ")"
+		}
+		binary, ok = binary.Left.(BinaryOperatorNode)
+	}
+	return printNode(node)
+}
+
+// printStatements prints the statements of a block, ending one with ; when
+// the next one would otherwise continue it
+func printStatements(exprs []Node) []string {
+	lines := []string{}
+	for i, expr := range exprs {
+		line := printStatement(expr)
+		if i > 0 && strings.ContainsAny(line[:1], "-+([{") {
+			lines[i-1] += ";"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// printOperand brackets node when it binds looser than min
+func printOperand(node Node, min int) string {
+	if precedence(node) < min {
+		return "(" + printNode(node) + ")"
+	}
+	return printNode(node)
+}
+
+func printBlock(block BlockNode) string {
+	if len(block.ExprList) == 0 {
+		return "{}"
+	}
+	buf := "{"
+	for _, line := range printStatements(block.ExprList) {
+		buf += "\n" + INDENT + strings.Replace(line, "\n", "\n"+INDENT, -1)
+	}
+	return buf + "\n}"
+}
+
+func printNodes(nodes []Node) string {
+	printed := []string{}
+	for _, node := range nodes {
+		printed = append(printed, printNode(node))
+	}
+	return strings.Join(printed, ", ")
+}
+
+// printArguments prints the arguments of a call, the named ones as
+// name: value
+func printArguments(paramList []Node, names []string) string {
+	printed := []string{}
+	for i, param := range paramList {
+		if i < len(names) && names[i] != "" {
+			printed = append(printed, names[i]+": "+printNode(param))
+		} else {
+			printed = append(printed, printNode(param))
+		}
+	}
+	return strings.Join(printed, ", ")
+}
+
+func printNameTypes(nameTypes []NameType) string {
+	printed := []string{}
+	for _, nameType := range nameTypes {
+		if nameType.Type == "" {
+			printed = append(printed, nameType.Name)
+		} else {
+			printed = append(printed, nameType.Name+": "+nameType.Type)
+		}
+	}
+	return strings.Join(printed, ", ")
+}
+
+func printType(typeName string) string {
+	if typeName == "" {
+		return ""
+	}
+	return ": " + typeName
+}
+
+func printFloat(value float64) string {
+	literal := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(literal, ".e") {
+		literal += ".0"
+	}
+	return literal
+}
+
+func printDef(node FunctionDefNode) string {
+	if node.Operator != "" {
+		left, right := node.ArgList[0], node.ArgList[1]
+		def := fmt.Sprintf("def (%s: %s) %s (%s: %s)%s %s", left.Name, left.Type, node.Operator, right.Name, right.Type, printType(node.ReturnType), printBlock(node.Block))
+		if node.Const {
+			return "const " + def
+		}
+		return def
+	}
+	args := []string{}
+	for i, arg := range node.ArgList {
+		printed := arg.Name
+		if node.Variadic && i == len(node.ArgList)-1 {
+			printed += ": ..." + arg.Type
+		} else {
+			printed += printType(arg.Type)
+		}
+		if i < len(node.Defaults) && node.Defaults[i] != nil {
+			printed += " = " + printNode(node.Defaults[i])
+		}
+		args = append(args, printed)
+	}
+	def := fmt.Sprintf("def %s(%s)%s %s", node.Name, strings.Join(args, ", "), printType(node.ReturnType), printBlock(node.Block))
+	if node.Const {
+		return "const " + def
+	}
+	return def
+}
+
+func printPattern(pattern Pattern) string {
+	switch p := pattern.(type) {
+	case WildcardPattern:
+		return "_"
+	case BindingPattern:
+		return p.Name
+	case LiteralPattern:
+		return printNode(p.Value)
+	case AlternativePattern:
+		printed := []string{}
+		for _, alternative := range p.Alternatives {
+			printed = append(printed, printPattern(alternative))
+		}
+		return strings.Join(printed, " | ")
+	case StructPattern:
+		printed := []string{}
+		for i, field := range p.Fields {
+			if binding, ok := p.Patterns[i].(BindingPattern); ok && binding.Name == field {
+				printed = append(printed, field)
+			} else {
+				printed = append(printed, field+": "+printPattern(p.Patterns[i]))
+			}
+		}
+		return fmt.Sprintf("%s{%s}", p.Type, strings.Join(printed, ", "))
+	case VariantPattern:
+		printed := []string{}
+		for _, field := range p.Patterns {
+			printed = append(printed, printPattern(field))
+		}
+		return fmt.Sprintf("%s(%s)", p.Variant, strings.Join(printed, ", "))
+	}
+	panic(fmt.Sprintf("Unknown pattern %v", pattern))
+}
+
+func printNode(node Node) string {
+	switch n := node.(type) {
+	case IntegerLiteralNode:
+		return strconv.FormatInt(n.Value, 10)
+	case FloatLiteralNode:
+		return printFloat(n.Value)
+	case StringLiteralNode:
+		return strconv.Quote(n.Value)
+	case BoolLiteralNode:
+		return strconv.FormatBool(n.Value)
+	case IdentifierNode:
+		return n.Name
+	case FunctionDefNode:
+		return printDef(n)
+	case LambdaNode:
+		return fmt.Sprintf("fn(%s) %s", printNameTypes(n.ArgList), printBlock(n.Block))
+	case FunctionCallNode:
+		return fmt.Sprintf("%s(%s)", n.Name, printArguments(n.ParamList, n.Names))
+	case CallNode:
+		// name() would call the function name
+		callee := printOperand(n.Callee, PRECEDENCE_PRIMARY)
+		switch n.Callee.(type) {
+		case IdentifierNode, FieldNode:
+			callee = "(" + callee + ")"
+		}
+		return fmt.Sprintf("%s(%s)", callee, printNodes(n.ParamList))
+	case MethodCallNode:
+		// name.method() would call a function of a module or a type
+		receiver := printOperand(n.Receiver, PRECEDENCE_PRIMARY)
+		if _, ok := n.Receiver.(IdentifierNode); ok {
+			receiver = "(" + receiver + ")"
+		}
+		return fmt.Sprintf("%s.%s(%s)", receiver, n.Method, printArguments(n.ParamList, n.Names))
+	case BinaryOperatorNode:
+		p, ok := BINARY_PRECEDENCE[n.Operator]
+		left, right := p, p+1
+		if !ok {
+			// declared with infixl or infixr, only the parser knows how it
+			// binds
+			left, right = PRECEDENCE_UNARY, PRECEDENCE_UNARY
+		} else if RIGHT_ASSOCIATIVE[n.Operator] {
+			left, right = p+1, p
+		}
+		if n.Operator == "**" {
+			// -x ** y is -(x ** y)
+			left = PRECEDENCE_BLOCK
+		}
+		return fmt.Sprintf("%s %s %s", printOperand(n.Left, left), n.Operator, printOperand(n.Right, right))
+	case ListLiteralNode:
+		return "[" + printNodes(n.Elements) + "]"
+	case MapLiteralNode:
+		entries := []string{}
+		for i := range n.Keys {
+			entries = append(entries, printNode(n.Keys[i])+": "+printNode(n.Values[i]))
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	case IndexNode:
+		return fmt.Sprintf("%s[%s]", printOperand(n.Container, PRECEDENCE_PRIMARY), printNode(n.Index))
+	case SliceNode:
+		low, high := "", ""
+		if n.Low != nil {
+			low = printNode(n.Low)
+		}
+		if n.High != nil {
+			high = printNode(n.High)
+		}
+		return fmt.Sprintf("%s[%s:%s]", printOperand(n.Container, PRECEDENCE_PRIMARY), low, high)
+	case IndexAssignmentNode:
+		return fmt.Sprintf("%s[%s] = %s", printOperand(n.Container, PRECEDENCE_PRIMARY), printNode(n.Index), printNode(n.Expr))
+	case ImportNode:
+		if n.Alias != "" {
+			return fmt.Sprintf("import %s as %s", strconv.Quote(n.Path), n.Alias)
+		}
+		return "import " + strconv.Quote(n.Path)
+	case InfixDefNode:
+		keyword := "infixl"
+		if n.Right {
+			keyword = "infixr"
+		}
+		return fmt.Sprintf("%s %d %s = %s", keyword, n.Precedence, n.Operator, n.Function)
+	case TypeDefNode:
+		return fmt.Sprintf("type %s { %s }", n.Name, printNameTypes(n.Fields))
+	case EnumDefNode:
+		variants := []string{}
+		for _, variant := range n.Variants {
+			if len(variant.Fields) == 0 {
+				variants = append(variants, variant.Name)
+			} else {
+				variants = append(variants, fmt.Sprintf("%s(%s)", variant.Name, printNameTypes(variant.Fields)))
+			}
+		}
+		return fmt.Sprintf("enum %s { %s }", n.Name, strings.Join(variants, ", "))
+	case StructLiteralNode:
+		fields := []string{}
+		for i := range n.Names {
+			fields = append(fields, n.Names[i]+": "+printNode(n.Values[i]))
+		}
+		return fmt.Sprintf("%s{%s}", n.Type, strings.Join(fields, ", "))
+	case FieldNode:
+		return fmt.Sprintf("%s.%s", printOperand(n.Object, PRECEDENCE_PRIMARY), n.Field)
+	case FieldAssignmentNode:
+		return fmt.Sprintf("%s.%s = %s", printOperand(n.Object, PRECEDENCE_PRIMARY), n.Field, printNode(n.Expr))
+	case CompoundAssignmentNode:
+		return fmt.Sprintf("%s %s= %s", printNode(n.Target), n.Operator, printNode(n.Expr))
+	case UnaryOperatorNode:
+		operand := printOperand(n.Operand, BINARY_PRECEDENCE["**"])
+		switch n.Operand.(type) {
+		case IntegerLiteralNode, FloatLiteralNode:
+			// -1 is a negative number
+			if n.Operator == "-" && precedence(n.Operand) == PRECEDENCE_PRIMARY {
+				operand = "(" + operand + ")"
+			}
+		}
+		return n.Operator + operand
+	case DeclarationNode:
+		keyword := "let"
+		if n.Mutable {
+			keyword = "var"
+		}
+		return fmt.Sprintf("%s %s%s = %s", keyword, n.Name, printType(n.Type), printNode(n.Expr))
+	case ConstNode:
+		return fmt.Sprintf("const %s%s = %s", n.Name, printType(n.Type), printNode(n.Expr))
+	case AssignmentNode:
+		return fmt.Sprintf("%s = %s", n.Dest, printNode(n.Expr))
+	case IfNode:
+		printed := fmt.Sprintf("if %s %s", printNode(n.Cond), printBlock(n.Then))
+		if n.Else != nil {
+			printed += " else " + printNode(n.Else)
+		}
+		return printed
+	case WhileNode:
+		return fmt.Sprintf("while %s %s", printNode(n.Cond), printBlock(n.Block))
+	case ForNode:
+		return fmt.Sprintf("for %s in %s %s", n.Var, printNode(n.Iterable), printBlock(n.Block))
+	case RangeNode:
+		return fmt.Sprintf("%s..%s", printNode(n.From), printNode(n.To))
+	case MatchNode:
+		printed := fmt.Sprintf("match %s {", printNode(n.Value))
+		for i, arm := range n.Arms {
+			body := printNode(arm.Body)
+			if block, ok := arm.Body.(BlockNode); ok && len(block.ExprList) == 0 {
+				// {} would be an empty map
+				body = "{;}"
+			}
+			body = strings.Replace(body, "\n", "\n"+INDENT, -1)
+			printed += fmt.Sprintf("\n%s%s => %s", INDENT, printPattern(arm.Pattern), body)
+			if i < len(n.Arms)-1 {
+				printed += ","
+			}
+		}
+		return printed + "\n}"
+	case TryNode:
+		printed := "try " + printBlock(n.Try)
+		if n.Catch != nil {
+			printed += fmt.Sprintf(" catch %s %s", n.CatchVar, printNode(n.Catch))
+		}
+		if n.Finally != nil {
+			printed += " finally " + printNode(n.Finally)
+		}
+		return printed
+	case ThrowNode:
+		return "throw " + printNode(n.Expr)
+	case BreakNode:
+		return "break"
+	case ContinueNode:
+		return "continue"
+	case ReturnNode:
+		return "return " + printNode(n.Expr)
+	case MacroDefNode:
+		return fmt.Sprintf("macro %s(%s) %s", n.Name, strings.Join(n.Params, ", "), printBlock(n.Block))
+	case MacroCallNode:
+		return fmt.Sprintf("%s!(%s)", n.Name, printNodes(n.Args))
+	case QuoteNode:
+		return "quote " + printBlock(n.Block)
+	case UnquoteNode:
+		return "$" + n.Name
+	case BlockNode:
+		return printBlock(n)
+	case ModuleNode:
+		return Print(n)
+	}
+	panic(fmt.Sprintf("Unknown node %v", node))
+}
@@ -0,0 +1,427 @@
+package parser
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+func TestPrint(t *testing.T) {
+	a, b, c := IdentifierNode{Name: "a"}, IdentifierNode{Name: "b"}, IdentifierNode{Name: "c"}
+	for _, test := range []struct {
+		node     Node
+		expected string
+	}{
+		{
+			BinaryOperatorNode{Left: BinaryOperatorNode{Left: a, Operator: "+", Right: b}, Operator: "*", Right: c},
+			"(a + b) * c",
+		},
+		{
+			BinaryOperatorNode{Left: a, Operator: "-", Right: BinaryOperatorNode{Left: b, Operator: "-", Right: c}},
+			"a - (b - c)",
+		},
+		{
+			BinaryOperatorNode{Left: BinaryOperatorNode{Left: a, Operator: "**", Right: b}, Operator: "**", Right: c},
+			"(a ** b) ** c",
+		},
+		{
+			UnaryOperatorNode{Operator: "-", Operand: BinaryOperatorNode{Left: a, Operator: "*", Right: b}},
+			"-(a * b)",
+		},
+		{
+			// ** binds tighter than a unary operator
+			UnaryOperatorNode{Operator: "-", Operand: BinaryOperatorNode{Left: IntegerLiteralNode{Value: 2}, Operator: "**", Right: b}},
+			"-2 ** b",
+		},
+		{
+			BinaryOperatorNode{Left: UnaryOperatorNode{Operator: "-", Operand: a}, Operator: "**", Right: b},
+			"(-a) ** b",
+		},
+		{
+			BinaryOperatorNode{Left: IntegerLiteralNode{Value: -2}, Operator: "**", Right: IntegerLiteralNode{Value: -2}},
+			"(-2) ** -2",
+		},
+		{
+			// -1 would be a negative number
+			UnaryOperatorNode{Operator: "-", Operand: IntegerLiteralNode{Value: 1}},
+			"-(1)",
+		},
+		{
+			UnaryOperatorNode{Operator: "-", Operand: FloatLiteralNode{Value: -0.5}},
+			"--0.5",
+		},
+		{
+			FieldNode{Object: IntegerLiteralNode{Value: -5}, Field: "x"},
+			"(-5).x",
+		},
+		{
+			BinaryOperatorNode{Left: FloatLiteralNode{Value: 1}, Operator: "-", Right: IntegerLiteralNode{Value: math.MinInt64}},
+			"1.0 - -9223372036854775808",
+		},
+		{
+			CallNode{Callee: CallNode{Callee: a, ParamList: []Node{b}}, ParamList: []Node{c}},
+			"(a)(b)(c)",
+		},
+		{
+			BinaryOperatorNode{Left: BinaryOperatorNode{Left: a, Operator: "<+>", Right: b}, Operator: "+", Right: UnaryOperatorNode{Operator: "-", Operand: c}},
+			"(a <+> b) + -c",
+		},
+		{
+			// the statements which would continue the previous one are
+			// separated
+			ModuleNode{Block: BlockNode{ExprList: []Node{
+				IdentifierNode{Name: "f"},
+				BinaryOperatorNode{
+					Left:     BinaryOperatorNode{Left: IntegerLiteralNode{Value: 1}, Operator: "+", Right: IntegerLiteralNode{Value: 2}},
+					Operator: "*",
+					Right:    IntegerLiteralNode{Value: 3},
+				},
+				IfNode{Cond: a, Then: BlockNode{ExprList: []Node{b, UnaryOperatorNode{Operator: "-", Operand: b}}}},
+				ListLiteralNode{Elements: []Node{IntegerLiteralNode{Value: 1}}},
+			}}},
+			"f;\n(1 + 2) * 3\nif a {\n    b;\n    -b\n};\n[1]\n",
+		},
+		{
+			MatchNode{Value: a, Arms: []MatchArm{{Pattern: WildcardPattern{}, Body: BlockNode{}}}},
+			"match a {\n    _ => {;}\n}",
+		},
+		{
+			MacroDefNode{Name: "m", Params: []string{"x"}, Block: BlockNode{ExprList: []Node{
+				QuoteNode{Block: BlockNode{ExprList: []Node{
+					AssignmentNode{Dest: "$x", Expr: MacroCallNode{Name: "n", Args: []Node{UnquoteNode{Name: "x"}}}},
+				}}},
+			}}},
+			"macro m(x) {\n    quote {\n        $x = n!($x)\n    }\n}",
+		},
+		{
+			FunctionDefNode{
+				Name:       "f",
+				ArgList:    []NameType{{Name: "x", Type: "int"}, {Name: "rest", Type: "string"}},
+				Defaults:   []Node{IntegerLiteralNode{Value: 1}, nil},
+				Variadic:   true,
+				ReturnType: "int",
+				Block:      BlockNode{ExprList: []Node{IfNode{Cond: a, Then: BlockNode{ExprList: []Node{a}}}}},
+			},
+			"def f(x: int = 1, rest: ...string): int {\n    if a {\n        a\n    }\n}",
+		},
+	} {
+		if source := Print(test.node); source != test.expected {
+			t.Errorf("Expecting:\n%s\ngot:\n%s", test.expected, source)
+		}
+	}
+}
+
+// TestPrintRoundTrip parses back the source of random modules
+func TestPrintRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		module := (&generator{Rand: random}).module()
+		source := Print(module)
+		parsed, err := Parse(source)
+		if err != nil {
+			t.Fatalf("Should parse:\n%s\n%s", source, err)
+		}
+		if d := Diff(parsed, module); d != "" {
+			t.Fatalf("Should parse back to the same tree:\n%s\n%s", source, d)
+		}
+	}
+}
+
+// generator builds random trees of the nodes the parser can produce
+type generator struct {
+	*rand.Rand
+	// the binary operators, including the ones the module declares
+	operators []string
+}
+
+var generatedNames = []string{"a", "b", "x", "y", "total", "_tmp"}
+var generatedTypes = []string{"int", "string", "P", "Shape"}
+var generatedStrings = []string{"", "a", "hello world", "quote \" and \\", "tab\tnew\nline", "é", "\x00"}
+var generatedFloats = []float64{0, 0.5, 1, 2.5e10, 1e-7, 123.456, math.MaxFloat64}
+
+// the operators a module may declare, with infixl or infixr
+var generatedInfixDefs = []InfixDefNode{
+	{Right: false, Precedence: 6, Operator: "<+>", Function: "add"},
+	{Right: true, Precedence: 5, Operator: "++", Function: "concat"},
+	{Right: false, Precedence: 9, Operator: "<?>", Function: "x.get"},
+}
+
+func (g *generator) pick(values []string) string {
+	return values[g.Intn(len(values))]
+}
+
+func (g *generator) module() ModuleNode {
+	g.operators = []string{}
+	for operator := range BINARY_PRECEDENCE {
+		g.operators = append(g.operators, operator)
+	}
+	// a fixed order, for the trees to only depend on the seed
+	sort.Strings(g.operators)
+
+	// the operators are declared at the top level, before they're used
+	exprs := []Node{}
+	for _, def := range generatedInfixDefs {
+		if g.Intn(2) == 0 {
+			exprs = append(exprs, def)
+			g.operators = append(g.operators, def.Operator)
+		}
+	}
+	return ModuleNode{Block: BlockNode{ExprList: append(exprs, g.block(3).ExprList...)}}
+}
+
+func (g *generator) block(depth int) BlockNode {
+	exprs := []Node{}
+	for i := g.Intn(4); i > 0; i-- {
+		exprs = append(exprs, g.statement(depth))
+	}
+	return BlockNode{ExprList: exprs}
+}
+
+func (g *generator) statement(depth int) Node {
+	switch g.Intn(12) {
+	case 0:
+		return TypeDefNode{Name: "P", Fields: []NameType{{Name: "x", Type: "int"}, {Name: "y"}}}
+	case 1:
+		return EnumDefNode{Name: "Shape", Variants: []Variant{
+			{Name: "Circle", Fields: []NameType{{Name: "r", Type: "float"}}},
+			{Name: "Empty"},
+		}}
+	case 2:
+		return ImportNode{Path: "lib/h.gm", Alias: g.pick([]string{"", "h"})}
+	}
+	return g.expr(depth)
+}
+
+func (g *generator) names(n int) []NameType {
+	args := []NameType{}
+	for i := 0; i < n; i++ {
+		nameType := NameType{Name: generatedNames[i]}
+		if g.Intn(2) == 0 {
+			nameType.Type = g.pick(generatedTypes)
+		}
+		args = append(args, nameType)
+	}
+	return args
+}
+
+func (g *generator) exprs(depth int) []Node {
+	exprs := []Node{}
+	for i := g.Intn(3); i > 0; i-- {
+		exprs = append(exprs, g.expr(depth))
+	}
+	return exprs
+}
+
+// the names of call arguments, nil or one for each, the named ones last
+func (g *generator) argumentNames(n int) []string {
+	if n == 0 || g.Intn(2) == 0 {
+		return nil
+	}
+	names := make([]string, n)
+	for i := g.Intn(n); i < n; i++ {
+		names[i] = generatedNames[i]
+	}
+	return names
+}
+
+func (g *generator) expr(depth int) Node {
+	if depth <= 0 {
+		return g.leaf()
+	}
+	depth--
+	switch g.Intn(38) {
+	case 0, 1, 2, 3, 4:
+		return BinaryOperatorNode{Left: g.expr(depth), Operator: g.pick(g.operators), Right: g.expr(depth)}
+	case 5:
+		return UnaryOperatorNode{Operator: g.pick([]string{"-", "+", "~"}), Operand: g.expr(depth)}
+	case 6:
+		args := g.exprs(depth)
+		return FunctionCallNode{Name: g.pick(generatedNames), ParamList: args, Names: g.argumentNames(len(args))}
+	case 7:
+		args := g.exprs(depth)
+		return MethodCallNode{Receiver: g.expr(depth), Method: g.pick(generatedNames), ParamList: args, Names: g.argumentNames(len(args))}
+	case 8:
+		return ListLiteralNode{Elements: g.exprs(depth)}
+	case 9:
+		keys := g.exprs(depth)
+		values := []Node{}
+		for range keys {
+			values = append(values, g.expr(depth))
+		}
+		return MapLiteralNode{Keys: keys, Values: values}
+	case 10:
+		return IndexNode{Container: g.expr(depth), Index: g.expr(depth)}
+	case 11:
+		node := SliceNode{Container: g.expr(depth)}
+		if g.Intn(2) == 0 {
+			node.Low = g.expr(depth)
+		}
+		if g.Intn(2) == 0 {
+			node.High = g.expr(depth)
+		}
+		return node
+	case 12:
+		return IndexAssignmentNode{Container: g.expr(depth), Index: g.expr(depth), Expr: g.expr(depth)}
+	case 13:
+		return StructLiteralNode{Type: "P", Names: []string{"x", "y"}, Values: []Node{g.expr(depth), g.expr(depth)}}
+	case 14:
+		return FieldNode{Object: g.expr(depth), Field: g.pick(generatedNames)}
+	case 15:
+		return FieldAssignmentNode{Object: g.expr(depth), Field: g.pick(generatedNames), Expr: g.expr(depth)}
+	case 16:
+		var target Node
+		switch g.Intn(4) {
+		case 0:
+			target = IndexNode{Container: g.expr(depth), Index: g.expr(depth)}
+		case 1:
+			target = FieldNode{Object: g.expr(depth), Field: g.pick(generatedNames)}
+		case 2:
+			target = UnquoteNode{Name: g.pick(generatedNames)}
+		default:
+			target = IdentifierNode{Name: g.pick(generatedNames)}
+		}
+		return CompoundAssignmentNode{Target: target, Operator: g.pick([]string{"+", "-", "*", "/", "%"}), Expr: g.expr(depth)}
+	case 17:
+		return DeclarationNode{Mutable: g.Intn(2) == 0, Name: g.pick(generatedNames), Type: g.pick(append(generatedTypes, "")), Expr: g.expr(depth)}
+	case 18:
+		return ConstNode{Name: g.pick(generatedNames), Type: g.pick(append(generatedTypes, "")), Expr: g.expr(depth)}
+	case 19:
+		dest := g.pick(generatedNames)
+		if g.Intn(4) == 0 {
+			dest = "$" + dest
+		}
+		return AssignmentNode{Dest: dest, Expr: g.expr(depth)}
+	case 20:
+		node := IfNode{Cond: g.expr(depth), Then: g.block(depth)}
+		switch g.Intn(3) {
+		case 0:
+			node.Else = g.block(depth)
+		case 1:
+			node.Else = IfNode{Cond: g.expr(depth), Then: g.block(depth)}
+		}
+		return node
+	case 21:
+		return WhileNode{Cond: g.expr(depth), Block: g.block(depth)}
+	case 22:
+		var iterable Node = g.expr(depth)
+		if g.Intn(2) == 0 {
+			iterable = RangeNode{From: g.expr(depth), To: g.expr(depth)}
+		}
+		return ForNode{Var: g.pick(generatedNames), Iterable: iterable, Block: g.block(depth)}
+	case 23:
+		n := g.Intn(3)
+		def := FunctionDefNode{
+			Name:       g.pick(generatedNames),
+			Const:      g.Intn(4) == 0,
+			ArgList:    g.names(n),
+			Defaults:   make([]Node, n),
+			ReturnType: g.pick(append(generatedTypes, "")),
+			Block:      g.block(depth),
+		}
+		for i := range def.Defaults {
+			if g.Intn(3) == 0 {
+				def.Defaults[i] = g.expr(depth)
+			}
+		}
+		if n > 0 && g.Intn(3) == 0 {
+			def.Variadic = true
+			def.Defaults[n-1] = nil
+			def.ArgList[n-1].Type = "int"
+		}
+		return def
+	case 24:
+		return LambdaNode{ArgList: g.names(g.Intn(3)), Block: g.block(depth)}
+	case 25:
+		arms := []MatchArm{}
+		for i := g.Intn(3); i > 0; i-- {
+			var body Node = g.expr(depth)
+			if g.Intn(2) == 0 {
+				body = g.block(depth)
+			}
+			arms = append(arms, MatchArm{Pattern: g.pattern(2), Body: body})
+		}
+		return MatchNode{Value: g.expr(depth), Arms: arms}
+	case 26:
+		node := TryNode{Try: g.block(depth)}
+		if g.Intn(2) == 0 {
+			node.CatchVar, node.Catch = g.pick(generatedNames), g.block(depth)
+		}
+		if node.Catch == nil || g.Intn(2) == 0 {
+			node.Finally = g.block(depth)
+		}
+		return node
+	case 27:
+		return ThrowNode{Expr: g.expr(depth)}
+	case 28:
+		return ReturnNode{Expr: g.expr(depth)}
+	case 29:
+		if g.Intn(2) == 0 {
+			return BreakNode{}
+		}
+		return ContinueNode{}
+	case 30:
+		return CallNode{Callee: g.expr(depth), ParamList: g.exprs(depth)}
+	case 31:
+		params := []string{}
+		for i := g.Intn(3); i > 0; i-- {
+			params = append(params, g.pick(generatedNames))
+		}
+		return MacroDefNode{Name: g.pick(generatedNames), Params: params, Block: g.block(depth)}
+	case 32:
+		return MacroCallNode{Name: g.pick(generatedNames), Args: g.exprs(depth)}
+	case 33:
+		return QuoteNode{Block: g.block(depth)}
+	}
+	return g.leaf()
+}
+
+func (g *generator) leaf() Node {
+	switch g.Intn(8) {
+	case 0:
+		return IdentifierNode{Name: g.pick(generatedNames)}
+	case 1:
+		return UnquoteNode{Name: g.pick(generatedNames)}
+	}
+	return g.literal()
+}
+
+func (g *generator) literal() Node {
+	switch g.Intn(6) {
+	case 0:
+		return IntegerLiteralNode{Value: g.Int63n(math.MaxInt64)}
+	case 1:
+		// down to math.MinInt64
+		return IntegerLiteralNode{Value: -g.Int63n(math.MaxInt64) - 1}
+	case 2:
+		return FloatLiteralNode{Value: generatedFloats[g.Intn(len(generatedFloats))]}
+	case 3:
+		return FloatLiteralNode{Value: -generatedFloats[g.Intn(len(generatedFloats))]}
+	case 4:
+		return StringLiteralNode{Value: g.pick(generatedStrings)}
+	}
+	return BoolLiteralNode{Value: g.Intn(2) == 0}
+}
+
+func (g *generator) pattern(depth int) Pattern {
+	if depth > 0 {
+		depth--
+		switch g.Intn(4) {
+		case 0:
+			return AlternativePattern{Alternatives: []Pattern{g.pattern(0), g.pattern(0)}}
+		case 1:
+			return StructPattern{Type: "P", Fields: []string{"x", "y"}, Patterns: []Pattern{g.pattern(depth), BindingPattern{Name: "y"}}}
+		case 2:
+			return VariantPattern{Variant: "Circle", Patterns: []Pattern{g.pattern(depth)}}
+		}
+	}
+	switch g.Intn(4) {
+	case 0:
+		return WildcardPattern{}
+	case 1:
+		return LiteralPattern{Value: g.literal()}
+	}
+	return BindingPattern{Name: g.pick(generatedNames)}
+}
@@ -2,6 +2,7 @@ package parser
 
 import . "github.com/trungaczne/gimmick/vm"
 import "fmt"
+import "strings"
 
 func NodeArrString(nodes []Node) string {
 	buf := "["
@@ -56,33 +57,308 @@ func (node FloatLiteralNode) String() string {
 	return fmt.Sprintf("{Float:%v}", node.Value)
 }
 
-func (node ParamListToken) String() string {
+func (node StringLiteralNode) String() string {
+	return fmt.Sprintf("{String:%q}", node.Value)
+}
+
+func (node BoolLiteralNode) String() string {
+	return fmt.Sprintf("{Bool:%v}", node.Value)
+}
+
+func (token ParamListToken) String() string {
 	buf := ""
-	for i, node := range node.ParamList {
+	for i, node := range token.ParamList {
 		if i > 0 {
 			buf += ", "
 		}
+		if i < len(token.Names) && token.Names[i] != "" {
+			buf += token.Names[i] + "="
+		}
 		buf += node.String()
 	}
 	return fmt.Sprintf("{ParamList:%s}", buf)
 }
 
+// the arguments of a def, like NameTypeArrString along with the defaults
+// and variadic
+func defArgsString(node FunctionDefNode) string {
+	buf := "["
+	for i, nametype := range node.ArgList {
+		buf += nametype.Name + ":"
+		if node.Variadic && i == len(node.ArgList)-1 {
+			buf += "..."
+		}
+		buf += nametype.Type
+		if i < len(node.Defaults) && node.Defaults[i] != nil {
+			buf += "=" + node.Defaults[i].String()
+		}
+		if i != len(node.ArgList)-1 {
+			buf += ","
+		}
+	}
+	return buf + "]"
+}
+
 func (node FunctionDefNode) String() string {
-	return fmt.Sprintf("{FunctionDef:%s:%s:%s}", node.Name, NameTypeArrString(node.ArgList), node.Block.String())
+	kind := "FunctionDef"
+	if node.Const {
+		kind = "ConstFunctionDef"
+	}
+	if node.ReturnType != "" {
+		return fmt.Sprintf("{%s:%s:%s:%s:%s}", kind, node.Name, defArgsString(node), node.ReturnType, node.Block.String())
+	}
+	return fmt.Sprintf("{%s:%s:%s:%s}", kind, node.Name, defArgsString(node), node.Block.String())
+}
+
+func (node LambdaNode) String() string {
+	return fmt.Sprintf("{Lambda:%s:%s}", NameTypeArrString(node.ArgList), node.Block.String())
+}
+
+// argumentsString is the repr of the arguments of a call, the named ones
+// being name=value
+func argumentsString(paramList []Node, names []string) string {
+	if names == nil {
+		return fmt.Sprint(paramList)
+	}
+	params := []string{}
+	for i, param := range paramList {
+		if names[i] != "" {
+			params = append(params, names[i]+"="+param.String())
+		} else {
+			params = append(params, param.String())
+		}
+	}
+	return "[" + strings.Join(params, " ") + "]"
 }
 
 func (node FunctionCallNode) String() string {
-	return fmt.Sprintf("{FunctionCall:%s:%s}", node.Name, node.ParamList)
+	return fmt.Sprintf("{FunctionCall:%s:%s}", node.Name, argumentsString(node.ParamList, node.Names))
+}
+
+func (node MethodCallNode) String() string {
+	return fmt.Sprintf("{MethodCall:%s:%s:%s}", node.Receiver.String(), node.Method, argumentsString(node.ParamList, node.Names))
+}
+
+func (node CallNode) String() string {
+	return fmt.Sprintf("{Call:%s:%s}", node.Callee.String(), node.ParamList)
 }
 
 func (node BinaryOperatorNode) String() string {
 	return fmt.Sprintf("{BinaryOperatorNode:%s:%s:%s}", node.Left.String(), node.Operator, node.Right.String())
 }
 
+func (node ListLiteralNode) String() string {
+	return fmt.Sprintf("{List:%s}", NodeArrString(node.Elements))
+}
+
+func (node MapLiteralNode) String() string {
+	buf := ""
+	for i := range node.Keys {
+		if i > 0 {
+			buf += ","
+		}
+		buf += node.Keys[i].String() + ":" + node.Values[i].String()
+	}
+	return fmt.Sprintf("{Map:[%s]}", buf)
+}
+
+func (node IndexNode) String() string {
+	return fmt.Sprintf("{IndexNode:%s:%s}", node.Container.String(), node.Index.String())
+}
+
+// optionalString is for the nil members of nodes
+func optionalString(node Node) string {
+	if node == nil {
+		return ""
+	}
+	return node.String()
+}
+
+func (node SliceNode) String() string {
+	return fmt.Sprintf("{SliceNode:%s:%s:%s}", node.Container.String(), optionalString(node.Low), optionalString(node.High))
+}
+
+func (node IndexAssignmentNode) String() string {
+	return fmt.Sprintf("{IndexAssignmentNode:%s:%s:%s}", node.Container.String(), node.Index.String(), node.Expr.String())
+}
+
+func (node ImportNode) String() string {
+	return fmt.Sprintf("{Import:%q:%s}", node.Path, node.Alias)
+}
+
+func (node InfixDefNode) String() string {
+	return fmt.Sprintf("{InfixDef:%t:%d:%s:%s}", node.Right, node.Precedence, node.Operator, node.Function)
+}
+
+func (node TypeDefNode) String() string {
+	return fmt.Sprintf("{TypeDef:%s:%s}", node.Name, NameTypeArrString(node.Fields))
+}
+
+func (node EnumDefNode) String() string {
+	buf := ""
+	for i, variant := range node.Variants {
+		if i > 0 {
+			buf += ","
+		}
+		buf += variant.Name + NameTypeArrString(variant.Fields)
+	}
+	return fmt.Sprintf("{EnumDef:%s:[%s]}", node.Name, buf)
+}
+
+func (node StructLiteralNode) String() string {
+	buf := ""
+	for i := range node.Names {
+		if i > 0 {
+			buf += ","
+		}
+		buf += node.Names[i] + ":" + node.Values[i].String()
+	}
+	return fmt.Sprintf("{Struct:%s:[%s]}", node.Type, buf)
+}
+
+func (node FieldNode) String() string {
+	return fmt.Sprintf("{FieldNode:%s:%s}", node.Object.String(), node.Field)
+}
+
+func (node FieldAssignmentNode) String() string {
+	return fmt.Sprintf("{FieldAssignmentNode:%s:%s:%s}", node.Object.String(), node.Field, node.Expr.String())
+}
+
+func (node CompoundAssignmentNode) String() string {
+	return fmt.Sprintf("{CompoundAssignmentNode:%s:%s=:%s}", node.Target.String(), node.Operator, node.Expr.String())
+}
+
+func (node UnaryOperatorNode) String() string {
+	return fmt.Sprintf("{UnaryOperatorNode:%s:%s}", node.Operator, node.Operand.String())
+}
+
+func (node DeclarationNode) String() string {
+	keyword := "let"
+	if node.Mutable {
+		keyword = "var"
+	}
+	return fmt.Sprintf("{DeclarationNode:%s:%s:%s:%s}", keyword, node.Name, node.Type, node.Expr.String())
+}
+
+func (node ConstNode) String() string {
+	return fmt.Sprintf("{ConstNode:%s:%s:%s}", node.Name, node.Type, node.Expr.String())
+}
+
 func (node AssignmentNode) String() string {
 	return fmt.Sprintf("{AssignmentNode:%s:%s}", node.Dest, node.Expr.String())
 }
 
+func (node IfNode) String() string {
+	if node.Else == nil {
+		return fmt.Sprintf("{IfNode:%s:%s}", node.Cond.String(), node.Then.String())
+	}
+	return fmt.Sprintf("{IfNode:%s:%s:%s}", node.Cond.String(), node.Then.String(), node.Else.String())
+}
+
+func (node WhileNode) String() string {
+	return fmt.Sprintf("{WhileNode:%s:%s}", node.Cond.String(), node.Block.String())
+}
+
+func (node ForNode) String() string {
+	return fmt.Sprintf("{ForNode:%s:%s:%s}", node.Var, node.Iterable.String(), node.Block.String())
+}
+
+func (node RangeNode) String() string {
+	return fmt.Sprintf("{RangeNode:%s:%s}", node.From.String(), node.To.String())
+}
+
+func (node MatchNode) String() string {
+	buf := ""
+	for i, arm := range node.Arms {
+		if i > 0 {
+			buf += ","
+		}
+		buf += arm.Pattern.String() + "=>" + arm.Body.String()
+	}
+	return fmt.Sprintf("{MatchNode:%s:[%s]}", node.Value.String(), buf)
+}
+
+func (pattern WildcardPattern) String() string {
+	return "{WildcardPattern}"
+}
+
+func (pattern BindingPattern) String() string {
+	return fmt.Sprintf("{BindingPattern:%s}", pattern.Name)
+}
+
+func (pattern LiteralPattern) String() string {
+	return fmt.Sprintf("{LiteralPattern:%s}", pattern.Value.String())
+}
+
+func (pattern AlternativePattern) String() string {
+	buf := ""
+	for i, alternative := range pattern.Alternatives {
+		if i > 0 {
+			buf += "|"
+		}
+		buf += alternative.String()
+	}
+	return fmt.Sprintf("{AlternativePattern:%s}", buf)
+}
+
+func (pattern StructPattern) String() string {
+	buf := ""
+	for i := range pattern.Fields {
+		if i > 0 {
+			buf += ","
+		}
+		buf += pattern.Fields[i] + ":" + pattern.Patterns[i].String()
+	}
+	return fmt.Sprintf("{StructPattern:%s:[%s]}", pattern.Type, buf)
+}
+
+func (pattern VariantPattern) String() string {
+	buf := ""
+	for i, field := range pattern.Patterns {
+		if i > 0 {
+			buf += ","
+		}
+		buf += field.String()
+	}
+	return fmt.Sprintf("{VariantPattern:%s:[%s]}", pattern.Variant, buf)
+}
+
+func (node TryNode) String() string {
+	return fmt.Sprintf("{TryNode:%s:%s:%s:%s}", node.Try.String(), node.CatchVar, optionalString(node.Catch), optionalString(node.Finally))
+}
+
+func (node ThrowNode) String() string {
+	return fmt.Sprintf("{ThrowNode:%s}", node.Expr.String())
+}
+
+func (node BreakNode) String() string {
+	return "{BreakNode}"
+}
+
+func (node ContinueNode) String() string {
+	return "{ContinueNode}"
+}
+
+func (node ReturnNode) String() string {
+	return fmt.Sprintf("{ReturnNode:%s}", node.Expr.String())
+}
+
+func (node MacroDefNode) String() string {
+	return fmt.Sprintf("{MacroDef:%s:%v:%s}", node.Name, node.Params, node.Block.String())
+}
+
+func (node MacroCallNode) String() string {
+	return fmt.Sprintf("{MacroCall:%s:%s}", node.Name, node.Args)
+}
+
+func (node QuoteNode) String() string {
+	return fmt.Sprintf("{Quote:%s}", node.Block.String())
+}
+
+func (node UnquoteNode) String() string {
+	return fmt.Sprintf("{Unquote:%s}", node.Name)
+}
+
 func (node BlockNode) String() string {
 	buf := ""
 	for i, node := range node.ExprList {
@@ -0,0 +1,1377 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/trungaczne/gimmick/vm"
+)
+
+/* --- Static type inference --- */
+
+// The types of a module are inferred by unification, Hindley-Milner style:
+// the unannotated arguments, results and variables start as TypeVars that
+// the way they're used narrows down. Functions and the values bound by let
+// are generalized, a function can be called with different types as long
+// as its body allows it. Annotations are types to unify with.
+//
+// The type any, and the names the checker doesn't know like the qualified
+// types of imported modules, are dynamic: they unify with every type. So do
+// the values of indexes, of if without else and of the branches that don't
+// agree, which the interpreter checks at runtime
+
+// InferredType is a *TypeVar or a TypeCon
+type InferredType interface {
+	String() string
+}
+
+// TypeVar is a type not known yet, Instance is the type it stands for once
+// unified
+type TypeVar struct {
+	Instance InferredType
+	// the types the variable can stand for, nil for every type. The
+	// operators only work on a few types
+	Allowed []string
+	// how deep in the definitions the variable was introduced, only the
+	// ones deeper than a definition are generalized
+	Level int
+}
+
+// TypeCon is a named type: int, float, bool, string, list, map, any, the
+// struct and enum types, or fn whose Args are the types of the arguments
+// then the type of the result. The value of a function defined with def
+// keeps its Params, calls through it bind the arguments like direct calls
+type TypeCon struct {
+	Name   string
+	Args   []InferredType
+	Params []Param
+}
+
+// Scheme is a type generic over Vars, each use instantiates fresh ones
+type Scheme struct {
+	Vars []*TypeVar
+	Type InferredType
+}
+
+// Signature is the inferred type of a function or variable, defined at Pos
+type Signature struct {
+	Name string
+	Pos  Pos
+	Type string
+}
+
+func (sig Signature) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", sig.Pos.Line, sig.Pos.Column, sig.Name, sig.Type)
+}
+
+var (
+	ANY    = TypeCon{Name: "any"}
+	INT    = TypeCon{Name: "int"}
+	FLOAT  = TypeCon{Name: "float"}
+	BOOL   = TypeCon{Name: "bool"}
+	STRING = TypeCon{Name: "string"}
+	LIST   = TypeCon{Name: "list"}
+	MAP    = TypeCon{Name: "map"}
+)
+
+// BUILTIN_TYPES are the types every module knows, besides its struct and
+// enum types. fn isn't there, a function type needs its arguments
+var BUILTIN_TYPES = map[string]TypeCon{
+	"any":    ANY,
+	"int":    INT,
+	"float":  FLOAT,
+	"bool":   BOOL,
+	"string": STRING,
+	"list":   LIST,
+	"map":    MAP,
+}
+
+func fnType(args []InferredType, result InferredType) TypeCon {
+	return TypeCon{Name: "fn", Args: append(append([]InferredType{}, args...), result)}
+}
+
+func (v *TypeVar) String() string {
+	return typeNames{}.format(v)
+}
+
+func (con TypeCon) String() string {
+	return typeNames{}.format(con)
+}
+
+// typeNames names the variables of the types it formats a, b, ...
+type typeNames map[*TypeVar]string
+
+func (names typeNames) format(t InferredType) string {
+	switch t := prune(t).(type) {
+	case *TypeVar:
+		name, ok := names[t]
+		if !ok {
+			name = string(rune('a' + len(names)%26))
+			if len(names) >= 26 {
+				name += fmt.Sprint(len(names) / 26)
+			}
+			names[t] = name
+		}
+		return name
+	case TypeCon:
+		if t.Name != "fn" {
+			return t.Name
+		}
+		args := []string{}
+		for _, arg := range t.Args[:len(t.Args)-1] {
+			args = append(args, names.format(arg))
+		}
+		return fmt.Sprintf("fn(%s): %s", strings.Join(args, ", "), names.format(t.Args[len(t.Args)-1]))
+	}
+	return "?"
+}
+
+// constraints lists the types the named variables are restricted to, e.g.
+// " where a: int|float"
+func (names typeNames) constraints() string {
+	buf := []string{}
+	for v, name := range names {
+		if v.Allowed != nil {
+			buf = append(buf, name+": "+strings.Join(v.Allowed, "|"))
+		}
+	}
+	if len(buf) == 0 {
+		return ""
+	}
+	sort.Strings(buf)
+	return " where " + strings.Join(buf, ", ")
+}
+
+func (scheme Scheme) String() string {
+	names := typeNames{}
+	return names.format(scheme.Type) + names.constraints()
+}
+
+// prune follows the instances of t down to the type it stands for
+func prune(t InferredType) InferredType {
+	for {
+		v, ok := t.(*TypeVar)
+		if !ok || v.Instance == nil {
+			return t
+		}
+		t = v.Instance
+	}
+}
+
+type typeSymbol struct {
+	Kind SymbolType
+	// the type of a variable, function or unit variant
+	Scheme Scheme
+	// the fields of a struct type or variant, the arguments of a builtin
+	Fields []NameType
+	// the arguments of a function
+	Params []Param
+	// the variants of an enum, the enum of a variant
+	Variants []string
+	Enum     string
+
+	// a function not inferred yet, with the scopes and level it's defined
+	// in. Functions are inferred when first used, before the code using
+	// them is generalized
+	def    *FunctionDefNode
+	scopes []map[string]*typeSymbol
+	level  int
+}
+
+// the state of a TypeVar before unification changed it
+type trailEntry struct {
+	v        *TypeVar
+	instance InferredType
+	allowed  []string
+	level    int
+}
+
+type signature struct {
+	name   string
+	pos    Pos
+	scheme Scheme
+}
+
+// a field of an object whose type wasn't known when the field was accessed
+type pendingField struct {
+	object InferredType
+	name   string
+	result InferredType
+	pos    Pos
+}
+
+// NodeTypes are the types TypeCheck infers for the nodes CodeGen needs
+// them for: the objects of the field accesses and the receivers of the
+// method calls, keyed by the Pos of the access or call. The types not known
+// are left out
+type NodeTypes map[Pos]string
+
+type typeChecker struct {
+	scopes []map[string]*typeSymbol
+	level  int
+	// the results of the enclosing functions
+	returns []InferredType
+	// what unify changed, undone when it fails
+	trail []trailEntry
+	// the position of the innermost node having one
+	pos        Pos
+	errors     CompileErrors
+	signatures []signature
+	// the types of the objects of the field accesses and method calls, and
+	// the accesses settled once the module is checked
+	objects map[Pos]InferredType
+	pending []pendingField
+	// the operators the module defines, see overload
+	overloaded map[string]bool
+}
+
+// TypeCheck infers the types of module, returning them along with the
+// errors found. The errors are positioned at the innermost node having a
+// Pos. Names that aren't defined are left for the CodeBuilder to report
+func TypeCheck(module ModuleNode) (NodeTypes, CompileErrors) {
+	c := infer(module)
+	types := NodeTypes{}
+	for pos, object := range c.objects {
+		if con, ok := prune(object).(TypeCon); ok && con.Name != "any" {
+			types[pos] = con.Name
+		}
+	}
+	return types, c.errors
+}
+
+// InferTypes returns the inferred types of the functions and variables of
+// module in the order they're defined, along with the type errors
+func InferTypes(module ModuleNode) ([]Signature, CompileErrors) {
+	c := infer(module)
+	signatures := []Signature{}
+	for _, sig := range c.signatures {
+		signatures = append(signatures, Signature{sig.name, sig.pos, sig.scheme.String()})
+	}
+	sort.SliceStable(signatures, func(i, j int) bool {
+		a, b := signatures[i].Pos, signatures[j].Pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return signatures, c.errors
+}
+
+func infer(module ModuleNode) *typeChecker {
+	c := &typeChecker{objects: map[Pos]InferredType{}}
+	c.push()
+	for _, builtin := range Builtins {
+		args := make([]InferredType, builtin.NumArgs)
+		for i := range args {
+			args[i] = ANY
+		}
+		c.define(builtin.Name, &typeSymbol{
+			Kind:   SYM_BUILTIN,
+			Scheme: Scheme{Type: fnType(args, c.annotation(builtin.Type))},
+			Fields: make([]NameType, builtin.NumArgs),
+		})
+	}
+	c.define("Error", &typeSymbol{Kind: SYM_TYPE, Fields: ERROR_FIELDS})
+	c.push()
+	c.check(module.Block)
+	c.settle()
+	return c
+}
+
+func (c *typeChecker) errorf(format string, args ...interface{}) {
+	c.errors = append(c.errors, Diagnostic{c.pos.Line, c.pos.Column, fmt.Sprintf(format, args...)})
+}
+
+// at makes pos the position of the errors until the returned function is
+// called, nodes built by the compiler keep the enclosing position
+func (c *typeChecker) at(pos Pos) func() {
+	saved := c.pos
+	if pos != (Pos{}) {
+		c.pos = pos
+	}
+	return func() { c.pos = saved }
+}
+
+func (c *typeChecker) push() {
+	c.scopes = append(c.scopes, map[string]*typeSymbol{})
+}
+
+func (c *typeChecker) pop() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *typeChecker) define(name string, sym *typeSymbol) {
+	c.scopes[len(c.scopes)-1][name] = sym
+}
+
+func (c *typeChecker) lookup(name string) (*typeSymbol, bool) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if sym, ok := c.scopes[i][name]; ok {
+			return sym, true
+		}
+	}
+	return nil, false
+}
+
+// defineVar defines a variable holding values of type t
+func (c *typeChecker) defineVar(name string, t InferredType) {
+	c.define(name, &typeSymbol{Kind: SYM_VAR, Scheme: Scheme{Type: t}})
+}
+
+func (c *typeChecker) fresh() *TypeVar {
+	return &TypeVar{Level: c.level}
+}
+
+// annotation is the type written name in an annotation
+func (c *typeChecker) annotation(name string) InferredType {
+	if con, ok := BUILTIN_TYPES[name]; ok {
+		return con
+	}
+	if sym, ok := c.lookup(name); ok {
+		switch sym.Kind {
+		case SYM_TYPE, SYM_ENUM:
+			return TypeCon{Name: name}
+		case SYM_VARIANT:
+			return TypeCon{Name: sym.Enum}
+		}
+	}
+	return ANY
+}
+
+/* --- Unification --- */
+
+func (c *typeChecker) save(v *TypeVar) {
+	c.trail = append(c.trail, trailEntry{v, v.Instance, v.Allowed, v.Level})
+}
+
+// unify makes a and b the same type, telling whether it could. Nothing is
+// changed when it can't
+func (c *typeChecker) unify(a, b InferredType) bool {
+	c.trail = c.trail[:0]
+	if c.unifyTypes(a, b) {
+		return true
+	}
+	for i := len(c.trail) - 1; i >= 0; i-- {
+		entry := c.trail[i]
+		entry.v.Instance, entry.v.Allowed, entry.v.Level = entry.instance, entry.allowed, entry.level
+	}
+	return false
+}
+
+func (c *typeChecker) unifyTypes(a, b InferredType) bool {
+	a, b = prune(a), prune(b)
+	if v, ok := a.(*TypeVar); ok {
+		return c.bind(v, b)
+	}
+	if v, ok := b.(*TypeVar); ok {
+		return c.bind(v, a)
+	}
+	conA, conB := a.(TypeCon), b.(TypeCon)
+	if conA.Name == "any" || conB.Name == "any" {
+		return true
+	}
+	if conB.Params != nil && conA.Params == nil {
+		conA, conB = conB, conA
+	}
+	if conA.Name == "fn" && conB.Name == "fn" && conA.Params != nil && conB.Params == nil {
+		return c.unifyParams(conA, conB)
+	}
+	if conA.Name != conB.Name || len(conA.Args) != len(conB.Args) {
+		return false
+	}
+	for i := range conA.Args {
+		if !c.unifyTypes(conA.Args[i], conB.Args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// unifyParams unifies the value of a function defined with def with the
+// type fn of the calls made through it, binding its arguments the way
+// INST_CALL does
+func (c *typeChecker) unifyParams(def, fn TypeCon) bool {
+	count := len(fn.Args) - 1
+	fixed := len(def.Params)
+	variadic := fixed > 0 && def.Params[fixed-1].Variadic
+	if variadic {
+		fixed--
+	}
+	if count > fixed && !variadic {
+		return false
+	}
+	for i, param := range def.Params[:fixed] {
+		if i >= count {
+			if !param.HasDefault {
+				return false
+			}
+			continue
+		}
+		if !c.unifyTypes(def.Args[i], fn.Args[i]) {
+			return false
+		}
+	}
+	for i := fixed; i < count; i++ {
+		if !c.unifyTypes(c.annotation(def.Params[fixed].Type), fn.Args[i]) {
+			return false
+		}
+	}
+	return c.unifyTypes(def.Args[len(def.Args)-1], fn.Args[count])
+}
+
+func allows(allowed []string, name string) bool {
+	if allowed == nil || name == "any" {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bind makes v stand for t
+func (c *typeChecker) bind(v *TypeVar, t InferredType) bool {
+	if other, ok := t.(*TypeVar); ok {
+		if other == v {
+			return true
+		}
+		allowed := other.Allowed
+		if v.Allowed != nil {
+			allowed = []string{}
+			for _, name := range v.Allowed {
+				if allows(other.Allowed, name) {
+					allowed = append(allowed, name)
+				}
+			}
+			if len(allowed) == 0 {
+				return false
+			}
+		}
+		c.save(other)
+		other.Allowed = allowed
+		if v.Level < other.Level {
+			other.Level = v.Level
+		}
+		c.save(v)
+		v.Instance = other
+		return true
+	}
+	if !allows(v.Allowed, t.(TypeCon).Name) || !c.adjust(v, t) {
+		return false
+	}
+	c.save(v)
+	v.Instance = t
+	return true
+}
+
+// adjust lowers the level of the variables of t to the one of v, so they
+// aren't generalized before v is. It fails when v occurs in t
+func (c *typeChecker) adjust(v *TypeVar, t InferredType) bool {
+	switch t := prune(t).(type) {
+	case *TypeVar:
+		if t == v {
+			return false
+		}
+		if t.Level > v.Level {
+			c.save(t)
+			t.Level = v.Level
+		}
+	case TypeCon:
+		for _, arg := range t.Args {
+			if !c.adjust(v, arg) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// generalize makes the variables of t introduced deeper than the current
+// level generic
+func (c *typeChecker) generalize(t InferredType) Scheme {
+	vars := []*TypeVar{}
+	seen := map[*TypeVar]bool{}
+	var collect func(t InferredType)
+	collect = func(t InferredType) {
+		switch t := prune(t).(type) {
+		case *TypeVar:
+			if t.Level > c.level && !seen[t] {
+				seen[t] = true
+				vars = append(vars, t)
+			}
+		case TypeCon:
+			for _, arg := range t.Args {
+				collect(arg)
+			}
+		}
+	}
+	collect(t)
+	return Scheme{vars, t}
+}
+
+func (c *typeChecker) instantiate(scheme Scheme) InferredType {
+	if len(scheme.Vars) == 0 {
+		return scheme.Type
+	}
+	fresh := map[*TypeVar]InferredType{}
+	for _, v := range scheme.Vars {
+		fresh[v] = &TypeVar{Allowed: v.Allowed, Level: c.level}
+	}
+	var substitute func(t InferredType) InferredType
+	substitute = func(t InferredType) InferredType {
+		switch t := prune(t).(type) {
+		case *TypeVar:
+			if v, ok := fresh[t]; ok {
+				return v
+			}
+			return t
+		case TypeCon:
+			args := make([]InferredType, len(t.Args))
+			for i, arg := range t.Args {
+				args[i] = substitute(arg)
+			}
+			return TypeCon{t.Name, args, t.Params}
+		}
+		return t
+	}
+	return substitute(scheme.Type)
+}
+
+// join is the type of an expression taking the value of one of branches,
+// dynamic when they don't agree
+func (c *typeChecker) join(branches ...InferredType) InferredType {
+	for _, branch := range branches[1:] {
+		if !c.unify(branches[0], branch) {
+			return ANY
+		}
+	}
+	return branches[0]
+}
+
+/* --- Definitions --- */
+
+// hoist defines the functions and types of block, which can be used before
+// their definition
+func (c *typeChecker) hoist(block BlockNode) {
+	for _, expr := range block.ExprList {
+		switch node := expr.(type) {
+		case FunctionDefNode:
+			c.defineFunction(node)
+		case TypeDefNode:
+			c.define(node.Name, &typeSymbol{Kind: SYM_TYPE, Fields: node.Fields})
+		case EnumDefNode:
+			enum := &typeSymbol{Kind: SYM_ENUM}
+			c.define(node.Name, enum)
+			for _, variant := range node.Variants {
+				enum.Variants = append(enum.Variants, variant.Name)
+				c.define(variant.Name, &typeSymbol{Kind: SYM_VARIANT, Fields: variant.Fields, Enum: node.Name})
+			}
+			// the fields may use types defined further
+			defer c.variants(node)
+		case ImportNode:
+			c.define(node.Name(), &typeSymbol{Kind: SYM_MODULE})
+		}
+	}
+}
+
+// variants types the variants of an enum, a function building the enum
+// from its fields or a constant
+func (c *typeChecker) variants(node EnumDefNode) {
+	for _, variant := range node.Variants {
+		sym, _ := c.lookup(variant.Name)
+		if len(variant.Fields) == 0 {
+			sym.Scheme = Scheme{Type: TypeCon{Name: node.Name}}
+			continue
+		}
+		fields := []InferredType{}
+		for _, field := range variant.Fields {
+			fields = append(fields, c.annotation(field.Type))
+		}
+		sym.Scheme = Scheme{Type: fnType(fields, TypeCon{Name: node.Name})}
+	}
+}
+
+func (c *typeChecker) defineFunction(node FunctionDefNode) *typeSymbol {
+	params, _ := node.params()
+	sym := &typeSymbol{
+		Kind:   SYM_FUN,
+		Params: params,
+		def:    &node,
+		scopes: c.scopes[:len(c.scopes):len(c.scopes)],
+		level:  c.level,
+	}
+	c.define(node.Name, sym)
+	if node.Operator != "" {
+		if c.overloaded == nil {
+			c.overloaded = map[string]bool{}
+		}
+		c.overloaded[node.Operator] = true
+	}
+	return sym
+}
+
+// signature is the type of a function or lambda as annotated, the types
+// omitted are variables. A variadic argument is a list
+func (c *typeChecker) signature(argList []NameType, variadic bool, returnType string) TypeCon {
+	args := []InferredType{}
+	for i, arg := range argList {
+		var argType InferredType = c.fresh()
+		if variadic && i == len(argList)-1 {
+			argType = LIST
+		} else if arg.Type != "" {
+			argType = c.annotation(arg.Type)
+		}
+		args = append(args, argType)
+	}
+	var result InferredType = c.fresh()
+	if returnType != "" {
+		result = c.annotation(returnType)
+	}
+	return fnType(args, result)
+}
+
+// body checks the block of a function of type fn, the value of the block
+// must be a valid result
+func (c *typeChecker) body(name string, argList []NameType, fn TypeCon, block BlockNode) {
+	c.push()
+	defer c.pop()
+	for i, arg := range argList {
+		c.defineVar(arg.Name, fn.Args[i])
+	}
+	result := fn.Args[len(fn.Args)-1]
+	c.returns = append(c.returns, result)
+	body := c.check(block)
+	c.returns = c.returns[:len(c.returns)-1]
+	if !c.unify(result, body) {
+		c.errorf("cannot use %s as %s in return of %s", body, result, name)
+	}
+}
+
+// resolve infers the type of the function sym when it's first used. The
+// recursive calls see the type before it's generalized
+func (c *typeChecker) resolve(sym *typeSymbol) {
+	if sym.def == nil {
+		return
+	}
+	node := sym.def
+	sym.def = nil
+	savedScopes, savedLevel, savedReturns := c.scopes, c.level, c.returns
+	defer c.at(node.Pos)()
+	c.scopes, c.level, c.returns = sym.scopes, sym.level+1, nil
+
+	fn := c.signature(node.ArgList, node.Variadic, node.ReturnType)
+	sym.Scheme = Scheme{Type: fn}
+	for i, value := range node.Defaults {
+		if value == nil {
+			continue
+		}
+		if result := c.check(value); !c.unify(fn.Args[i], result) {
+			c.errorf("cannot use %s as %s in default of %s", result, fn.Args[i], node.ArgList[i].Name)
+		}
+	}
+	c.body(node.Name, node.ArgList, fn, node.Block)
+	c.level = sym.level
+	sym.Scheme = c.generalize(fn)
+	c.signatures = append(c.signatures, signature{node.Name, node.Pos, sym.Scheme})
+	c.scopes, c.level, c.returns = savedScopes, savedLevel, savedReturns
+}
+
+// field is the type of the field name of a value of type object. When the
+// type isn't known yet, the struct type having that field is assumed, the
+// way CodeBuilder.ResolveField does. When several have it, the field is
+// settled once the module is checked, the uses of the object may tell its
+// type by then
+func (c *typeChecker) field(object InferredType, name string) InferredType {
+	switch t := prune(object).(type) {
+	case *TypeVar:
+		owner := ""
+		var ownerSym *typeSymbol
+		for _, scope := range c.scopes {
+			for typeName, sym := range scope {
+				if typeName == "Error" || sym.Kind != SYM_TYPE && sym.Kind != SYM_VARIANT {
+					continue
+				}
+				if c.fieldOf(sym, name) == nil {
+					continue
+				}
+				if ownerSym != nil {
+					return c.postpone(t, name)
+				}
+				owner, ownerSym = typeName, sym
+			}
+		}
+		if ownerSym == nil {
+			return ANY
+		}
+		if ownerSym.Kind == SYM_VARIANT {
+			owner = ownerSym.Enum
+		}
+		c.unify(t, TypeCon{Name: owner})
+		return c.fieldOf(ownerSym, name)
+	case TypeCon:
+		if t.Name == "any" {
+			return ANY
+		}
+		if _, ok := BUILTIN_TYPES[t.Name]; ok || t.Name == "fn" {
+			c.errorf("%s has no field %s", t, name)
+			return ANY
+		}
+		sym, ok := c.lookup(t.Name)
+		if !ok {
+			return ANY
+		}
+		if sym.Kind != SYM_ENUM {
+			if fieldType := c.fieldOf(sym, name); fieldType != nil {
+				return fieldType
+			}
+			return ANY
+		}
+		for _, variant := range sym.Variants {
+			if variantSym, ok := c.lookup(variant); ok && c.fieldOf(variantSym, name) != nil {
+				return c.fieldOf(variantSym, name)
+			}
+		}
+	}
+	return ANY
+}
+
+// object records the type of the object of the field access or method call
+// at pos
+func (c *typeChecker) object(pos Pos, object InferredType) {
+	if pos != (Pos{}) {
+		c.objects[pos] = object
+	}
+}
+
+// postpone leaves the field name of a value of type object to settle. The
+// type isn't generalized meanwhile, the function accessing the field takes
+// the type of the object it's first called with
+func (c *typeChecker) postpone(object *TypeVar, name string) InferredType {
+	object.Level = 0
+	result := &TypeVar{}
+	c.pending = append(c.pending, pendingField{object, name, result, c.pos})
+	return result
+}
+
+// settle types the deferred fields whose objects got a type, the ones still
+// unknown are left for the CodeBuilder to report
+func (c *typeChecker) settle() {
+	for settled := true; settled; {
+		settled = false
+		pending := c.pending
+		c.pending = nil
+		for _, access := range pending {
+			if _, ok := prune(access.object).(*TypeVar); ok {
+				c.pending = append(c.pending, access)
+				continue
+			}
+			settled = true
+			restore := c.at(access.pos)
+			fieldType := c.field(access.object, access.name)
+			if !c.unify(access.result, fieldType) {
+				c.errorf("cannot use field %s of type %s as %s", access.name, fieldType, access.result)
+			}
+			restore()
+		}
+	}
+}
+
+// fieldOf is the type of the field name of a struct type or variant, nil
+// when there's no such field
+func (c *typeChecker) fieldOf(sym *typeSymbol, name string) InferredType {
+	for _, field := range sym.Fields {
+		if field.Name == name {
+			return c.annotation(field.Type)
+		}
+	}
+	return nil
+}
+
+/* --- Expressions --- */
+
+// call checks calling name, a value of type callee, with arguments of
+// types args and returns the type of the result. params names the
+// arguments when known
+func (c *typeChecker) call(name string, callee InferredType, params []NameType, args []InferredType) InferredType {
+	switch t := prune(callee).(type) {
+	case *TypeVar:
+		result := c.fresh()
+		if !c.unify(t, fnType(args, result)) {
+			c.errorf("cannot call %s of type %s", name, t)
+			return ANY
+		}
+		return result
+	case TypeCon:
+		if t.Name == "any" {
+			return ANY
+		}
+		if t.Name != "fn" {
+			c.errorf("cannot call %s of type %s", name, t)
+			return ANY
+		}
+		if t.Params != nil {
+			return c.callFunction(name, nil, t.Params, t, args)
+		}
+		result := t.Args[len(t.Args)-1]
+		if len(args) != len(t.Args)-1 {
+			c.errorf("%s expects %d arguments, got %d", name, len(t.Args)-1, len(args))
+			return result
+		}
+		for i, arg := range args {
+			if !c.unify(t.Args[i], arg) {
+				argument := fmt.Sprint(i + 1)
+				if i < len(params) && params[i].Name != "" {
+					argument = params[i].Name
+				}
+				c.errorf("cannot use %s as %s in argument %s of %s", arg, t.Args[i], argument, name)
+			}
+		}
+		return result
+	}
+	return ANY
+}
+
+// callNode checks node, whose arguments are of types args
+func (c *typeChecker) callNode(node FunctionCallNode, args []InferredType) InferredType {
+	sym, ok := c.lookup(node.Name)
+	if !ok {
+		return ANY
+	}
+	if sym.Kind == SYM_FUN {
+		c.resolve(sym)
+		return c.callFunction(node.Name, node.Names, sym.Params, c.instantiate(sym.Scheme).(TypeCon), args)
+	}
+	if node.Names != nil {
+		c.errorf("%s takes no named arguments", node.Name)
+		return ANY
+	}
+	switch sym.Kind {
+	case SYM_BUILTIN:
+		return c.call(node.Name, sym.Scheme.Type, sym.Fields, args)
+	case SYM_VARIANT:
+		if len(sym.Fields) == 0 {
+			// a unit variant can be called as well
+			return c.call(node.Name, fnType(nil, sym.Scheme.Type), nil, args)
+		}
+		return c.call(node.Name, sym.Scheme.Type, sym.Fields, args)
+	case SYM_VAR:
+		return c.call(node.Name, c.instantiate(sym.Scheme), nil, args)
+	}
+	return ANY
+}
+
+// method is the name of the function called by the method call
+// value.name(), value being of type receiver, the way
+// CodeBuilder.ResolveMethod finds it. It's false when the call is
+// ambiguous, which the CodeBuilder reports
+func (c *typeChecker) method(receiver InferredType, name string) (string, bool) {
+	if t, ok := prune(receiver).(TypeCon); ok && t.Name != "any" {
+		if sym, ok := c.lookup(t.Name + "." + name); ok && sym.Kind == SYM_FUN {
+			return t.Name + "." + name, true
+		}
+		return name, true
+	}
+
+	owners := map[string]bool{}
+	for _, scope := range c.scopes {
+		for qualified, sym := range scope {
+			owner := strings.TrimSuffix(qualified, "."+name)
+			if sym.Kind == SYM_FUN && owner != qualified && !strings.Contains(owner, ".") {
+				owners[owner] = true
+			}
+		}
+	}
+	_, inScope := c.lookup(name)
+	switch {
+	case len(owners) == 0:
+		return name, true
+	case len(owners) == 1 && !inScope:
+		for owner := range owners {
+			return owner + "." + name, true
+		}
+	}
+	return "", false
+}
+
+// callFunction checks a call to a function defined with def, of type fn,
+// binding the arguments to params like the compiler does. names are the
+// names of the arguments, nil when they're all positional
+func (c *typeChecker) callFunction(name string, names []string, params []Param, fn TypeCon, args []InferredType) InferredType {
+	slots, rest, errs := bindArguments(name, params, len(args), names)
+	for _, err := range errs {
+		c.errorf("%s", err)
+	}
+	argument := func(param Param, expected InferredType, arg InferredType) {
+		if !c.unify(expected, arg) {
+			c.errorf("cannot use %s as %s in argument %s of %s", arg, expected, param.Name, name)
+		}
+	}
+	for p, param := range params {
+		if param.Variadic {
+			element := c.annotation(param.Type)
+			for _, i := range rest {
+				argument(param, element, args[i])
+			}
+		} else if slots[p] >= 0 {
+			argument(param, fn.Args[p], args[slots[p]])
+		}
+	}
+	return fn.Args[len(fn.Args)-1]
+}
+
+// operands checks that both operands of op have the same type, one of
+// allowed, and returns it
+func (c *typeChecker) operands(op string, left, right InferredType, allowed ...string) InferredType {
+	if !c.unify(left, right) {
+		c.errorf("mismatched types %s and %s for %s", left, right, op)
+		return ANY
+	}
+	if !c.unify(&TypeVar{Allowed: allowed, Level: c.level}, left) {
+		c.errorf("operator %s not defined on %s", op, left)
+		return ANY
+	}
+	return left
+}
+
+// overload is the result of the operator op defined by the module for the
+// types of left and right. When they aren't known, the operator may be
+// found at run time, the result being dynamic
+func (c *typeChecker) overload(op string, left, right InferredType) (InferredType, bool) {
+	l, ok1 := prune(left).(TypeCon)
+	r, ok2 := prune(right).(TypeCon)
+	if !ok1 || !ok2 {
+		if c.overloaded[op] {
+			return ANY, true
+		}
+		return nil, false
+	}
+	name := operatorName(op, l.Name, r.Name)
+	sym, ok := c.lookup(name)
+	if !ok || sym.Kind != SYM_FUN {
+		return nil, false
+	}
+	c.resolve(sym)
+	return c.call(name, c.instantiate(sym.Scheme), sym.Fields, []InferredType{left, right}), true
+}
+
+func (c *typeChecker) binary(op string, left, right InferredType) InferredType {
+	if result, ok := c.overload(op, left, right); ok {
+		return result
+	}
+	switch op {
+	case "==", "!=":
+		if !c.unify(left, right) {
+			c.errorf("mismatched types %s and %s for %s", left, right, op)
+		}
+		return BOOL
+	case "<", "<=", ">", ">=":
+		c.operands(op, left, right, "int", "float", "string")
+		return BOOL
+	case "+":
+		return c.operands(op, left, right, "int", "float", "string")
+	case "-", "*", "/", "**":
+		return c.operands(op, left, right, "int", "float")
+	case "%", "&", "|", "^", "<<", ">>":
+		return c.operands(op, left, right, "int")
+	}
+	return ANY
+}
+
+func (c *typeChecker) unary(op string, operand InferredType) InferredType {
+	switch op {
+	case "-", "+":
+		return c.operands(op, operand, operand, "int", "float")
+	case "~":
+		return c.operands(op, operand, operand, "int")
+	}
+	return ANY
+}
+
+func (c *typeChecker) condition(node Node) {
+	if cond := c.check(node); !c.unify(BOOL, cond) {
+		c.errorf("condition must be bool, got %s", cond)
+	}
+}
+
+func (c *typeChecker) index(container, index InferredType) {
+	t, ok := prune(container).(TypeCon)
+	if !ok {
+		return
+	}
+	switch t.Name {
+	case "list", "string":
+		if !c.unify(INT, index) {
+			c.errorf("%s index must be int, got %s", t.Name, index)
+		}
+	case "map", "any":
+	default:
+		c.errorf("cannot index %s", t)
+	}
+}
+
+// scoped checks node in a scope of its own
+func (c *typeChecker) scoped(node Node) InferredType {
+	c.push()
+	defer c.pop()
+	return c.check(node)
+}
+
+// generic tells whether the value of node can be generalized, evaluating it
+// has no effect
+func generic(node Node) bool {
+	switch node.(type) {
+	case LambdaNode, FunctionDefNode, IdentifierNode, IntegerLiteralNode, FloatLiteralNode, StringLiteralNode, BoolLiteralNode:
+		return true
+	}
+	return false
+}
+
+// check returns the type of node
+func (c *typeChecker) check(node Node) InferredType {
+	switch node := node.(type) {
+	case IntegerLiteralNode:
+		return INT
+	case FloatLiteralNode:
+		return FLOAT
+	case StringLiteralNode:
+		return STRING
+	case BoolLiteralNode:
+		return BOOL
+	case IdentifierNode:
+		sym, ok := c.lookup(node.Name)
+		if !ok {
+			return ANY
+		}
+		switch sym.Kind {
+		case SYM_FUN:
+			c.resolve(sym)
+			fn := c.instantiate(sym.Scheme).(TypeCon)
+			fn.Params = sym.Params
+			return fn
+		case SYM_VAR:
+			return c.instantiate(sym.Scheme)
+		case SYM_VARIANT:
+			if len(sym.Fields) == 0 {
+				return TypeCon{Name: sym.Enum}
+			}
+		}
+		return ANY
+	case ListLiteralNode:
+		for _, element := range node.Elements {
+			c.check(element)
+		}
+		return LIST
+	case MapLiteralNode:
+		for i := range node.Keys {
+			c.check(node.Keys[i])
+			c.check(node.Values[i])
+		}
+		return MAP
+	case FunctionDefNode:
+		sym, ok := c.scopes[len(c.scopes)-1][node.Name]
+		if !ok || sym.Kind != SYM_FUN {
+			sym = c.defineFunction(node)
+		}
+		c.resolve(sym)
+		return c.instantiate(sym.Scheme)
+	case LambdaNode:
+		fn := c.signature(node.ArgList, false, "")
+		c.body("fn", node.ArgList, fn, node.Block)
+		return fn
+	case FunctionCallNode:
+		if dot := strings.Index(node.Name, "."); dot >= 0 {
+			sym, ok := c.lookup(node.Name[:dot])
+			if !ok || sym.Kind != SYM_MODULE && sym.Kind != SYM_TYPE && sym.Kind != SYM_ENUM {
+				// x.f(a), the way FunctionCallNode.method reads it
+				receiver := IdentifierNode{node.Name[:dot]}
+				return c.check(MethodCallNode{receiver, node.Name[dot+1:], node.ParamList, node.Names, node.Pos})
+			}
+		}
+		defer c.at(node.Pos)()
+		args := make([]InferredType, len(node.ParamList))
+		for i, param := range node.ParamList {
+			args[i] = c.check(param)
+		}
+		return c.callNode(node, args)
+	case MethodCallNode:
+		receiver := c.check(node.Receiver)
+		defer c.at(node.Pos)()
+		c.object(node.Pos, receiver)
+		args := []InferredType{receiver}
+		for _, param := range node.ParamList {
+			args = append(args, c.check(param))
+		}
+		name, ok := c.method(receiver, node.Method)
+		if !ok {
+			return ANY
+		}
+		return c.callNode(node.call(name), args)
+	case CallNode:
+		callee := c.check(node.Callee)
+		args := make([]InferredType, len(node.ParamList))
+		for i, param := range node.ParamList {
+			args[i] = c.check(param)
+		}
+		defer c.at(node.Pos)()
+		return c.call("a value", callee, nil, args)
+	case BinaryOperatorNode:
+		if call, ok := node.infixCall(); ok {
+			return c.check(call)
+		}
+		left := c.check(node.Left)
+		right := c.check(node.Right)
+		defer c.at(node.Pos)()
+		return c.binary(node.Operator, left, right)
+	case UnaryOperatorNode:
+		operand := c.check(node.Operand)
+		defer c.at(node.Pos)()
+		return c.unary(node.Operator, operand)
+	case IndexNode:
+		c.index(c.check(node.Container), c.check(node.Index))
+		return ANY
+	case SliceNode:
+		container := c.check(node.Container)
+		for _, bound := range []Node{node.Low, node.High} {
+			if bound == nil {
+				continue
+			}
+			if index := c.check(bound); !c.unify(INT, index) {
+				c.errorf("slice bound must be int, got %s", index)
+			}
+		}
+		if t, ok := prune(container).(TypeCon); ok && (t.Name == "list" || t.Name == "string") {
+			return t
+		}
+		return ANY
+	case IndexAssignmentNode:
+		c.index(c.check(node.Container), c.check(node.Index))
+		return c.check(node.Expr)
+	case InfixDefNode:
+		if sym, ok := c.lookup(node.Function); ok {
+			c.define(node.Operator, sym)
+		}
+		return ANY
+	case ImportNode, TypeDefNode, EnumDefNode:
+		return ANY
+	case StructLiteralNode:
+		sym, ok := c.lookup(node.Type)
+		known := ok && (sym.Kind == SYM_TYPE || sym.Kind == SYM_VARIANT)
+		for i, value := range node.Values {
+			result := c.check(value)
+			if !known {
+				continue
+			}
+			if fieldType := c.fieldOf(sym, node.Names[i]); fieldType != nil && !c.unify(fieldType, result) {
+				c.errorf("cannot use %s as %s in field %s of %s", result, fieldType, node.Names[i], node.Type)
+			}
+		}
+		if !known {
+			return ANY
+		}
+		if sym.Kind == SYM_VARIANT {
+			return TypeCon{Name: sym.Enum}
+		}
+		return TypeCon{Name: node.Type}
+	case FieldNode:
+		if object, ok := node.Object.(IdentifierNode); ok {
+			if sym, ok := c.lookup(object.Name); ok && sym.Kind == SYM_MODULE {
+				return ANY
+			} else if ok && (sym.Kind == SYM_TYPE || sym.Kind == SYM_ENUM) {
+				// a function associated with the type
+				return c.check(IdentifierNode{object.Name + "." + node.Field})
+			}
+		}
+		object := c.check(node.Object)
+		defer c.at(node.Pos)()
+		c.object(node.Pos, object)
+		return c.field(object, node.Field)
+	case FieldAssignmentNode:
+		object := c.check(node.Object)
+		restore := c.at(node.Pos)
+		c.object(node.Pos, object)
+		fieldType := c.field(object, node.Field)
+		restore()
+		result := c.check(node.Expr)
+		if !c.unify(fieldType, result) {
+			c.errorf("cannot assign %s to field %s of type %s", result, node.Field, fieldType)
+		}
+		return result
+	case CompoundAssignmentNode:
+		target := c.check(node.Target)
+		expr := c.check(node.Expr)
+		defer c.at(node.Pos)()
+		result := c.binary(strings.TrimSuffix(node.Operator, "="), target, expr)
+		if !c.unify(target, result) {
+			c.errorf("cannot assign %s to %s", result, target)
+		}
+		return target
+	case ConstNode:
+		// typed like a let declaration
+		return c.check(DeclarationNode{false, node.Name, node.Type, node.Expr, node.Pos})
+	case DeclarationNode:
+		defer c.at(node.Pos)()
+		generalize := !node.Mutable && generic(node.Expr)
+		if generalize {
+			c.level++
+		}
+		result := c.check(node.Expr)
+		if node.Type != "" {
+			declared := c.annotation(node.Type)
+			if !c.unify(declared, result) {
+				c.errorf("cannot use %s as %s in declaration of %s", result, declared, node.Name)
+			}
+			result = declared
+		}
+		scheme := Scheme{Type: result}
+		if generalize {
+			c.level--
+			scheme = c.generalize(result)
+		}
+		c.define(node.Name, &typeSymbol{Kind: SYM_VAR, Scheme: scheme})
+		c.signatures = append(c.signatures, signature{node.Name, node.Pos, scheme})
+		return result
+	case AssignmentNode:
+		result := c.check(node.Expr)
+		defer c.at(node.Pos)()
+		if sym, ok := c.lookup(node.Dest); ok && sym.Kind == SYM_VAR && !c.unify(sym.Scheme.Type, result) {
+			c.errorf("cannot assign %s to %s of type %s", result, node.Dest, sym.Scheme.Type)
+		}
+		return result
+	case IfNode:
+		defer c.at(node.Pos)()
+		c.condition(node.Cond)
+		then := c.scoped(node.Then)
+		if node.Else == nil {
+			return ANY
+		}
+		return c.join(then, c.scoped(node.Else))
+	case WhileNode:
+		defer c.at(node.Pos)()
+		c.condition(node.Cond)
+		c.scoped(node.Block)
+		return ANY
+	case ForNode:
+		c.push()
+		defer c.pop()
+		if iterable, ok := node.Iterable.(RangeNode); ok {
+			c.check(iterable)
+			c.defineVar(node.Var, INT)
+		} else {
+			iterable := c.check(node.Iterable)
+			if t, ok := prune(iterable).(TypeCon); ok && !allows([]string{"list", "map", "string"}, t.Name) {
+				c.errorf("cannot iterate over %s", t)
+			}
+			c.defineVar(node.Var, ANY)
+		}
+		c.check(node.Block)
+		return ANY
+	case RangeNode:
+		for _, bound := range []Node{node.From, node.To} {
+			if result := c.check(bound); !c.unify(INT, result) {
+				c.errorf("range bound must be int, got %s", result)
+			}
+		}
+		return ANY
+	case MatchNode:
+		subject := c.check(node.Value)
+		results := []InferredType{}
+		for _, arm := range node.Arms {
+			c.push()
+			c.pattern(arm.Pattern, subject)
+			results = append(results, c.check(arm.Body))
+			c.pop()
+		}
+		if len(results) == 0 {
+			return ANY
+		}
+		return c.join(results...)
+	case TryNode:
+		result := c.scoped(node.Try)
+		if node.Catch != nil {
+			c.push()
+			c.defineVar(node.CatchVar, TypeCon{Name: "Error"})
+			result = c.join(result, c.check(node.Catch))
+			c.pop()
+		}
+		if node.Finally != nil {
+			c.scoped(node.Finally)
+		}
+		return result
+	case ThrowNode:
+		c.check(node.Expr)
+		return c.fresh()
+	case BreakNode, ContinueNode:
+		return c.fresh()
+	case ReturnNode:
+		defer c.at(node.Pos)()
+		result := c.check(node.Expr)
+		if len(c.returns) > 0 {
+			if expected := c.returns[len(c.returns)-1]; !c.unify(expected, result) {
+				c.errorf("cannot use %s as %s in return", result, expected)
+			}
+		}
+		return c.fresh()
+	case BlockNode:
+		c.hoist(node)
+		var result InferredType = ANY
+		for _, expr := range node.ExprList {
+			result = c.check(expr)
+		}
+		return result
+	}
+	return ANY
+}
+
+// pattern defines the variables bound by pattern, matched against a value
+// of type subject
+func (c *typeChecker) pattern(pattern Pattern, subject InferredType) {
+	switch pattern := pattern.(type) {
+	case BindingPattern:
+		if sym, ok := c.lookup(pattern.Name); ok && sym.Kind == SYM_VARIANT && len(sym.Fields) == 0 {
+			c.matchType(TypeCon{Name: sym.Enum}, subject)
+			return
+		}
+		c.defineVar(pattern.Name, subject)
+	case LiteralPattern:
+		c.matchType(c.check(pattern.Value), subject)
+	case AlternativePattern:
+		for _, alternative := range pattern.Alternatives {
+			c.pattern(alternative, subject)
+		}
+	case StructPattern:
+		sym, ok := c.lookup(pattern.Type)
+		if ok && sym.Kind == SYM_VARIANT {
+			c.matchType(TypeCon{Name: sym.Enum}, subject)
+		} else if ok && sym.Kind == SYM_TYPE {
+			c.matchType(TypeCon{Name: pattern.Type}, subject)
+		}
+		for i, field := range pattern.Fields {
+			var fieldType InferredType = ANY
+			if ok {
+				if t := c.fieldOf(sym, field); t != nil {
+					fieldType = t
+				}
+			}
+			c.pattern(pattern.Patterns[i], fieldType)
+		}
+	case VariantPattern:
+		sym, ok := c.lookup(pattern.Variant)
+		variant := ok && sym.Kind == SYM_VARIANT
+		if variant {
+			c.matchType(TypeCon{Name: sym.Enum}, subject)
+		}
+		for i, sub := range pattern.Patterns {
+			var fieldType InferredType = ANY
+			if variant && i < len(sym.Fields) {
+				fieldType = c.annotation(sym.Fields[i].Type)
+			}
+			c.pattern(sub, fieldType)
+		}
+	}
+}
+
+func (c *typeChecker) matchType(pattern, subject InferredType) {
+	if !c.unify(subject, pattern) {
+		c.errorf("cannot match %s against %s", pattern, subject)
+	}
+}
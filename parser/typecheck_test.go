@@ -0,0 +1,135 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTypeCheck(t *testing.T) {
+	for _, test := range []struct {
+		code     string
+		expected string
+	}{
+		{`1 + "a"`, `1:3: mismatched types int and string for +`},
+		{"let x = 1\nlet y = 2.0\nx * y", "3:3: mismatched types int and float for *"},
+		{`"a" - "b"`, "1:5: operator - not defined on string"},
+		{"~1.5", "1:1: operator ~ not defined on float"},
+		{`"abc"["a"]`, `string index must be int, got string`},
+		{"let x = 1\n(x)(2)", "2:4: cannot call a value of type int"},
+		{"def f(x: int) { x }\nf(1, 2)", "2:1: f expects 1 arguments, got 2"},
+		{`def f(x: int) { x } f("a")`, "1:21: cannot use string as int in argument x of f"},
+		{`len()`, "1:1: len expects 1 arguments, got 0"},
+		{`def f(): int { "a" }`, "1:1: cannot use string as int in return of f"},
+		{"def f(x: int): string {\n\treturn x\n}", "2:2: cannot use int as string in return"},
+		{`let x: int = "a"`, "1:1: cannot use string as int in declaration of x"},
+		{"var x = 1\nx = true", "2:3: cannot assign bool to x of type int"},
+		{"if 1 { 2 }", "1:1: condition must be bool, got int"},
+		{"type P { x: int }\nP{x: 1.5}", "cannot use float as int in field x of P"},
+		{"type P { x: int }\nlet p = P{x: 1}\np.x + \"a\"", "3:5: mismatched types int and string for +"},
+		{"enum E { A(x: int), B }\nA(\"a\")", "2:1: cannot use string as int in argument x of A"},
+		{"enum E { A(x: int), B }\nmatch A(1) { A(s) => s + \"a\", B => \"b\" }", "2:24: mismatched types int and string for +"},
+		{"match 1 { \"a\" => 1, _ => 2 }", "cannot match string against int"},
+		{"let x = 1\nx(2)", "2:1: cannot call x of type int"},
+		{`let f = fn(x: int) { x } f("a")`, "1:26: cannot use string as int in argument 1 of f"},
+		{"def add(x, y) { x + y }\nadd(1, \"a\")", "2:1: cannot use string as int in argument y of add"},
+		{"def f(x) { x * 2 }\nf(true)", "2:1: cannot use bool as int in argument x of f"},
+		{"def fact(n) { if n < 2 { 1 } else { n * fact(n - 1) } }\nfact(1.5)", "2:1: cannot use float as int in argument n of fact"},
+		{"let f = fn(x) { x }\nvar g = f\ng(1) + g(\"a\")", "3:8: cannot use string as int in argument 1 of g"},
+		{"def f(x) { x(1) }\nf(2)", "2:1: cannot use int as fn(int): a in argument x of f"},
+		{"type P { x: int }\ntype Q { x: int }\ndef f(a) { a.x }\nf(P{x: 1})\nf(Q{x: 1})", "5:1: cannot use Q as P in argument a of f"},
+		{"var s = \"a\"\ns += 1", "2:3: mismatched types string and int for +"},
+		{"try { 1 } catch e { e.message + 1 }", "1:31: mismatched types string and int for +"},
+		{"def f(x: int, y: int = 1) { x + y }\nf(y: 2)", "2:1: missing argument x in call to f"},
+		{"def f(x: int) { x }\nf(x: 1, x: 2)", "2:1: argument x of f is given twice"},
+		{"def f(x: int) { x }\nf(z: 1)", "2:1: f has no argument z"},
+		{"def f(x: int, y: int) { x }\nf(x: 1, 2)", "2:1: positional argument after named arguments in call to f"},
+		{"def f(x: int = \"a\") { x }", "1:1: cannot use string as int in default of x"},
+		{"def sum(xs: ...int) { xs }\nsum(1, \"a\")", "2:1: cannot use string as int in argument xs of sum"},
+		{"def sum(xs: ...int) { xs }\nsum(xs: 1)", "2:1: variadic argument xs of sum cannot be named"},
+		{"let f = fn(x: int) { x }\nf(x: 1)", "2:1: f takes no named arguments"},
+		{"def f(x: int, y: int = 1) { x + y }\nlet g = f\ng()", "3:1: missing argument x in call to g"},
+		{"def sum(xs: ...int) { xs }\ndef apply(h) { h(1, \"a\") }\napply(sum)", "3:1: cannot use fn(list): list as fn(int, string): a in argument h of apply"},
+		{"const N = 1\nN + \"a\"", "2:3: mismatched types int and string for +"},
+		{"const N: string = 1", "1:1: cannot use int as string in declaration of N"},
+		{"def inc(x: int) { x + 1 }\n\"a\".inc()", "2:5: cannot use string as int in argument x of inc"},
+		{"type P { x: int }\ndef P.get(p: P): int { p.x }\nlet p = P{x: 1}\np.get() + \"a\"", "4:9: mismatched types int and string for +"},
+		{"type V { x: int }\ndef (a: V) + (b: V): V { a }\nlet v = V{x: 1}\nv + 1", "4:3: mismatched types V and int for +"},
+		{"def add(a: int, b: int) { a + b }\ninfixl 6 <+> = add\n1 <+> \"a\"", "3:3: cannot use string as int in argument b of <+>"},
+	} {
+		module, err := Parse(test.code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", test.code, err)
+			continue
+		}
+		_, errs := TypeCheck(module)
+		if len(errs) != 1 || errs[0].Error() != test.expected && !strings.HasSuffix(errs[0].Error(), ": "+test.expected) {
+			t.Errorf("Expecting %q from %s, got %v", test.expected, test.code, errs)
+		}
+	}
+
+	for _, code := range []string{
+		`def f(x: int): int { x * 2 } f(3) + len("ab")`,
+		`let x: any = 1 x + "a"`,
+		"def f(xs: list) { xs[0] + 1 } f([1])",
+		`def f(x: float) { x } f(g()) def g() { 1.5 }`,
+		`def f(p: h.Point) { p.x } 1`,
+		"enum E { A(x: int), B }\nmatch A(1) { A(x) => x + 1, B => 0 }",
+		"def f(x: int, y: int = 10) { x + y } f(1) + f(y: 2, x: 3)",
+		"def sum(xs: ...int) { xs } len(sum()) + len(sum(1, 2))",
+		"def f(x: int, y: int = 10) { x + y } let g = f g(1) + g(2, 3)",
+		"def sum(xs: ...int) { xs } def apply(h) { h(1, 2) } len(apply(sum))",
+		"type P { x: int }\ndef P.len(p: P) { p.x }\nlet p = P{x: 1}\np.len() + \"abc\".len()",
+		"type V { x: int }\ndef (a: V) + (b: V): V { a }\nlet v = V{x: 1}\n(v + v).x + 1",
+	} {
+		module, err := Parse(code)
+		if err != nil {
+			t.Errorf("Should parse: %s - %s", code, err)
+			continue
+		}
+		if _, errs := TypeCheck(module); len(errs) > 0 {
+			t.Errorf("Should type check: %s - %v", code, errs)
+		}
+	}
+}
+
+func TestInferTypes(t *testing.T) {
+	module, err := Parse(`
+def id(x) { x }
+def add(x, y) { x + y }
+def fact(n) { if n < 2 { 1 } else { n * fact(n - 1) } }
+def even(n) { if n == 0 { true } else { odd(n - 1) } }
+def odd(n) { if n == 0 { false } else { even(n - 1) } }
+type P { x: int, y: int }
+def norm(p) { p.x * p.x + p.y * p.y }
+let compose = fn(f, g) { fn(x) { f(g(x)) } }
+let s = id("a") + id("b")
+var total = 0
+for i in 0..3 { total += add(i, 1) }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures, errs := InferTypes(module)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	expected := []string{
+		"2:1: id: fn(a): a",
+		"3:1: add: fn(a, a): a where a: int|float|string",
+		"4:1: fact: fn(int): int",
+		"5:1: even: fn(int): bool",
+		"6:1: odd: fn(int): bool",
+		"8:1: norm: fn(P): int",
+		"9:1: compose: fn(fn(a): b, fn(c): a): fn(c): b",
+		"10:1: s: string",
+		"11:1: total: int",
+	}
+	if len(signatures) != len(expected) {
+		t.Fatalf("Expecting %d signatures, got %v", len(expected), signatures)
+	}
+	for i, signature := range signatures {
+		if signature.String() != expected[i] {
+			t.Errorf("Expecting %s, got %s", expected[i], signature)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package parser
+
+// Visitor's Visit is called by Walk for every node. When the visitor w it
+// returns isn't nil, Walk visits each of the children of node with w, then
+// calls w.Visit(nil)
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree rooted at node depth first, visiting the children
+// of a node in the order they appear in the source. Patterns are not nodes,
+// they aren't visited, and neither are the bodies of macros
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	mapChildren(node, func(child Node) Node {
+		Walk(v, child)
+		return child
+	})
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree rooted at node like Walk, calling f on every
+// node. The children of a node are only inspected when f returns true for
+// it, f(nil) being called after them
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrite returns a copy of the tree rooted at node, rebuilt bottom up: the
+// children of a node are rewritten first, then f is given the node holding
+// them and returns its replacement, node itself to keep it. f may return nil
+// for the optional children only, such as the Else of an IfNode. The tree
+// given isn't modified
+func Rewrite(node Node, f func(Node) Node) Node {
+	return f(mapChildren(node, func(child Node) Node {
+		return Rewrite(child, f)
+	}))
+}
+
+// mapChildren returns a copy of node whose children are replaced by f of
+// them, in the order they appear in the source. The bodies of macros are
+// not children, they're run by Expand rather than being part of the code.
+// Where a BlockNode is expected, a node of another kind returned by f is
+// wrapped in a block
+func mapChildren(node Node, f func(node Node) Node) Node {
+	optional := func(child Node) Node {
+		if child == nil {
+			return nil
+		}
+		return f(child)
+	}
+	each := func(children []Node) []Node {
+		if children == nil {
+			return nil
+		}
+		mapped := make([]Node, len(children))
+		for i, child := range children {
+			mapped[i] = optional(child)
+		}
+		return mapped
+	}
+	block := func(child BlockNode) BlockNode {
+		switch mapped := f(child).(type) {
+		case BlockNode:
+			return mapped
+		case nil:
+			return BlockNode{[]Node{}}
+		default:
+			return BlockNode{[]Node{mapped}}
+		}
+	}
+
+	switch n := node.(type) {
+	case FunctionDefNode:
+		n.Defaults = each(n.Defaults)
+		n.Block = block(n.Block)
+		return n
+	case LambdaNode:
+		n.Block = block(n.Block)
+		return n
+	case FunctionCallNode:
+		n.ParamList = each(n.ParamList)
+		return n
+	case CallNode:
+		n.Callee = f(n.Callee)
+		n.ParamList = each(n.ParamList)
+		return n
+	case MethodCallNode:
+		n.Receiver = f(n.Receiver)
+		n.ParamList = each(n.ParamList)
+		return n
+	case BinaryOperatorNode:
+		n.Left = f(n.Left)
+		n.Right = f(n.Right)
+		return n
+	case ListLiteralNode:
+		n.Elements = each(n.Elements)
+		return n
+	case MapLiteralNode:
+		keys, values := make([]Node, len(n.Keys)), make([]Node, len(n.Values))
+		for i := range n.Keys {
+			keys[i] = f(n.Keys[i])
+			values[i] = f(n.Values[i])
+		}
+		n.Keys, n.Values = keys, values
+		return n
+	case IndexNode:
+		n.Container = f(n.Container)
+		n.Index = f(n.Index)
+		return n
+	case SliceNode:
+		n.Container = f(n.Container)
+		n.Low = optional(n.Low)
+		n.High = optional(n.High)
+		return n
+	case IndexAssignmentNode:
+		n.Container = f(n.Container)
+		n.Index = f(n.Index)
+		n.Expr = f(n.Expr)
+		return n
+	case StructLiteralNode:
+		n.Values = each(n.Values)
+		return n
+	case FieldNode:
+		n.Object = f(n.Object)
+		return n
+	case FieldAssignmentNode:
+		n.Object = f(n.Object)
+		n.Expr = f(n.Expr)
+		return n
+	case CompoundAssignmentNode:
+		n.Target = f(n.Target)
+		n.Expr = f(n.Expr)
+		return n
+	case UnaryOperatorNode:
+		n.Operand = f(n.Operand)
+		return n
+	case DeclarationNode:
+		n.Expr = f(n.Expr)
+		return n
+	case ConstNode:
+		n.Expr = f(n.Expr)
+		return n
+	case AssignmentNode:
+		n.Expr = f(n.Expr)
+		return n
+	case IfNode:
+		n.Cond = f(n.Cond)
+		n.Then = block(n.Then)
+		n.Else = optional(n.Else)
+		return n
+	case WhileNode:
+		n.Cond = f(n.Cond)
+		n.Block = block(n.Block)
+		return n
+	case ForNode:
+		n.Iterable = f(n.Iterable)
+		n.Block = block(n.Block)
+		return n
+	case RangeNode:
+		n.From = f(n.From)
+		n.To = f(n.To)
+		return n
+	case MatchNode:
+		n.Value = f(n.Value)
+		arms := make([]MatchArm, len(n.Arms))
+		for i, arm := range n.Arms {
+			arms[i] = MatchArm{arm.Pattern, f(arm.Body)}
+		}
+		n.Arms = arms
+		return n
+	case TryNode:
+		n.Try = block(n.Try)
+		n.Catch = optional(n.Catch)
+		n.Finally = optional(n.Finally)
+		return n
+	case ThrowNode:
+		n.Expr = f(n.Expr)
+		return n
+	case ReturnNode:
+		n.Expr = optional(n.Expr)
+		return n
+	case MacroCallNode:
+		n.Args = each(n.Args)
+		return n
+	case QuoteNode:
+		n.Block = block(n.Block)
+		return n
+	case BlockNode:
+		n.ExprList = each(n.ExprList)
+		return n
+	case ModuleNode:
+		n.Block = block(n.Block)
+		return n
+	}
+	return node
+}
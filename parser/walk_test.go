@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// records the names, literals and operators it visits, the operands of an
+// operator being closed by ")"
+type tracer struct {
+	trace *[]string
+}
+
+func (v tracer) Visit(node Node) Visitor {
+	switch n := node.(type) {
+	case IdentifierNode:
+		*v.trace = append(*v.trace, n.Name)
+	case IntegerLiteralNode:
+		*v.trace = append(*v.trace, printNode(n))
+	case BinaryOperatorNode:
+		*v.trace = append(*v.trace, "("+n.Operator)
+		return closer{v}
+	case LambdaNode:
+		// not walked
+		*v.trace = append(*v.trace, "fn")
+		return nil
+	}
+	return v
+}
+
+type closer struct {
+	tracer
+}
+
+func (v closer) Visit(node Node) Visitor {
+	if node == nil {
+		*v.trace = append(*v.trace, ")")
+		return nil
+	}
+	return v.tracer.Visit(node)
+}
+
+func TestWalk(t *testing.T) {
+	module, err := Parse(`let m = {a: 1, b: x + 2 * y} if m { f(z) } else { fn() { w } } (h)(v)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := []string{}
+	Walk(tracer{&trace}, module)
+	expected := "a 1 b (+ x (* 2 y ) ) m z fn h v"
+	if got := strings.Join(trace, " "); got != expected {
+		t.Errorf("Expecting %s, got %s", expected, got)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	module, err := Parse(`
+def f(x) { x + g(x) }
+def g(y) { let z = y * 2 z }
+f(1) + g(2)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := map[string]int{}
+	Inspect(module, func(node Node) bool {
+		switch n := node.(type) {
+		case FunctionCallNode:
+			calls[n.Name]++
+		case FunctionDefNode:
+			// skip the body of g
+			return n.Name != "g"
+		}
+		return true
+	})
+	if len(calls) != 2 || calls["f"] != 1 || calls["g"] != 2 {
+		t.Errorf("Wrong calls: %v", calls)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	module, err := Parse(`var x = 1 + 2 * 3 if x > 0 { x + 1 * 2 } else { -(4 - 1) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fold the operations on integers
+	fold := func(node Node) Node {
+		switch n := node.(type) {
+		case BinaryOperatorNode:
+			left, ok1 := n.Left.(IntegerLiteralNode)
+			right, ok2 := n.Right.(IntegerLiteralNode)
+			if !ok1 || !ok2 {
+				return n
+			}
+			switch n.Operator {
+			case "+":
+				return IntegerLiteralNode{left.Value + right.Value}
+			case "-":
+				return IntegerLiteralNode{left.Value - right.Value}
+			case "*":
+				return IntegerLiteralNode{left.Value * right.Value}
+			}
+		case UnaryOperatorNode:
+			if operand, ok := n.Operand.(IntegerLiteralNode); ok && n.Operator == "-" {
+				return IntegerLiteralNode{-operand.Value}
+			}
+		}
+		return node
+	}
+	folded := Rewrite(module, fold)
+	expected := "var x = 7\nif x > 0 {\n    x + 2\n} else {\n    -3\n}\n"
+	if source := Print(folded); source != expected {
+		t.Errorf("Expecting:\n%s\ngot:\n%s", expected, source)
+	}
+	if source := Print(module); !strings.HasPrefix(source, "var x = 1 + 2 * 3") {
+		t.Errorf("The original tree shouldn't change:\n%s", source)
+	}
+
+	// a block replaced by an expression is wrapped in a new block
+	unwrapped := Rewrite(module, func(node Node) Node {
+		if block, ok := node.(BlockNode); ok && len(block.ExprList) == 1 {
+			return block.ExprList[0]
+		}
+		return node
+	})
+	if _, ok := unwrapped.(ModuleNode).Block.ExprList[1].(IfNode).Then.ExprList[0].(BinaryOperatorNode); !ok {
+		t.Errorf("Expecting the block to be kept: %s", printNode(unwrapped))
+	}
+}
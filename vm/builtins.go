@@ -0,0 +1,73 @@
+package vm
+
+import "fmt"
+
+/* --- Functions implemented by the interpreter --- */
+
+type Builtin struct {
+	Name    string
+	NumArgs int64
+	// the type of the result, empty when it varies
+	Type string
+	Func func(args []interface{}) (interface{}, error)
+}
+
+// The CodeBuilder resolves names to builtins when nothing else matches,
+// INST_BUILTIN refers to them by index
+var Builtins = []Builtin{
+	{"len", 1, "int", builtinLen},
+	{"has", 2, "bool", builtinHas},
+	{"delete", 2, "", builtinDelete},
+	{"tag", 1, "string", builtinTag},
+}
+
+func builtinLen(args []interface{}) (interface{}, error) {
+	switch value := args[0].(type) {
+	case *List:
+		return int64(len(value.Elements)), nil
+	case *Map:
+		return value.Len(), nil
+	case string:
+		return int64(len(value)), nil
+	}
+	return nil, fmt.Errorf("len of unsupported value %v", args[0])
+}
+
+// has(map, key)
+func builtinHas(args []interface{}) (interface{}, error) {
+	m, ok := args[0].(*Map)
+	if !ok {
+		return nil, fmt.Errorf("has expects a map, got %v", args[0])
+	}
+	return m.Has(args[1]), nil
+}
+
+// delete(map, key), deleting a missing key does nothing
+func builtinDelete(args []interface{}) (interface{}, error) {
+	m, ok := args[0].(*Map)
+	if !ok {
+		return nil, fmt.Errorf("delete expects a map, got %v", args[0])
+	}
+	m.Delete(args[1])
+	return nil, nil
+}
+
+// tag(value) is the name of the variant of an enum value
+func builtinTag(args []interface{}) (interface{}, error) {
+	object, ok := args[0].(*Struct)
+	if !ok || object.Type.Enum == nil {
+		return nil, fmt.Errorf("tag expects an enum value, got %s", Repr(args[0]))
+	}
+	return object.Type.Name, nil
+}
+
+// BuiltinID returns the index of the builtin name, for generated code that
+// must reach the builtin even when a script shadows it
+func BuiltinID(name string) int64 {
+	for i, builtin := range Builtins {
+		if builtin.Name == name {
+			return int64(i)
+		}
+	}
+	panic("No builtin " + name)
+}
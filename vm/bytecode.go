@@ -12,6 +12,34 @@ const (
 	INST_BINARY
 	INST_INVOKE
 	INST_ASSIGN
+	INST_UNARY
+	INST_LOAD
+	INST_CONST
+	INST_JUMP
+	INST_JUMP_IF_FALSE
+	INST_MARK
+	INST_UNWIND
+	INST_RETURN
+	INST_DEFINE
+	INST_CLOSURE
+	INST_CALL
+	INST_LOAD_UPVAL
+	INST_ASSIGN_UPVAL
+	INST_LOAD_GLOBAL
+	INST_ASSIGN_GLOBAL
+	INST_BUILTIN
+	INST_LIST
+	INST_INDEX
+	INST_SET_INDEX
+	INST_SLICE
+	INST_ITER
+	INST_MAP
+	INST_STRUCT
+	INST_GET_FIELD
+	INST_SET_FIELD
+	INST_IS_STRUCT
+	INST_NO_MATCH
+	INST_THROW
 )
 
 const ARG_NOOP int64 = 0xFFFFFFFF
@@ -21,6 +49,21 @@ const (
 	ARG_OP_MUL
 	ARG_OP_DIV
 	ARG_OP_ASSIGN
+	ARG_OP_NEG
+	ARG_OP_EQ
+	ARG_OP_NE
+	ARG_OP_LT
+	ARG_OP_LE
+	ARG_OP_GT
+	ARG_OP_GE
+	ARG_OP_MOD
+	ARG_OP_POW
+	ARG_OP_AND
+	ARG_OP_OR
+	ARG_OP_XOR
+	ARG_OP_SHL
+	ARG_OP_SHR
+	ARG_OP_NOT
 )
 
 // Base type
@@ -52,6 +95,118 @@ type AssignInstruction struct {
 	Instruction
 }
 
+type UnaryInstruction struct {
+	Instruction
+}
+
+type LoadInstruction struct {
+	Instruction
+}
+
+type ConstInstruction struct {
+	Instruction
+}
+
+type JumpInstruction struct {
+	Instruction
+}
+
+type JumpIfFalseInstruction struct {
+	Instruction
+}
+
+type MarkInstruction struct {
+	Instruction
+}
+
+type UnwindInstruction struct {
+	Instruction
+}
+
+type ReturnInstruction struct {
+	Instruction
+}
+
+type DefineInstruction struct {
+	Instruction
+}
+
+type ClosureInstruction struct {
+	Instruction
+}
+
+type CallInstruction struct {
+	Instruction
+}
+
+type LoadUpvalInstruction struct {
+	Instruction
+}
+
+type AssignUpvalInstruction struct {
+	Instruction
+}
+
+type LoadGlobalInstruction struct {
+	Instruction
+}
+
+type AssignGlobalInstruction struct {
+	Instruction
+}
+
+type BuiltinInstruction struct {
+	Instruction
+}
+
+type ListInstruction struct {
+	Instruction
+}
+
+type IndexInstruction struct {
+	Instruction
+}
+
+type SetIndexInstruction struct {
+	Instruction
+}
+
+type SliceInstruction struct {
+	Instruction
+}
+
+type IterInstruction struct {
+	Instruction
+}
+
+type MapInstruction struct {
+	Instruction
+}
+
+type StructInstruction struct {
+	Instruction
+}
+
+type GetFieldInstruction struct {
+	Instruction
+}
+
+type SetFieldInstruction struct {
+	Instruction
+}
+
+type IsStructInstruction struct {
+	Instruction
+}
+
+type NoMatchInstruction struct {
+	Instruction
+}
+
+type ThrowInstruction struct {
+	Instruction
+}
+
 // Put value ontop of stack. Value could be anything castable to int64
 // StackSize +1
 func PushInst(value int64) Instruction {
@@ -76,6 +231,32 @@ func BinaryInst(op string) Instruction {
 		return Instruction{INST_BINARY, ARG_OP_MUL, ARG_NOOP}
 	case "/":
 		return Instruction{INST_BINARY, ARG_OP_DIV, ARG_NOOP}
+	case "==":
+		return Instruction{INST_BINARY, ARG_OP_EQ, ARG_NOOP}
+	case "!=":
+		return Instruction{INST_BINARY, ARG_OP_NE, ARG_NOOP}
+	case "<":
+		return Instruction{INST_BINARY, ARG_OP_LT, ARG_NOOP}
+	case "<=":
+		return Instruction{INST_BINARY, ARG_OP_LE, ARG_NOOP}
+	case ">":
+		return Instruction{INST_BINARY, ARG_OP_GT, ARG_NOOP}
+	case ">=":
+		return Instruction{INST_BINARY, ARG_OP_GE, ARG_NOOP}
+	case "%":
+		return Instruction{INST_BINARY, ARG_OP_MOD, ARG_NOOP}
+	case "**":
+		return Instruction{INST_BINARY, ARG_OP_POW, ARG_NOOP}
+	case "&":
+		return Instruction{INST_BINARY, ARG_OP_AND, ARG_NOOP}
+	case "|":
+		return Instruction{INST_BINARY, ARG_OP_OR, ARG_NOOP}
+	case "^":
+		return Instruction{INST_BINARY, ARG_OP_XOR, ARG_NOOP}
+	case "<<":
+		return Instruction{INST_BINARY, ARG_OP_SHL, ARG_NOOP}
+	case ">>":
+		return Instruction{INST_BINARY, ARG_OP_SHR, ARG_NOOP}
 	}
 	panic("Don't let this happen")
 }
@@ -91,3 +272,195 @@ func InvokeInst(id int64) Instruction {
 func AssignInst(id int64) Instruction {
 	return Instruction{INST_ASSIGN, id, ARG_NOOP}
 }
+
+// Pops 1 value from the stack, compute the operation, then push the value back
+// StackSize: 0
+func UnaryInst(op string) Instruction {
+	switch op {
+	case "-":
+		return Instruction{INST_UNARY, ARG_OP_NEG, ARG_NOOP}
+	case "~":
+		return Instruction{INST_UNARY, ARG_OP_NOT, ARG_NOOP}
+	}
+	panic("Don't let this happen")
+}
+
+// Push the value of the variable ID of the current function
+// StackSize: +1
+func LoadInst(id int64) Instruction {
+	return Instruction{INST_LOAD, id, ARG_NOOP}
+}
+
+// Push the constant ID from the interpreter's constant pool. Used for every
+// value that doesn't fit in an int64 argument
+// StackSize: +1
+func ConstInst(id int64) Instruction {
+	return Instruction{INST_CONST, id, ARG_NOOP}
+}
+
+// Continue execution at the given index of the current function
+// StackSize: 0
+func JumpInst(target int64) Instruction {
+	return Instruction{INST_JUMP, target, ARG_NOOP}
+}
+
+// Pops a bool from the stack, jumps to the given index of the current function
+// if it's false
+// StackSize: -1
+func JumpIfFalseInst(target int64) Instruction {
+	return Instruction{INST_JUMP_IF_FALSE, target, ARG_NOOP}
+}
+
+// Stores the current stack height into the variable ID
+// StackSize: 0
+func MarkInst(id int64) Instruction {
+	return Instruction{INST_MARK, id, ARG_NOOP}
+}
+
+// Pops values until the stack height is back to the one stored by MarkInst
+// into the variable ID. Lets break and continue leave a loop in the middle
+// of an expression
+// StackSize: varies
+func UnwindInst(id int64) Instruction {
+	return Instruction{INST_UNWIND, id, ARG_NOOP}
+}
+
+// Pops the return value, discards whatever the current function left on the
+// stack, leaves the function and pushes the return value back for the caller
+// StackSize: callee's stack gone, +1 for the caller
+func ReturnInst() Instruction {
+	return Instruction{INST_RETURN, ARG_NOOP, ARG_NOOP}
+}
+
+// Like AssignInst, but the variable gets a new cell. Closures created before
+// keep seeing the old one, e.g. the ones created in previous loop iterations
+// StackSize: -1
+func DefineInst(id int64) Instruction {
+	return Instruction{INST_DEFINE, id, ARG_NOOP}
+}
+
+// Push a closure of the function ID, capturing the function's upvalues from
+// the current function
+// StackSize: +1
+func ClosureInst(id int64) Instruction {
+	return Instruction{INST_CLOSURE, id, ARG_NOOP}
+}
+
+// Pops a closure, then invoke it with the given number of arguments
+// StackSize: -(number of arguments)
+func CallInst(numArgs int64) Instruction {
+	return Instruction{INST_CALL, numArgs, ARG_NOOP}
+}
+
+// Push the value of the upvalue ID of the current closure
+// StackSize: +1
+func LoadUpvalInst(id int64) Instruction {
+	return Instruction{INST_LOAD_UPVAL, id, ARG_NOOP}
+}
+
+// Pops the topmost value from the stack and assigns it to the upvalue ID of
+// the current closure
+// StackSize: -1
+func AssignUpvalInst(id int64) Instruction {
+	return Instruction{INST_ASSIGN_UPVAL, id, ARG_NOOP}
+}
+
+// Push the value of the global ID, a variable declared at the top level of a
+// module
+// StackSize: +1
+func LoadGlobalInst(id int64) Instruction {
+	return Instruction{INST_LOAD_GLOBAL, id, ARG_NOOP}
+}
+
+// Pops the topmost value from the stack and assigns it to the global ID
+// StackSize: -1
+func AssignGlobalInst(id int64) Instruction {
+	return Instruction{INST_ASSIGN_GLOBAL, id, ARG_NOOP}
+}
+
+// Call the builtin ID with the given number of arguments, they're popped
+// and the result pushed
+// StackSize: 1 - (number of arguments)
+func BuiltinInst(id int64, numArgs int64) Instruction {
+	return Instruction{INST_BUILTIN, id, numArgs}
+}
+
+// Pops the given number of values, then push a list of them in the order
+// they were pushed
+// StackSize: 1 - (number of elements)
+func ListInst(size int64) Instruction {
+	return Instruction{INST_LIST, size, ARG_NOOP}
+}
+
+// For container[index], we expect the container then the index to be pushed.
+// Pops both and push the element
+// StackSize: -1
+func IndexInst() Instruction {
+	return Instruction{INST_INDEX, ARG_NOOP, ARG_NOOP}
+}
+
+// For container[index] = value, we expect the container, the index then the
+// value to be pushed. Pops all 3, store the value then push it back
+// StackSize: -2
+func SetIndexInst() Instruction {
+	return Instruction{INST_SET_INDEX, ARG_NOOP, ARG_NOOP}
+}
+
+// For container[low:high], we expect the container, low then high to be
+// pushed, nil for an omitted bound. Pops all 3 and push a new list
+// StackSize: -2
+func SliceInst() Instruction {
+	return Instruction{INST_SLICE, ARG_NOOP, ARG_NOOP}
+}
+
+// Pops an iterable value and push the list of values a for loop over it
+// goes through
+// StackSize: 0
+func IterInst() Instruction {
+	return Instruction{INST_ITER, ARG_NOOP, ARG_NOOP}
+}
+
+// Pops the given number of key and value pairs, pushed as key1 value1 key2
+// value2 ..., then push a map of them in that order
+// StackSize: 1 - 2 * (number of entries)
+func MapInst(size int64) Instruction {
+	return Instruction{INST_MAP, size, ARG_NOOP}
+}
+
+// Pops the fields of the struct type ID, pushed in declaration order, then
+// push a struct of them
+// StackSize: 1 - (number of fields)
+func StructInst(id int64) Instruction {
+	return Instruction{INST_STRUCT, id, ARG_NOOP}
+}
+
+// Pops a struct of the type ID and push its field at index
+// StackSize: 0
+func GetFieldInst(id int64, index int64) Instruction {
+	return Instruction{INST_GET_FIELD, id, index}
+}
+
+// For object.field = value, we expect the struct of the type ID then the
+// value to be pushed. Pops both, store the value at index then push it back
+// StackSize: -1
+func SetFieldInst(id int64, index int64) Instruction {
+	return Instruction{INST_SET_FIELD, id, index}
+}
+
+// Pops a value and push whether it's a struct of the type ID
+// StackSize: 0
+func IsStructInst(id int64) Instruction {
+	return Instruction{INST_IS_STRUCT, id, ARG_NOOP}
+}
+
+// Pops the value no arm of a match accepts, and fails with an error naming it
+// StackSize: -1
+func NoMatchInst() Instruction {
+	return Instruction{INST_NO_MATCH, ARG_NOOP, ARG_NOOP}
+}
+
+// Pops a value and raise it as an exception, see Handler
+// StackSize: -1
+func ThrowInst() Instruction {
+	return Instruction{INST_THROW, ARG_NOOP, ARG_NOOP}
+}
@@ -1,6 +1,12 @@
 package vm
 
-import "github.com/trungaczne/gimmick/utils"
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/trungaczne/gimmick/utils"
+)
 
 /* --- Generic code builder, hopefully extensible --- */
 
@@ -9,20 +15,156 @@ type NameType struct {
 	Type string
 }
 
+// Param is an argument of a function defined with DefineFunc
+type Param struct {
+	NameType
+	// the value of the argument when omitted, a constant
+	Default    interface{}
+	HasDefault bool
+	// the last argument may be variadic, collecting the remaining
+	// arguments into a list
+	Variadic bool
+}
+
+// Variant is a case of an enum, see DefineEnum
+type Variant struct {
+	Name   string
+	Fields []NameType
+}
+
 type ScopedBuilder func(scopedBuilder CodeBuilder)
 
 type CodeBuilder interface {
 	Push(instructions ...Instruction)
-	DefineFunc(signature []NameType, builder ScopedBuilder)
-	Resolve(symbol string) int64
-	ResolveOrDefine(symbol string) int64
+	// DeclareFunc declares a function so it can be called before being
+	// defined, params are resolved by the callers, see Params
+	DeclareFunc(name string, params []Param) int64
+	DefineFunc(name string, params []Param, builder ScopedBuilder) int64
+	// MarkConst lets Evaluate call the function id, which has to be free of
+	// side effects
+	MarkConst(id int64)
+	// DefineOperator makes the function id the implementation of the binary
+	// operator for operands of the types left and right, one of them at
+	// least being a struct type or an enum. The interpreter calls it when
+	// INST_BINARY finds operands of these types
+	DefineOperator(operator string, left string, right string, id int64)
+	// Operator returns the function implementing operator for operands of
+	// the types left and right, if any
+	Operator(operator string, left string, right string) (int64, bool)
+	// DefineLambda defines an anonymous function, which unlike the ones
+	// from DefineFunc can capture variables of the enclosing functions
+	DefineLambda(signature []NameType, builder ScopedBuilder) int64
+	// Resolve and Lookup accept the qualified names of the members of a
+	// module, module.name, and of the functions associated with a type,
+	// Type.name
+	Resolve(symbol string) Symbol
+	// Lookup finds a symbol without capturing it or reporting an error, to
+	// query compile time information such as its DataType
+	Lookup(symbol string) (Symbol, bool)
+	// DefineAlias makes name another name of sym in the innermost scope
+	DefineAlias(name string, sym Symbol)
+	// Define declares a variable in the innermost scope. It may shadow a
+	// symbol of an enclosing scope, but not one of the same scope. dataType
+	// is the name of its type, empty when unknown
+	Define(symbol string, readOnly bool, dataType string) int64
+	// Evaluate builds code as a function of its own and runs it at compile
+	// time, returning the value it leaves on the stack. The code can only
+	// call the functions marked with MarkConst and already defined. The
+	// value is nil when building the code failed, the errors being reported
+	Evaluate(name string, code ScopedBuilder) (interface{}, error)
+	// DefineConst declares a constant holding value in the innermost scope
+	DefineConst(name string, value interface{}) int64
+	// ConstValue is the value of the constant id
+	ConstValue(id int64) interface{}
+	// DefineType declares a struct type in the innermost scope
+	DefineType(name string, fields []NameType) int64
+	Type(id int64) *StructType
+	// DefineEnum declares an enum in the innermost scope, along with its
+	// variants, which are in scope on their own like Haskell's
+	// constructors
+	DefineEnum(name string, variants []Variant) int64
+	Enum(id int64) *EnumType
+	// Params are the arguments the function id was declared with, nil when
+	// they aren't known
+	Params(id int64) []Param
+	// ResolveField returns the type ID and index of a field of the struct
+	// type or variant typeName. When typeName is an enum, the field is
+	// looked up in its variants, and in every struct type when it isn't a
+	// known type. Either way it has to be unambiguous
+	ResolveField(typeName string, field string) (int64, int64)
+	// ResolveMethod returns the name of the function called by the method
+	// call value.method(), value being of type typeName: the function
+	// typeName.method associated with the type, or else method. When
+	// typeName isn't known, the only type having such a function is
+	// assumed, unless method is in scope as well
+	ResolveMethod(typeName string, method string) string
+	// BeginScope and EndScope delimit a lexical block
+	BeginScope()
+	EndScope()
+	Constant(value interface{}) int64
+	// NewLocal allocates an unnamed variable in the current function
+	NewLocal() int64
+
+	// Position is the index the next pushed instruction will have in the
+	// function currently being built. Patch rewrites the target of the jump
+	// at the given index, so forward jumps can be emitted before their
+	// target is known
+	Position() int64
+	Patch(position int64, target int64)
+
+	// BeginLoop and EndLoop surround the code of a loop. Break and Continue
+	// emit the jumps out of the innermost loop, they're patched by EndLoop:
+	// breaks to the position EndLoop is called at, continues to
+	// continueTarget
+	BeginLoop()
+	Break()
+	Continue()
+	EndLoop(continueTarget int64)
+
+	// AddHandler adds an entry to the exception table of the current
+	// function, see Handler. Inner handlers have to be added first
+	AddHandler(start int64, end int64, target int64, mark int64)
+	// BeginFinally and EndFinally delimit the code of a try block with a
+	// finally block, BeginFinally being called where the try block starts.
+	// Return, and Break and Continue out of a loop starting before
+	// BeginFinally, emit the code of finalizer before leaving. The handlers
+	// of the try block and of the enclosing ones don't cover that copy
+	BeginFinally(finalizer ScopedBuilder)
+	EndFinally()
+	// Return emits the return from the current function, the value being
+	// on top of the stack
+	Return()
+
+	// Errorf records a compile error, code generation carries on so that
+	// as many errors as possible are reported at once
+	Errorf(format string, args ...interface{})
+	// Warnf records a problem that doesn't stop the compilation
+	Warnf(format string, args ...interface{})
 }
 
 /* --- Default code builder --- */
 
 const (
-	SYM_FUN int64 = iota
+	SYM_FUN SymbolType = iota
 	SYM_VAR
+	// variable of an enclosing function captured by the current closure
+	SYM_UPVAL
+	// variable declared at the top level of the module, read from a function
+	SYM_GLOBAL
+	// function implemented by the interpreter, see Builtins
+	SYM_BUILTIN
+	// struct type, the ID indexes GimmickInterpreter.Types
+	SYM_TYPE
+	// imported module, see DefineModule
+	SYM_MODULE
+	// enum type, the ID indexes GimmickInterpreter.Enums
+	SYM_ENUM
+	// variant of an enum, the ID indexes GimmickInterpreter.Types. Its
+	// DataType is the name of the enum
+	SYM_VARIANT
+	// constant computed at compile time, the ID indexes
+	// GimmickInterpreter.Const
+	SYM_CONST
 )
 
 type SymbolType int64
@@ -30,35 +172,879 @@ type SymbolType int64
 type Symbol struct {
 	ID   int64
 	Type SymbolType
+	// variables declared with let can't be assigned to
+	ReadOnly bool
+	// the declared or inferred type name of a variable, empty if unknown
+	DataType string
 }
 
 type Scope struct {
-	// doesn't seem like anything else goes inside a scope, does there?
 	SymbolTable map[string]Symbol
+	// the function owning the scope, variables can't be accessed across
+	// function boundaries
+	FuncID int64
+}
+
+func NewScope(funcID int64) *Scope {
+	return &Scope{make(map[string]Symbol), funcID}
+}
+
+// a function whose code is still being generated
+type funcBuilder struct {
+	ID        int64
+	Name      string
+	Inst      []Instruction
+	NumArgs   int64
+	NumLocals int64
+	Loops     []*loopBuilder
+	IsClosure bool
+	// built by Evaluate
+	IsConst    bool
+	Upvalues   []Upvalue
+	Globals    map[int64]int64
+	Handlers   []Handler
+	Finalizers []finalizer
+	// the copies of finalizers emitted by jumps out of try blocks
+	Inlined []inlinedFinalizer
+}
+
+// the finally block of a try block starting at Start
+type finalizer struct {
+	Start int64
+	Code  ScopedBuilder
 }
 
-func NewScope() Scope {
-	return Scope{make(map[string]Symbol)}
+// a copy of the finally block of the try block starting at Try, emitted
+// from Start up to but excluding End
+type inlinedFinalizer struct {
+	Try   int64
+	Start int64
+	End   int64
+}
+
+// jumps out of a loop waiting to be patched
+type loopBuilder struct {
+	// variable holding the stack height when entering the loop
+	Mark      int64
+	Breaks    []int64
+	Continues []int64
+	// the number of finalizers of the function when entering the loop
+	Finalizers int
+}
+
+type CompileErrors []error
+
+func (errs CompileErrors) Error() string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
 }
 
 type GimmickBuilder struct {
 	ScopeStack utils.Stack
+	FuncStack  utils.Stack
+	Interp     *GimmickInterpreter
+	Errors     CompileErrors
+	Warnings   []error
+
+	constants map[interface{}]int64
+	// the top level scope of the module, its variables are globals
+	topLevel *Scope
+	// the exports of the modules defined with DefineModule
+	modules []map[string]Symbol
+}
+
+// NewBuilder creates a builder emitting code into interp. Top level code goes
+// into a new function, see Finish
+func NewBuilder(interp *GimmickInterpreter) *GimmickBuilder {
+	builder := &GimmickBuilder{Interp: interp, constants: make(map[interface{}]int64)}
+	// builtins live in their own scope, below the top level one, so they
+	// can be shadowed
+	builtins := NewScope(-1)
+	for i, builtin := range Builtins {
+		builtins.SymbolTable[builtin.Name] = Symbol{int64(i), SYM_BUILTIN, true, ""}
+	}
+	builtins.SymbolTable[interp.ErrorType.Name] = Symbol{interp.ErrorType.ID, SYM_TYPE, true, ""}
+	builder.ScopeStack.Push(builtins)
+	builder.beginFunc(interp.AddFunc(nil), "<module>")
+	builder.topLevel = builder.currentScope()
+	return builder
+}
+
+// Finish completes the top level function and returns its ID
+func (builder *GimmickBuilder) Finish() (int64, error) {
+	id := builder.endFunc()
+	if len(builder.Errors) > 0 {
+		return id, builder.Errors
+	}
+	return id, nil
 }
 
 // Interface methods
 
-func (builder GimmickBuilder) Push(instructions ...Instruction) {
+func (builder *GimmickBuilder) Push(instructions ...Instruction) {
+	fn := builder.currentFunc()
+	fn.Inst = append(fn.Inst, instructions...)
+}
+
+func (builder *GimmickBuilder) DeclareFunc(name string, params []Param) int64 {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already defined", name)
+		return -1
+	}
+	id := builder.Interp.AddFunc(nil)
+	builder.Interp.Func[id].Name = name
+	builder.Interp.Func[id].Params = params
+	scope.SymbolTable[name] = Symbol{id, SYM_FUN, true, ""}
+	return id
+}
+
+func (builder *GimmickBuilder) MarkConst(id int64) {
+	if id >= 0 && id < int64(len(builder.Interp.Func)) {
+		builder.Interp.Func[id].Const = true
+	}
+}
+
+// typeKey is the TypeKey of the values of the type name, empty when it
+// isn't known
+func (builder *GimmickBuilder) typeKey(name string) string {
+	switch name {
+	case "int", "float", "string", "bool", "list", "map":
+		return name
+	}
+	sym, ok := builder.Lookup(name)
+	if !ok {
+		return ""
+	}
+	switch sym.Type {
+	case SYM_TYPE:
+		return structTypeKey(builder.Type(sym.ID))
+	case SYM_ENUM:
+		return fmt.Sprintf("enum %d", sym.ID)
+	}
+	return ""
+}
+
+func (builder *GimmickBuilder) DefineOperator(operator string, left string, right string, id int64) {
+	leftKey, rightKey := builder.typeKey(left), builder.typeKey(right)
+	if leftKey == "" || rightKey == "" {
+		unknown := left
+		if leftKey != "" {
+			unknown = right
+		}
+		builder.Errorf("unknown type %s in the definition of operator %s", unknown, operator)
+		return
+	}
+	if leftKey == left && rightKey == right {
+		builder.Errorf("operator %s can't be defined on %s and %s, one of them has to be a struct type or an enum", operator, left, right)
+		return
+	}
+	key := OperatorKey{BinaryInst(operator).Arg1, leftKey, rightKey}
+	if builder.Interp.Operators == nil {
+		builder.Interp.Operators = map[OperatorKey]int64{}
+	}
+	if _, ok := builder.Interp.Operators[key]; ok {
+		builder.Errorf("operator %s is already defined on %s and %s", operator, left, right)
+		return
+	}
+	builder.Interp.Operators[key] = id
 }
 
-func (builder GimmickBuilder) DefineFunc(signature []NameType, scopedBuilder ScopedBuilder) {
+func (builder *GimmickBuilder) Operator(operator string, left string, right string) (int64, bool) {
+	leftKey, rightKey := builder.typeKey(left), builder.typeKey(right)
+	if leftKey == "" || rightKey == "" {
+		return 0, false
+	}
+	id, ok := builder.Interp.Operators[OperatorKey{BinaryInst(operator).Arg1, leftKey, rightKey}]
+	return id, ok
 }
 
-func (builder GimmickBuilder) Resolve(symbol string) int64 {
-	return -1
+func (builder *GimmickBuilder) DefineFunc(name string, params []Param, scopedBuilder ScopedBuilder) int64 {
+	sym, ok := builder.currentScope().SymbolTable[name]
+	if !ok {
+		// not hoisted, e.g. a definition nested inside an expression
+		builder.DeclareFunc(name, params)
+		sym = builder.currentScope().SymbolTable[name]
+	} else if sym.Type != SYM_FUN {
+		builder.Errorf("%s is already defined", name)
+		return -1
+	}
+
+	signature := []NameType{}
+	for _, param := range params {
+		if param.Variadic {
+			param.Type = "list"
+		}
+		signature = append(signature, param.NameType)
+	}
+	builder.beginFunc(sym.ID, name)
+	builder.defineArgs(name, signature)
+	scopedBuilder(builder)
+	builder.endFunc()
+	return sym.ID
 }
 
-func (builder GimmickBuilder) ResolveOrDefine(symbol string) int64 {
-	return -1
+func (builder *GimmickBuilder) DefineLambda(signature []NameType, scopedBuilder ScopedBuilder) int64 {
+	id := builder.Interp.AddFunc(nil)
+	builder.beginFunc(id, "fn")
+	builder.currentFunc().IsClosure = true
+	builder.defineArgs("fn", signature)
+	scopedBuilder(builder)
+	builder.endFunc()
+	return id
+}
+
+// EVALUATION_STEPS bounds the instructions run to evaluate constants, so
+// that a loop that never ends can't hang the compiler
+const EVALUATION_STEPS = 10000000
+
+func (builder *GimmickBuilder) Evaluate(name string, code ScopedBuilder) (interface{}, error) {
+	errors := len(builder.Errors)
+	id := builder.Interp.AddFunc(nil)
+	builder.beginFunc(id, name)
+	builder.currentFunc().IsConst = true
+	code(builder)
+	builder.endFunc()
+	if len(builder.Errors) > errors {
+		return nil, nil
+	}
+	if err := builder.checkConst(id, map[int64]bool{id: true}); err != nil {
+		return nil, err
+	}
+
+	// a separate stack, the code and data being shared
+	interp := &GimmickInterpreter{
+		Func:      builder.Interp.Func,
+		Const:     builder.Interp.Const,
+		Types:     builder.Interp.Types,
+		Enums:     builder.Interp.Enums,
+		ErrorType: builder.Interp.ErrorType,
+		MaxSteps:  EVALUATION_STEPS,
+		Operators: builder.Interp.Operators,
+	}
+	if err := interp.ExecFunc(id); err != nil {
+		return nil, err
+	}
+	return interp.Stack.Pop()
+}
+
+func (builder *GimmickBuilder) DefineConst(name string, value interface{}) int64 {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already declared in this scope", name)
+	}
+	id := builder.Interp.AddConst(value)
+	scope.SymbolTable[name] = Symbol{id, SYM_CONST, true, dataType(value)}
+	return id
+}
+
+func (builder *GimmickBuilder) ConstValue(id int64) interface{} {
+	if id < 0 || id >= int64(len(builder.Interp.Const)) {
+		return nil
+	}
+	return builder.Interp.Const[id]
+}
+
+// DefineModule makes the exports of another module available under name in
+// the innermost scope, see Exports
+func (builder *GimmickBuilder) DefineModule(name string, exports map[string]Symbol) int64 {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already defined", name)
+		return -1
+	}
+	builder.modules = append(builder.modules, exports)
+	id := int64(len(builder.modules) - 1)
+	scope.SymbolTable[name] = Symbol{id, SYM_MODULE, true, ""}
+	return id
+}
+
+// Exports returns the functions and types defined at the top level, except
+// the ones starting with an underscore. It has to be called before Finish
+func (builder *GimmickBuilder) Exports() map[string]Symbol {
+	exports := map[string]Symbol{}
+	for name, sym := range builder.topLevel.SymbolTable {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		switch sym.Type {
+		case SYM_FUN, SYM_TYPE, SYM_ENUM, SYM_VARIANT, SYM_CONST:
+			exports[name] = sym
+		}
+	}
+	return exports
+}
+
+func (builder *GimmickBuilder) Resolve(symbol string) Symbol {
+	if dot := strings.Index(symbol, "."); dot >= 0 {
+		sym, err := builder.member(symbol[0:dot], symbol[dot+1:])
+		if err != nil {
+			builder.Errorf("%v", err)
+			return Symbol{-1, SYM_VAR, false, ""}
+		}
+		return sym
+	}
+	funcID := builder.currentFunc().ID
+	for i := len(builder.ScopeStack.Value) - 1; i >= 0; i-- {
+		scope := builder.ScopeStack.Value[i].(*Scope)
+		sym, ok := scope.SymbolTable[symbol]
+		if !ok {
+			continue
+		}
+		if sym.Type != SYM_VAR || scope.FuncID == funcID {
+			return sym
+		}
+		id, ok := builder.capture(len(builder.FuncStack.Value)-1, scope.FuncID, sym.ID)
+		if !ok && builder.evaluating(scope.FuncID) {
+			builder.Errorf("%s isn't a constant, it can't be used at compile time", symbol)
+			return Symbol{-1, SYM_VAR, false, ""}
+		}
+		if !ok && scope == builder.topLevel {
+			module := builder.FuncStack.Value[0].(*funcBuilder)
+			return Symbol{module.Globals[sym.ID], SYM_GLOBAL, sym.ReadOnly, sym.DataType}
+		}
+		if !ok {
+			builder.Errorf("%s belongs to an enclosing function, only fn closures can capture it", symbol)
+			return Symbol{-1, SYM_VAR, false, ""}
+		}
+		return Symbol{id, SYM_UPVAL, sym.ReadOnly, sym.DataType}
+	}
+	builder.Errorf("undefined: %s", symbol)
+	return Symbol{-1, SYM_VAR, false, ""}
+}
+
+func (builder *GimmickBuilder) Lookup(symbol string) (Symbol, bool) {
+	if dot := strings.Index(symbol, "."); dot >= 0 {
+		sym, err := builder.member(symbol[0:dot], symbol[dot+1:])
+		return sym, err == nil
+	}
+	for i := len(builder.ScopeStack.Value) - 1; i >= 0; i-- {
+		scope := builder.ScopeStack.Value[i].(*Scope)
+		if sym, ok := scope.SymbolTable[symbol]; ok {
+			return sym, true
+		}
+	}
+	return Symbol{}, false
+}
+
+func (builder *GimmickBuilder) Define(symbol string, readOnly bool, dataType string) int64 {
+	if _, ok := builder.currentScope().SymbolTable[symbol]; ok {
+		builder.Errorf("%s is already declared in this scope", symbol)
+	}
+	return builder.defineVar(symbol, readOnly, dataType)
+}
+
+func (builder *GimmickBuilder) DefineAlias(name string, sym Symbol) {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already defined", name)
+		return
+	}
+	scope.SymbolTable[name] = sym
+}
+
+func (builder *GimmickBuilder) DefineType(name string, fields []NameType) int64 {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already defined", name)
+		return -1
+	}
+	if len(fields) == 0 {
+		// Name{} would be ambiguous with the block of if Name {}
+		builder.Errorf("type %s has no fields", name)
+	}
+	seen := map[string]bool{}
+	for _, field := range fields {
+		if seen[field.Name] {
+			builder.Errorf("duplicate field %s in %s", field.Name, name)
+		}
+		seen[field.Name] = true
+	}
+	id := builder.Interp.AddType(name, fields)
+	scope.SymbolTable[name] = Symbol{id, SYM_TYPE, true, ""}
+	return id
+}
+
+func (builder *GimmickBuilder) Type(id int64) *StructType {
+	return builder.Interp.Types[id]
+}
+
+func (builder *GimmickBuilder) DefineEnum(name string, variants []Variant) int64 {
+	scope := builder.currentScope()
+	if _, ok := scope.SymbolTable[name]; ok {
+		builder.Errorf("%s is already defined", name)
+		return -1
+	}
+	if len(variants) == 0 {
+		builder.Errorf("enum %s has no variants", name)
+	}
+	for i, variant := range variants {
+		if _, ok := scope.SymbolTable[variant.Name]; ok || variant.Name == name {
+			builder.Errorf("%s is already defined", variant.Name)
+		}
+		for _, other := range variants[0:i] {
+			if other.Name == variant.Name {
+				builder.Errorf("duplicate variant %s in %s", variant.Name, name)
+			}
+		}
+		seen := map[string]bool{}
+		for _, field := range variant.Fields {
+			if seen[field.Name] {
+				builder.Errorf("duplicate field %s in %s", field.Name, variant.Name)
+			}
+			seen[field.Name] = true
+		}
+	}
+	id := builder.Interp.AddEnum(name, variants)
+	scope.SymbolTable[name] = Symbol{id, SYM_ENUM, true, ""}
+	for _, variantType := range builder.Enum(id).Variants {
+		if _, ok := scope.SymbolTable[variantType.Name]; !ok {
+			scope.SymbolTable[variantType.Name] = Symbol{variantType.ID, SYM_VARIANT, true, name}
+		}
+	}
+	return id
+}
+
+func (builder *GimmickBuilder) Enum(id int64) *EnumType {
+	return builder.Interp.Enums[id]
+}
+
+func (builder *GimmickBuilder) Params(id int64) []Param {
+	if id < 0 || id >= int64(len(builder.Interp.Func)) {
+		return nil
+	}
+	return builder.Interp.Func[id].Params
+}
+
+func (builder *GimmickBuilder) ResolveField(typeName string, field string) (int64, int64) {
+	sym, ok := builder.Lookup(typeName)
+	if ok && (sym.Type == SYM_TYPE || sym.Type == SYM_VARIANT) {
+		if index := builder.Type(sym.ID).FieldIndex(field); index >= 0 {
+			return sym.ID, index
+		}
+		builder.Errorf("%s has no field %s", typeName, field)
+		return -1, -1
+	}
+
+	candidates := builder.scopeTypes()
+	if ok && sym.Type == SYM_ENUM {
+		candidates = builder.Enum(sym.ID).Variants
+	}
+	owners := []*StructType{}
+	for _, structType := range candidates {
+		// exceptions are known to be Errors, their common field names
+		// shouldn't make user types ambiguous
+		if structType == builder.Interp.ErrorType {
+			continue
+		}
+		if structType.FieldIndex(field) >= 0 {
+			owners = append(owners, structType)
+		}
+	}
+	switch len(owners) {
+	case 0:
+		if ok && sym.Type == SYM_ENUM {
+			builder.Errorf("no variant of %s has a field %s", typeName, field)
+			return -1, -1
+		}
+		builder.Errorf("no type has a field %s", field)
+		return -1, -1
+	case 1:
+		return owners[0].ID, owners[0].FieldIndex(field)
+	}
+	names := []string{}
+	for _, owner := range owners {
+		names = append(names, owner.Name)
+	}
+	builder.Errorf("field %s is ambiguous between %s, annotate the type of the value", field, strings.Join(names, ", "))
+	return -1, -1
+}
+
+// scopeTypes returns the struct types and the variants of the enums visible
+// in the scopes, so declared by the module being compiled and not by the
+// modules it imports, ordered by ID
+func (builder *GimmickBuilder) scopeTypes() []*StructType {
+	types := []*StructType{}
+	seen := map[string]bool{}
+	for i := len(builder.ScopeStack.Value) - 1; i >= 0; i-- {
+		scope := builder.ScopeStack.Value[i].(*Scope)
+		for name, sym := range scope.SymbolTable {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			switch sym.Type {
+			case SYM_TYPE:
+				types = append(types, builder.Type(sym.ID))
+			case SYM_ENUM:
+				types = append(types, builder.Enum(sym.ID).Variants...)
+			}
+		}
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].ID < types[j].ID
+	})
+	return types
+}
+
+func (builder *GimmickBuilder) ResolveMethod(typeName string, method string) string {
+	if typeName != "" && typeName != "any" {
+		if sym, ok := builder.Lookup(typeName + "." + method); ok && sym.Type == SYM_FUN {
+			return typeName + "." + method
+		}
+		return method
+	}
+
+	owners := []string{}
+	seen := map[string]bool{}
+	for i := len(builder.ScopeStack.Value) - 1; i >= 0; i-- {
+		scope := builder.ScopeStack.Value[i].(*Scope)
+		for name, sym := range scope.SymbolTable {
+			owner := strings.TrimSuffix(name, "."+method)
+			if sym.Type != SYM_FUN || owner == name || strings.Contains(owner, ".") || seen[owner] {
+				continue
+			}
+			// an inner definition shadows the outer ones
+			seen[owner] = true
+			owners = append(owners, owner+"."+method)
+		}
+	}
+	sort.Strings(owners)
+	if _, ok := builder.Lookup(method); ok && len(owners) > 0 {
+		owners = append(owners, method)
+	}
+	switch len(owners) {
+	case 0:
+		return method
+	case 1:
+		return owners[0]
+	}
+	builder.Errorf("method %s is ambiguous between %s, annotate the type of the value", method, strings.Join(owners, ", "))
+	return method
+}
+
+func (builder *GimmickBuilder) BeginScope() {
+	builder.ScopeStack.Push(NewScope(builder.currentFunc().ID))
+}
+
+func (builder *GimmickBuilder) EndScope() {
+	builder.ScopeStack.Pop()
+}
+
+func (builder *GimmickBuilder) Constant(value interface{}) int64 {
+	if id, ok := builder.constants[value]; ok {
+		return id
+	}
+	id := builder.Interp.AddConst(value)
+	builder.constants[value] = id
+	return id
+}
+
+func (builder *GimmickBuilder) NewLocal() int64 {
+	fn := builder.currentFunc()
+	fn.NumLocals += 1
+	return fn.NumLocals - 1
+}
+
+func (builder *GimmickBuilder) Position() int64 {
+	return int64(len(builder.currentFunc().Inst))
+}
+
+func (builder *GimmickBuilder) Patch(position int64, target int64) {
+	fn := builder.currentFunc()
+	if position < 0 || position >= int64(len(fn.Inst)) {
+		panic("Patching a non-existent instruction")
+	}
+	fn.Inst[position].Arg1 = target
+}
+
+func (builder *GimmickBuilder) BeginLoop() {
+	mark := builder.NewLocal()
+	builder.Push(MarkInst(mark))
+	fn := builder.currentFunc()
+	fn.Loops = append(fn.Loops, &loopBuilder{Mark: mark, Finalizers: len(fn.Finalizers)})
+}
+
+func (builder *GimmickBuilder) Break() {
+	loop := builder.currentLoop("break")
+	if loop == nil {
+		return
+	}
+	builder.Push(UnwindInst(loop.Mark))
+	builder.finalize(loop.Finalizers)
+	loop.Breaks = append(loop.Breaks, builder.Position())
+	builder.Push(JumpInst(ARG_NOOP))
+}
+
+func (builder *GimmickBuilder) Continue() {
+	loop := builder.currentLoop("continue")
+	if loop == nil {
+		return
+	}
+	builder.Push(UnwindInst(loop.Mark))
+	builder.finalize(loop.Finalizers)
+	loop.Continues = append(loop.Continues, builder.Position())
+	builder.Push(JumpInst(ARG_NOOP))
+}
+
+func (builder *GimmickBuilder) EndLoop(continueTarget int64) {
+	fn := builder.currentFunc()
+	loop := fn.Loops[len(fn.Loops)-1]
+	fn.Loops = fn.Loops[0 : len(fn.Loops)-1]
+	for _, position := range loop.Breaks {
+		builder.Patch(position, builder.Position())
+	}
+	for _, position := range loop.Continues {
+		builder.Patch(position, continueTarget)
+	}
+}
+
+// AddHandler leaves out the finally blocks of the enclosing try blocks, and
+// of the try block itself, copied by the jumps out of it: the exceptions they
+// raise are the ones of the code following the jump
+func (builder *GimmickBuilder) AddHandler(start int64, end int64, target int64, mark int64) {
+	fn := builder.currentFunc()
+	excluded := []inlinedFinalizer{}
+	for _, inlined := range fn.Inlined {
+		if inlined.Try <= start && inlined.Start < end && inlined.End > start {
+			excluded = append(excluded, inlined)
+		}
+	}
+	sort.Slice(excluded, func(i, j int) bool {
+		return excluded[i].Start < excluded[j].Start
+	})
+	for _, inlined := range excluded {
+		if inlined.Start > start {
+			fn.Handlers = append(fn.Handlers, Handler{start, inlined.Start, target, mark})
+		}
+		if inlined.End > start {
+			start = inlined.End
+		}
+	}
+	if start < end {
+		fn.Handlers = append(fn.Handlers, Handler{start, end, target, mark})
+	}
+}
+
+func (builder *GimmickBuilder) BeginFinally(code ScopedBuilder) {
+	fn := builder.currentFunc()
+	fn.Finalizers = append(fn.Finalizers, finalizer{builder.Position(), code})
+}
+
+func (builder *GimmickBuilder) EndFinally() {
+	fn := builder.currentFunc()
+	fn.Finalizers = fn.Finalizers[0 : len(fn.Finalizers)-1]
+}
+
+func (builder *GimmickBuilder) Return() {
+	builder.finalize(0)
+	builder.Push(ReturnInst())
+}
+
+func (builder *GimmickBuilder) Errorf(format string, args ...interface{}) {
+	builder.Errors = append(builder.Errors, fmt.Errorf(format, args...))
+}
+
+func (builder *GimmickBuilder) Warnf(format string, args ...interface{}) {
+	builder.Warnings = append(builder.Warnings, fmt.Errorf(format, args...))
 }
 
 // private methods
+
+func (builder *GimmickBuilder) currentFunc() *funcBuilder {
+	return builder.FuncStack.Value[len(builder.FuncStack.Value)-1].(*funcBuilder)
+}
+
+func (builder *GimmickBuilder) currentScope() *Scope {
+	return builder.ScopeStack.Value[len(builder.ScopeStack.Value)-1].(*Scope)
+}
+
+// currentLoop returns the innermost loop of the current function, statement
+// is used in the error message when there's none
+func (builder *GimmickBuilder) currentLoop(statement string) *loopBuilder {
+	fn := builder.currentFunc()
+	if len(fn.Loops) == 0 {
+		builder.Errorf("%s outside of a loop", statement)
+		return nil
+	}
+	return fn.Loops[len(fn.Loops)-1]
+}
+
+// member finds an export of the module imported as module
+func (builder *GimmickBuilder) member(module string, name string) (Symbol, error) {
+	sym, ok := builder.Lookup(module)
+	if ok && (sym.Type == SYM_TYPE || sym.Type == SYM_ENUM) {
+		// a function associated with the type, defined with def Type.name
+		for i := len(builder.ScopeStack.Value) - 1; i >= 0; i-- {
+			scope := builder.ScopeStack.Value[i].(*Scope)
+			if fn, ok := scope.SymbolTable[module+"."+name]; ok {
+				return fn, nil
+			}
+		}
+		return Symbol{}, fmt.Errorf("%s has no function %s", module, name)
+	}
+	if !ok || sym.Type != SYM_MODULE {
+		return Symbol{}, fmt.Errorf("%s is not a module", module)
+	}
+	exported, ok := builder.modules[sym.ID][name]
+	if !ok {
+		return Symbol{}, fmt.Errorf("module %s has no exported %s", module, name)
+	}
+	if exported.Type == SYM_VARIANT {
+		// the enum is known by its qualified name here
+		exported.DataType = module + "." + exported.DataType
+	}
+	return exported, nil
+}
+
+// finalize emits the finalizers of the current function from the given
+// one on, innermost first. Each runs with only the enclosing ones active,
+// for the jumps out of a finally block
+func (builder *GimmickBuilder) finalize(from int) {
+	fn := builder.currentFunc()
+	finalizers := fn.Finalizers
+	for i := len(finalizers) - 1; i >= from; i-- {
+		fn.Finalizers = finalizers[0:i]
+		start := builder.Position()
+		builder.BeginScope()
+		finalizers[i].Code(builder)
+		builder.EndScope()
+		fn.Inlined = append(fn.Inlined, inlinedFinalizer{finalizers[i].Start, start, builder.Position()})
+	}
+	fn.Finalizers = finalizers
+}
+
+func (builder *GimmickBuilder) defineArgs(name string, signature []NameType) {
+	for _, arg := range signature {
+		if _, ok := builder.currentScope().SymbolTable[arg.Name]; ok {
+			builder.Errorf("duplicate argument %s in %s", arg.Name, name)
+		}
+		builder.defineVar(arg.Name, false, arg.Type)
+	}
+	builder.currentFunc().NumArgs = int64(len(signature))
+}
+
+// capture returns the upvalue of the function at the given FuncStack level
+// holding the variable slot of the enclosing function owner. Every closure
+// between the two captures it as well
+func (builder *GimmickBuilder) capture(level int, owner int64, slot int64) (int64, bool) {
+	fn := builder.FuncStack.Value[level].(*funcBuilder)
+	if !fn.IsClosure {
+		return -1, false
+	}
+	parent := builder.FuncStack.Value[level-1].(*funcBuilder)
+	upvalue := Upvalue{true, slot}
+	if parent.ID != owner {
+		index, ok := builder.capture(level-1, owner, slot)
+		if !ok {
+			return -1, false
+		}
+		upvalue = Upvalue{false, index}
+	}
+	for i, existing := range fn.Upvalues {
+		if existing == upvalue {
+			return int64(i), true
+		}
+	}
+	fn.Upvalues = append(fn.Upvalues, upvalue)
+	return int64(len(fn.Upvalues) - 1), true
+}
+
+// evaluating tells whether a function built by Evaluate encloses the
+// current one within the function owner
+func (builder *GimmickBuilder) evaluating(owner int64) bool {
+	for i := len(builder.FuncStack.Value) - 1; i >= 0; i-- {
+		fn := builder.FuncStack.Value[i].(*funcBuilder)
+		if fn.ID == owner {
+			break
+		}
+		if fn.IsConst {
+			return true
+		}
+	}
+	return false
+}
+
+// every variable gets its own slot, even when its scope has ended
+func (builder *GimmickBuilder) defineVar(symbol string, readOnly bool, dataType string) int64 {
+	id := builder.NewLocal()
+	builder.currentScope().SymbolTable[symbol] = Symbol{id, SYM_VAR, readOnly, dataType}
+	if builder.currentScope() == builder.topLevel {
+		fn := builder.currentFunc()
+		if fn.Globals == nil {
+			fn.Globals = make(map[int64]int64)
+		}
+		fn.Globals[id] = builder.Interp.AddGlobal()
+	}
+	return id
+}
+
+// checkConst tells why the function id, called by Evaluate, can't be run
+// at compile time: globals don't exist yet. The functions it invokes or
+// makes closures of are checked as well, lambdas being allowed as their
+// code is checked
+func (builder *GimmickBuilder) checkConst(id int64, checked map[int64]bool) error {
+	for _, inst := range builder.Interp.Func[id].Inst {
+		if inst.Type == INST_LOAD_GLOBAL {
+			return fmt.Errorf("%s reads a global variable", builder.Interp.Func[id].Name)
+		}
+		if inst.Type != INST_INVOKE && inst.Type != INST_CLOSURE || checked[inst.Arg1] {
+			continue
+		}
+		checked[inst.Arg1] = true
+		fn := builder.Interp.Func[inst.Arg1]
+		switch {
+		case fn.Inst == nil:
+			return fmt.Errorf("%s is used before its definition", fn.Name)
+		case !fn.Const && fn.Params != nil:
+			return fmt.Errorf("%s isn't a const def", fn.Name)
+		}
+		if err := builder.checkConst(inst.Arg1, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataType is the name of the type of a value, empty for functions
+func dataType(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case *List:
+		return "list"
+	case *Map:
+		return "map"
+	case *Struct:
+		if v.Type.Enum != nil {
+			return v.Type.Enum.Name
+		}
+		return v.Type.Name
+	}
+	return ""
+}
+
+func (builder *GimmickBuilder) beginFunc(id int64, name string) {
+	builder.FuncStack.Push(&funcBuilder{ID: id, Name: name})
+	builder.ScopeStack.Push(NewScope(id))
+}
+
+func (builder *GimmickBuilder) endFunc() int64 {
+	// the function body left its value on the stack
+	builder.Push(ReturnInst())
+	builder.ScopeStack.Pop()
+	raw, _ := builder.FuncStack.Pop()
+	fn := raw.(*funcBuilder)
+	declared := builder.Interp.Func[fn.ID]
+	builder.Interp.Func[fn.ID] = &Function{fn.Name, fn.Inst, fn.NumArgs, fn.NumLocals, fn.Upvalues, fn.Globals, fn.Handlers, declared.Params, declared.Const}
+	return fn.ID
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* --- Exceptions, raised by INST_THROW and failing instructions --- */
+
+// the fields of the Error type, see GimmickInterpreter.ErrorType. value is
+// the thrown value, nil for the errors of the interpreter
+var ERROR_FIELDS = []NameType{{"message", "string"}, {"value", "any"}, {"trace", "list"}}
+
+// Handler is an entry of the exception table of a function. Exceptions
+// raised by the instructions from Start up to but excluding End jump to
+// Target, with the stack cut back to the height saved in the variable Mark
+// and the exception pushed
+type Handler struct {
+	Start  int64
+	End    int64
+	Target int64
+	Mark   int64
+}
+
+// Thrown is the error of INST_THROW
+type Thrown struct {
+	Value interface{}
+}
+
+func (err Thrown) Error() string {
+	return Repr(err.Value)
+}
+
+// UncaughtError is returned by ExecFunc when no handler catches an
+// exception
+type UncaughtError struct {
+	Exception *Struct
+}
+
+func (err UncaughtError) Error() string {
+	lines := []string{fmt.Sprintf("Uncaught error: %v", err.Exception.Fields[0])}
+	if trace, ok := err.Exception.Fields[2].(*List); ok {
+		for _, frame := range trace.Elements {
+			lines = append(lines, fmt.Sprintf("    %v", frame))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// raise unwinds the CallStack down to the innermost handler covering the
+// failing instruction. When there's none, the CallStack is emptied and the
+// error returned
+func (interp *GimmickInterpreter) raise(err error) error {
+	exception := interp.exception(err)
+	for len(interp.CallStack) > 0 {
+		frame := interp.LastCallStack()
+		// PC is past the failing instruction, or the call in the frames
+		// below
+		pc := frame.PC - 1
+		for _, handler := range interp.Func[frame.FuncID].Handlers {
+			if pc < handler.Start || pc >= handler.End {
+				continue
+			}
+			height, ok := frame.Locals[handler.Mark].Value.(int64)
+			if !ok || height > int64(len(interp.Stack.Value)) {
+				return fmt.Errorf("Invalid stack mark: %v", frame.Locals[handler.Mark].Value)
+			}
+			interp.Stack.Value = interp.Stack.Value[0:height]
+			interp.Stack.Push(exception)
+			frame.PC = handler.Target
+			return nil
+		}
+		if frame.Base <= int64(len(interp.Stack.Value)) {
+			interp.Stack.Value = interp.Stack.Value[0:frame.Base]
+		}
+		interp.CallStack = interp.CallStack[0 : len(interp.CallStack)-1]
+	}
+	return UncaughtError{exception}
+}
+
+// exception turns err into a value of the Error type. Thrown Error values
+// are kept as they are, so that rethrowing one keeps its trace
+func (interp *GimmickInterpreter) exception(err error) *Struct {
+	var value interface{}
+	message := err.Error()
+	if thrown, ok := err.(Thrown); ok {
+		if object, ok := thrown.Value.(*Struct); ok && object.Type == interp.ErrorType {
+			return object
+		}
+		value = thrown.Value
+		if text, ok := value.(string); ok {
+			message = text
+		}
+	}
+	return NewStruct(interp.ErrorType, []interface{}{message, value, interp.trace()})
+}
+
+// trace describes the CallStack, innermost frame first
+func (interp *GimmickInterpreter) trace() *List {
+	frames := []interface{}{}
+	for i := len(interp.CallStack) - 1; i >= 0; i-- {
+		frame := interp.CallStack[i]
+		name := interp.Func[frame.FuncID].Name
+		if name == "" {
+			name = fmt.Sprintf("function %d", frame.FuncID)
+		}
+		frames = append(frames, fmt.Sprintf("at %s, instruction %d", name, frame.PC-1))
+	}
+	return NewList(frames)
+}
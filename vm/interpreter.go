@@ -1,46 +1,147 @@
 package vm
 
 import "fmt"
+import "math"
 import "github.com/trungaczne/gimmick/utils"
 
 type Function struct {
+	// for stack traces, empty for hand written code
+	Name string
 	Inst []Instruction
+	// the first NumArgs locals are the arguments, popped off the stack by
+	// the caller's INST_INVOKE
+	NumArgs   int64
+	NumLocals int64
+	// variables of enclosing functions captured by closures of the function
+	Upvalues []Upvalue
+	// locals of a module's top level that are globals too, by global ID.
+	// Declaring one makes its new cell the global
+	Globals map[int64]int64
+	// the exception table, inner handlers first
+	Handlers []Handler
+	// the arguments as declared, for the compiler to resolve named
+	// arguments, defaults and variadics, and for INST_CALL to bind the
+	// arguments of calls through function values. Nil for lambdas
+	Params []Param
+	// declared with const def, it can be called at compile time
+	Const bool
+}
+
+// Upvalue tells INST_CLOSURE where to find a captured variable: a local of
+// the function creating the closure, or one of its own upvalues
+type Upvalue struct {
+	FromLocal bool
+	Index     int64
+}
+
+// Cell holds the value of a variable. Closures share cells with the frame
+// that created them, so captured variables are shared rather than copied
+type Cell struct {
+	Value interface{}
+}
+
+// Closure is a function value
+type Closure struct {
+	FuncID   int64
+	Upvalues []*Cell
 }
 
 type CallStack struct {
 	FuncID int64
 	PC     int64
+	Locals []*Cell
+	// stack height when the function was entered, arguments excluded
+	Base int64
+	// the closure being executed, nil for functions called by ID
+	Closure *Closure
 }
 
 type GimmickInterpreter struct {
 	// Code ...
 	Func      []*Function
+	Const     []interface{}
+	Types     []*StructType
+	Enums     []*EnumType
 	CallStack []*CallStack
+	// cells of the variables declared at the top level of modules, nil until
+	// the declaration runs
+	Globals []*Cell
+	// the type of exceptions, see ERROR_FIELDS
+	ErrorType *StructType
+	// calls deeper than MaxDepth raise a stack overflow, 0 for no limit
+	MaxDepth int
+	// the number of instructions Start may execute, no limit when 0. Going
+	// over it is an error scripts can't catch
+	MaxSteps int64
+	Steps    int64
+	// the functions scripts define operators with, called by INST_BINARY
+	// when the operands have the types of the key
+	Operators map[OperatorKey]int64
 
 	/// ... and data
 	Stack utils.Stack
 	Heap  []int64
 }
 
+// the default GimmickInterpreter.MaxDepth
+const MAX_DEPTH = 10000
+
 func NewInterpreter() *GimmickInterpreter {
-	// zero values are sufficient
-	return &GimmickInterpreter{}
+	interp := &GimmickInterpreter{MaxDepth: MAX_DEPTH}
+	interp.ErrorType = interp.Types[interp.AddType("Error", ERROR_FIELDS)]
+	return interp
 }
 
 // Name is stripped by the CodeBuilder, there's only ID
 func (interp *GimmickInterpreter) AddFunc(instructions []Instruction) int64 {
-	newFunc := &Function{instructions}
+	newFunc := &Function{Inst: instructions}
 	interp.Func = append(interp.Func, newFunc)
 	id := int64(len(interp.Func) - 1)
 	return id
 }
 
+func (interp *GimmickInterpreter) AddConst(value interface{}) int64 {
+	interp.Const = append(interp.Const, value)
+	return int64(len(interp.Const) - 1)
+}
+
+func (interp *GimmickInterpreter) AddGlobal() int64 {
+	interp.Globals = append(interp.Globals, nil)
+	return int64(len(interp.Globals) - 1)
+}
+
+func (interp *GimmickInterpreter) AddType(name string, fields []NameType) int64 {
+	id := int64(len(interp.Types))
+	interp.Types = append(interp.Types, &StructType{ID: id, Name: name, Fields: fields})
+	return id
+}
+
+// AddEnum adds the enum along with a struct type for each of its variants
+func (interp *GimmickInterpreter) AddEnum(name string, variants []Variant) int64 {
+	enum := &EnumType{ID: int64(len(interp.Enums)), Name: name}
+	for _, variant := range variants {
+		variantType := interp.Types[interp.AddType(variant.Name, variant.Fields)]
+		variantType.Enum = enum
+		enum.Variants = append(enum.Variants, variantType)
+		var unit *Struct
+		if len(variant.Fields) == 0 {
+			unit = NewStruct(variantType, nil)
+		}
+		enum.Units = append(enum.Units, unit)
+	}
+	interp.Enums = append(interp.Enums, enum)
+	return enum.ID
+}
+
 func (interp *GimmickInterpreter) ExecFunc(id int64) error {
 	if id < 0 || id >= int64(len(interp.Func)) {
 		return fmt.Errorf("Invalid function ID to execute")
 	}
 
-	callstack := &CallStack{id, 0}
+	callstack, err := interp.newCallStack(id)
+	if err != nil {
+		return err
+	}
 	interp.CallStack = append(interp.CallStack, callstack)
 	return interp.Start()
 }
@@ -67,19 +168,29 @@ func (interp *GimmickInterpreter) Start() error {
 		}
 
 		if curStack.PC >= int64(len(curFunc.Inst)) {
-			// nothing else to execute in this stack, return
-			// TODO make an explicit instruction for returning
+			// nothing else to execute in this stack, return. Compiled code
+			// always ends with INST_RETURN, this is for hand written code
 			interp.CallStack = interp.CallStack[0 : len(interp.CallStack)-1]
 			continue
 		}
 
+		if interp.MaxSteps > 0 {
+			interp.Steps++
+			if interp.Steps > interp.MaxSteps {
+				return fmt.Errorf("Exceeded the limit of %d instructions", interp.MaxSteps)
+			}
+		}
+
 		inst := curFunc.Inst[curStack.PC]
 		curStack.PC += 1
 
 		// Yay!
 		err := interp.Exec(inst)
 		if err != nil {
-			return fmt.Errorf("Inst %v failed: %v", inst, err)
+			// caught, or the CallStack is now empty
+			if err := interp.raise(err); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -98,6 +209,63 @@ func (interp *GimmickInterpreter) Exec(inst Instruction) error {
 		return interp.ExecBinary(inst)
 	case INST_INVOKE:
 		return interp.ExecInvoke(inst)
+	case INST_UNARY:
+		return interp.ExecUnary(inst)
+	case INST_LOAD:
+		return interp.ExecLoad(inst)
+	case INST_CONST:
+		return interp.ExecConst(inst)
+	case INST_JUMP:
+		interp.LastCallStack().PC = inst.Arg1
+		return nil
+	case INST_JUMP_IF_FALSE:
+		return interp.ExecJumpIfFalse(inst)
+	case INST_MARK:
+		return interp.ExecMark(inst)
+	case INST_UNWIND:
+		return interp.ExecUnwind(inst)
+	case INST_RETURN:
+		return interp.ExecReturn(inst)
+	case INST_DEFINE:
+		return interp.ExecDefine(inst)
+	case INST_CLOSURE:
+		return interp.ExecClosure(inst)
+	case INST_CALL:
+		return interp.ExecCall(inst)
+	case INST_LOAD_UPVAL:
+		return interp.ExecLoadUpval(inst)
+	case INST_ASSIGN_UPVAL:
+		return interp.ExecAssignUpval(inst)
+	case INST_LOAD_GLOBAL:
+		return interp.ExecLoadGlobal(inst)
+	case INST_ASSIGN_GLOBAL:
+		return interp.ExecAssignGlobal(inst)
+	case INST_BUILTIN:
+		return interp.ExecBuiltin(inst)
+	case INST_LIST:
+		return interp.ExecList(inst)
+	case INST_INDEX:
+		return interp.ExecIndex(inst)
+	case INST_SET_INDEX:
+		return interp.ExecSetIndex(inst)
+	case INST_SLICE:
+		return interp.ExecSlice(inst)
+	case INST_ITER:
+		return interp.ExecIter(inst)
+	case INST_MAP:
+		return interp.ExecMap(inst)
+	case INST_STRUCT:
+		return interp.ExecStruct(inst)
+	case INST_GET_FIELD:
+		return interp.ExecGetField(inst)
+	case INST_SET_FIELD:
+		return interp.ExecSetField(inst)
+	case INST_IS_STRUCT:
+		return interp.ExecIsStruct(inst)
+	case INST_NO_MATCH:
+		return interp.ExecNoMatch(inst)
+	case INST_THROW:
+		return interp.ExecThrow(inst)
 	}
 	return nil
 }
@@ -109,17 +277,40 @@ func (interp *GimmickInterpreter) ExecBinary(inst Instruction) error {
 	if err != nil {
 		return err
 	}
-	vals := []int64{}
-	for _, v := range raw {
-		vi, ok := v.(int64)
-		if !ok {
-			panic("Typecasting failure")
+
+	if id, ok := interp.operator(inst.Arg1, raw[1], raw[0]); ok {
+		interp.Stack.Push(raw[1])
+		interp.Stack.Push(raw[0])
+		return interp.ExecInvoke(InvokeInst(id))
+	}
+
+	switch inst.Arg1 {
+	case ARG_OP_EQ:
+		interp.Stack.Push(raw[1] == raw[0])
+		return nil
+	case ARG_OP_NE:
+		interp.Stack.Push(raw[1] != raw[0])
+		return nil
+	}
+
+	switch left := raw[1].(type) {
+	case string:
+		if right, ok := raw[0].(string); ok {
+			return interp.binaryString(inst.Arg1, left, right)
 		}
-		vals = append(vals, vi)
+	case float64:
+		if right, ok := raw[0].(float64); ok {
+			return interp.binaryFloat(inst.Arg1, left, right)
+		}
+	}
+
+	left, ok1 := raw[1].(int64)
+	right, ok2 := raw[0].(int64)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("Unsupported operands %v and %v", raw[1], raw[0])
 	}
-	left := vals[1]
-	right := vals[0]
-	// only do int64 math for now, the rest will require some bytecode changes
+	// Like Go, division truncates towards zero and the remainder has the sign
+	// of the dividend
 	switch inst.Arg1 {
 	case ARG_OP_ADD:
 		interp.Stack.Push(left + right)
@@ -136,17 +327,720 @@ func (interp *GimmickInterpreter) ExecBinary(inst Instruction) error {
 		}
 		interp.Stack.Push(left / right)
 		return nil
+	case ARG_OP_MOD:
+		if right == 0 {
+			return fmt.Errorf("Division by zero")
+		}
+		interp.Stack.Push(left % right)
+		return nil
+	case ARG_OP_POW:
+		if right < 0 {
+			return fmt.Errorf("Negative exponent: %d", right)
+		}
+		interp.Stack.Push(power(left, right))
+		return nil
+	case ARG_OP_AND:
+		interp.Stack.Push(left & right)
+		return nil
+	case ARG_OP_OR:
+		interp.Stack.Push(left | right)
+		return nil
+	case ARG_OP_XOR:
+		interp.Stack.Push(left ^ right)
+		return nil
+	case ARG_OP_SHL, ARG_OP_SHR:
+		if right < 0 {
+			return fmt.Errorf("Negative shift count: %d", right)
+		}
+		// shifting by 64 or more gives 0, or -1 for >> of a negative value
+		if inst.Arg1 == ARG_OP_SHL {
+			interp.Stack.Push(left << uint64(right))
+		} else {
+			interp.Stack.Push(left >> uint64(right))
+		}
+		return nil
+	case ARG_OP_LT:
+		interp.Stack.Push(left < right)
+		return nil
+	case ARG_OP_LE:
+		interp.Stack.Push(left <= right)
+		return nil
+	case ARG_OP_GT:
+		interp.Stack.Push(left > right)
+		return nil
+	case ARG_OP_GE:
+		interp.Stack.Push(left >= right)
+		return nil
 	default:
 		return fmt.Errorf("Bad bytecode")
 	}
 }
 
+// binaryString concatenates or compares left and right, byte-wise
+func (interp *GimmickInterpreter) binaryString(op int64, left string, right string) error {
+	switch op {
+	case ARG_OP_ADD:
+		interp.Stack.Push(left + right)
+	case ARG_OP_LT:
+		interp.Stack.Push(left < right)
+	case ARG_OP_LE:
+		interp.Stack.Push(left <= right)
+	case ARG_OP_GT:
+		interp.Stack.Push(left > right)
+	case ARG_OP_GE:
+		interp.Stack.Push(left >= right)
+	default:
+		return fmt.Errorf("Unsupported operands %v and %v", Repr(left), Repr(right))
+	}
+	return nil
+}
+
+// binaryFloat follows IEEE 754, dividing by zero gives an infinity or NaN
+func (interp *GimmickInterpreter) binaryFloat(op int64, left float64, right float64) error {
+	switch op {
+	case ARG_OP_ADD:
+		interp.Stack.Push(left + right)
+	case ARG_OP_SUB:
+		interp.Stack.Push(left - right)
+	case ARG_OP_MUL:
+		interp.Stack.Push(left * right)
+	case ARG_OP_DIV:
+		interp.Stack.Push(left / right)
+	case ARG_OP_POW:
+		interp.Stack.Push(math.Pow(left, right))
+	case ARG_OP_LT:
+		interp.Stack.Push(left < right)
+	case ARG_OP_LE:
+		interp.Stack.Push(left <= right)
+	case ARG_OP_GT:
+		interp.Stack.Push(left > right)
+	case ARG_OP_GE:
+		interp.Stack.Push(left >= right)
+	default:
+		return fmt.Errorf("Unsupported operands %v and %v", left, right)
+	}
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecUnary(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	if val, ok := raw.(float64); ok && inst.Arg1 == ARG_OP_NEG {
+		interp.Stack.Push(-val)
+		return nil
+	}
+	val, ok := raw.(int64)
+	if !ok {
+		return fmt.Errorf("Unsupported operand %v", raw)
+	}
+	switch inst.Arg1 {
+	case ARG_OP_NEG:
+		interp.Stack.Push(-val)
+		return nil
+	case ARG_OP_NOT:
+		interp.Stack.Push(^val)
+		return nil
+	default:
+		return fmt.Errorf("Bad bytecode")
+	}
+}
+
+// operator returns the function defined for op on the types of left and
+// right, one of them being a struct
+func (interp *GimmickInterpreter) operator(op int64, left interface{}, right interface{}) (int64, bool) {
+	if len(interp.Operators) == 0 {
+		return 0, false
+	}
+	_, ok1 := left.(*Struct)
+	_, ok2 := right.(*Struct)
+	if !ok1 && !ok2 {
+		return 0, false
+	}
+	id, ok := interp.Operators[OperatorKey{op, TypeKey(left), TypeKey(right)}]
+	return id, ok
+}
+
 func (interp *GimmickInterpreter) ExecInvoke(inst Instruction) error {
-	callstack := CallStack{inst.Arg1, 0}
-	interp.CallStack = append(interp.CallStack, &callstack)
+	callstack, err := interp.newCallStack(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	interp.CallStack = append(interp.CallStack, callstack)
 	return nil
 }
 
 func (interp *GimmickInterpreter) ExecAssign(inst Instruction) error {
+	cell, err := interp.local(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	val, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	cell.Value = val
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecDefine(inst Instruction) error {
+	if _, err := interp.local(inst.Arg1); err != nil {
+		return err
+	}
+	val, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	// closures created earlier keep the previous cell
+	cell := &Cell{val}
+	callstack := interp.LastCallStack()
+	callstack.Locals[inst.Arg1] = cell
+	if id, ok := interp.Func[callstack.FuncID].Globals[inst.Arg1]; ok {
+		interp.Globals[id] = cell
+	}
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecLoad(inst Instruction) error {
+	cell, err := interp.local(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(cell.Value)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecLoadUpval(inst Instruction) error {
+	cell, err := interp.upvalue(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(cell.Value)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecAssignUpval(inst Instruction) error {
+	cell, err := interp.upvalue(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	val, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	cell.Value = val
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecLoadGlobal(inst Instruction) error {
+	cell, err := interp.global(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(cell.Value)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecAssignGlobal(inst Instruction) error {
+	cell, err := interp.global(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	val, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	cell.Value = val
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecClosure(inst Instruction) error {
+	if inst.Arg1 < 0 || inst.Arg1 >= int64(len(interp.Func)) {
+		return fmt.Errorf("Invalid function ID: %v", inst.Arg1)
+	}
+	closure := &Closure{inst.Arg1, nil}
+	for _, upvalue := range interp.Func[inst.Arg1].Upvalues {
+		var cell *Cell
+		var err error
+		if upvalue.FromLocal {
+			cell, err = interp.local(upvalue.Index)
+		} else {
+			cell, err = interp.upvalue(upvalue.Index)
+		}
+		if err != nil {
+			return err
+		}
+		closure.Upvalues = append(closure.Upvalues, cell)
+	}
+	interp.Stack.Push(closure)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecCall(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	closure, ok := raw.(*Closure)
+	if !ok {
+		return fmt.Errorf("Calling a non-function value: %v", raw)
+	}
+	if closure.FuncID < 0 || closure.FuncID >= int64(len(interp.Func)) {
+		return fmt.Errorf("Invalid function ID: %v", closure.FuncID)
+	}
+	if err := interp.bindParams(interp.Func[closure.FuncID], inst.Arg1); err != nil {
+		return err
+	}
+	callstack, err := interp.newCallStack(closure.FuncID)
+	if err != nil {
+		return err
+	}
+	callstack.Closure = closure
+	interp.CallStack = append(interp.CallStack, callstack)
+	return nil
+}
+
+// bindParams completes the count arguments on the stack of a call to fn
+// through a function value, like the compiler does for a direct call: the
+// omitted arguments take their defaults and the variadic one collects the
+// remaining arguments into a list. Named arguments are only resolved by the
+// compiler
+func (interp *GimmickInterpreter) bindParams(fn *Function, count int64) error {
+	fixed := int64(len(fn.Params))
+	variadic := fixed > 0 && fn.Params[fixed-1].Variadic
+	if variadic {
+		fixed--
+	}
+	required := fixed
+	for required > 0 && fn.Params[required-1].HasDefault {
+		required--
+	}
+	switch {
+	case fn.Params == nil:
+		if fn.NumArgs != count {
+			return fmt.Errorf("Function expects %d arguments, got %d", fn.NumArgs, count)
+		}
+		return nil
+	case count < required:
+		return fmt.Errorf("Function expects at least %d arguments, got %d", required, count)
+	case count > fixed && !variadic:
+		return fmt.Errorf("Function expects at most %d arguments, got %d", fixed, count)
+	case count > fixed:
+		rest, err := interp.popInOrder(count - fixed)
+		if err != nil {
+			return err
+		}
+		interp.Stack.Push(NewList(rest))
+		return nil
+	}
+	for _, param := range fn.Params[count:fixed] {
+		interp.Stack.Push(param.Default)
+	}
+	if variadic {
+		interp.Stack.Push(NewList([]interface{}{}))
+	}
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecConst(inst Instruction) error {
+	if inst.Arg1 < 0 || inst.Arg1 >= int64(len(interp.Const)) {
+		return fmt.Errorf("Invalid constant ID: %v", inst.Arg1)
+	}
+	interp.Stack.Push(interp.Const[inst.Arg1])
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecJumpIfFalse(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	cond, ok := raw.(bool)
+	if !ok {
+		return fmt.Errorf("Condition is not a bool: %v", raw)
+	}
+	if !cond {
+		interp.LastCallStack().PC = inst.Arg1
+	}
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecMark(inst Instruction) error {
+	cell, err := interp.local(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	cell.Value = int64(len(interp.Stack.Value))
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecUnwind(inst Instruction) error {
+	cell, err := interp.local(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	height, ok := cell.Value.(int64)
+	if !ok || height < 0 || height > int64(len(interp.Stack.Value)) {
+		return fmt.Errorf("Invalid stack mark: %v", cell.Value)
+	}
+	interp.Stack.Value = interp.Stack.Value[0:height]
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecReturn(inst Instruction) error {
+	val, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	callstack := interp.LastCallStack()
+	if callstack.Base > int64(len(interp.Stack.Value)) {
+		return fmt.Errorf("Stack underflow when returning")
+	}
+	interp.Stack.Value = interp.Stack.Value[0:callstack.Base]
+	interp.Stack.Push(val)
+	interp.CallStack = interp.CallStack[0 : len(interp.CallStack)-1]
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecBuiltin(inst Instruction) error {
+	if inst.Arg1 < 0 || inst.Arg1 >= int64(len(Builtins)) {
+		return fmt.Errorf("Invalid builtin ID: %v", inst.Arg1)
+	}
+	builtin := Builtins[inst.Arg1]
+	if builtin.NumArgs != inst.Arg2 {
+		return fmt.Errorf("%s expects %d arguments, got %d", builtin.Name, builtin.NumArgs, inst.Arg2)
+	}
+	args, err := interp.popInOrder(inst.Arg2)
+	if err != nil {
+		return err
+	}
+	result, err := builtin.Func(args)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(result)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecList(inst Instruction) error {
+	elements, err := interp.popInOrder(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(NewList(elements))
 	return nil
 }
+
+func (interp *GimmickInterpreter) ExecIndex(inst Instruction) error {
+	raw, err := interp.popInOrder(2)
+	if err != nil {
+		return err
+	}
+	switch container := raw[0].(type) {
+	case *List:
+		index, ok := raw[1].(int64)
+		if !ok {
+			return fmt.Errorf("List index is not an int: %v", raw[1])
+		}
+		element, err := container.Get(index)
+		if err != nil {
+			return err
+		}
+		interp.Stack.Push(element)
+		return nil
+	case *Map:
+		value, err := container.Get(raw[1])
+		if err != nil {
+			return err
+		}
+		interp.Stack.Push(value)
+		return nil
+	case string:
+		// like len, strings are indexed by byte
+		index, ok := raw[1].(int64)
+		if !ok {
+			return fmt.Errorf("String index is not an int: %v", raw[1])
+		}
+		if index < 0 || index >= int64(len(container)) {
+			return fmt.Errorf("Index %d out of range for string of length %d", index, len(container))
+		}
+		interp.Stack.Push(container[index : index+1])
+		return nil
+	}
+	return fmt.Errorf("Cannot index %v", raw[0])
+}
+
+func (interp *GimmickInterpreter) ExecSetIndex(inst Instruction) error {
+	raw, err := interp.popInOrder(3)
+	if err != nil {
+		return err
+	}
+	switch container := raw[0].(type) {
+	case *List:
+		index, ok := raw[1].(int64)
+		if !ok {
+			return fmt.Errorf("List index is not an int: %v", raw[1])
+		}
+		if err := container.Set(index, raw[2]); err != nil {
+			return err
+		}
+		interp.Stack.Push(raw[2])
+		return nil
+	case *Map:
+		container.Set(raw[1], raw[2])
+		interp.Stack.Push(raw[2])
+		return nil
+	}
+	return fmt.Errorf("Cannot index %v", raw[0])
+}
+
+func (interp *GimmickInterpreter) ExecSlice(inst Instruction) error {
+	raw, err := interp.popInOrder(3)
+	if err != nil {
+		return err
+	}
+	switch container := raw[0].(type) {
+	case *List:
+		low, high, err := sliceBounds(raw[1], raw[2], int64(len(container.Elements)))
+		if err != nil {
+			return err
+		}
+		slice, err := container.Slice(low, high)
+		if err != nil {
+			return err
+		}
+		interp.Stack.Push(slice)
+		return nil
+	case string:
+		low, high, err := sliceBounds(raw[1], raw[2], int64(len(container)))
+		if err != nil {
+			return err
+		}
+		if low < 0 || high < low || high > int64(len(container)) {
+			return fmt.Errorf("Slice [%d:%d] out of range for string of length %d", low, high, len(container))
+		}
+		interp.Stack.Push(container[low:high])
+		return nil
+	}
+	return fmt.Errorf("Cannot slice %v", raw[0])
+}
+
+// sliceBounds returns the bounds of a slice, a missing one being the start
+// or the length of the container
+func sliceBounds(low interface{}, high interface{}, length int64) (int64, int64, error) {
+	bounds := []int64{0, length}
+	for i, bound := range []interface{}{low, high} {
+		if bound == nil {
+			continue
+		}
+		value, ok := bound.(int64)
+		if !ok {
+			return 0, 0, fmt.Errorf("Slice bound is not an int: %v", bound)
+		}
+		bounds[i] = value
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func (interp *GimmickInterpreter) ExecIter(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	switch iterable := raw.(type) {
+	case *List:
+		// changes to the list while iterating don't affect the loop
+		snapshot, _ := iterable.Slice(0, int64(len(iterable.Elements)))
+		interp.Stack.Push(snapshot)
+		return nil
+	case *Map:
+		interp.Stack.Push(iterable.Keys())
+		return nil
+	}
+	return fmt.Errorf("Cannot iterate over %v", raw)
+}
+
+func (interp *GimmickInterpreter) ExecMap(inst Instruction) error {
+	entries, err := interp.popInOrder(2 * inst.Arg1)
+	if err != nil {
+		return err
+	}
+	m := NewMap()
+	for i := 0; i < len(entries); i += 2 {
+		m.Set(entries[i], entries[i+1])
+	}
+	interp.Stack.Push(m)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecStruct(inst Instruction) error {
+	structType, err := interp.structType(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	fields, err := interp.popInOrder(int64(len(structType.Fields)))
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(NewStruct(structType, fields))
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecGetField(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	object, err := interp.structOf(raw, inst.Arg1, inst.Arg2)
+	if err != nil {
+		return err
+	}
+	interp.Stack.Push(object.Fields[inst.Arg2])
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecSetField(inst Instruction) error {
+	raw, err := interp.popInOrder(2)
+	if err != nil {
+		return err
+	}
+	object, err := interp.structOf(raw[0], inst.Arg1, inst.Arg2)
+	if err != nil {
+		return err
+	}
+	object.Fields[inst.Arg2] = raw[1]
+	interp.Stack.Push(raw[1])
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecIsStruct(inst Instruction) error {
+	structType, err := interp.structType(inst.Arg1)
+	if err != nil {
+		return err
+	}
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	object, ok := raw.(*Struct)
+	interp.Stack.Push(ok && object.Type == structType)
+	return nil
+}
+
+func (interp *GimmickInterpreter) ExecNoMatch(inst Instruction) error {
+	value, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("No arm matches %s", Repr(value))
+}
+
+func (interp *GimmickInterpreter) ExecThrow(inst Instruction) error {
+	raw, err := interp.Stack.Pop()
+	if err != nil {
+		return err
+	}
+	return Thrown{raw}
+}
+
+// power computes base ** exponent by squaring, wrapping around on overflow
+// like the other operators
+func power(base int64, exponent int64) int64 {
+	result := int64(1)
+	for ; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	return result
+}
+
+// popInOrder pops num values, returning them in the order they were pushed
+func (interp *GimmickInterpreter) popInOrder(num int64) ([]interface{}, error) {
+	raw, err := interp.Stack.Pops(num)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(raw)-1; i < j; i, j = i+1, j-1 {
+		raw[i], raw[j] = raw[j], raw[i]
+	}
+	return raw, nil
+}
+
+// newCallStack creates the frame for calling the function ID, moving its
+// arguments from the stack into its locals
+func (interp *GimmickInterpreter) newCallStack(id int64) (*CallStack, error) {
+	if id < 0 || id >= int64(len(interp.Func)) {
+		return nil, fmt.Errorf("Invalid function ID: %v", id)
+	}
+	if interp.MaxDepth > 0 && len(interp.CallStack) >= interp.MaxDepth {
+		return nil, fmt.Errorf("Stack overflow: more than %d nested calls", interp.MaxDepth)
+	}
+	fn := interp.Func[id]
+	locals := make([]*Cell, fn.NumLocals)
+	for i := range locals {
+		locals[i] = &Cell{}
+	}
+	args, err := interp.Stack.Pops(fn.NumArgs)
+	if err != nil {
+		return nil, err
+	}
+	// arguments are pushed from left to right, so they're popped in reverse
+	for i, arg := range args {
+		locals[fn.NumArgs-1-int64(i)].Value = arg
+	}
+	return &CallStack{id, 0, locals, int64(len(interp.Stack.Value)), nil}, nil
+}
+
+func (interp *GimmickInterpreter) local(id int64) (*Cell, error) {
+	locals := interp.LastCallStack().Locals
+	if id < 0 || id >= int64(len(locals)) {
+		return nil, fmt.Errorf("Invalid variable ID: %v", id)
+	}
+	return locals[id], nil
+}
+
+func (interp *GimmickInterpreter) upvalue(id int64) (*Cell, error) {
+	closure := interp.LastCallStack().Closure
+	if closure == nil || id < 0 || id >= int64(len(closure.Upvalues)) {
+		return nil, fmt.Errorf("Invalid upvalue ID: %v", id)
+	}
+	return closure.Upvalues[id], nil
+}
+
+func (interp *GimmickInterpreter) global(id int64) (*Cell, error) {
+	if id < 0 || id >= int64(len(interp.Globals)) {
+		return nil, fmt.Errorf("Invalid global ID: %v", id)
+	}
+	if interp.Globals[id] == nil {
+		return nil, fmt.Errorf("Global %v used before its declaration", id)
+	}
+	return interp.Globals[id], nil
+}
+
+func (interp *GimmickInterpreter) structType(id int64) (*StructType, error) {
+	if id < 0 || id >= int64(len(interp.Types)) {
+		return nil, fmt.Errorf("Invalid type ID: %v", id)
+	}
+	return interp.Types[id], nil
+}
+
+// structOf checks that value is a struct of the type ID having a field at
+// index. The compiler picks the field index from the type it expects, this
+// catches the values of another type
+func (interp *GimmickInterpreter) structOf(value interface{}, id int64, index int64) (*Struct, error) {
+	structType, err := interp.structType(id)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := value.(*Struct)
+	if !ok || object.Type != structType {
+		return nil, fmt.Errorf("Expected a %s, got %s", structType.Name, Repr(value))
+	}
+	if index < 0 || index >= int64(len(object.Fields)) {
+		return nil, fmt.Errorf("Invalid field index %d for %s", index, structType.Name)
+	}
+	return object, nil
+}
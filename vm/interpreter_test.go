@@ -1,6 +1,10 @@
 package vm
 
-import "testing"
+import (
+	"math"
+	"strings"
+	"testing"
+)
 
 func TestBinaryInst(t *testing.T) {
 	interp := NewInterpreter()
@@ -94,6 +98,52 @@ func TestBinaryInst(t *testing.T) {
 	}
 }
 
+func TestIntegerOperators(t *testing.T) {
+	interp := NewInterpreter()
+
+	cases := []struct {
+		left     int64
+		op       string
+		right    int64
+		expected int64
+	}{
+		{-7, "/", 2, -7 / 2},
+		{7, "/", -2, 7 / -2},
+		{-7, "%", 2, -7 % 2},
+		{7, "%", -2, 7 % -2},
+		{3, "**", 4, 81},
+		{-2, "**", 3, -8},
+		{5, "**", 0, 1},
+		{12, "&", 10, 12 & 10},
+		{12, "|", 10, 12 | 10},
+		{12, "^", 10, 12 ^ 10},
+		{-3, "<<", 2, -3 << 2},
+		{-9, ">>", 1, -9 >> 1},
+		{1, "<<", 64, 0},
+		{-1, ">>", 70, -1},
+	}
+	for _, c := range cases {
+		id := interp.AddFunc([]Instruction{PushInst(c.left), PushInst(c.right), BinaryInst(c.op)})
+		if err := interp.ExecFunc(id); err != nil {
+			t.Errorf("%d %s %d: %v", c.left, c.op, c.right, err)
+			continue
+		}
+		if result, _ := interp.Stack.Pop(); result != c.expected {
+			t.Errorf("%d %s %d: expecting %d, got %v", c.left, c.op, c.right, c.expected, result)
+		}
+	}
+
+	for _, f := range [][]Instruction{
+		{PushInst(1), PushInst(0), BinaryInst("%")},
+		{PushInst(2), PushInst(-1), BinaryInst("**")},
+		{PushInst(1), PushInst(-1), BinaryInst("<<")},
+	} {
+		if err := interp.ExecFunc(interp.AddFunc(f)); err == nil {
+			t.Errorf("Expecting error: %v", f)
+		}
+	}
+}
+
 func TestInvokeInst(t *testing.T) {
 	interp := NewInterpreter()
 
@@ -121,4 +171,495 @@ func TestInvokeInst(t *testing.T) {
 	if v != 200 || err != nil {
 		t.Error("Wrong result")
 	}
+
+	// a function invoking itself forever
+	interp.MaxDepth = 5
+	recursiveID := interp.AddFunc(nil)
+	interp.Func[recursiveID].Inst = []Instruction{InvokeInst(recursiveID)}
+	err = interp.ExecFunc(recursiveID)
+	if err == nil || !strings.Contains(err.Error(), "Stack overflow") {
+		t.Errorf("Expecting a stack overflow, got %v", err)
+	}
+	if len(interp.CallStack) != 0 {
+		t.Errorf("Should unwind everything: %v", interp.CallStack)
+	}
+}
+
+func TestUnaryInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	f := []Instruction{
+		PushInst(42),
+		UnaryInst("-"),
+		PushInst(8),
+		BinaryInst("-"),
+	}
+
+	id := interp.AddFunc(f)
+	err := interp.ExecFunc(id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	result, err := interp.Stack.Pop()
+	r := result.(int64)
+	if r != -50 || err != nil {
+		t.Error("Wrong result")
+	}
+}
+
+func TestBitwiseNotInst(t *testing.T) {
+	interp := NewInterpreter()
+	id := interp.AddFunc([]Instruction{PushInst(5), UnaryInst("~")})
+	if err := interp.ExecFunc(id); err != nil {
+		t.Error(err)
+	}
+	if result, _ := interp.Stack.Pop(); result != int64(^5) {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
+
+func TestJumpInst(t *testing.T) {
+	interp := NewInterpreter()
+	trueID := interp.AddConst(true)
+	falseID := interp.AddConst(false)
+
+	for _, c := range []struct {
+		cond     int64
+		expected int64
+	}{{trueID, 1}, {falseID, 2}} {
+		f := []Instruction{
+			ConstInst(c.cond),
+			JumpIfFalseInst(4),
+			PushInst(1),
+			JumpInst(5),
+			PushInst(2),
+		}
+
+		id := interp.AddFunc(f)
+		err := interp.ExecFunc(id)
+		if err != nil {
+			t.Error(err)
+		}
+
+		result, err := interp.Stack.Pop()
+		r := result.(int64)
+		if r != c.expected || err != nil || len(interp.Stack.Value) != 0 {
+			t.Error("Wrong result")
+		}
+	}
+
+	f := []Instruction{
+		PushInst(1),
+		JumpIfFalseInst(0),
+	}
+	id := interp.AddFunc(f)
+	if interp.ExecFunc(id) == nil {
+		t.Error("Expecting error")
+	}
+}
+
+func TestFloatInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	cases := []struct {
+		left     float64
+		op       string
+		right    float64
+		expected interface{}
+	}{
+		{1.5, "+", 2.25, 3.75},
+		{1.5, "-", 2.25, -0.75},
+		{1.5, "*", 4.0, 6.0},
+		{1.0, "/", 4.0, 0.25},
+		{2.0, "**", 0.5, math.Sqrt2},
+		{4.0, "**", -1.0, 0.25},
+		{1.5, "<", 2.25, true},
+		{1.5, ">=", 2.25, false},
+		{1.5, "==", 1.5, true},
+	}
+	for _, c := range cases {
+		id := interp.AddFunc([]Instruction{
+			ConstInst(interp.AddConst(c.left)),
+			ConstInst(interp.AddConst(c.right)),
+			BinaryInst(c.op),
+		})
+		if err := interp.ExecFunc(id); err != nil {
+			t.Errorf("%v %s %v: %v", c.left, c.op, c.right, err)
+			continue
+		}
+		if result, _ := interp.Stack.Pop(); result != c.expected {
+			t.Errorf("%v %s %v: expecting %v, got %v", c.left, c.op, c.right, c.expected, result)
+		}
+	}
+
+	id := interp.AddFunc([]Instruction{ConstInst(interp.AddConst(2.5)), UnaryInst("-")})
+	if err := interp.ExecFunc(id); err != nil {
+		t.Error(err)
+	}
+	if result, _ := interp.Stack.Pop(); result != -2.5 {
+		t.Errorf("Wrong result: %v", result)
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	interp := NewInterpreter()
+	interp.MaxSteps = 100
+	// 1 + 1 + ... forever
+	id := interp.AddFunc([]Instruction{PushInst(1), PushInst(1), BinaryInst("+"), JumpInst(1)})
+	err := interp.ExecFunc(id)
+	if err == nil || err.Error() != "Exceeded the limit of 100 instructions" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if interp.Steps != 101 {
+		t.Errorf("Wrong steps: %d", interp.Steps)
+	}
+}
+
+func TestUnwindInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	f := []Instruction{
+		PushInst(1),
+		MarkInst(0),
+		PushInst(2),
+		PushInst(3),
+		UnwindInst(0),
+	}
+
+	id := interp.AddFunc(f)
+	interp.Func[id].NumLocals = 1
+	err := interp.ExecFunc(id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(interp.Stack.Value) != 1 || interp.Stack.Value[0].(int64) != 1 {
+		t.Errorf("Wrong stack: %v", interp.Stack.Value)
+	}
+}
+
+func TestReturnInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	childFunc := []Instruction{
+		PushInst(1),
+		PushInst(2),
+		PushInst(42),
+		ReturnInst(),
+		PushInst(3),
+	}
+
+	childID := interp.AddFunc(childFunc)
+
+	parentFunc := []Instruction{
+		PushInst(100),
+		InvokeInst(childID),
+		BinaryInst("+"),
+	}
+
+	parentID := interp.AddFunc(parentFunc)
+
+	err := interp.ExecFunc(parentID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	val, err := interp.Stack.Pop()
+	v := val.(int64)
+	if v != 142 || err != nil || len(interp.Stack.Value) != 0 {
+		t.Error("Wrong result")
+	}
+}
+
+func TestThrowInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	childFunc := []Instruction{
+		PushInst(7),
+		PushInst(1),
+		PushInst(0),
+		BinaryInst("/"),
+	}
+	childID := interp.AddFunc(childFunc)
+
+	parentFunc := []Instruction{
+		PushInst(100),
+		MarkInst(0),
+		PushInst(5),
+		InvokeInst(childID),
+		ThrowInst(),
+	}
+	parentID := interp.AddFunc(parentFunc)
+	interp.Func[parentID].NumLocals = 1
+	interp.Func[parentID].Handlers = []Handler{{2, 4, 4, 0}}
+
+	// the handler catches the division, the stack is cut back to 100
+	// before the exception is pushed, and ThrowInst rethrows it
+	err := interp.ExecFunc(parentID)
+	uncaught, ok := err.(UncaughtError)
+	if !ok || uncaught.Exception.Fields[0] != "Division by zero" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if trace := uncaught.Exception.Fields[2].(*List); len(trace.Elements) != 2 {
+		t.Errorf("Wrong trace: %v", trace)
+	}
+	if len(interp.CallStack) != 0 || len(interp.Stack.Value) != 0 {
+		t.Errorf("Should unwind everything: %v", interp.Stack.Value)
+	}
+}
+
+func TestClosureInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	// returns its argument plus the captured variable
+	childFunc := []Instruction{
+		LoadInst(0),
+		LoadUpvalInst(0),
+		BinaryInst("+"),
+		ReturnInst(),
+	}
+	childID := interp.AddFunc(childFunc)
+	interp.Func[childID].NumArgs = 1
+	interp.Func[childID].NumLocals = 1
+	interp.Func[childID].Upvalues = []Upvalue{{true, 0}}
+
+	parentFunc := []Instruction{
+		PushInst(10),
+		DefineInst(0),
+		ClosureInst(childID),
+		AssignInst(1),
+		// the closure sees assignments made after its creation
+		PushInst(20),
+		AssignInst(0),
+		PushInst(1),
+		LoadInst(1),
+		CallInst(1),
+	}
+	parentID := interp.AddFunc(parentFunc)
+	interp.Func[parentID].NumLocals = 2
+
+	err := interp.ExecFunc(parentID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	val, err := interp.Stack.Pop()
+	v := val.(int64)
+	if v != 21 || err != nil || len(interp.Stack.Value) != 0 {
+		t.Error("Wrong result")
+	}
+}
+
+func TestCallParams(t *testing.T) {
+	interp := NewInterpreter()
+
+	// returns its arguments as a list
+	childID := interp.AddFunc([]Instruction{
+		LoadInst(0), LoadInst(1), LoadInst(2),
+		ListInst(3),
+		ReturnInst(),
+	})
+	interp.Func[childID].NumArgs = 3
+	interp.Func[childID].NumLocals = 3
+	interp.Func[childID].Params = []Param{
+		{NameType: NameType{Name: "x", Type: "int"}},
+		{NameType: NameType{Name: "y", Type: "int"}, Default: int64(10), HasDefault: true},
+		{NameType: NameType{Name: "rest", Type: "int"}, Variadic: true},
+	}
+
+	cases := map[int64]string{
+		1: "[1, 10, []]",
+		2: "[1, 2, []]",
+		4: "[1, 2, [3, 4]]",
+	}
+	for count, expected := range cases {
+		code := []Instruction{}
+		for i := int64(1); i <= count; i++ {
+			code = append(code, PushInst(i))
+		}
+		code = append(code, ClosureInst(childID), CallInst(count))
+		if err := interp.ExecFunc(interp.AddFunc(code)); err != nil {
+			t.Error(err)
+			continue
+		}
+		val, err := interp.Stack.Pop()
+		if err != nil || Repr(val) != expected || len(interp.Stack.Value) != 0 {
+			t.Errorf("Expecting %s from %d arguments, got %v", expected, count, val)
+		}
+	}
+
+	err := interp.ExecFunc(interp.AddFunc([]Instruction{ClosureInst(childID), CallInst(0)}))
+	if err == nil || !strings.Contains(err.Error(), "Function expects at least 1 arguments, got 0") {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestListInst(t *testing.T) {
+	interp := NewInterpreter()
+
+	f := []Instruction{
+		PushInst(1),
+		PushInst(2),
+		PushInst(3),
+		ListInst(3),
+		AssignInst(0),
+		// xs[0] = 10
+		LoadInst(0),
+		PushInst(0),
+		PushInst(10),
+		SetIndexInst(),
+		PopInst(),
+		// xs[0:2][1] + xs[0]
+		LoadInst(0),
+		PushInst(0),
+		PushInst(2),
+		SliceInst(),
+		PushInst(1),
+		IndexInst(),
+		LoadInst(0),
+		PushInst(0),
+		IndexInst(),
+		BinaryInst("+"),
+	}
+
+	id := interp.AddFunc(f)
+	interp.Func[id].NumLocals = 1
+	err := interp.ExecFunc(id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	result, err := interp.Stack.Pop()
+	r := result.(int64)
+	if r != 12 || err != nil {
+		t.Error("Wrong result")
+	}
+
+	f = []Instruction{
+		PushInst(1),
+		ListInst(1),
+		PushInst(1),
+		IndexInst(),
+	}
+	id = interp.AddFunc(f)
+	if interp.ExecFunc(id) == nil {
+		t.Error("Expecting error")
+	}
+}
+
+func TestMapInst(t *testing.T) {
+	interp := NewInterpreter()
+	a := interp.AddConst("a")
+	b := interp.AddConst("b")
+
+	f := []Instruction{
+		ConstInst(b),
+		PushInst(1),
+		ConstInst(a),
+		PushInst(2),
+		MapInst(2),
+	}
+
+	id := interp.AddFunc(f)
+	err := interp.ExecFunc(id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	result, err := interp.Stack.Pop()
+	m := result.(*Map)
+	if err != nil || m.String() != `{"b": 1, "a": 2}` {
+		t.Errorf("Wrong result: %v", m)
+	}
+}
+
+func TestStructInst(t *testing.T) {
+	interp := NewInterpreter()
+	point := interp.AddType("Point", []NameType{{"x", "int"}, {"y", "int"}})
+	size := interp.AddType("Size", []NameType{{"w", "int"}, {"h", "int"}})
+
+	f := []Instruction{
+		PushInst(1),
+		PushInst(2),
+		StructInst(point),
+		GetFieldInst(point, 1),
+	}
+	id := interp.AddFunc(f)
+	if err := interp.ExecFunc(id); err != nil {
+		t.Error(err)
+	}
+	result, err := interp.Stack.Pop()
+	if err != nil || result != int64(2) {
+		t.Errorf("Wrong result: %v", result)
+	}
+
+	f = []Instruction{
+		PushInst(1),
+		PushInst(2),
+		StructInst(size),
+		IsStructInst(point),
+	}
+	id = interp.AddFunc(f)
+	if err := interp.ExecFunc(id); err != nil {
+		t.Error(err)
+	}
+	result, err = interp.Stack.Pop()
+	if err != nil || result != false {
+		t.Errorf("Wrong result: %v", result)
+	}
+
+	f = []Instruction{
+		PushInst(1),
+		PushInst(2),
+		StructInst(size),
+		GetFieldInst(point, 0),
+	}
+	id = interp.AddFunc(f)
+	err = interp.ExecFunc(id)
+	if err == nil || !strings.Contains(err.Error(), "Expected a Point, got Size{w: 1, h: 2}") {
+		t.Errorf("Expecting a type mismatch, got %v", err)
+	}
+	f = []Instruction{
+		PushInst(1),
+		PushInst(2),
+		StructInst(size),
+		NoMatchInst(),
+	}
+	id = interp.AddFunc(f)
+	err = interp.ExecFunc(id)
+	if err == nil || !strings.Contains(err.Error(), "No arm matches Size{w: 1, h: 2}") {
+		t.Errorf("Expecting a match failure, got %v", err)
+	}
+}
+
+func TestEnumValues(t *testing.T) {
+	interp := NewInterpreter()
+	enum := interp.Enums[interp.AddEnum("Shape", []Variant{
+		{"Circle", []NameType{{"r", "int"}}},
+		{"Empty", []NameType{}},
+	})]
+	circle, empty := enum.Variant("Circle"), enum.Variant("Empty")
+	if circle == nil || empty == nil || circle.Enum != enum || enum.Units[0] != nil || enum.Units[1] == nil {
+		t.Fatalf("Wrong enum: %v", enum)
+	}
+
+	f := []Instruction{
+		PushInst(2),
+		StructInst(circle.ID),
+		BuiltinInst(BuiltinID("tag"), 1),
+	}
+	id := interp.AddFunc(f)
+	if err := interp.ExecFunc(id); err != nil {
+		t.Error(err)
+	}
+	result, err := interp.Stack.Pop()
+	if err != nil || result != "Circle" {
+		t.Errorf("Wrong result: %v", result)
+	}
+
+	value := NewStruct(circle, []interface{}{int64(2)})
+	if value.String() != "Circle(2)" || enum.Units[1].String() != "Empty" {
+		t.Errorf("Wrong repr: %v %v", value, enum.Units[1])
+	}
 }
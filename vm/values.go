@@ -0,0 +1,232 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* --- Heap allocated values, the stack only holds references to them --- */
+
+// Repr formats a value the way it's written in scripts
+func Repr(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "nil"
+	}
+	return fmt.Sprint(value)
+}
+
+type List struct {
+	Elements []interface{}
+}
+
+func NewList(elements []interface{}) *List {
+	return &List{elements}
+}
+
+func (list *List) String() string {
+	items := []string{}
+	for _, element := range list.Elements {
+		items = append(items, Repr(element))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func (list *List) checkIndex(index int64) error {
+	if index < 0 || index >= int64(len(list.Elements)) {
+		return fmt.Errorf("Index %d out of range for list of length %d", index, len(list.Elements))
+	}
+	return nil
+}
+
+func (list *List) Get(index int64) (interface{}, error) {
+	if err := list.checkIndex(index); err != nil {
+		return nil, err
+	}
+	return list.Elements[index], nil
+}
+
+func (list *List) Set(index int64, value interface{}) error {
+	if err := list.checkIndex(index); err != nil {
+		return err
+	}
+	list.Elements[index] = value
+	return nil
+}
+
+// Slice copies the elements from low up to but excluding high
+func (list *List) Slice(low int64, high int64) (*List, error) {
+	if low < 0 || high < low || high > int64(len(list.Elements)) {
+		return nil, fmt.Errorf("Slice [%d:%d] out of range for list of length %d", low, high, len(list.Elements))
+	}
+	elements := make([]interface{}, high-low)
+	copy(elements, list.Elements[low:high])
+	return NewList(elements), nil
+}
+
+// Map keeps its keys in insertion order, so that iterating over it is
+// deterministic
+type Map struct {
+	keys   []interface{}
+	values map[interface{}]interface{}
+}
+
+func NewMap() *Map {
+	return &Map{values: make(map[interface{}]interface{})}
+}
+
+func (m *Map) String() string {
+	items := []string{}
+	for _, key := range m.keys {
+		items = append(items, Repr(key)+": "+Repr(m.values[key]))
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+func (m *Map) Len() int64 {
+	return int64(len(m.keys))
+}
+
+func (m *Map) Has(key interface{}) bool {
+	_, ok := m.values[key]
+	return ok
+}
+
+func (m *Map) Get(key interface{}) (interface{}, error) {
+	value, ok := m.values[key]
+	if !ok {
+		return nil, fmt.Errorf("Key %s not found in map", Repr(key))
+	}
+	return value, nil
+}
+
+// Set keeps the position of existing keys
+func (m *Map) Set(key interface{}, value interface{}) {
+	if !m.Has(key) {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+func (m *Map) Delete(key interface{}) {
+	if !m.Has(key) {
+		return
+	}
+	delete(m.values, key)
+	for i, existing := range m.keys {
+		if existing == key {
+			m.keys = append(m.keys[0:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns a new list of the keys in insertion order
+func (m *Map) Keys() *List {
+	keys := make([]interface{}, len(m.keys))
+	copy(keys, m.keys)
+	return NewList(keys)
+}
+
+// StructType is a type declared with `type Name { field: type, ... }`. The
+// compiler resolves fields to their index in Fields
+type StructType struct {
+	ID     int64
+	Name   string
+	Fields []NameType
+	// the enum the type is a variant of, nil for the types declared with
+	// `type`
+	Enum *EnumType
+}
+
+// FieldIndex returns -1 when there's no such field
+func (structType *StructType) FieldIndex(name string) int64 {
+	for i, field := range structType.Fields {
+		if field.Name == name {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+type Struct struct {
+	Type   *StructType
+	Fields []interface{}
+}
+
+func NewStruct(structType *StructType, fields []interface{}) *Struct {
+	return &Struct{structType, fields}
+}
+
+func (s *Struct) String() string {
+	if s.Type.Enum != nil {
+		return s.variantString()
+	}
+	items := []string{}
+	for i, field := range s.Type.Fields {
+		items = append(items, field.Name+": "+Repr(s.Fields[i]))
+	}
+	return s.Type.Name + "{" + strings.Join(items, ", ") + "}"
+}
+
+// variants are written like the calls to their constructor: Circle(1.5),
+// Empty
+func (s *Struct) variantString() string {
+	if len(s.Fields) == 0 {
+		return s.Type.Name
+	}
+	items := []string{}
+	for _, field := range s.Fields {
+		items = append(items, Repr(field))
+	}
+	return s.Type.Name + "(" + strings.Join(items, ", ") + ")"
+}
+
+// OperatorKey identifies an operator defined by a script, Op being one of
+// ARG_OP_* and Left and Right the TypeKey of the operands
+type OperatorKey struct {
+	Op    int64
+	Left  string
+	Right string
+}
+
+// TypeKey is the name of the type of value, or the ID of its struct type or
+// enum, since the ones of different modules may share a name
+func TypeKey(value interface{}) string {
+	if s, ok := value.(*Struct); ok {
+		return structTypeKey(s.Type)
+	}
+	return dataType(value)
+}
+
+func structTypeKey(structType *StructType) string {
+	if structType.Enum != nil {
+		return fmt.Sprintf("enum %d", structType.Enum.ID)
+	}
+	return fmt.Sprintf("type %d", structType.ID)
+}
+
+// EnumType is a tagged union declared with `enum Name { Variant(field:
+// type), Variant, ... }`. Each variant is a StructType, the tag of a value
+// being the Type of its Struct
+type EnumType struct {
+	ID       int64
+	Name     string
+	Variants []*StructType
+	// the only value of each variant without fields, so that they compare
+	// equal. nil for the variants with fields
+	Units []*Struct
+}
+
+// Variant returns nil when there's no such variant
+func (enum *EnumType) Variant(name string) *StructType {
+	for _, variant := range enum.Variants {
+		if variant.Name == name {
+			return variant
+		}
+	}
+	return nil
+}